@@ -5,22 +5,33 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/maruel/huggingface"
 	"github.com/maruel/n-bits-go/n_bits"
 	"github.com/maruel/safetensors"
 	"github.com/pbnjay/memory"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 func humanBytes(i int64) string {
@@ -36,22 +47,55 @@ func humanBytes(i int64) string {
 	}
 }
 
-func processSafetensorsFile(ctx context.Context, name string, reTensors *regexp.Regexp, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
-	s := safetensors.Mapped{}
+// processFunc analyzes the tensors selected by opts in a file.
+//
+// cpuLimit limits the number of tensors analyzed concurrently.
+type processFunc func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error)
+
+// processLocalFile analyzes a local safetensors, .npy or .npz file.
+func processLocalFile(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+	if isNumpy(name) {
+		return processNumpyFile(ctx, name, opts, cpuLimit)
+	}
+	return processSafetensorsFile(ctx, name, opts, cpuLimit)
+}
+
+func processSafetensorsFile(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+	s := n_bits.Mapped{}
 	if err := s.Open(name); err != nil {
 		return nil, err
 	}
 	defer s.Close()
+	return analyzeTensors(ctx, name, s.Tensors, newPackHint(s.Metadata), nil, opts, cpuLimit)
+}
+
+// tensorAnalyzer analyzes the tensor i of a file with ao.
+type tensorAnalyzer func(ctx context.Context, i int, ao *n_bits.AnalyzerOptions) (n_bits.AnalyzedTensor, error)
+
+// analyzeTensors analyzes the tensors selected by opts concurrently.
+//
+// The I32 and U32 tensors are unpacked as hinted by hint, which may be nil,
+// unless -pack-bits is specified.
+//
+// analyze analyzes each selected tensor. When nil, the tensors' Data is
+// analyzed in memory, otherwise only their name, dtype and shape are used.
+func analyzeTensors(ctx context.Context, name string, tensors []safetensors.Tensor, hint *packHint, analyze tensorAnalyzer, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	toAnalyze := make([]int, 0, len(s.Tensors))
-	for i, tensor := range s.Tensors {
-		if reTensors.MatchString(tensor.Name) {
+	ao := opts.analyzerOptions()
+	// The shards of large tensors take slots from the same limit.
+	ao.Tensor.ShardLimit = cpuLimit
+	toAnalyze := make([]int, 0, len(tensors))
+	for i, tensor := range tensors {
+		if ao.Selected(tensor.Name, tensor.Shape) {
 			toAnalyze = append(toAnalyze, i)
 		}
 	}
-	slog.Info("analyze", "file", filepath.Base(name), "num_tensors", len(s.Tensors), "to_analyze", len(toAnalyze))
+	if opts.maxTensors != 0 && len(toAnalyze) > opts.maxTensors {
+		toAnalyze = toAnalyze[:opts.maxTensors]
+	}
+	slog.Info("analyze", "file", filepath.Base(name), "num_tensors", len(tensors), "to_analyze", len(toAnalyze))
 	analyzed := make([]n_bits.AnalyzedTensor, len(toAnalyze))
 	// Analyze tensors concurrently.
 	eg := errgroup.Group{}
@@ -65,14 +109,252 @@ func processSafetensorsFile(ctx context.Context, name string, reTensors *regexp.
 				return err2
 			}
 			var err2 error
-			n := s.Tensors[i].Name
-			slog.Info("analyze", "file", filepath.Base(name), "name", n, "dtype", s.Tensors[i].DType)
-			analyzed[j], err2 = n_bits.AnalyzeTensor(n, s.Tensors[i])
+			slog.Info("analyze", "file", filepath.Base(name), "name", tensors[i].Name, "dtype", tensors[i].DType)
+			tao := ao
+			if tao.PackBits == 0 {
+				tao.PackBits = hint.bits(tensors[i].Name)
+			}
+			if analyze != nil {
+				analyzed[j], err2 = analyze(ctx, i, &tao)
+			} else {
+				analyzed[j], err2 = tao.AnalyzeTensor(ctx, tensors[i])
+			}
+			if err2 != nil && ao.Skip(tensors[i].Name, err2) {
+				opts.unsupported.add(tensors[i].Name)
+				return nil
+			}
 			return err2
 		})
 	}
 	err := eg.Wait()
-	return analyzed, err
+	return removeSkipped(analyzed), err
+}
+
+// unsupportedTensors is the names of the tensors skipped because of their
+// dtype. It is safe for concurrent use.
+type unsupportedTensors struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (u *unsupportedTensors) add(name string) {
+	u.mu.Lock()
+	u.names = append(u.names, name)
+	u.mu.Unlock()
+}
+
+func (u *unsupportedTensors) len() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.names)
+}
+
+// truncate forgets the names added after the first n.
+func (u *unsupportedTensors) truncate(n int) {
+	u.mu.Lock()
+	u.names = u.names[:n]
+	u.mu.Unlock()
+}
+
+// sorted returns the names sorted, since the files are analyzed concurrently.
+func (u *unsupportedTensors) sorted() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := slices.Clone(u.names)
+	slices.Sort(out)
+	return out
+}
+
+// removeSkipped removes the tensors skipped because of their dtype, which were
+// left zero.
+func removeSkipped(analyzed []n_bits.AnalyzedTensor) []n_bits.AnalyzedTensor {
+	return slices.DeleteFunc(analyzed, func(a n_bits.AnalyzedTensor) bool { return a.DType == "" })
+}
+
+// jsonStream writes an AnalyzedModel as JSON one tensor at a time, so the
+// whole model is never marshaled in memory at once.
+//
+// With lines, it writes newline delimited JSON instead: one AnalyzedTensor per
+// line and no metadata.
+type jsonStream struct {
+	w     io.Writer
+	enc   *json.Encoder
+	lines bool
+	n     int
+	err   error
+}
+
+func newJSONStream(w io.Writer) *jsonStream {
+	j := &jsonStream{w: w, enc: json.NewEncoder(w)}
+	_, j.err = io.WriteString(w, "{\"tensors\":[")
+	return j
+}
+
+func newNDJSONStream(w io.Writer) *jsonStream {
+	return &jsonStream{w: w, enc: json.NewEncoder(w), lines: true}
+}
+
+// write appends the tensors to the array.
+func (j *jsonStream) write(tensors []n_bits.AnalyzedTensor) error {
+	for i := range tensors {
+		if j.err != nil {
+			break
+		}
+		if j.n != 0 && !j.lines {
+			_, j.err = io.WriteString(j.w, ",")
+		}
+		if j.err == nil {
+			j.err = j.enc.Encode(&tensors[i])
+		}
+		j.n++
+	}
+	return j.err
+}
+
+// close terminates the JSON document with the model metadata. It doesn't
+// close the underlying writer.
+func (j *jsonStream) close(metadata map[string]string) error {
+	if j.lines {
+		return j.err
+	}
+	if j.err == nil {
+		_, j.err = io.WriteString(j.w, "]")
+	}
+	if j.err == nil && len(metadata) != 0 {
+		if _, j.err = io.WriteString(j.w, ",\"metadata\":"); j.err == nil {
+			j.err = j.enc.Encode(metadata)
+		}
+	}
+	if j.err == nil {
+		_, j.err = io.WriteString(j.w, "}\n")
+	}
+	return j.err
+}
+
+// gradeThresholds are the maximum percentages of bits wasted to get the
+// efficiency grades A, B, C, D and E. Anything above is graded F.
+//
+// It implements flag.Value as a comma separated list of percentages.
+type gradeThresholds [5]float64
+
+// defaultGradeThresholds is used when the thresholds are not set.
+//
+// Most models waste between 5% and 20%.
+var defaultGradeThresholds = gradeThresholds{5, 10, 20, 35, 50}
+
+// grade returns the efficiency grade for the percentage of bits wasted.
+func (g *gradeThresholds) grade(pct float64) byte {
+	if *g == (gradeThresholds{}) {
+		g = &defaultGradeThresholds
+	}
+	for i, t := range g {
+		if pct <= t {
+			return byte('A' + i)
+		}
+	}
+	return 'F'
+}
+
+func (g *gradeThresholds) Set(s string) error {
+	parts := strings.Split(s, ",")
+	if len(parts) != len(g) {
+		return fmt.Errorf("expected %d comma separated percentages", len(g))
+	}
+	var n gradeThresholds
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return err
+		}
+		if v < 0 || (i > 0 && v < n[i-1]) {
+			return errors.New("percentages must be positive and increasing")
+		}
+		n[i] = v
+	}
+	*g = n
+	return nil
+}
+
+func (g *gradeThresholds) String() string {
+	if *g == (gradeThresholds{}) {
+		g = &defaultGradeThresholds
+	}
+	parts := make([]string, len(g))
+	for i, v := range g {
+		parts[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+// printSummary prints the model wide stats.
+func printSummary(w io.Writer, s *n_bits.Summary, opts *analyzeOptions) {
+	pct := 0.
+	if s.Bytes != 0 {
+		pct = 100. * float64(s.BytesWasted) / float64(s.Bytes)
+	}
+	fmt.Fprintf(w, "%s (%.1f%%) wasted on %s total storing %d weights, grade %c\n", humanBytes(s.BytesWasted), pct, humanBytes(s.Bytes), s.NumEl, opts.grades.grade(pct))
+	if s.SignBitsWasted+s.ExponentBitsWasted+s.MantissaBitsWasted != 0 && !opts.quiet {
+		sign, exponent, mantissa := s.WastedBreakdown()
+		fmt.Fprintf(w, "Waste: %.1f%% in mantissa, %.1f%% in exponent, %.1f%% in sign\n", mantissa, exponent, sign)
+	}
+}
+
+// writeCSV writes one row per tensor, sorted by name.
+func writeCSV(w io.Writer, tensors []n_bits.AnalyzedTensor) error {
+	sorted := slices.Clone(tensors)
+	slices.SortStableFunc(sorted, func(a, b n_bits.AnalyzedTensor) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	c := csv.NewWriter(w)
+	err := c.Write([]string{
+		"name", "dtype", "numel", "avg", "min", "max", "inf", "nan",
+		"sign_used", "exponent_used", "exponent_alloc", "mantissa_used", "mantissa_alloc",
+		"bits_wasted", "bytes_wasted",
+	})
+	if err != nil {
+		return err
+	}
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	for _, a := range sorted {
+		wasted := int64(a.BitsWasted())
+		err = c.Write([]string{
+			a.Name, string(a.DType), strconv.FormatInt(a.NumEl, 10), f(a.Avg), f(a.Min), f(a.Max),
+			strconv.Itoa(a.Inf), strconv.Itoa(a.NaN),
+			f(a.Sign.BitsActuallyUsed()),
+			f(a.Exponent.BitsActuallyUsed()), strconv.Itoa(int(a.Exponent.GetAllocation())),
+			f(a.Mantissa.BitsActuallyUsed()), strconv.Itoa(int(a.Mantissa.GetAllocation())),
+			strconv.FormatInt(wasted, 10), strconv.FormatInt(wasted*a.NumEl/8, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	return c.Error()
+}
+
+// writePrometheus writes the summary in the Prometheus text exposition format.
+//
+// Every metric is a gauge since it is the result of a single analysis.
+func writePrometheus(w io.Writer, model string, s *n_bits.Summary) {
+	label := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(model)
+	for _, m := range []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"nbits_tensors", "Number of tensors analyzed.", float64(s.NumTensors)},
+		{"nbits_weights", "Number of weights analyzed.", float64(s.NumEl)},
+		{"nbits_bytes", "Bytes used to store the weights.", float64(s.Bytes)},
+		{"nbits_wasted_bytes", "Bytes wasted by bits that are never used.", float64(s.BytesWasted)},
+		{"nbits_inf", "Number of infinite weights.", float64(s.Inf)},
+		{"nbits_nan", "Number of NaN weights.", float64(s.NaN)},
+		{"nbits_effective_bits_per_weight", "Average number of bits actually used per weight.", s.EffectiveBitsPerWeight()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s{model=\"%s\"} %s\n", m.name, m.help, m.name, m.name, label, strconv.FormatFloat(m.value, 'g', -1, 64))
+	}
 }
 
 func calcNameLen(tensors []n_bits.AnalyzedTensor) (int, int) {
@@ -89,131 +371,1097 @@ func calcNameLen(tensors []n_bits.AnalyzedTensor) (int, int) {
 	return maxNameLen, maxSizeLen
 }
 
-func cmdAnalyze(ctx context.Context, hfToken, author, repo, fileglob string, reTensors *regexp.Regexp, out string) error {
-	hf, err := huggingface.New(hfToken)
+// benchmarkConcurrency analyzes a sample of the tensors of the file at a few
+// tensor concurrency levels up to maxWorkers and returns the level that gave
+// the best throughput.
+//
+// The sample is 2*maxWorkers tensors, so each worker gets a couple of tensors
+// at the highest level. It is analyzed once beforehand so that it is paged in
+// and the measurements are not skewed by I/O. opts is temporarily modified so
+// it must not be used concurrently.
+func benchmarkConcurrency(ctx context.Context, process processFunc, name string, opts *analyzeOptions, maxWorkers int) (int, error) {
+	opts.maxTensors = 2 * maxWorkers
+	// The skipped tensors will be collected again when the file is analyzed.
+	skipped := opts.unsupported.len()
+	defer func() {
+		opts.maxTensors = 0
+		opts.unsupported.truncate(skipped)
+	}()
+	analyzed, err := process(ctx, name, opts, make(chan struct{}, maxWorkers))
 	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, a := range analyzed {
+		total += a.Len()
+	}
+	best := maxWorkers
+	bestThroughput := 0.
+	for _, workers := range []int{maxWorkers / 4, maxWorkers / 2, maxWorkers} {
+		if workers < 1 {
+			continue
+		}
+		start := time.Now()
+		if _, err = process(ctx, name, opts, make(chan struct{}, workers)); err != nil {
+			return 0, err
+		}
+		d := time.Since(start)
+		throughput := float64(total) / d.Seconds()
+		slog.Info("analyze", "auto_tune", filepath.Base(name), "tensor_workers", workers, "duration", d, "throughput", humanBytes(int64(throughput))+"/s")
+		if throughput > bestThroughput {
+			best = workers
+			bestThroughput = throughput
+		}
+	}
+	return best, nil
+}
+
+// fileResult is the analysis of a file, waiting to be printed.
+type fileResult struct {
+	analyzed []n_bits.AnalyzedTensor
+	// done is closed once analyzed is set.
+	done chan struct{}
+}
+
+// analyzeFiles analyzes the files concurrently and prints the results to w in
+// the order of files.
+func analyzeFiles(ctx context.Context, w io.Writer, files []string, process processFunc, opts *analyzeOptions) (n_bits.AnalyzedModel, error) {
+	all := n_bits.AnalyzedModel{}
+	results := make([]fileResult, len(files))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+
+	// Concurrency limit.
+	cpus := runtime.NumCPU()
+	if opts.workers > 0 {
+		cpus = opts.workers
+	} else if cpus < 2 {
+		cpus = 2
+	} else if cpus > 1024 {
+		// Limit for now.
+		cpus = 1024
+	}
+	// The number of files processed concurrently is limited by the amount of
+	// RAM, based on the actual file sizes, see below. Limit it for now.
+	p := uint64(16)
+	if opts.fileWorkers > 0 {
+		p = uint64(opts.fileWorkers)
+	}
+	budget := opts.memBudget
+	if budget == 0 {
+		// Keep some headroom for the rest of the system.
+		budget = int64(memory.TotalMemory() / 5 * 4)
+	}
+	mem := semaphore.NewWeighted(budget)
+	prog := newProgress(slog.Default(), files)
+	if opts.progress {
+		ctxProg, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go prog.run(ctxProg, 2*time.Second)
+	}
+	// tensorWorkers is the number of tensors of each file analyzed
+	// concurrently when auto tuned. Otherwise the file workers share cpuLimit.
+	tensorWorkers := 0
+	if opts.autoTune && len(files) > 1 {
+		var err error
+		if tensorWorkers, err = benchmarkConcurrency(ctx, process, files[0], opts, cpus); err != nil {
+			return all, err
+		}
+		// Process more files concurrently to use the CPUs left idle by the
+		// tensor workers of a single file, within the memory limit.
+		if f := uint64(cpus / tensorWorkers); f < p {
+			p = f
+		}
+		slog.Info("analyze", "auto_tune", true, "tensor_workers", tensorWorkers, "file_workers", p)
+	}
+	cpuLimit := make(chan struct{}, cpus)
+	loadPipe := make(chan int, p)
+	ctx2, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx2 := errgroup.WithContext(ctx2)
+	eg.Go(func() error {
+		defer close(loadPipe)
+		for i := range files {
+			// A file larger than the budget is allowed through alone.
+			if mem.Acquire(ctx2, min(fileWeight(files[i]), budget)) != nil {
+				return nil
+			}
+			select {
+			case loadPipe <- i:
+			case <-ctx2.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+	for range p {
+		eg.Go(func() error {
+			limit := cpuLimit
+			if tensorWorkers != 0 {
+				limit = make(chan struct{}, tensorWorkers)
+			}
+			for i := range loadPipe {
+				if err2 := ctx2.Err(); err2 != nil {
+					return err2
+				}
+				analyzed, err2 := process(ctx2, files[i], opts, limit)
+				mem.Release(min(fileWeight(files[i]), budget))
+				if err2 != nil {
+					return err2
+				}
+				results[i].analyzed = analyzed
+				close(results[i].done)
+				prog.done(files[i])
+			}
+			return nil
+		})
+	}
+	// Print the results in order as they become available.
+	for i := range results {
+		select {
+		case <-results[i].done:
+		case <-ctx2.Done():
+			if err := eg.Wait(); err != nil {
+				return all, err
+			}
+			return all, ctx.Err()
+		}
+		if opts.top == 0 && !opts.quiet && opts.index == nil {
+			printAnalyzed(w, files[i], results[i].analyzed, opts)
+		}
+		for _, s := range []*jsonStream{opts.stream, opts.ndjson} {
+			if s != nil {
+				if err := s.write(results[i].analyzed); err != nil {
+					// Stop the workers and the loader before returning.
+					cancel()
+					_ = eg.Wait()
+					return all, err
+				}
+			}
+		}
+		all.AppendTensors(results[i].analyzed...)
+		results[i].analyzed = nil
+	}
+	if err := eg.Wait(); err != nil {
+		return all, err
+	}
+	if opts.index != nil {
+		// The index interleaves the tensors of the shards, so print them all at
+		// once.
+		orderByIndex(all.Tensors, opts.index)
+		if opts.top == 0 && !opts.quiet {
+			printTable(w, sortTensors(all.Tensors, opts.sortKey, opts.sortDesc), opts)
+		}
+	}
+	if opts.top != 0 {
+		printTop(w, all.Tensors, opts)
+	}
+	all.Unsupported = opts.unsupported.sorted()
+	return all, nil
+}
+
+// printTop prints the table of the opts.top tensors wasting the most bytes.
+func printTop(w io.Writer, tensors []n_bits.AnalyzedTensor, opts *analyzeOptions) {
+	top := topWasted(tensors, opts.top)
+	fmt.Fprintf(w, "Top %d tensors by bytes wasted:\n", len(top))
+	printTable(w, top, opts)
+}
+
+// fileWeight returns the amount of memory needed to process a file, which is
+// its size. Remote files are streamed so they are not accounted for.
+func fileWeight(name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// topWasted returns the n tensors wasting the most bytes, in decreasing order.
+func topWasted(tensors []n_bits.AnalyzedTensor, n int) []n_bits.AnalyzedTensor {
+	sorted := slices.Clone(tensors)
+	slices.SortStableFunc(sorted, func(a, b n_bits.AnalyzedTensor) int {
+		return cmp.Compare(b.BytesWasted(), a.BytesWasted())
+	})
+	return sorted[:min(n, len(sorted))]
+}
+
+// sortKeys are the keys accepted by -sort. "file" keeps the order of the
+// tensors in the file, or in the index of a sharded model.
+var sortKeys = []string{"name", "numel", "wasted", "dtype", "file"}
+
+// sortTensors returns a copy of the tensors stably sorted by key, one of
+// sortKeys. "file" and an empty key keep the original order.
+func sortTensors(tensors []n_bits.AnalyzedTensor, key string, desc bool) []n_bits.AnalyzedTensor {
+	if key == "" || key == "file" {
+		if !desc {
+			return tensors
+		}
+		sorted := slices.Clone(tensors)
+		slices.Reverse(sorted)
+		return sorted
+	}
+	sorted := slices.Clone(tensors)
+	slices.SortStableFunc(sorted, func(a, b n_bits.AnalyzedTensor) int {
+		c := 0
+		switch key {
+		case "name":
+			c = strings.Compare(a.Name, b.Name)
+		case "numel":
+			c = cmp.Compare(a.NumEl, b.NumEl)
+		case "wasted":
+			c = cmp.Compare(a.BytesWasted(), b.BytesWasted())
+		case "dtype":
+			c = strings.Compare(string(a.DType), string(b.DType))
+		}
+		if desc {
+			return -c
+		}
+		return c
+	})
+	return sorted
+}
+
+// dtypeStats is the aggregated size of the tensors of one dtype.
+type dtypeStats struct {
+	DType      safetensors.DType
+	NumTensors int
+	NumEl      int64
+	Bytes      int64
+}
+
+// dtypeBreakdown aggregates the tensors per dtype, sorted by decreasing size.
+func dtypeBreakdown(tensors []n_bits.AnalyzedTensor) []dtypeStats {
+	m := map[safetensors.DType]*dtypeStats{}
+	for i := range tensors {
+		a := &tensors[i]
+		d := m[a.DType]
+		if d == nil {
+			d = &dtypeStats{DType: a.DType}
+			m[a.DType] = d
+		}
+		d.NumTensors++
+		d.NumEl += a.NumEl
+		d.Bytes += a.Len()
+	}
+	out := make([]dtypeStats, 0, len(m))
+	for _, d := range m {
+		out = append(out, *d)
+	}
+	slices.SortFunc(out, func(a, b dtypeStats) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.DType, b.DType)
+	})
+	return out
+}
+
+// printDTypes prints the share of each dtype.
+func printDTypes(w io.Writer, tensors []n_bits.AnalyzedTensor, s *n_bits.Summary) {
+	for _, d := range dtypeBreakdown(tensors) {
+		pct := 0.
+		if s.Bytes != 0 {
+			pct = 100. * float64(d.Bytes) / float64(s.Bytes)
+		}
+		fmt.Fprintf(w, "  %s: %5.1f%% of bytes (%s) in %d tensors storing %d weights\n", d.DType, pct, humanBytes(d.Bytes), d.NumTensors, d.NumEl)
+	}
+}
+
+// printCompression prints the size the tensors would have if entropy coded.
+//
+// It uses the order-0 entropy of the sign and exponent plus the mantissa bits
+// actually used, as computed in AnalyzedTensor.Entropy.
+func printCompression(w io.Writer, tensors []n_bits.AnalyzedTensor) {
+	var total, compressed int64
+	for i := range tensors {
+		a := &tensors[i]
+		total += a.Len()
+		compressed += int64(math.Ceil(float64(a.NumEl) * a.Entropy / 8))
+	}
+	ratio := 0.
+	if compressed != 0 {
+		ratio = float64(total) / float64(compressed)
+	}
+	fmt.Fprintf(w, "Estimated compressed size: %s (%.2fx smaller than %s)\n", humanBytes(compressed), ratio, humanBytes(total))
+}
+
+// printWhatIf prints the size and the error of converting every float tensor
+// to dtype with round to nearest even.
+//
+// It relies on the downcast simulation, so TensorOptions.Downcast must be
+// set to dtype.
+func printWhatIf(w io.Writer, tensors []n_bits.AnalyzedTensor, dtype safetensors.DType) {
+	var current, converted int64
+	maxErr := 0.
+	lost := 0
+	for i := range tensors {
+		a := &tensors[i]
+		e, _ := a.SimulateDowncast(dtype, n_bits.RoundNearestEven)
+		if math.IsNaN(e) {
+			// Not a float tensor.
+			continue
+		}
+		current += a.Len()
+		converted += a.NumEl * int64(dtype.WordSize())
+		if math.IsInf(e, 0) || a.Inf != 0 {
+			// The values out of range, and infinities when dtype has none, can't
+			// be represented.
+			lost++
+		} else {
+			maxErr = max(maxErr, e)
+		}
+	}
+	ratio := 0.
+	if converted != 0 {
+		ratio = float64(current) / float64(converted)
+	}
+	fmt.Fprintf(w, "What if %s: %s -> %s (%.2fx smaller), max error %.3g, %d tensors would lose values out of range\n",
+		dtype, humanBytes(current), humanBytes(converted), ratio, maxErr, lost)
+}
+
+// printDuplicates prints the groups of tensors with identical content and the
+// bytes that could be saved by storing each only once.
+//
+// It relies on AnalyzedTensor.Digest, so TensorOptions.Hash must be set. When
+// data is not nil, it returns the raw bytes of a tensor to compare the tensors
+// with the same digest byte for byte, otherwise the digest is trusted.
+func printDuplicates(w io.Writer, tensors []n_bits.AnalyzedTensor, data func(name string) []byte) {
+	groups := map[string][]int{}
+	var order []string
+	for i := range tensors {
+		h := tensors[i].Digest
+		if h == "" {
+			continue
+		}
+		if len(groups[h]) == 0 {
+			order = append(order, h)
+		}
+		groups[h] = append(groups[h], i)
+	}
+	var saved int64
+	for _, h := range order {
+		g := groups[h]
+		if len(g) < 2 {
+			continue
+		}
+		names := make([]string, len(g))
+		for j, i := range g {
+			names[j] = tensors[i].Name
+		}
+		dups := [][]string{names}
+		if data != nil {
+			raw := make([]safetensors.Tensor, len(g))
+			for j, i := range g {
+				raw[j] = safetensors.Tensor{Name: tensors[i].Name, Data: data(tensors[i].Name)}
+			}
+			dups = n_bits.FindDuplicates(raw, nil)
+		}
+		for _, names := range dups {
+			s := int64(len(names)-1) * tensors[g[0]].Len()
+			saved += s
+			fmt.Fprintf(w, "Duplicates: %s (%s saved)\n", strings.Join(names, ", "), humanBytes(s))
+		}
+	}
+	fmt.Fprintf(w, "Deduplication would save %s\n", humanBytes(saved))
+}
+
+// mapTensors memory maps the local safetensors files and returns a function
+// returning the raw bytes of a tensor by name, and a function to unmap the
+// files.
+func mapTensors(files []string) (func(name string) []byte, func(), error) {
+	var mapped []*n_bits.Mapped
+	closeAll := func() {
+		for _, m := range mapped {
+			_ = m.Close()
+		}
+	}
+	data := map[string][]byte{}
+	for _, name := range files {
+		var tensors []safetensors.Tensor
+		if isNumpy(name) {
+			var err error
+			if tensors, err = readNumpy(name); err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+		} else {
+			m := &n_bits.Mapped{}
+			if err := m.Open(name); err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			mapped = append(mapped, m)
+			tensors = m.Tensors
+		}
+		for _, t := range tensors {
+			data[t.Name] = t.Data
+		}
+	}
+	return func(name string) []byte { return data[name] }, closeAll, nil
+}
+
+// printPrunable prints how many weights are below the pruning threshold and
+// the bytes saved if they were not stored, ignoring the sparse indices
+// overhead.
+//
+// It relies on AnalyzedTensor.Prunable, so TensorOptions.PruneThreshold must
+// be set.
+func printPrunable(w io.Writer, tensors []n_bits.AnalyzedTensor, threshold float64) {
+	var prunable, numEl, saved int64
+	for i := range tensors {
+		a := &tensors[i]
+		numEl += a.NumEl
+		prunable += a.Prunable
+		saved += a.Prunable * int64(a.DType.WordSize())
+	}
+	pct := 0.
+	if numEl != 0 {
+		pct = 100 * float64(prunable) / float64(numEl)
+	}
+	fmt.Fprintf(w, "Prunable: %d of %d weights (%.1f%%) below %g; sparsifying would save %s\n", prunable, numEl, pct, threshold, humanBytes(saved))
+}
+
+// tensorHistogram is the distribution of a tensor's exponent and mantissa
+// bits, as exported by -export-hist.
+type tensorHistogram struct {
+	Name         string            `json:"name"`
+	DType        safetensors.DType `json:"dtype"`
+	NumEl        int64             `json:"numel"`
+	Exponent     []uint64          `json:"exponent"`
+	MantissaBits []uint64          `json:"mantissa_bits"`
+}
+
+// exportHistograms writes one JSON file per tensor in dir.
+func exportHistograms(dir string, tensors []n_bits.AnalyzedTensor) error {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
 		return err
 	}
-	if repo != "" {
-		if fileglob == "" {
-			fileglob = "*.safetensors"
+	for i := range tensors {
+		a := &tensors[i]
+		h := tensorHistogram{
+			Name:         a.Name,
+			DType:        a.DType,
+			NumEl:        a.NumEl,
+			Exponent:     a.ExponentHistogram(),
+			MantissaBits: a.MantissaBitOccupancy(),
 		}
-		ref := huggingface.ModelRef{Author: author, Repo: repo}
-		files, err := hf.EnsureSnapshot(ctx, ref, "main", []string{fileglob})
+		data, err := json.Marshal(&h)
 		if err != nil {
 			return err
 		}
+		// Tensor names don't normally contain path separators but be safe.
+		name := strings.ReplaceAll(a.Name, string(os.PathSeparator), "_") + ".json"
+		if err = os.WriteFile(filepath.Join(dir, name), data, 0o666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reLayer extracts the layer index from a tensor name.
+var reLayer = regexp.MustCompile(`layers\.(\d+)\.`)
 
-		mu := sync.Mutex{}
-		all := n_bits.AnalyzedModel{}
-
-		// Concurrency limit.
-		cpus := runtime.NumCPU()
-		if cpus < 2 {
-			cpus = 2
-		} else if cpus > 1024 {
-			// Limit for now.
-			cpus = 1024
-		}
-		cpuLimit := make(chan struct{}, cpus)
-		// This is limited by the amount of RAM.
-		// Assume roughly 4GiB per safetensors, round down, then minus one. In
-		// practice safetensors tend to be about 4.5GiB but there are exceptions.
-		// TODO: limit by actual safetensors size. This is very approximative and
-		// will lead to crashes.
-		p := memory.TotalMemory()/1024/1024/1024/5 - 1
-		if p < 1 {
-			p = 1
-		} else if p > 16 {
-			// limit for now.
-			p = 16
-		}
-		loadPipe := make(chan string, p)
-		go func() {
-			// TODO: Handle cancelation.
-			for _, f := range files {
-				loadPipe <- f
-			}
-			close(loadPipe)
-		}()
-
-		eg, ctx2 := errgroup.WithContext(ctx)
-		for range p {
-			eg.Go(func() error {
-				// TODO: Use a pipeline so they are processed in order.
-				for f := range loadPipe {
-					if err2 := ctx2.Err(); err2 != nil {
-						return err2
-					}
-					// TODO: This prints stuff out of order.
-					fmt.Printf("Processing %s:\n", filepath.Base(f))
-					// TODO: os.Stat() the file and "consume" this amount of ram from the throttler.
-					analyzed, err2 := processSafetensorsFile(ctx2, f, reTensors, cpuLimit)
-					if err2 != nil {
-						return err2
-					}
-					if err2 := ctx2.Err(); err2 != nil {
-						return err2
-					}
-					maxNameLen, maxSizeLen := calcNameLen(analyzed)
-					for _, a := range analyzed {
-						bits := 8 * a.DType.WordSize()
-						ratio := 100. / float64(bits)
-						wasted := int64(a.Sign.BitsWasted() + a.Exponent.BitsWasted() + a.Mantissa.BitsWasted())
-						if a.Exponent.GetAllocation() != 0 {
-							fmt.Printf("%-*s: %*dw  avg=%4.1f [%6.1f, %6.1f]  sign=%1.0fbit  exponent=%3.1f/%dbits  mantissa=%4.1f/%dbits  wasted=%2d/%dbits %4.1f%%  %8s\n",
-								maxNameLen, a.Name, maxSizeLen, a.NumEl,
-								a.Avg, a.Min, a.Max,
-								a.Sign.BitsActuallyUsed(),
-								a.Exponent.BitsActuallyUsed(), a.Exponent.GetAllocation(),
-								a.Mantissa.BitsActuallyUsed(), a.Mantissa.GetAllocation(),
-								wasted, bits, ratio*float64(wasted), humanBytes(wasted*a.NumEl/8),
-							)
-						} else if a.Sign.GetAllocation() != 0 {
-							// Integers.
-							fmt.Printf("%-*s: %*dw  avg=%11.0f [%11.0f, %10.0f]  sign=%1.0fbit  mantissa=%2.0f/%dbits  wasted=%2d/%dbits %4.1f%%  %8s\n",
-								maxNameLen, a.Name, maxSizeLen, a.NumEl,
-								a.Avg, a.Min, a.Max,
-								a.Sign.BitsActuallyUsed(),
-								a.Mantissa.BitsActuallyUsed(), a.Mantissa.GetAllocation(),
-								wasted, bits, ratio*float64(wasted), humanBytes(wasted*a.NumEl/8),
-							)
-						} else {
-							// Unsigned Integers.
-							fmt.Printf("%-*s: %*dw  avg=%11.0f [%11.0f, %10.0f]  mantissa=%2.0f/%dbits  wasted=%2d/%dbits %4.1f%%  %8s\n",
-								maxNameLen, a.Name, maxSizeLen, a.NumEl,
-								a.Avg, a.Min, a.Max,
-								a.Mantissa.BitsActuallyUsed(), a.Mantissa.GetAllocation(),
-								wasted, bits, ratio*float64(wasted), humanBytes(wasted*a.NumEl/8),
-							)
-						}
-					}
-					mu.Lock()
-					all.Tensors = append(all.Tensors, analyzed...)
-					mu.Unlock()
+// printByLayer prints the bytes wasted aggregated per layer index. Tensors
+// without a layer index are aggregated as "other".
+func printByLayer(w io.Writer, tensors []n_bits.AnalyzedTensor) {
+	layers := map[int]*n_bits.AnalyzedModel{}
+	other := &n_bits.AnalyzedModel{}
+	for _, a := range tensors {
+		m := other
+		if match := reLayer.FindStringSubmatch(a.Name); match != nil {
+			i, err := strconv.Atoi(match[1])
+			if err == nil {
+				if m = layers[i]; m == nil {
+					m = &n_bits.AnalyzedModel{}
+					layers[i] = m
 				}
-				return nil
-			})
+			}
 		}
-		if err = eg.Wait(); err != nil {
-			return err
+		m.Tensors = append(m.Tensors, a)
+	}
+	keys := slices.Sorted(maps.Keys(layers))
+	fmt.Fprintf(w, "Bytes wasted per layer:\n")
+	for _, i := range keys {
+		printLayer(w, strconv.Itoa(i), layers[i])
+	}
+	if len(other.Tensors) != 0 {
+		printLayer(w, "other", other)
+	}
+}
+
+// prefixStats is the aggregated size of the tensors sharing a name prefix.
+type prefixStats struct {
+	Prefix      string
+	NumTensors  int
+	NumEl       int64
+	Bytes       int64
+	BytesWasted int64
+}
+
+// prefixBreakdown aggregates the tensors by the first depth components of
+// their name split on ".", in the order each prefix is first seen.
+func prefixBreakdown(tensors []n_bits.AnalyzedTensor, depth int) []prefixStats {
+	var out []prefixStats
+	index := map[string]int{}
+	for i := range tensors {
+		a := &tensors[i]
+		parts := strings.SplitN(a.Name, ".", depth+1)
+		prefix := strings.Join(parts[:min(depth, len(parts))], ".")
+		j, ok := index[prefix]
+		if !ok {
+			j = len(out)
+			index[prefix] = j
+			out = append(out, prefixStats{Prefix: prefix})
+		}
+		p := &out[j]
+		p.NumTensors++
+		p.NumEl += a.NumEl
+		p.Bytes += a.Len()
+		p.BytesWasted += a.BytesWasted()
+	}
+	return out
+}
+
+// printByPrefix prints the bytes wasted aggregated by the first depth
+// components of the tensor names.
+func printByPrefix(w io.Writer, tensors []n_bits.AnalyzedTensor, depth int) {
+	groups := prefixBreakdown(tensors, depth)
+	maxLen := 0
+	for _, p := range groups {
+		maxLen = max(maxLen, len(p.Prefix))
+	}
+	fmt.Fprintf(w, "Bytes wasted per prefix:\n")
+	for _, p := range groups {
+		pct := 0.
+		if p.Bytes != 0 {
+			pct = 100. * float64(p.BytesWasted) / float64(p.Bytes)
+		}
+		fmt.Fprintf(w, "  %-*s: %8s/%8s (%4.1f%%) in %d tensors storing %d weights\n", maxLen, p.Prefix, humanBytes(p.BytesWasted), humanBytes(p.Bytes), pct, p.NumTensors, p.NumEl)
+	}
+}
+
+func printLayer(w io.Writer, name string, m *n_bits.AnalyzedModel) {
+	s := m.Summary()
+	pct := 0.
+	if s.Bytes != 0 {
+		pct = 100. * float64(s.BytesWasted) / float64(s.Bytes)
+	}
+	fmt.Fprintf(w, "  %5s: %8s/%8s (%4.1f%%)\n", name, humanBytes(s.BytesWasted), humanBytes(s.Bytes), pct)
+}
+
+// printAnalyzed prints the table of the tensors analyzed in a file.
+func printAnalyzed(w io.Writer, name string, analyzed []n_bits.AnalyzedTensor, opts *analyzeOptions) {
+	fmt.Fprintf(w, "Processing %s:\n", filepath.Base(name))
+	printTable(w, sortTensors(analyzed, opts.sortKey, opts.sortDesc), opts)
+	printFileSummary(w, name, analyzed)
+}
+
+// printFileSummary prints the bytes wasted by the tensors of a file on one
+// line.
+func printFileSummary(w io.Writer, name string, analyzed []n_bits.AnalyzedTensor) {
+	m := n_bits.AnalyzedModel{Tensors: analyzed}
+	s := m.Summary()
+	pct := 0.
+	if s.Bytes != 0 {
+		pct = 100. * float64(s.BytesWasted) / float64(s.Bytes)
+	}
+	fmt.Fprintf(w, "%s: %s (%.1f%%) wasted on %s\n", filepath.Base(name), humanBytes(s.BytesWasted), pct, humanBytes(s.Bytes))
+}
+
+// printTable prints one row per tensor.
+//
+// The first column is the efficiency grade.
+func printTable(w io.Writer, analyzed []n_bits.AnalyzedTensor, opts *analyzeOptions) {
+	maxNameLen, maxSizeLen := calcNameLen(analyzed)
+	for _, a := range analyzed {
+		bits := 8 * a.DType.WordSize()
+		ratio := 100. / float64(bits)
+		wasted := int64(a.BitsWasted())
+		fmt.Fprintf(w, "%c ", opts.grades.grade(ratio*float64(wasted)))
+		if a.Exponent.GetAllocation() != 0 {
+			fmt.Fprintf(w, "%-*s: %*dw  avg=%4.1f [%6.1f, %6.1f]  sign=%1.0fbit  exponent=%3.1f/%dbits  mantissa=%4.1f/%dbits  wasted=%2d/%dbits %4.1f%%  %8s",
+				maxNameLen, a.Name, maxSizeLen, a.NumEl,
+				a.Avg, a.Min, a.Max,
+				a.Sign.BitsActuallyUsed(),
+				a.Exponent.BitsActuallyUsed(), a.Exponent.GetAllocation(),
+				a.Mantissa.BitsActuallyUsed(), a.Mantissa.GetAllocation(),
+				wasted, bits, ratio*float64(wasted), humanBytes(wasted*a.NumEl/8),
+			)
+		} else if a.Sign.GetAllocation() != 0 {
+			// Integers.
+			fmt.Fprintf(w, "%-*s: %*dw  avg=%11.0f [%11.0f, %10.0f]  sign=%1.0fbit  mantissa=%2.0f/%dbits  wasted=%2d/%dbits %4.1f%%  %8s",
+				maxNameLen, a.Name, maxSizeLen, a.NumEl,
+				a.Avg, a.Min, a.Max,
+				a.Sign.BitsActuallyUsed(),
+				a.Mantissa.BitsActuallyUsed(), a.Mantissa.GetAllocation(),
+				wasted, bits, ratio*float64(wasted), humanBytes(wasted*a.NumEl/8),
+			)
+		} else {
+			// Unsigned Integers.
+			fmt.Fprintf(w, "%-*s: %*dw  avg=%11.0f [%11.0f, %10.0f]  mantissa=%2.0f/%dbits  wasted=%2d/%dbits %4.1f%%  %8s",
+				maxNameLen, a.Name, maxSizeLen, a.NumEl,
+				a.Avg, a.Min, a.Max,
+				a.Mantissa.BitsActuallyUsed(), a.Mantissa.GetAllocation(),
+				wasted, bits, ratio*float64(wasted), humanBytes(wasted*a.NumEl/8),
+			)
+		}
+		fmt.Fprintf(w, "  entropy=%4.1f  suggest=%s", a.Entropy, a.RecommendDType())
+		if a.Exponent.GetAllocation() != 0 {
+			fmt.Fprintf(w, "  exp_range=[%d,%d]", a.MinExp, a.MaxExp)
+		}
+		if opts.showShape {
+			fmt.Fprintf(w, "  shape=%v", a.Shape)
+		}
+		if e := a.ExponentHistogram(); e != nil && opts.sparkline {
+			fmt.Fprintf(w, "  exp_hist=%s", sparkline(e, 16))
+		}
+		if m, ok := a.Mantissa.(*n_bits.BitMaskCount); ok && opts.showBitmask {
+			fmt.Fprintf(w, "  mantissa_bits=%s", bitmaskString(m.BitOccupancy()))
+		}
+		if a.Flushed != 0 {
+			fmt.Fprintf(w, "  flushed=%d", a.Flushed)
+		}
+		if a.IsConstant {
+			io.WriteString(w, "  const")
+		}
+		if a.TF32 {
+			io.WriteString(w, "  tf32")
+		}
+		if a.DistinctValues != 0 {
+			fmt.Fprintf(w, "  distinct=%d", a.DistinctValues)
+		}
+		if a.MantissaTrailingZeros != 0 {
+			fmt.Fprintf(w, "  man_trailing_zeros=%d", a.MantissaTrailingZeros)
+		}
+		if a.NoFinite {
+			io.WriteString(w, "  no_finite_value")
+		}
+		if d := a.RecommendIntDType(); d != "" {
+			fmt.Fprintf(w, "  integral=%s", d)
+		}
+		if a.Prunable != 0 {
+			fmt.Fprintf(w, "  prunable=%.1f%%", 100*float64(a.Prunable)/float64(a.NumEl))
+		}
+		if opts.compareDType != "" {
+			if s, err := a.SimulateAsDType(opts.compareDType); err == nil {
+				fmt.Fprintf(w, "  as_%s=overflow:%d,underflow:%d,subnormal:%d", s.DType, s.Overflow, s.Underflow, s.Subnormal)
+			}
+		}
+		for _, d := range a.Downcast {
+			fmt.Fprintf(w, "  %s_%s=%.3g/%.3g", d.DType, d.Rounding, d.MaxAbsErr, d.MeanAbsErr)
+		}
+		errs := a.DowncastErrors()
+		for _, d := range []safetensors.DType{safetensors.BF16, safetensors.F16, safetensors.F8_E4M3} {
+			if e, ok := errs[d]; ok {
+				fmt.Fprintf(w, "  rmse_%s=%.3g", d, e)
+			}
+		}
+		io.WriteString(w, "\n")
+	}
+}
+
+// bitmaskString returns the bits used, least significant first, as 1 or 0.
+func bitmaskString(used []bool) string {
+	b := make([]byte, len(used))
+	for i, u := range used {
+		b[i] = '0'
+		if u {
+			b[i] = '1'
 		}
-		var bytesWasted, totalBytes, totalWeights int64
-		for _, a := range all.Tensors {
-			bytesWasted += a.NumEl * int64(a.Sign.BitsWasted()+a.Exponent.BitsWasted()+a.Mantissa.BitsWasted()) / 8
-			totalBytes += a.Len()
-			totalWeights += a.NumEl
+	}
+	return string(b)
+}
+
+// sparkBlocks are the characters of sparkline, from the lowest to the highest.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline returns the counts as up to maxBuckets block characters, scaled
+// to the largest bucket.
+//
+// Only the range from the first to the last non-zero count is shown, split in
+// buckets of equal width. Empty buckets are spaces. It returns an empty string
+// if every count is zero.
+func sparkline(counts []uint64, maxBuckets int) string {
+	first := slices.IndexFunc(counts, func(c uint64) bool { return c != 0 })
+	if first == -1 {
+		return ""
+	}
+	last := len(counts) - 1
+	for counts[last] == 0 {
+		last--
+	}
+	counts = counts[first : last+1]
+	width := (len(counts) + maxBuckets - 1) / maxBuckets
+	buckets := make([]uint64, (len(counts)+width-1)/width)
+	for i, c := range counts {
+		buckets[i/width] += c
+	}
+	top := slices.Max(buckets)
+	out := make([]rune, len(buckets))
+	for i, c := range buckets {
+		if c == 0 {
+			out[i] = ' '
+			continue
 		}
-		fmt.Printf("%s (%.1f%%) wasted on %s total storing %d weights\n", humanBytes(bytesWasted), 100.*float64(bytesWasted)/float64(totalBytes), humanBytes(totalBytes), totalWeights)
-		if out != "" {
-			data, err := json.Marshal(all)
+		// Round up so any non-zero bucket is visible.
+		out[i] = sparkBlocks[(c*uint64(len(sparkBlocks))+top-1)/top-1]
+	}
+	return string(out)
+}
+
+// analyzeOptions are the options of the analyze command.
+type analyzeOptions struct {
+	// reTensors selects the tensors to analyze.
+	reTensors *regexp.Regexp
+	// reExclude skips the tensors selected by reTensors, if set.
+	reExclude *regexp.Regexp
+	// minNumEl skips the tensors with fewer elements.
+	minNumEl int64
+	// jsonOut is the file to save the stats as JSON, if set.
+	jsonOut string
+	// jsonStream writes jsonOut incrementally as each file is analyzed instead
+	// of all at once at the end.
+	jsonStream bool
+	// stream is the incremental JSON writer used by analyzeFiles when
+	// jsonStream is set.
+	stream *jsonStream
+	// ndjsonOut is the file to save the stats as newline delimited JSON, one
+	// tensor per line, if set. It is written incrementally.
+	ndjsonOut string
+	// ndjson writes ndjsonOut. It is set by cmdAnalyze.
+	ndjson *jsonStream
+	// csvOut is the file to save the stats as CSV, if set.
+	csvOut string
+	// htmlOut is the file to save the HTML report, if set.
+	htmlOut string
+	// promOut is the file to save the summary as Prometheus metrics, if set.
+	promOut string
+	// grades are the thresholds used to grade the efficiency.
+	grades gradeThresholds
+	// showBitmask prints which bits of integer tensors are used.
+	showBitmask bool
+	// sparkline prints the distribution of the exponents of float tensors.
+	sparkline bool
+	// showShape prints the shape of each tensor in the table.
+	showShape bool
+	// sortKey orders the tensors of each file in the table, if set. It is one
+	// of sortKeys.
+	sortKey string
+	// sortDesc reverses the order of sortKey.
+	sortDesc bool
+	// quiet only prints the summary line, and the reports explicitly requested,
+	// instead of the tables of each file.
+	quiet bool
+	// top only prints the top tensors wasting the most bytes when not 0.
+	top int
+	// exportHist is the directory to save the per tensor histograms, if set.
+	exportHist string
+	// estimateCompression prints the estimated entropy coded size.
+	estimateCompression bool
+	// byLayer prints the bytes wasted aggregated per layer.
+	byLayer bool
+	// groupDepth prints the bytes wasted aggregated by the first groupDepth
+	// components of the tensor names when not 0.
+	groupDepth int
+	// useIndex validates the shards of a sharded model with its index and
+	// prints the tensors in the order of the index.
+	useIndex bool
+	// index is the index loaded when useIndex is set.
+	index *safetensorsIndex
+	// memBudget is the number of bytes of files that can be processed
+	// concurrently. Defaults to most of the RAM when 0.
+	memBudget int64
+	// autoTune benchmarks the concurrency on the first file.
+	autoTune bool
+	// maxTensors limits the number of tensors analyzed in each file when not
+	// 0. It is used to benchmark a sample of a file.
+	maxTensors int
+	// workers is the number of tensors analyzed concurrently. Defaults to the
+	// number of CPUs when 0.
+	workers int
+	// fileWorkers is the number of files processed concurrently, within
+	// memBudget. Defaults to 16 when 0.
+	fileWorkers int
+	// failOnNonFinite returns an error if any tensor contains NaN or Inf.
+	failOnNonFinite bool
+	// maxRelError returns an error if the relative error of downcasting any
+	// tensor to tensorOpts.Downcast is above it, when not 0.
+	maxRelError float64
+	// packBits unpacks I32 and U32 tensors as weights of this many bits, like
+	// GPTQ and AWQ quantized models, when not 0.
+	packBits int
+	// whatIf prints the model wide effect of converting every float tensor to
+	// this dtype, if set. It requires tensorOpts.Downcast to be the same dtype.
+	whatIf safetensors.DType
+	// compareDType prints how many values of each float tensor would overflow
+	// or underflow if stored as this dtype, if set.
+	compareDType safetensors.DType
+	// findDuplicates prints the tensors with identical content.
+	findDuplicates bool
+	// skipUnsupported skips the tensors of an unsupported dtype instead of
+	// failing. They are collected in unsupported.
+	skipUnsupported bool
+	unsupported     unsupportedTensors
+	// retries is the number of attempts to download the HuggingFace snapshot.
+	retries int
+	// maxFileBytes is the maximum size of each file and of all the files of the
+	// HuggingFace snapshot combined, checked before downloading. Unlimited when
+	// 0.
+	maxFileBytes int64
+	// progress periodically logs the progress, in addition to when each file
+	// is done.
+	progress bool
+	// tensorOpts controls the analysis of each tensor.
+	tensorOpts n_bits.TensorOptions
+}
+
+// analyzerOptions returns the options to analyze each file's tensors.
+func (o *analyzeOptions) analyzerOptions() n_bits.AnalyzerOptions {
+	return n_bits.AnalyzerOptions{Include: o.reTensors, Exclude: o.reExclude, MinNumEl: o.minNumEl, Workers: o.workers, PackBits: o.packBits, SkipUnsupported: o.skipUnsupported, Tensor: o.tensorOpts}
+}
+
+func cmdAnalyze(ctx context.Context, hfToken, author, repo, fileglob, name, url, dir string, opts *analyzeOptions) error {
+	var files []string
+	process := processLocalFile
+	metadata := localMetadata
+	index := ""
+	if name != "" {
+		if isCompressed(name) {
+			tmp, err := decompressFile(name)
 			if err != nil {
 				return err
 			}
-			if err := os.WriteFile(out, data, 0o666); err != nil {
+			defer os.RemoveAll(filepath.Dir(tmp))
+			name = tmp
+		}
+		files = []string{name}
+	} else if url != "" {
+		files = []string{url}
+		process = processRemoteSafetensorsFile
+		metadata = remoteMetadata
+	} else if dir != "" {
+		if fileglob == "" {
+			fileglob = "*.safetensors"
+		}
+		var err error
+		if files, err = filepath.Glob(filepath.Join(dir, fileglob)); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no file matching %q in %s", fileglob, dir)
+		}
+		if opts.useIndex {
+			idx, _ := filepath.Glob(filepath.Join(dir, indexGlob))
+			if len(idx) == 0 {
+				return fmt.Errorf("-index: no file matching %q in %s", indexGlob, dir)
+			}
+			index = idx[0]
+		}
+	} else {
+		hf, err := huggingface.New(hfToken)
+		if err != nil {
+			return err
+		}
+		if fileglob == "" {
+			fileglob = "*.safetensors"
+		}
+		globs := []string{fileglob}
+		if opts.useIndex {
+			globs = append(globs, indexGlob)
+		}
+		ref := huggingface.ModelRef{Author: author, Repo: repo}
+		if err = checkRemoteSizes(ctx, hf, ref, globs, opts.maxFileBytes); err != nil {
+			return err
+		}
+		if files, err = ensureSnapshot(ctx, hf.EnsureSnapshot, ref, globs, max(opts.retries, 1)); err != nil {
+			return err
+		}
+		if index, files = splitIndex(files); opts.useIndex && index == "" {
+			return fmt.Errorf("-index: no file matching %q in %s", indexGlob, ref.RepoID())
+		}
+	}
+	if index != "" {
+		idx, err := loadIndex(index)
+		if err != nil {
+			return err
+		}
+		if err = checkIndex(os.Stdout, idx, files); err != nil {
+			return err
+		}
+		opts.index = idx
+	}
+
+	if url != "" && opts.tensorOpts.Hash && opts.tensorOpts.Hasher == nil {
+		// The remote data can't be compared, so use a hash without practical
+		// collisions.
+		opts.tensorOpts.Hasher = n_bits.SHA256Hasher{}
+	}
+	var streamFile *os.File
+	if opts.jsonOut != "" && opts.jsonStream {
+		var err error
+		if streamFile, err = os.Create(opts.jsonOut); err != nil {
+			return err
+		}
+		defer streamFile.Close()
+		opts.stream = newJSONStream(streamFile)
+	}
+	var ndjsonFile *os.File
+	if opts.ndjsonOut != "" {
+		var err error
+		if ndjsonFile, err = os.Create(opts.ndjsonOut); err != nil {
+			return err
+		}
+		defer ndjsonFile.Close()
+		opts.ndjson = newNDJSONStream(ndjsonFile)
+	}
+	all, err := analyzeFiles(ctx, os.Stdout, files, process, opts)
+	if err != nil {
+		return err
+	}
+	// The metadata is normally the same in every shard.
+	if all.Metadata, err = metadata(ctx, files[0]); err != nil {
+		return err
+	}
+	if opts.stream != nil {
+		err = opts.stream.close(all.Metadata)
+		if err2 := streamFile.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if opts.ndjson != nil {
+		err = opts.ndjson.close(nil)
+		if err2 := ndjsonFile.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if opts.byLayer {
+		printByLayer(os.Stdout, all.Tensors)
+	}
+	if opts.groupDepth != 0 {
+		printByPrefix(os.Stdout, all.Tensors, opts.groupDepth)
+	}
+	summary := all.Summary()
+	printSummary(os.Stdout, &summary, opts)
+	if !opts.quiet {
+		printDTypes(os.Stdout, all.Tensors, &summary)
+	}
+	if len(all.Unsupported) != 0 {
+		fmt.Fprintf(os.Stdout, "Skipped %d tensors of an unsupported dtype: %s\n", len(all.Unsupported), strings.Join(all.Unsupported, ", "))
+	}
+	if opts.estimateCompression {
+		printCompression(os.Stdout, all.Tensors)
+	}
+	if opts.whatIf != "" {
+		printWhatIf(os.Stdout, all.Tensors, opts.whatIf)
+	}
+	if opts.findDuplicates {
+		var data func(string) []byte
+		if url == "" {
+			var closeAll func()
+			if data, closeAll, err = mapTensors(files); err != nil {
 				return err
 			}
+			defer closeAll()
+		}
+		printDuplicates(os.Stdout, all.Tensors, data)
+	}
+	if opts.tensorOpts.PruneThreshold > 0 {
+		printPrunable(os.Stdout, all.Tensors, opts.tensorOpts.PruneThreshold)
+	}
+	if opts.jsonOut != "" && !opts.jsonStream {
+		data, err := json.Marshal(all)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(opts.jsonOut, data, 0o666); err != nil {
+			return err
+		}
+	}
+	if opts.exportHist != "" {
+		if err := exportHistograms(opts.exportHist, all.Tensors); err != nil {
+			return err
+		}
+	}
+	if opts.csvOut != "" {
+		b := bytes.Buffer{}
+		if err := writeCSV(&b, all.Tensors); err != nil {
+			return err
+		}
+		if err := os.WriteFile(opts.csvOut, b.Bytes(), 0o666); err != nil {
+			return err
+		}
+	}
+	model := url
+	if model == "" {
+		model = dir
+	}
+	if model == "" {
+		model = author + "/" + repo
+	}
+	if opts.htmlOut != "" {
+		if err := writeHTMLFile(opts.htmlOut, model, &all, opts); err != nil {
+			return err
+		}
+	}
+	if opts.promOut != "" {
+		b := bytes.Buffer{}
+		writePrometheus(&b, model, &summary)
+		if err := os.WriteFile(opts.promOut, b.Bytes(), 0o666); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	if opts.failOnNonFinite {
+		errs = append(errs, checkNonFinite(os.Stdout, all.Tensors))
+	}
+	if opts.maxRelError > 0 {
+		errs = append(errs, checkRelativeError(os.Stdout, all.Tensors, opts.tensorOpts.Downcast, opts.maxRelError))
+	}
+	return errors.Join(errs...)
+}
+
+// checkNonFinite prints the tensors containing NaN or Inf and returns an
+// error if there is any.
+func checkNonFinite(w io.Writer, tensors []n_bits.AnalyzedTensor) error {
+	affected := 0
+	for i := range tensors {
+		if a := &tensors[i]; a.NaN+a.Inf != 0 {
+			fmt.Fprintf(w, "%s: %d NaN, %d Inf\n", a.Name, a.NaN, a.Inf)
+			affected++
 		}
 	}
+	if affected != 0 {
+		return fmt.Errorf("%d tensors contain non-finite values", affected)
+	}
+	return nil
+}
+
+// checkRelativeError prints the tensors whose relative error of downcasting to
+// dtype with RoundNearestEven is above threshold and returns an error if there
+// is any.
+//
+// It relies on AnalyzedTensor.Downcast, so TensorOptions.Downcast must be
+// dtype. Tensors not simulated, like integer ones, are ignored.
+func checkRelativeError(w io.Writer, tensors []n_bits.AnalyzedTensor, dtype safetensors.DType, threshold float64) error {
+	affected := 0
+	for i := range tensors {
+		a := &tensors[i]
+		// A NaN error means the tensor wasn't simulated.
+		if e := a.RelativeDowncastError(dtype, n_bits.RoundNearestEven); e > threshold {
+			fmt.Fprintf(w, "%s: relative error %.3g above %g\n", a.Name, e, threshold)
+			affected++
+		}
+	}
+	if affected != 0 {
+		return fmt.Errorf("%d tensors exceed the relative error of %g when downcast to %s", affected, threshold, dtype)
+	}
 	return nil
 }
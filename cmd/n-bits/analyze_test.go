@@ -5,9 +5,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/maruel/n-bits-go/n_bits"
+	"github.com/maruel/safetensors"
 )
 
 func TestCmdAnalyze(t *testing.T) {
@@ -16,7 +33,1040 @@ func TestCmdAnalyze(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := cmdAnalyze(context.Background(), "", "openai", "whisper-tiny", "", reTensors, ""); err != nil {
+	if err := cmdAnalyze(context.Background(), "", "openai", "whisper-tiny", "", "", "", "", &analyzeOptions{reTensors: reTensors}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCmdAnalyze_Dir(t *testing.T) {
+	dir := t.TempDir()
+	writeSafetensors(t, filepath.Join(dir, "model.safetensors"), nil, []safetensors.Tensor{newF32Tensor("a", 1, 2, 3, 4)})
+	jsonOut := filepath.Join(t.TempDir(), "out.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut}
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := n_bits.AnalyzedModel{}
+	if err = json.Unmarshal(data, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Tensors) != 1 || all.Tensors[0].Name != "a" || all.Tensors[0].NumEl != 4 {
+		t.Fatalf("unexpected %+v", all)
+	}
+	if err = cmdAnalyze(context.Background(), "", "", "", "*.gguf", "", "", dir, &opts); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCmdAnalyze_SkipUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	double := safetensors.Tensor{Name: "double", DType: safetensors.F64, Shape: []uint64{1}, Data: make([]byte, 8)}
+	writeSafetensors(t, filepath.Join(dir, "model.safetensors"), nil, []safetensors.Tensor{newF32Tensor("a", 1, 2, 3, 4), double})
+	jsonOut := filepath.Join(t.TempDir(), "out.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut}
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); !errors.Is(err, n_bits.ErrUnsupportedDType) {
+		t.Fatal(err)
+	}
+	opts = analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut, skipUnsupported: true}
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := n_bits.AnalyzedModel{}
+	if err = json.Unmarshal(data, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Tensors) != 1 || all.Tensors[0].Name != "a" || all.Tensors[0].NumEl != 4 {
+		t.Fatalf("unexpected %+v", all.Tensors)
+	}
+	if len(all.Unsupported) != 1 || all.Unsupported[0] != "double" {
+		t.Fatalf("unexpected %q", all.Unsupported)
+	}
+}
+
+func TestCmdAnalyze_Quiet(t *testing.T) {
+	dir := t.TempDir()
+	writeSafetensors(t, filepath.Join(dir, "model.safetensors"), nil, []safetensors.Tensor{newF32Tensor("a", 1, 2, 3, 4), newF32Tensor("b", -1)})
+	jsonOut := filepath.Join(t.TempDir(), "out.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut, quiet: true}
+	got := captureStdout(t, func() {
+		if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+			t.Error(err)
+		}
+	})
+	data, err := os.ReadFile(jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := n_bits.AnalyzedModel{}
+	if err = json.Unmarshal(data, &all); err != nil {
+		t.Fatal(err)
+	}
+	// Only the summary line, with the same numbers.
+	s := all.Summary()
+	b := bytes.Buffer{}
+	printSummary(&b, &s, &analyzeOptions{quiet: true})
+	if want := b.String(); got != want || strings.Count(got, "\n") != 1 || !strings.Contains(got, "wasted on 20B total storing 5 weights") {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+}
+
+// captureStdout returns what fn printed to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	old := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+	done := make(chan []byte)
+	go func() {
+		b := bytes.Buffer{}
+		_, _ = b.ReadFrom(r)
+		done <- b.Bytes()
+	}()
+	fn()
+	_ = w.Close()
+	return string(<-done)
+}
+
+func TestCmdAnalyze_JSONStream(t *testing.T) {
+	dir := t.TempDir()
+	writeSafetensors(t, filepath.Join(dir, "model-00001-of-00002.safetensors"), map[string]string{"format": "pt"}, []safetensors.Tensor{
+		newF32Tensor("a", 1, 2, 3, 4),
+		newF32Tensor("b", 1),
+	})
+	writeSafetensors(t, filepath.Join(dir, "model-00002-of-00002.safetensors"), nil, []safetensors.Tensor{
+		newF32Tensor("c", -1, 2),
+	})
+	jsonOut := filepath.Join(t.TempDir(), "out.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut, jsonStream: true}
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := n_bits.AnalyzedModel{}
+	if err = json.Unmarshal(data, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Tensors) != 3 || all.Tensors[0].Name != "a" || all.Tensors[2].Name != "c" || all.Tensors[2].Mantissa == nil {
+		t.Fatalf("unexpected %+v", all)
+	}
+	if all.Metadata["format"] != "pt" {
+		t.Fatalf("unexpected metadata %+v", all.Metadata)
+	}
+
+	// An empty stream is still valid.
+	b := bytes.Buffer{}
+	if err = newJSONStream(&b).close(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b.Bytes(), &all); err != nil || len(all.Tensors) != 0 {
+		t.Fatal(all, err)
+	}
+}
+
+func TestCmdAnalyze_NDJSON(t *testing.T) {
+	dir := t.TempDir()
+	writeSafetensors(t, filepath.Join(dir, "model-00001-of-00002.safetensors"), nil, []safetensors.Tensor{
+		newF32Tensor("a", 1, 2, 3, 4),
+		newF32Tensor("b", 1),
+	})
+	writeSafetensors(t, filepath.Join(dir, "model-00002-of-00002.safetensors"), nil, []safetensors.Tensor{
+		{Name: "c", DType: safetensors.I32, Shape: []uint64{1}, Data: []byte{1, 0, 0, 0}},
+	})
+	ndjsonOut := filepath.Join(t.TempDir(), "out.ndjson")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), ndjsonOut: ndjsonOut}
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(ndjsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	var names []string
+	for _, l := range lines {
+		a := n_bits.AnalyzedTensor{}
+		if err = json.Unmarshal([]byte(l), &a); err != nil {
+			t.Fatalf("%q: %v", l, err)
+		}
+		if a.Mantissa == nil {
+			t.Fatalf("unexpected %+v", a)
+		}
+		names = append(names, a.Name)
+	}
+	if !slices.Equal(names, []string{"a", "b", "c"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestCmdAnalyze_FailOnNonFinite(t *testing.T) {
+	dir := t.TempDir()
+	writeSafetensors(t, filepath.Join(dir, "model.safetensors"), nil, []safetensors.Tensor{
+		newF32Tensor("a", 1, 2),
+		newF32Tensor("b", 1, float32(math.NaN())),
+	})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*")}
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.failOnNonFinite = true
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err == nil {
+		t.Fatal("expected error")
+	}
+	b := bytes.Buffer{}
+	err := checkNonFinite(&b, []n_bits.AnalyzedTensor{{Name: "a"}, {Name: "b", NaN: 1}})
+	if err == nil || err.Error() != "1 tensors contain non-finite values" {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "b: 1 NaN, 0 Inf\n" {
+		t.Fatalf("unexpected %q", got)
+	}
+}
+
+func TestCheckRelativeError(t *testing.T) {
+	o := n_bits.TensorOptions{Downcast: safetensors.F8_E4M3}
+	// Well within the range of F8_E4M3, with its 3 bits of mantissa.
+	good, err := o.AnalyzeTensor(context.Background(), "good", newF32Tensor("good", 1, -1.1, 0.9, 1.3, -0.7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1000 overflows F8_E4M3 and the small values underflow.
+	bad, err := o.AnalyzeTensor(context.Background(), "bad", newF32Tensor("bad", 1000, 1e-5, -3e-6, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Integers are not simulated.
+	i, err := o.AnalyzeTensor(context.Background(), "i", safetensors.Tensor{DType: safetensors.I32, Shape: []uint64{1}, Data: []byte{1, 0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	err = checkRelativeError(&b, []n_bits.AnalyzedTensor{good, bad, i}, safetensors.F8_E4M3, 0.05)
+	if err == nil || err.Error() != "1 tensors exceed the relative error of 0.05 when downcast to F8_E4M3" {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != "bad: relative error +Inf above 0.05\n" {
+		t.Fatalf("unexpected %q", got)
+	}
+	b.Reset()
+	if err = checkRelativeError(&b, []n_bits.AnalyzedTensor{good, i}, safetensors.F8_E4M3, 0.05); err != nil || b.Len() != 0 {
+		t.Fatal(err, b.String())
+	}
+}
+
+func TestBenchmarkConcurrency(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "model.safetensors")
+	writeSafetensors(t, name, nil, []safetensors.Tensor{
+		newF32Tensor("a", 1, 2, 3, 4),
+		newF32Tensor("b", -1, 0.5),
+		newF32Tensor("c", 2),
+		newF32Tensor("d", 3),
+		newF32Tensor("e", 4),
+	})
+	var mu sync.Mutex
+	var sizes []int
+	process := func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+		analyzed, err := processSafetensorsFile(ctx, name, opts, cpuLimit)
+		mu.Lock()
+		sizes = append(sizes, len(analyzed))
+		mu.Unlock()
+		return analyzed, err
+	}
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*")}
+	workers, err := benchmarkConcurrency(context.Background(), process, name, &opts, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workers != 1 && workers != 2 {
+		t.Fatalf("unexpected workers %d", workers)
+	}
+	// Only a sample of 2*2 tensors is analyzed, once to warm up then at each
+	// level.
+	if !slices.Equal(sizes, []int{4, 4, 4}) {
+		t.Fatalf("unexpected sizes %v", sizes)
+	}
+	if opts.maxTensors != 0 {
+		t.Fatalf("opts not restored: %d", opts.maxTensors)
+	}
+}
+
+func TestAnalyzeFiles_AutoTune(t *testing.T) {
+	files := []string{"/x/1.safetensors", "/x/2.safetensors", "/x/3.safetensors"}
+	var mu sync.Mutex
+	limits := map[chan struct{}]struct{}{}
+	process := func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+		if opts.maxTensors == 0 {
+			mu.Lock()
+			limits[cpuLimit] = struct{}{}
+			mu.Unlock()
+		}
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, 1))
+		return []n_bits.AnalyzedTensor{a}, err
+	}
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), autoTune: true, workers: 4}
+	all, err := analyzeFiles(context.Background(), &bytes.Buffer{}, files, process, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Tensors) != 3 || all.Tensors[0].Name != files[0] {
+		t.Fatalf("unexpected %+v", all.Tensors)
+	}
+	// Each file worker has its own tensor workers, and together they don't use
+	// more than the CPUs.
+	total := 0
+	for l := range limits {
+		total += cap(l)
+	}
+	if total > 4 {
+		t.Fatalf("%d file workers using %d tensor workers", len(limits), total)
+	}
+}
+
+// errWriter fails all writes.
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestAnalyzeFiles_StreamError(t *testing.T) {
+	files := []string{"/x/1.safetensors", "/x/2.safetensors", "/x/3.safetensors"}
+	var running atomic.Int32
+	process := func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+		if name != files[0] {
+			// Block until canceled.
+			running.Add(1)
+			defer running.Add(-1)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, 1))
+		return []n_bits.AnalyzedTensor{a}, err
+	}
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), quiet: true, ndjson: newNDJSONStream(errWriter{})}
+	if _, err := analyzeFiles(context.Background(), &bytes.Buffer{}, files, process, &opts); err == nil || err.Error() != "disk full" {
+		t.Fatal(err)
+	}
+	// The workers returned before analyzeFiles.
+	if n := running.Load(); n != 0 {
+		t.Fatalf("%d workers still running", n)
+	}
+}
+
+// newF32Tensor returns a 1D F32 tensor.
+func newF32Tensor(name string, values ...float32) safetensors.Tensor {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return safetensors.Tensor{Name: name, DType: safetensors.F32, Shape: []uint64{uint64(len(values))}, Data: data}
+}
+
+// writeSafetensors writes a safetensors file containing the tensors.
+func writeSafetensors(t testing.TB, name string, metadata map[string]string, tensors []safetensors.Tensor) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sf := safetensors.File{Tensors: tensors, Metadata: metadata}
+	if err = sf.Serialize(f); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessSafetensorsFile_Exclude(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "model.safetensors")
+	writeSafetensors(t, name, nil, []safetensors.Tensor{
+		newF32Tensor("decoder.layers.0.fc1.bias", 1, 2),
+		newF32Tensor("decoder.layers.0.fc1.weight", 1, 2),
+		newF32Tensor("decoder.layers.0.self_attn_layer_norm.weight", 1, 2),
+		newF32Tensor("encoder.conv1.weight", 1, 2),
+	})
+	opts := analyzeOptions{
+		reTensors: regexp.MustCompile("^decoder\\."),
+		reExclude: regexp.MustCompile("bias$|layer_norm"),
+	}
+	analyzed, err := processSafetensorsFile(context.Background(), name, &opts, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analyzed) != 1 || analyzed[0].Name != "decoder.layers.0.fc1.weight" {
+		t.Fatalf("unexpected tensors %+v", analyzed)
+	}
+}
+
+func TestProcessSafetensorsFile_MinNumEl(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "model.safetensors")
+	writeSafetensors(t, name, nil, []safetensors.Tensor{
+		newF32Tensor("bias", 1, 2),
+		newF32Tensor("weight", 1, 2, 3, 4),
+		newF32Tensor("norm", 1),
+		newF32Tensor("embed", 1, 2, 3, 4, 5),
+	})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), minNumEl: 4}
+	analyzed, err := processSafetensorsFile(context.Background(), name, &opts, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analyzed) != 2 || analyzed[0].Name != "weight" || analyzed[1].Name != "embed" {
+		t.Fatalf("unexpected tensors %+v", analyzed)
+	}
+	all := n_bits.AnalyzedModel{Tensors: analyzed}
+	if s := all.Summary(); s.NumEl != 9 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+}
+
+func TestProcessSafetensorsFile_PackBits(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "model.safetensors")
+	writeSafetensors(t, name, nil, []safetensors.Tensor{
+		{Name: "qweight", DType: safetensors.I32, Shape: []uint64{1}, Data: []byte{0x10, 0x32, 0x10, 0x32}},
+		newF32Tensor("scales", 1, 2),
+	})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), packBits: 4}
+	analyzed, err := processSafetensorsFile(context.Background(), name, &opts, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analyzed) != 2 || analyzed[0].PackBits != 4 || analyzed[0].NumEl != 8 || analyzed[0].Mantissa.BitsActuallyUsed() != 2 || analyzed[1].PackBits != 0 {
+		t.Fatalf("unexpected tensors %+v", analyzed)
+	}
+}
+
+func TestPrintTable_Empty(t *testing.T) {
+	a, err := n_bits.AnalyzeTensor(context.Background(), "empty", safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{0, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := n_bits.AnalyzedModel{Tensors: []n_bits.AnalyzedTensor{a}}
+	b := bytes.Buffer{}
+	printModel(&b, &all, &analyzeOptions{})
+	if got := b.String(); strings.Contains(got, "NaN") || strings.Contains(got, "e+38") {
+		t.Fatalf("unexpected %q", got)
+	}
+}
+
+func TestSortTensors(t *testing.T) {
+	var tensors []n_bits.AnalyzedTensor
+	for _, tensor := range []safetensors.Tensor{
+		newF32Tensor("b", 1, 2, 3),
+		{Name: "c", DType: safetensors.I32, Shape: []uint64{1}, Data: make([]byte, 4)},
+		newF32Tensor("a", 1, 1.5),
+	} {
+		a, err := n_bits.AnalyzeTensor(context.Background(), tensor.Name, tensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tensors = append(tensors, a)
+	}
+	data := []struct {
+		key  string
+		desc bool
+		want string
+	}{
+		{"", false, "bca"},
+		{"file", false, "bca"},
+		{"file", true, "acb"},
+		{"name", false, "abc"},
+		{"name", true, "cba"},
+		{"numel", false, "cab"},
+		{"numel", true, "bac"},
+		{"wasted", false, "cab"},
+		{"wasted", true, "bac"},
+		// Stable.
+		{"dtype", false, "bac"},
+		{"dtype", true, "cba"},
+	}
+	for _, l := range data {
+		got := ""
+		for _, a := range sortTensors(tensors, l.key, l.desc) {
+			got += a.Name
+		}
+		if got != l.want {
+			t.Errorf("%s %t: want %s, got %s", l.key, l.desc, l.want, got)
+		}
+	}
+	if tensors[0].Name != "b" {
+		t.Fatal("input was modified")
+	}
+}
+
+func TestPrintWhatIf(t *testing.T) {
+	opts := n_bits.TensorOptions{Downcast: safetensors.F8_E4M3}
+	var tensors []n_bits.AnalyzedTensor
+	for _, tensor := range []safetensors.Tensor{
+		newF32Tensor("a", 1, 0.3),
+		// Larger than the 448 maximum.
+		newF32Tensor("b", 1000),
+		newF32Tensor("c", float32(math.Inf(1)), 1),
+		{Name: "d", DType: safetensors.I32, Shape: []uint64{1}, Data: make([]byte, 4)},
+	} {
+		a, err := opts.AnalyzeTensor(context.Background(), tensor.Name, tensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tensors = append(tensors, a)
+	}
+	b := bytes.Buffer{}
+	printWhatIf(&b, tensors, safetensors.F8_E4M3)
+	want := "What if F8_E4M3: 20B -> 5B (4.00x smaller), max error 0.0125, 2 tensors would lose values out of range\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+}
+
+func TestPrintDuplicates(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "model.safetensors")
+	writeSafetensors(t, name, nil, []safetensors.Tensor{
+		newF32Tensor("embed.weight", 1, 2, 3),
+		newF32Tensor("a", 1, 2),
+		newF32Tensor("lm_head.weight", 1, 2, 3),
+		newF32Tensor("b", 2, 1),
+	})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*")}
+	opts.tensorOpts.Hash = true
+	analyzed, err := processSafetensorsFile(context.Background(), name, &opts, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Duplicates: embed.weight, lm_head.weight (12B saved)\nDeduplication would save 12B\n"
+	b := bytes.Buffer{}
+	printDuplicates(&b, analyzed, nil)
+	if got := b.String(); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+	data, closeAll, err := mapTensors([]string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAll()
+	b.Reset()
+	printDuplicates(&b, analyzed, data)
+	if got := b.String(); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+	// Simulate a collision: a and b have the same digest but not the same
+	// content.
+	for i := range analyzed {
+		analyzed[i].Digest = "0"
+	}
+	b.Reset()
+	printDuplicates(&b, analyzed, data)
+	if got := b.String(); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+}
+
+func TestPrintTable_Integral(t *testing.T) {
+	a, err := n_bits.AnalyzeTensor(context.Background(), "codes", newF32Tensor("codes", 0, 3, 15, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printTable(&b, []n_bits.AnalyzedTensor{a}, &analyzeOptions{})
+	if !strings.Contains(b.String(), "  integral=U8") {
+		t.Fatal(b.String())
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	data := []struct {
+		counts []uint64
+		want   string
+	}{
+		{nil, ""},
+		{[]uint64{0, 0}, ""},
+		// Constant.
+		{[]uint64{0, 5, 0}, "█"},
+		{[]uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 0}, "▁▂▃▄▅▆▇█"},
+		{[]uint64{8, 0, 1}, "█ ▁"},
+		// 20 values are grouped by 2 in 10 buckets.
+		{[]uint64{1, 1, 0, 0, 2, 2, 0, 0, 4, 4, 0, 0, 8, 8, 0, 0, 16, 16, 0, 1}, "▁ ▁ ▂ ▄ █▁"},
+	}
+	for i, l := range data {
+		if got := sparkline(l.counts, 16); got != l.want {
+			t.Errorf("#%d: want %q, got %q", i, l.want, got)
+		}
+	}
+}
+
+func TestPrintTable_Sparkline(t *testing.T) {
+	a, err := n_bits.AnalyzeTensor(context.Background(), "a", newF32Tensor("a", 1, 2, 2, 4, 4, 4, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printTable(&b, []n_bits.AnalyzedTensor{a}, &analyzeOptions{sparkline: true})
+	if !strings.Contains(b.String(), "  exp_hist=▂▄█") {
+		t.Fatal(b.String())
+	}
+}
+
+func TestPrintTable_CompareDType(t *testing.T) {
+	a, err := n_bits.AnalyzeTensor(context.Background(), "a", newF32Tensor("a", 1, 0x1p20, 0x1p-20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printTable(&b, []n_bits.AnalyzedTensor{a}, &analyzeOptions{compareDType: safetensors.F16})
+	if !strings.Contains(b.String(), "  as_F16=overflow:1,underflow:0,subnormal:1") {
+		t.Fatal(b.String())
+	}
+}
+
+func TestPrintPrunable(t *testing.T) {
+	o := n_bits.TensorOptions{PruneThreshold: 0.1}
+	a, err := o.AnalyzeTensor(context.Background(), "a", newF32Tensor("a", 0, 0.01, 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printPrunable(&b, []n_bits.AnalyzedTensor{a}, 0.1)
+	want := "Prunable: 2 of 4 weights (50.0%) below 0.1; sparsifying would save 8B\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+	b.Reset()
+	printTable(&b, []n_bits.AnalyzedTensor{a}, &analyzeOptions{})
+	if !strings.Contains(b.String(), "  prunable=50.0%") {
+		t.Fatal(b.String())
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var tensors []n_bits.AnalyzedTensor
+	for _, n := range []string{"b", "c", "a"} {
+		a, err := n_bits.AnalyzeTensor(context.Background(), n, newF32Tensor(n, 1, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tensors = append(tensors, a)
+	}
+	b := bytes.Buffer{}
+	if err := writeCSV(&b, tensors); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("unexpected rows: %q", rows)
+	}
+	if rows[0][0] != "name" || len(rows[0]) != 15 {
+		t.Fatalf("unexpected header: %q", rows[0])
+	}
+	for i, n := range []string{"a", "b", "c"} {
+		if rows[i+1][0] != n {
+			t.Fatalf("row %d: want %q, got %q", i+1, n, rows[i+1][0])
+		}
+	}
+	// 1 and 2 only differ by the exponent.
+	if want := []string{"a", "F32", "2", "1.5", "1", "2", "0", "0", "0", "1", "8", "0", "23", "31", "7"}; !slices.Equal(rows[1], want) {
+		t.Fatalf("want %q\ngot  %q", want, rows[1])
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	b := bytes.Buffer{}
+	writePrometheus(&b, `org/"repo"`, &n_bits.Summary{NumTensors: 2, NumEl: 8, Bytes: 32, BytesWasted: 8, NaN: 3})
+	got := b.String()
+	for _, line := range []string{
+		"# TYPE nbits_wasted_bytes gauge\n",
+		"nbits_wasted_bytes{model=\"org/\\\"repo\\\"\"} 8\n",
+		"# TYPE nbits_nan gauge\n",
+		"nbits_nan{model=\"org/\\\"repo\\\"\"} 3\n",
+		"nbits_effective_bits_per_weight{model=\"org/\\\"repo\\\"\"} 24\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("missing %q in:\n%s", line, got)
+		}
+	}
+}
+
+func TestAnalyzeFiles_Order(t *testing.T) {
+	files := []string{"/x/1.safetensors", "/x/2.safetensors", "/x/3.safetensors"}
+	// Make the first files the slowest to process.
+	delays := map[string]time.Duration{files[0]: 30 * time.Millisecond, files[1]: 15 * time.Millisecond}
+	process := func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+		time.Sleep(delays[name])
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, 1))
+		return []n_bits.AnalyzedTensor{a}, err
+	}
+	b := bytes.Buffer{}
+	all, err := analyzeFiles(context.Background(), &b, files, process, &analyzeOptions{reTensors: regexp.MustCompile(".*")})
+	if err != nil {
 		t.Fatal(err)
 	}
+	var headers []string
+	for _, l := range strings.Split(b.String(), "\n") {
+		if strings.HasPrefix(l, "Processing ") {
+			headers = append(headers, l)
+		}
+	}
+	want := []string{"Processing 1.safetensors:", "Processing 2.safetensors:", "Processing 3.safetensors:"}
+	if !slices.Equal(want, headers) {
+		t.Fatalf("want %q\ngot  %q", want, headers)
+	}
+	for i, a := range all.Tensors {
+		if a.Name != files[i] {
+			t.Fatalf("tensor %d: want %q, got %q", i, files[i], a.Name)
+		}
+	}
+}
+
+func TestAnalyzeFiles_FileSummary(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "model-00001-of-00002.safetensors"), filepath.Join(dir, "model-00002-of-00002.safetensors")}
+	writeSafetensors(t, files[0], nil, []safetensors.Tensor{newF32Tensor("a", 1, 2, 3, 4)})
+	writeSafetensors(t, files[1], nil, []safetensors.Tensor{newF32Tensor("b", 1, -1)})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*")}
+	b := bytes.Buffer{}
+	all, err := analyzeFiles(context.Background(), &b, files, processSafetensorsFile, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := all.Summary()
+	printSummary(&b, &summary, &opts)
+	var got []string
+	for _, l := range strings.Split(b.String(), "\n") {
+		if strings.Contains(l, " wasted on ") {
+			got = append(got, l)
+		}
+	}
+	// "a" uses 3 exponents and 2 mantissas: 1+6+22=29 bits wasted per weight.
+	// "b" uses 2 signs: 0+8+23=31 bits wasted per weight.
+	want := []string{
+		"model-00001-of-00002.safetensors: 14B (87.5%) wasted on 16B",
+		"model-00002-of-00002.safetensors: 7B (87.5%) wasted on 8B",
+		"21B (87.5%) wasted on 24B total storing 6 weights, grade F",
+	}
+	if !slices.Equal(want, got) {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+}
+
+func TestAnalyzeFiles_Workers(t *testing.T) {
+	files := []string{"/x/1.safetensors", "/x/2.safetensors", "/x/3.safetensors"}
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	process := func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+		if cap(cpuLimit) != 1 {
+			t.Errorf("want 1 tensor worker, got %d", cap(cpuLimit))
+		}
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, 1, 2))
+		return []n_bits.AnalyzedTensor{a}, err
+	}
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), workers: 1, fileWorkers: 1}
+	all, err := analyzeFiles(context.Background(), &bytes.Buffer{}, files, process, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning != 1 {
+		t.Fatalf("want 1 file worker, got %d", maxRunning)
+	}
+	if len(all.Tensors) != 3 || all.Tensors[2].Name != files[2] || all.Tensors[2].Max != 2 {
+		t.Fatalf("unexpected %+v", all)
+	}
+}
+
+func TestAnalyzeFiles_Top(t *testing.T) {
+	// Each file has one tensor with as many 1.0 as its name, so the waste is
+	// proportional to the name.
+	files := []string{"1", "4", "2", "3"}
+	process := func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+		n, _ := strconv.Atoi(name)
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, slices.Repeat([]float32{1}, n)...))
+		return []n_bits.AnalyzedTensor{a}, err
+	}
+	b := bytes.Buffer{}
+	all, err := analyzeFiles(context.Background(), &b, files, process, &analyzeOptions{reTensors: regexp.MustCompile(".*"), top: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 3 || lines[0] != "Top 2 tensors by bytes wasted:" || !strings.HasPrefix(lines[1], "F 4: ") || !strings.HasPrefix(lines[2], "F 3: ") {
+		t.Fatalf("unexpected output:\n%s", b.String())
+	}
+	// The summary still covers all the tensors.
+	if s := all.Summary(); s.NumTensors != 4 || s.NumEl != 10 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+}
+
+func TestGradeThresholds(t *testing.T) {
+	var g gradeThresholds
+	for pct, want := range map[float64]byte{0: 'A', 5: 'A', 5.1: 'B', 20: 'C', 35: 'D', 50: 'E', 50.1: 'F', 100: 'F'} {
+		if got := g.grade(pct); got != want {
+			t.Errorf("grade(%g) = %c, want %c", pct, got, want)
+		}
+	}
+	if got := g.String(); got != "5,10,20,35,50" {
+		t.Fatal(got)
+	}
+	if err := g.Set("1,2,3,4,5"); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.grade(4.5); got != 'E' {
+		t.Fatalf("got %c", got)
+	}
+	for _, s := range []string{"1,2,3", "1,2,3,4,x", "5,4,3,2,1", "-1,2,3,4,5"} {
+		if err := g.Set(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestPrintByLayer(t *testing.T) {
+	var tensors []n_bits.AnalyzedTensor
+	for _, name := range []string{"model.layers.10.mlp.weight", "model.layers.2.mlp.weight", "model.layers.2.attn.weight", "lm_head.weight", "model.layers.x.weight"} {
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, 1, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tensors = append(tensors, a)
+	}
+	b := bytes.Buffer{}
+	printByLayer(&b, tensors)
+	want := "Bytes wasted per layer:\n" +
+		"      2:      14B/     16B (87.5%)\n" +
+		"     10:       7B/      8B (87.5%)\n" +
+		"  other:      14B/     16B (87.5%)\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+	// An empty layer doesn't print NaN.
+	empty, err := n_bits.AnalyzeTensor(context.Background(), "model.layers.0.bias", newF32Tensor("model.layers.0.bias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	printByLayer(&b, []n_bits.AnalyzedTensor{empty})
+	if got, want := b.String(), "Bytes wasted per layer:\n      0:       0B/      0B ( 0.0%)\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestPrintByPrefix(t *testing.T) {
+	var tensors []n_bits.AnalyzedTensor
+	for _, name := range []string{"model.embed.weight", "model.layers.0.mlp.weight", "model.layers.0.attn.weight", "model.layers.1.mlp.weight", "lm_head.weight", "bias"} {
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, 1, 2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tensors = append(tensors, a)
+	}
+	got := prefixBreakdown(tensors, 3)
+	want := []prefixStats{
+		{Prefix: "model.embed.weight", NumTensors: 1, NumEl: 2, Bytes: 8, BytesWasted: 7},
+		{Prefix: "model.layers.0", NumTensors: 2, NumEl: 4, Bytes: 16, BytesWasted: 14},
+		{Prefix: "model.layers.1", NumTensors: 1, NumEl: 2, Bytes: 8, BytesWasted: 7},
+		{Prefix: "lm_head.weight", NumTensors: 1, NumEl: 2, Bytes: 8, BytesWasted: 7},
+		{Prefix: "bias", NumTensors: 1, NumEl: 2, Bytes: 8, BytesWasted: 7},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+	if got = prefixBreakdown(tensors, 1); len(got) != 3 || got[0].Prefix != "model" || got[0].NumTensors != 4 || got[0].NumEl != 8 || got[0].BytesWasted != 28 {
+		t.Fatalf("unexpected %+v", got)
+	}
+	b := bytes.Buffer{}
+	printByPrefix(&b, tensors, 2)
+	want2 := "Bytes wasted per prefix:\n" +
+		"  model.embed   :       7B/      8B (87.5%) in 1 tensors storing 2 weights\n" +
+		"  model.layers  :      21B/     24B (87.5%) in 3 tensors storing 6 weights\n" +
+		"  lm_head.weight:       7B/      8B (87.5%) in 1 tensors storing 2 weights\n" +
+		"  bias          :       7B/      8B (87.5%) in 1 tensors storing 2 weights\n"
+	if got := b.String(); got != want2 {
+		t.Fatalf("want:\n%s\ngot:\n%s", want2, got)
+	}
+}
+
+func TestPrintCompression(t *testing.T) {
+	// Mostly the same value, so very low entropy.
+	values := slices.Repeat([]float32{1}, 1023)
+	values = append(values, -2)
+	a, err := n_bits.AnalyzeTensor(context.Background(), "a", newF32Tensor("a", values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printCompression(&b, []n_bits.AnalyzedTensor{a})
+	// Sign and exponent are each 0.0112 bits.
+	want := "Estimated compressed size: 3B (1365.33x smaller than 4.0kiB)\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestExportHistograms(t *testing.T) {
+	a, err := n_bits.AnalyzeTensor(context.Background(), "model.a", newF32Tensor("model.a", 1, 2, 2, -4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "hist")
+	if err = exportHistograms(dir, []n_bits.AnalyzedTensor{a}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "model.a.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := tensorHistogram{}
+	if err = json.Unmarshal(data, &h); err != nil {
+		t.Fatal(err)
+	}
+	sum := uint64(0)
+	for _, v := range h.Exponent {
+		sum += v
+	}
+	if h.Name != "model.a" || int64(sum) != h.NumEl || h.NumEl != 5 || len(h.MantissaBits) != 23 {
+		t.Fatalf("unexpected %+v", h)
+	}
+}
+
+func TestAnalyzeFiles_MemBudget(t *testing.T) {
+	dir := t.TempDir()
+	sizes := map[string]int64{"big1": 80, "small1": 10, "big2": 80, "huge": 500, "small2": 10}
+	var files []string
+	for _, n := range []string{"big1", "small1", "big2", "huge", "small2"} {
+		name := filepath.Join(dir, n)
+		if err := os.WriteFile(name, nil, 0o666); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(name, sizes[n]); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, name)
+	}
+	var mu sync.Mutex
+	inFlight := int64(0)
+	var overBudget []int64
+	process := func(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+		s := sizes[filepath.Base(name)]
+		mu.Lock()
+		inFlight += s
+		if inFlight > 100 && inFlight != 500 {
+			overBudget = append(overBudget, inFlight)
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight -= s
+		mu.Unlock()
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, 1))
+		return []n_bits.AnalyzedTensor{a}, err
+	}
+	b := bytes.Buffer{}
+	all, err := analyzeFiles(context.Background(), &b, files, process, &analyzeOptions{reTensors: regexp.MustCompile(".*"), memBudget: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Tensors) != len(files) {
+		t.Fatalf("got %d tensors", len(all.Tensors))
+	}
+	// The two big files never run concurrently and the huge file runs alone.
+	if len(overBudget) != 0 {
+		t.Fatalf("over budget: %v", overBudget)
+	}
+}
+
+func TestDTypeBreakdown(t *testing.T) {
+	var tensors []n_bits.AnalyzedTensor
+	for _, tensor := range []safetensors.Tensor{
+		newF32Tensor("a", 1, 2, 3),
+		{Name: "b", DType: safetensors.BF16, Shape: []uint64{4}, Data: make([]byte, 8)},
+		{Name: "c", DType: safetensors.BF16, Shape: []uint64{2}, Data: make([]byte, 4)},
+		{Name: "d", DType: safetensors.I32, Shape: []uint64{1}, Data: make([]byte, 4)},
+	} {
+		a, err := n_bits.AnalyzeTensor(context.Background(), tensor.Name, tensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tensors = append(tensors, a)
+	}
+	got := dtypeBreakdown(tensors)
+	want := []dtypeStats{
+		{DType: safetensors.BF16, NumTensors: 2, NumEl: 6, Bytes: 12},
+		{DType: safetensors.F32, NumTensors: 1, NumEl: 3, Bytes: 12},
+		{DType: safetensors.I32, NumTensors: 1, NumEl: 1, Bytes: 4},
+	}
+	if !slices.Equal(want, got) {
+		t.Fatalf("want %+v\ngot  %+v", want, got)
+	}
+	m := n_bits.AnalyzedModel{Tensors: tensors}
+	s := m.Summary()
+	var numEl, bytes int64
+	for _, d := range got {
+		numEl += d.NumEl
+		bytes += d.Bytes
+	}
+	if numEl != s.NumEl || bytes != s.Bytes {
+		t.Fatalf("%d/%d != %+v", numEl, bytes, s)
+	}
+}
+
+func TestPrintTable_Downcast(t *testing.T) {
+	o := n_bits.TensorOptions{Downcast: safetensors.BF16}
+	a, err := o.AnalyzeTensor(context.Background(), "a", newF32Tensor("a", 1, 1+0x1p-9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printTable(&b, []n_bits.AnalyzedTensor{a}, &analyzeOptions{})
+	if got := b.String(); !strings.HasSuffix(got, "  BF16_rne=0.00195/0.000977  BF16_trunc=0.00195/0.000977\n") {
+		t.Fatal(got)
+	}
+}
+
+func TestPrintTable_DowncastErrors(t *testing.T) {
+	o := n_bits.TensorOptions{DowncastErrors: true}
+	a, err := o.AnalyzeTensor(context.Background(), "a", newF32Tensor("a", 1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printTable(&b, []n_bits.AnalyzedTensor{a}, &analyzeOptions{})
+	if got := b.String(); !strings.HasSuffix(got, "  rmse_BF16=0  rmse_F16=0  rmse_F8_E4M3=0\n") {
+		t.Fatal(got)
+	}
+}
+
+func TestPrintTable_ShowBitmask(t *testing.T) {
+	i := safetensors.Tensor{Name: "i", DType: safetensors.U32, Shape: []uint64{2}, Data: []byte{5, 0, 0, 0, 3, 0, 0, 0}}
+	a, err := n_bits.AnalyzeTensor(context.Background(), "i", i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	printTable(&b, []n_bits.AnalyzedTensor{a}, &analyzeOptions{showBitmask: true})
+	if want := "  mantissa_bits=" + "111" + strings.Repeat("0", 29) + "\n"; !strings.HasSuffix(b.String(), want) {
+		t.Fatal(b.String())
+	}
 }
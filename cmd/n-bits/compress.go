@@ -0,0 +1,73 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// isCompressed returns true if name is a gzip or zstd compressed file, as
+// decided by its extension.
+func isCompressed(name string) bool {
+	return strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".zst")
+}
+
+// decompressFile decompresses name in a new temporary directory and returns
+// the path of the decompressed file, named like name without the compression
+// extension so the format is still detected.
+//
+// The caller must delete the directory of the returned file.
+func decompressFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var r io.Reader
+	base := filepath.Base(name)
+	if strings.HasSuffix(base, ".gz") {
+		g, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer g.Close()
+		r = g
+		base = strings.TrimSuffix(base, ".gz")
+	} else {
+		z, err := zstd.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer z.Close()
+		r = z
+		base = strings.TrimSuffix(base, ".zst")
+	}
+	dir, err := os.MkdirTemp("", "n-bits")
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(dir, base)
+	if err = copyFile(out, r); err != nil {
+		return "", errors.Join(err, os.RemoveAll(dir))
+	}
+	return out, nil
+}
+
+// copyFile writes the content of r to a new file named name.
+func copyFile(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return errors.Join(err, f.Close())
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestDecompressFile_Gzip(t *testing.T) {
+	name := filepath.Join("testdata", "tiny.safetensors.gz")
+	if !isCompressed(name) {
+		t.Fatal("expected compressed")
+	}
+	out, err := decompressFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(out))
+	if b := filepath.Base(out); b != "tiny.safetensors" {
+		t.Fatal(b)
+	}
+	s, err := loadMetadata(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tensors) != 1 || s.Tensors[0].Name != "a" {
+		t.Fatalf("unexpected %+v", s.Tensors)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecompressFile_Zstd(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "tiny.npy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "tiny.npy.zst")
+	if err = os.WriteFile(name, e.EncodeAll(want, nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := decompressFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(out))
+	if !isNumpy(out) {
+		t.Fatal(out)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("content differs")
+	}
+	// Not a zstd stream.
+	if err = os.WriteFile(name, want, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = decompressFile(name); err == nil {
+		os.RemoveAll(filepath.Dir(out))
+		t.Fatal("expected error")
+	}
+}
+
+func TestCmdAnalyze_Compressed(t *testing.T) {
+	jsonOut := filepath.Join(t.TempDir(), "out.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut}
+	name := filepath.Join("testdata", "tiny.safetensors.gz")
+	captureStdout(t, func() {
+		if err := cmdAnalyze(context.Background(), "", "", "", "", name, "", "", &opts); err != nil {
+			t.Error(err)
+		}
+	})
+	all, err := loadAnalyzedModel(jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Tensors) != 1 || all.Tensors[0].Name != "a" || all.Tensors[0].Max != 4 {
+		t.Fatalf("unexpected %+v", all.Tensors)
+	}
+	got := captureStdout(t, func() {
+		if err := cmdMetadata(context.Background(), name, "", "", "", "", 1); err != nil {
+			t.Error(err)
+		}
+	})
+	if !strings.Contains(got, "tiny.safetensors:\n  1 tensors of type F32\n") {
+		t.Fatalf("unexpected %q", got)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/maruel/n-bits-go/n_bits"
+)
+
+// stringsArg is a flag that can be specified multiple times.
+type stringsArg []string
+
+func (s *stringsArg) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringsArg) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+// bitsUsed returns the number of bits actually used per weight.
+func bitsUsed(a *n_bits.AnalyzedTensor) float64 {
+	return a.Sign.BitsActuallyUsed() + a.Exponent.BitsActuallyUsed() + a.Mantissa.BitsActuallyUsed()
+}
+
+// diffModels prints the changes between two analyzed models, per tensor.
+//
+// Tensors present in only one model are flagged. With normalize, the tensors
+// are matched by n_bits.NormalizeName, e.g. to compare a model with its GGUF
+// conversion.
+func diffModels(w io.Writer, oldName string, before *n_bits.AnalyzedModel, newName string, after *n_bits.AnalyzedModel, normalize bool) {
+	key := func(name string) string {
+		if normalize {
+			return n_bits.NormalizeName(name)
+		}
+		return name
+	}
+	newTensors := make(map[string]*n_bits.AnalyzedTensor, len(after.Tensors))
+	for i := range after.Tensors {
+		newTensors[key(after.Tensors[i].Name)] = &after.Tensors[i]
+	}
+	seen := make(map[string]bool, len(before.Tensors))
+	for i := range before.Tensors {
+		o := &before.Tensors[i]
+		k := key(o.Name)
+		seen[k] = true
+		n := newTensors[k]
+		if n == nil {
+			fmt.Fprintf(w, "%s: only in %s\n", o.Name, oldName)
+			continue
+		}
+		io.WriteString(w, o.Name)
+		if n.Name != o.Name {
+			fmt.Fprintf(w, " (%s)", n.Name)
+		}
+		ob := bitsUsed(o)
+		nb := bitsUsed(n)
+		fmt.Fprintf(w, ": %s->%s  bits used %4.1f->%4.1f (%+5.1f)  min %g->%g  max %g->%g", o.DType, n.DType, ob, nb, nb-ob, o.Min, n.Min, o.Max, n.Max)
+		if d := n.NaN - o.NaN; d > 0 {
+			fmt.Fprintf(w, "  +%d NaN", d)
+		}
+		if d := n.Inf - o.Inf; d > 0 {
+			fmt.Fprintf(w, "  +%d Inf", d)
+		}
+		io.WriteString(w, "\n")
+	}
+	for i := range after.Tensors {
+		if n := &after.Tensors[i]; !seen[key(n.Name)] {
+			fmt.Fprintf(w, "%s: only in %s\n", n.Name, newName)
+		}
+	}
+}
+
+// cmdDiff prints the changes between two analyses saved with analyze -json.
+func cmdDiff(w io.Writer, oldName, newName string, normalize bool) error {
+	before, err := loadAnalyzedModel(oldName)
+	if err != nil {
+		return err
+	}
+	after, err := loadAnalyzedModel(newName)
+	if err != nil {
+		return err
+	}
+	diffModels(w, oldName, before, newName, after, normalize)
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/n-bits-go/n_bits"
+)
+
+func TestCmdDiff(t *testing.T) {
+	save, analyze := diffHelpers(t)
+	before := save("before.json", analyze("a", 1, 2), analyze("b", 1.5, -1), analyze("gone", 1))
+	after := save("after.json", analyze("a", 1, 2), analyze("b", 1.5, float32(math.NaN()), float32(math.NaN())), analyze("added", 1))
+	b := bytes.Buffer{}
+	if err := cmdDiff(&b, before, after, false); err != nil {
+		t.Fatal(err)
+	}
+	want := "a: F32->F32  bits used  1.0-> 1.0 ( +0.0)  min 1->1  max 2->2\n" +
+		"b: F32->F32  bits used  2.0-> 1.0 ( -1.0)  min -1->1.5  max 1.5->1.5  +2 NaN\n" +
+		"gone: only in " + before + "\n" +
+		"added: only in " + after + "\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestCmdDiff_NormalizeNames(t *testing.T) {
+	save, analyze := diffHelpers(t)
+	hf := save("hf.json", analyze("model.layers.0.mlp.gate_proj.weight", 1, 2), analyze("lm_head.weight", 1))
+	gguf := save("gguf.json", analyze("blk.0.ffn_gate.weight", 1, 2), analyze("output.weight", 1))
+	b := bytes.Buffer{}
+	if err := cmdDiff(&b, hf, gguf, true); err != nil {
+		t.Fatal(err)
+	}
+	want := "model.layers.0.mlp.gate_proj.weight (blk.0.ffn_gate.weight): F32->F32  bits used  1.0-> 1.0 ( +0.0)  min 1->1  max 2->2\n" +
+		"lm_head.weight (output.weight): F32->F32  bits used  0.0-> 0.0 ( +0.0)  min 1->1  max 1->1\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+// diffHelpers returns functions to save an analyzed model as JSON in a
+// temporary directory and to analyze a F32 tensor.
+func diffHelpers(t *testing.T) (func(name string, tensors ...n_bits.AnalyzedTensor) string, func(name string, values ...float32) n_bits.AnalyzedTensor) {
+	dir := t.TempDir()
+	save := func(name string, tensors ...n_bits.AnalyzedTensor) string {
+		data, err := json.Marshal(&n_bits.AnalyzedModel{Tensors: tensors})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, name)
+		if err = os.WriteFile(p, data, 0o666); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	analyze := func(name string, values ...float32) n_bits.AnalyzedTensor {
+		a, err := n_bits.AnalyzeTensor(context.Background(), name, newF32Tensor(name, values...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	return save, analyze
+}
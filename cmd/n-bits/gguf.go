@@ -0,0 +1,272 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ggufMagic is "GGUF" in little endian.
+const ggufMagic = 0x46554747
+
+// ggufMaxString is the maximum length of a string in a GGUF header, to not
+// allocate unbounded memory on corrupted files.
+const ggufMaxString = 1 << 24
+
+// ggufTypes are the names of the ggml tensor types.
+var ggufTypes = map[uint32]string{
+	0:  "F32",
+	1:  "F16",
+	2:  "Q4_0",
+	3:  "Q4_1",
+	6:  "Q5_0",
+	7:  "Q5_1",
+	8:  "Q8_0",
+	9:  "Q8_1",
+	10: "Q2_K",
+	11: "Q3_K",
+	12: "Q4_K",
+	13: "Q5_K",
+	14: "Q6_K",
+	15: "Q8_K",
+	16: "IQ2_XXS",
+	17: "IQ2_XS",
+	18: "IQ3_XXS",
+	19: "IQ1_S",
+	20: "IQ4_NL",
+	21: "IQ3_S",
+	22: "IQ2_S",
+	23: "IQ4_XS",
+	24: "I8",
+	25: "I16",
+	26: "I32",
+	27: "I64",
+	28: "F64",
+	29: "IQ1_M",
+	30: "BF16",
+}
+
+// ggufValueTypes are the names of the metadata value types.
+var ggufValueTypes = [...]string{"uint8", "int8", "uint16", "int16", "uint32", "int32", "float32", "bool", "string", "array", "uint64", "int64", "float64"}
+
+// ggufKV is a metadata key-value pair.
+type ggufKV struct {
+	Key   string
+	Value string
+}
+
+// ggufTensor is a tensor info.
+type ggufTensor struct {
+	Name   string
+	Shape  []uint64
+	Type   string
+	Offset uint64
+}
+
+// ggufHeader is the parsed header of a GGUF file.
+type ggufHeader struct {
+	Version  uint32
+	Metadata []ggufKV
+	Tensors  []ggufTensor
+}
+
+// isGGUF returns true if the file is a GGUF file, based on its extension or
+// its magic bytes.
+func isGGUF(name string) bool {
+	if strings.EqualFold(filepath.Ext(name), ".gguf") {
+		return true
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var magic uint32
+	return binary.Read(f, binary.LittleEndian, &magic) == nil && magic == ggufMagic
+}
+
+// ggufReader reads the little endian GGUF header.
+type ggufReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (g *ggufReader) read(v any) {
+	if g.err == nil {
+		g.err = binary.Read(g.r, binary.LittleEndian, v)
+	}
+}
+
+func (g *ggufReader) u32() uint32 {
+	var v uint32
+	g.read(&v)
+	return v
+}
+
+func (g *ggufReader) u64() uint64 {
+	var v uint64
+	g.read(&v)
+	return v
+}
+
+func (g *ggufReader) string() string {
+	l := g.u64()
+	if g.err != nil {
+		return ""
+	}
+	if l > ggufMaxString {
+		g.err = fmt.Errorf("string too long: %d", l)
+		return ""
+	}
+	b := make([]byte, l)
+	_, g.err = io.ReadFull(g.r, b)
+	return string(b)
+}
+
+// value reads a metadata value of type t and returns it formatted.
+func (g *ggufReader) value(t uint32) string {
+	switch t {
+	case 0:
+		var v uint8
+		g.read(&v)
+		return fmt.Sprint(v)
+	case 1:
+		var v int8
+		g.read(&v)
+		return fmt.Sprint(v)
+	case 2:
+		var v uint16
+		g.read(&v)
+		return fmt.Sprint(v)
+	case 3:
+		var v int16
+		g.read(&v)
+		return fmt.Sprint(v)
+	case 4:
+		return fmt.Sprint(g.u32())
+	case 5:
+		return fmt.Sprint(int32(g.u32()))
+	case 6:
+		return fmt.Sprint(math.Float32frombits(g.u32()))
+	case 7:
+		var v uint8
+		g.read(&v)
+		return fmt.Sprint(v != 0)
+	case 8:
+		return g.string()
+	case 9:
+		et := g.u32()
+		n := g.u64()
+		if et == 9 {
+			g.err = errors.New("nested arrays are not supported")
+		}
+		// Arrays like the tokenizer vocabulary are huge; only print small ones.
+		const maxItems = 16
+		var items []string
+		for i := uint64(0); i < n && g.err == nil; i++ {
+			if v := g.value(et); i < maxItems {
+				items = append(items, v)
+			}
+		}
+		if g.err != nil {
+			return ""
+		}
+		if n > maxItems {
+			return fmt.Sprintf("[%d %s]", n, ggufValueTypes[et])
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case 10:
+		return fmt.Sprint(g.u64())
+	case 11:
+		return fmt.Sprint(int64(g.u64()))
+	case 12:
+		return fmt.Sprint(math.Float64frombits(g.u64()))
+	default:
+		if g.err == nil {
+			g.err = fmt.Errorf("unknown value type %d", t)
+		}
+		return ""
+	}
+}
+
+// parseGGUFHeader parses the metadata and tensor infos of a GGUF file.
+//
+// Only versions 2 and 3 are supported.
+func parseGGUFHeader(r io.Reader) (*ggufHeader, error) {
+	g := ggufReader{r: bufio.NewReader(r)}
+	if magic := g.u32(); g.err == nil && magic != ggufMagic {
+		return nil, errors.New("not a GGUF file")
+	}
+	h := &ggufHeader{Version: g.u32()}
+	if g.err == nil && h.Version != 2 && h.Version != 3 {
+		return nil, fmt.Errorf("unsupported GGUF version %d", h.Version)
+	}
+	numTensors := g.u64()
+	numKV := g.u64()
+	for i := uint64(0); i < numKV && g.err == nil; i++ {
+		kv := ggufKV{Key: g.string()}
+		kv.Value = g.value(g.u32())
+		h.Metadata = append(h.Metadata, kv)
+	}
+	for i := uint64(0); i < numTensors && g.err == nil; i++ {
+		t := ggufTensor{Name: g.string()}
+		nDims := g.u32()
+		if nDims > 8 {
+			return nil, fmt.Errorf("tensor %q: too many dimensions: %d", t.Name, nDims)
+		}
+		t.Shape = make([]uint64, nDims)
+		for j := range t.Shape {
+			t.Shape[j] = g.u64()
+		}
+		typ := g.u32()
+		if t.Type = ggufTypes[typ]; t.Type == "" {
+			t.Type = fmt.Sprintf("type%d", typ)
+		}
+		t.Offset = g.u64()
+		h.Tensors = append(h.Tensors, t)
+	}
+	if g.err != nil {
+		return nil, fmt.Errorf("invalid GGUF header: %w", g.err)
+	}
+	return h, nil
+}
+
+// printGGUFMetadata prints the tensor types and metadata of a GGUF file, like
+// cmdMetadata does for safetensors.
+func printGGUFMetadata(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h, err := parseGGUFHeader(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(name), err)
+	}
+	fmt.Fprintf(w, "%s:\n", filepath.Base(name))
+	types := map[string]int{}
+	var order []string
+	for _, t := range h.Tensors {
+		if types[t.Type] == 0 {
+			order = append(order, t.Type)
+		}
+		types[t.Type]++
+	}
+	for _, t := range order {
+		fmt.Fprintf(w, "  %d tensors of type %s\n", types[t], t)
+	}
+	for _, kv := range h.Metadata {
+		fmt.Fprintf(w, "- %s: %s\n", kv.Key, kv.Value)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrintGGUFMetadata(t *testing.T) {
+	name := filepath.Join("testdata", "tiny.gguf")
+	if !isGGUF(name) {
+		t.Fatal("expected GGUF")
+	}
+	b := bytes.Buffer{}
+	if err := printGGUFMetadata(&b, name); err != nil {
+		t.Fatal(err)
+	}
+	want := "tiny.gguf:\n" +
+		"  1 tensors of type F16\n" +
+		"  2 tensors of type Q8_0\n" +
+		"  1 tensors of type F32\n" +
+		"- general.architecture: llama\n" +
+		"- general.name: tiny\n" +
+		"- llama.block_count: 2\n" +
+		"- llama.rope.freq_base: 10000\n" +
+		"- tokenizer.ggml.add_bos_token: true\n" +
+		"- tokenizer.ggml.tokens: [<s>, a, b]\n" +
+		"- tokenizer.ggml.scores: [20 float32]\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestIsGGUF_Magic(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "tiny.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	name := filepath.Join(dir, "model.bin")
+	if err = os.WriteFile(name, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if !isGGUF(name) {
+		t.Fatal("expected GGUF")
+	}
+	other := filepath.Join(dir, "model.safetensors")
+	if err = os.WriteFile(other, []byte("{}"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if isGGUF(other) {
+		t.Fatal("unexpected GGUF")
+	}
+}
+
+func TestParseGGUFHeader_Truncated(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "tiny.gguf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []int{0, 4, 8, 30, 100, 500} {
+		if _, err = parseGGUFHeader(bytes.NewReader(data[:l])); err == nil {
+			t.Errorf("%d: expected error", l)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"os"
+
+	"github.com/maruel/n-bits-go/n_bits"
+)
+
+// htmlRow is a row of the HTML table. It mirrors printTable.
+type htmlRow struct {
+	Grade       string
+	Name        string
+	DType       string
+	NumEl       int64
+	Avg         float64
+	Min         float64
+	Max         float64
+	SignUsed    float64
+	ExpUsed     float64
+	ExpAlloc    int32
+	ManUsed     float64
+	ManAlloc    int32
+	Wasted      int64
+	Bits        int64
+	WastedPct   float64
+	WastedBytes int64
+	Entropy     float64
+	Suggest     string
+}
+
+// htmlPage is the data rendered by htmlTemplate.
+type htmlPage struct {
+	Title   string
+	Summary n_bits.Summary
+	Grade   string
+	Rows    []htmlRow
+}
+
+// htmlTemplate is a self-contained page; it must not load any external
+// asset.
+var htmlTemplate = template.Must(template.New("").Funcs(template.FuncMap{"human": humanBytes}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>n-bits: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; font-size: 0.9em; }
+th, td { padding: 2px 6px; border-bottom: 1px solid #ddd; text-align: right; white-space: nowrap; }
+th { cursor: pointer; background: #eee; position: sticky; top: 0; }
+td.l, th.l { text-align: left; }
+.bar { display: inline-block; height: 0.8em; background: #d55; vertical-align: middle; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Analyzed {{.Summary.NumTensors}} tensors, {{.Summary.NumEl}} weights, {{human .Summary.Bytes}}.
+Wasted {{human .Summary.BytesWasted}}, grade {{.Grade}}.
+Effective bits per weight: {{printf "%.2f" .Summary.EffectiveBitsPerWeight}}.
+Inf: {{.Summary.Inf}}, NaN: {{.Summary.NaN}}.</p>
+<table id="t">
+<thead><tr>
+<th class="l">Grade</th><th class="l">Name</th><th class="l">DType</th><th>Weights</th><th>Avg</th><th>Min</th><th>Max</th>
+<th>Sign</th><th>Exponent</th><th>Mantissa</th><th>Wasted bits</th><th>Wasted %</th><th>Wasted bytes</th><th>Entropy</th><th class="l">Suggest</th>
+</tr></thead>
+<tbody>
+{{- range .Rows}}
+<tr>
+<td class="l">{{.Grade}}</td><td class="l">{{.Name}}</td><td class="l">{{.DType}}</td><td>{{.NumEl}}</td>
+<td>{{printf "%.3g" .Avg}}</td><td>{{printf "%.3g" .Min}}</td><td>{{printf "%.3g" .Max}}</td>
+<td>{{printf "%.0f" .SignUsed}}</td><td data-v="{{.ExpUsed}}">{{printf "%.1f" .ExpUsed}}/{{.ExpAlloc}}</td><td data-v="{{.ManUsed}}">{{printf "%.1f" .ManUsed}}/{{.ManAlloc}}</td>
+<td data-v="{{.Wasted}}">{{.Wasted}}/{{.Bits}}</td>
+<td data-v="{{.WastedPct}}"><span class="bar" style="width:{{printf "%.0f" .WastedPct}}px"></span> {{printf "%.1f" .WastedPct}}%</td>
+<td data-v="{{.WastedBytes}}">{{human .WastedBytes}}</td><td>{{printf "%.1f" .Entropy}}</td><td class="l">{{.Suggest}}</td>
+</tr>
+{{- end}}
+</tbody>
+</table>
+<script>
+document.querySelectorAll("#t th").forEach(function(th, col) {
+  th.addEventListener("click", function() {
+    var body = document.querySelector("#t tbody");
+    var rows = Array.from(body.rows);
+    var desc = th.dataset.desc !== "1";
+    th.dataset.desc = desc ? "1" : "0";
+    var key = function(r) {
+      var c = r.cells[col];
+      var v = c.dataset.v !== undefined ? c.dataset.v : c.textContent;
+      var n = parseFloat(v);
+      return isNaN(n) ? v : n;
+    };
+    rows.sort(function(a, b) {
+      var x = key(a), y = key(b);
+      var c = x < y ? -1 : x > y ? 1 : 0;
+      return desc ? -c : c;
+    });
+    rows.forEach(function(r) { body.appendChild(r); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// writeHTML writes a self-contained HTML page with a sortable table of the
+// tensors and the summary.
+func writeHTML(w io.Writer, title string, all *n_bits.AnalyzedModel, opts *analyzeOptions) error {
+	summary := all.Summary()
+	p := htmlPage{
+		Title:   title,
+		Summary: summary,
+		Grade:   string(opts.grades.grade(100 * float64(summary.BytesWasted) / float64(max(summary.Bytes, 1)))),
+		Rows:    make([]htmlRow, len(all.Tensors)),
+	}
+	for i := range all.Tensors {
+		a := &all.Tensors[i]
+		bits := int64(8 * a.DType.WordSize())
+		wasted := int64(a.BitsWasted())
+		pct := 100 * float64(wasted) / float64(bits)
+		p.Rows[i] = htmlRow{
+			Grade:       string(opts.grades.grade(pct)),
+			Name:        a.Name,
+			DType:       string(a.DType),
+			NumEl:       a.NumEl,
+			Avg:         a.Avg,
+			Min:         a.Min,
+			Max:         a.Max,
+			SignUsed:    a.Sign.BitsActuallyUsed(),
+			ExpUsed:     a.Exponent.BitsActuallyUsed(),
+			ExpAlloc:    a.Exponent.GetAllocation(),
+			ManUsed:     a.Mantissa.BitsActuallyUsed(),
+			ManAlloc:    a.Mantissa.GetAllocation(),
+			Wasted:      wasted,
+			Bits:        bits,
+			WastedPct:   pct,
+			WastedBytes: a.BytesWasted(),
+			Entropy:     a.Entropy,
+			Suggest:     string(a.RecommendDType()),
+		}
+	}
+	return htmlTemplate.Execute(w, &p)
+}
+
+// writeHTMLFile renders the HTML report to a file.
+func writeHTMLFile(name, title string, all *n_bits.AnalyzedModel, opts *analyzeOptions) error {
+	b := bytes.Buffer{}
+	if err := writeHTML(&b, title, all, opts); err != nil {
+		return err
+	}
+	return os.WriteFile(name, b.Bytes(), 0o666)
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/maruel/n-bits-go/n_bits"
+)
+
+func TestWriteHTML(t *testing.T) {
+	all := n_bits.AnalyzedModel{}
+	for _, n := range []string{"model.embed.weight", "model.norm.weight", "<script>"} {
+		a, err := n_bits.AnalyzeTensor(context.Background(), n, newF32Tensor(n, 1, -2.5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		all.Tensors = append(all.Tensors, a)
+	}
+	b := bytes.Buffer{}
+	if err := writeHTML(&b, "org/model", &all, &analyzeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, want := range []string{"<title>n-bits: org/model</title>", "model.embed.weight", "model.norm.weight", "&lt;script&gt;", "grade F"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+	// Self-contained.
+	for _, bad := range []string{"http://", "https://", "<link", "<script src"} {
+		if strings.Contains(got, bad) {
+			t.Errorf("unexpected %q", bad)
+		}
+	}
+}
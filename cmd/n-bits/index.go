@@ -0,0 +1,155 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/maruel/n-bits-go/n_bits"
+)
+
+// indexGlob matches the index of a sharded HuggingFace model, normally
+// model.safetensors.index.json.
+const indexGlob = "*.safetensors.index.json"
+
+// indexEntry is a tensor listed in a safetensorsIndex.
+type indexEntry struct {
+	Name string
+	File string
+}
+
+// weightMap is the "weight_map" of a safetensorsIndex, in the order of the
+// file.
+type weightMap []indexEntry
+
+func (w *weightMap) UnmarshalJSON(data []byte) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if t, err := d.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return errors.New("weight_map must be an object")
+	}
+	*w = nil
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		e := indexEntry{Name: t.(string)}
+		if err = d.Decode(&e.File); err != nil {
+			return fmt.Errorf("weight_map %q: %w", e.Name, err)
+		}
+		*w = append(*w, e)
+	}
+	_, err := d.Token()
+	return err
+}
+
+// safetensorsIndex is a model.safetensors.index.json file, which maps each
+// tensor to the shard file containing it.
+type safetensorsIndex struct {
+	WeightMap weightMap `json:"weight_map"`
+}
+
+// loadIndex loads a model.safetensors.index.json file.
+func loadIndex(name string) (*safetensorsIndex, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	idx := &safetensorsIndex{}
+	if err = json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(name), err)
+	}
+	return idx, nil
+}
+
+// splitIndex returns the index file among files, if any, and the other files.
+func splitIndex(files []string) (string, []string) {
+	index := ""
+	var out []string
+	for _, f := range files {
+		if m, _ := filepath.Match(indexGlob, filepath.Base(f)); m {
+			index = f
+		} else {
+			out = append(out, f)
+		}
+	}
+	return index, out
+}
+
+// checkIndex prints the tensors listed in the index that are not in the shard
+// files it names and the tensors of the shard files not listed in the index.
+//
+// It returns an error if a listed tensor is missing, since the model is then
+// incomplete.
+func checkIndex(w io.Writer, idx *safetensorsIndex, files []string) error {
+	shards := map[string]map[string]bool{}
+	for _, f := range files {
+		s := n_bits.Mapped{}
+		if err := s.Open(f); err != nil {
+			return err
+		}
+		names := make(map[string]bool, len(s.Tensors))
+		for _, t := range s.Tensors {
+			names[t.Name] = true
+		}
+		if err := s.Close(); err != nil {
+			return err
+		}
+		shards[filepath.Base(f)] = names
+	}
+	missing := 0
+	listed := make(map[string]string, len(idx.WeightMap))
+	for _, e := range idx.WeightMap {
+		listed[e.Name] = e.File
+		if !shards[filepath.Base(e.File)][e.Name] {
+			fmt.Fprintf(w, "%s: listed in the index in %s but not found\n", e.Name, e.File)
+			missing++
+		}
+	}
+	for _, f := range files {
+		base := filepath.Base(f)
+		var extra []string
+		for name := range shards[base] {
+			if filepath.Base(listed[name]) != base {
+				extra = append(extra, name)
+			}
+		}
+		slices.Sort(extra)
+		for _, name := range extra {
+			fmt.Fprintf(w, "%s: in %s but not listed in the index\n", name, base)
+		}
+	}
+	if missing != 0 {
+		return fmt.Errorf("%d tensors listed in the index are missing", missing)
+	}
+	return nil
+}
+
+// orderByIndex sorts the tensors in the order of the index. The tensors not
+// listed are kept at the end in their original order.
+func orderByIndex(tensors []n_bits.AnalyzedTensor, idx *safetensorsIndex) {
+	pos := make(map[string]int, len(idx.WeightMap))
+	for i, e := range idx.WeightMap {
+		pos[e.Name] = i
+	}
+	rank := func(name string) int {
+		if i, ok := pos[name]; ok {
+			return i
+		}
+		return len(pos)
+	}
+	slices.SortStableFunc(tensors, func(a, b n_bits.AnalyzedTensor) int {
+		return rank(a.Name) - rank(b.Name)
+	})
+}
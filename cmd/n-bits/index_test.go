@@ -0,0 +1,154 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maruel/n-bits-go/n_bits"
+	"github.com/maruel/safetensors"
+)
+
+// writeShardedModel writes the shards listed in
+// testdata/model.safetensors.index.json and the index in a temporary
+// directory.
+func writeShardedModel(t *testing.T) string {
+	dir := t.TempDir()
+	writeSafetensors(t, filepath.Join(dir, "model-00001-of-00002.safetensors"), nil, []safetensors.Tensor{
+		newF32Tensor("model.layers.0.input_layernorm.weight", 1, 1),
+		newF32Tensor("model.embed_tokens.weight", 1, 2, 3, 4),
+	})
+	writeSafetensors(t, filepath.Join(dir, "model-00002-of-00002.safetensors"), nil, []safetensors.Tensor{
+		newF32Tensor("lm_head.weight", 0.5, 0.25),
+		newF32Tensor("model.layers.0.mlp.up_proj.weight", -1),
+	})
+	data, err := os.ReadFile(filepath.Join("testdata", "model.safetensors.index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "model.safetensors.index.json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestCmdAnalyze_Index(t *testing.T) {
+	dir := writeShardedModel(t)
+	jsonOut := filepath.Join(t.TempDir(), "out.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut, useIndex: true, sortKey: "file"}
+	out := captureStdout(t, func() {
+		if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+			t.Error(err)
+		}
+	})
+	data, err := os.ReadFile(jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := n_bits.AnalyzedModel{}
+	if err = json.Unmarshal(data, &all); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"model.embed_tokens.weight", "model.layers.0.mlp.up_proj.weight", "model.layers.0.input_layernorm.weight", "lm_head.weight"}
+	if len(all.Tensors) != len(want) {
+		t.Fatalf("unexpected %+v", all.Tensors)
+	}
+	for i, name := range want {
+		if all.Tensors[i].Name != name {
+			t.Errorf("#%d: want %q, got %q", i, name, all.Tensors[i].Name)
+		}
+	}
+	// The table is printed once, in the order of the index.
+	if strings.Contains(out, "Processing ") {
+		t.Errorf("unexpected per file table:\n%s", out)
+	}
+	last := -1
+	for _, name := range want {
+		i := strings.Index(out, name)
+		if i <= last {
+			t.Fatalf("%s out of order:\n%s", name, out)
+		}
+		last = i
+	}
+}
+
+func TestCmdAnalyze_NoIndex(t *testing.T) {
+	// Without -index, the index is ignored and the tensors are in file order.
+	dir := writeShardedModel(t)
+	jsonOut := filepath.Join(t.TempDir(), "out.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: jsonOut}
+	captureStdout(t, func() {
+		if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+			t.Error(err)
+		}
+	})
+	all, err := loadAnalyzedModel(jsonOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := all.Names(); !slices.Equal(got, []string{"model.layers.0.input_layernorm.weight", "model.embed_tokens.weight", "lm_head.weight", "model.layers.0.mlp.up_proj.weight"}) {
+		t.Fatal(got)
+	}
+	// -index fails without an index.
+	if err = os.Remove(filepath.Join(dir, "model.safetensors.index.json")); err != nil {
+		t.Fatal(err)
+	}
+	opts = analyzeOptions{reTensors: regexp.MustCompile(".*"), useIndex: true}
+	if err = cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err == nil || !strings.Contains(err.Error(), "-index") {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckIndex(t *testing.T) {
+	dir := writeShardedModel(t)
+	files, err := filepath.Glob(filepath.Join(dir, "*.safetensors"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := loadIndex(filepath.Join(dir, "model.safetensors.index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Buffer{}
+	if err = checkIndex(&b, idx, files); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("unexpected %q", b.String())
+	}
+
+	// One tensor moved to the other shard, one unknown and one not listed.
+	idx.WeightMap[1].File = "model-00001-of-00002.safetensors"
+	idx.WeightMap[3] = indexEntry{Name: "model.norm.weight", File: "model-00002-of-00002.safetensors"}
+	err = checkIndex(&b, idx, files)
+	if err == nil || err.Error() != "2 tensors listed in the index are missing" {
+		t.Fatal(err)
+	}
+	want := "model.layers.0.mlp.up_proj.weight: listed in the index in model-00001-of-00002.safetensors but not found\n" +
+		"model.norm.weight: listed in the index in model-00002-of-00002.safetensors but not found\n" +
+		"lm_head.weight: in model-00002-of-00002.safetensors but not listed in the index\n" +
+		"model.layers.0.mlp.up_proj.weight: in model-00002-of-00002.safetensors but not listed in the index\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+}
+
+func TestLoadIndex_Invalid(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "model.safetensors.index.json")
+	if err := os.WriteFile(name, []byte(`{"weight_map": ["a"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadIndex(name); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -9,15 +9,18 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
 	"regexp"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/lmittmann/tint"
+	"github.com/maruel/safetensors"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
 )
@@ -69,48 +72,67 @@ func (h *hfRepoArg) Repo() string {
 	return s[i+1:]
 }
 
+// dropEmptyAttr removes the attributes with a zero value to keep the logs
+// short.
+func dropEmptyAttr(groups []string, a slog.Attr) slog.Attr {
+	switch t := a.Value.Any().(type) {
+	case string:
+		if t == "" {
+			return slog.Attr{}
+		}
+	case bool:
+		if !t {
+			return slog.Attr{}
+		}
+	case uint64:
+		if t == 0 {
+			return slog.Attr{}
+		}
+	case int64:
+		if t == 0 {
+			return slog.Attr{}
+		}
+	case float64:
+		if t == 0 {
+			return slog.Attr{}
+		}
+	case time.Time:
+		if t.IsZero() {
+			return slog.Attr{}
+		}
+	case time.Duration:
+		if t == 0 {
+			return slog.Attr{}
+		}
+	}
+	return a
+}
+
+// newJSONHandler returns a handler logging one JSON object per line, e.g. for
+// a log aggregator.
+func newJSONHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: dropEmptyAttr})
+}
+
+// isFlagSet returns true if the flag was specified on the command line.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	found := false
+	fs.Visit(func(f *flag.Flag) {
+		found = found || f.Name == name
+	})
+	return found
+}
+
 func mainImpl(args []string) error {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	defer stop()
 	programLevel := &slog.LevelVar{}
 	programLevel.Set(slog.LevelError)
 	logger := slog.New(tint.NewHandler(colorable.NewColorable(os.Stderr), &tint.Options{
-		Level:      programLevel,
-		TimeFormat: "15:04:05.000", // Like time.TimeOnly plus milliseconds.
-		NoColor:    !isatty.IsTerminal(os.Stderr.Fd()),
-		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
-			switch t := a.Value.Any().(type) {
-			case string:
-				if t == "" {
-					return slog.Attr{}
-				}
-			case bool:
-				if !t {
-					return slog.Attr{}
-				}
-			case uint64:
-				if t == 0 {
-					return slog.Attr{}
-				}
-			case int64:
-				if t == 0 {
-					return slog.Attr{}
-				}
-			case float64:
-				if t == 0 {
-					return slog.Attr{}
-				}
-			case time.Time:
-				if t.IsZero() {
-					return slog.Attr{}
-				}
-			case time.Duration:
-				if t == 0 {
-					return slog.Attr{}
-				}
-			}
-			return a
-		},
+		Level:       programLevel,
+		TimeFormat:  "15:04:05.000", // Like time.TimeOnly plus milliseconds.
+		NoColor:     !isatty.IsTerminal(os.Stderr.Fd()),
+		ReplaceAttr: dropEmptyAttr,
 	}))
 	slog.SetDefault(logger)
 	go func() {
@@ -126,6 +148,20 @@ func mainImpl(args []string) error {
 
 	fs := flag.NewFlagSet("n-bits", flag.ContinueOnError)
 	verbose := fs.Bool("v", false, "Enable verbose logging")
+	logJSON := fs.Bool("log-json", false, "Log as JSON lines instead of text")
+	logLevel := fs.String("log-level", "", "Log level: debug, info, warn or error; overrides -v")
+	// applyLogFlags must be called after parsing the flags.
+	applyLogFlags := func() error {
+		if *logLevel != "" {
+			if err := programLevel.UnmarshalText([]byte(*logLevel)); err != nil {
+				return fmt.Errorf("-log-level is invalid: %w", err)
+			}
+		}
+		if *logJSON {
+			slog.SetDefault(slog.New(newJSONHandler(os.Stderr, programLevel)))
+		}
+		return nil
+	}
 	if len(args) == 0 {
 		fs.Usage()
 		return context.Canceled
@@ -137,8 +173,53 @@ func mainImpl(args []string) error {
 		fs.Var(&hfToken, "hf-token", "HuggingFace token")
 		fs.Var(&hfRepo, "hf-repo", "HuggingFace repository, e.g. \"meta-llama/Llama-3.2-1B\"")
 		hfGlob := fs.String("hf-glob", "", "Glob to use when loading files (default:*.safetensors)")
+		retries := fs.Int("retries", 3, "Number of attempts to download the HuggingFace snapshot")
+		maxFileBytes := fs.Int64("max-file-bytes", 0, "Refuse to download the HuggingFace snapshot if a file or all of them combined are larger than this; 0 is unlimited")
+		dir := fs.String("dir", "", "Local directory containing the safetensors files to analyze, instead of a HuggingFace repository")
+		name := fs.String("name", "", "Single local safetensors, .npy or .npz file to analyze, optionally compressed as .gz or .zst")
+		rawURL := fs.String("url", "", "Remote safetensors file to analyze, e.g. \"s3://bucket/model.safetensors\" with the AWS_* environment variables or ~/.aws/credentials, or \"gs://bucket/model.safetensors\" with a token in GOOGLE_OAUTH_ACCESS_TOKEN (not Application Default Credentials)")
 		tensors := fs.String("tensors", ".*", "regexp to filter tensors on")
+		exclude := fs.String("exclude", "", "regexp to skip tensors that matched -tensors")
+		minNumEl := fs.Int64("min-numel", 0, "Skip tensors with fewer elements, like layer norm weights and biases")
 		out := fs.String("json", "", "Save stats as a JSON file")
+		ndjsonOut := fs.String("ndjson", "", "Save stats as a newline delimited JSON file, one tensor per line, written incrementally")
+		jsonStream := fs.Bool("json-stream", false, "Write the -json file incrementally as each file is analyzed to bound memory usage")
+		csvOut := fs.String("csv", "", "Save stats as a CSV file")
+		htmlOut := fs.String("html", "", "Save a self-contained HTML report")
+		promOut := fs.String("prometheus", "", "Save summary as a Prometheus metrics text file")
+		exportHist := fs.String("export-hist", "", "Save the exponent and mantissa distribution of each tensor as JSON files in this directory")
+		var grades gradeThresholds
+		fs.Var(&grades, "grades", "Maximum percentages of bits wasted for the efficiency grades A to E; above is F")
+		top := fs.Int("top", 0, "Only print the N tensors wasting the most bytes")
+		byLayer := fs.Bool("by-layer", false, "Print the bytes wasted aggregated per layer")
+		groupDepth := fs.Int("group-depth", 0, "Print the bytes wasted aggregated by the first N dot separated components of the tensor names")
+		quiet := fs.Bool("quiet", false, "Only print the summary line instead of the tensors of each file")
+		showShape := fs.Bool("show-shape", false, "Print the shape of each tensor")
+		showBitmask := fs.Bool("show-bitmask", false, "Print which bits of integer tensors are used, least significant first")
+		sparkline := fs.Bool("sparkline", false, "Print the distribution of the exponents of float tensors as a sparkline")
+		sortKey := fs.String("sort", "name", "Order the tensors of each file by: "+strings.Join(sortKeys, ", "))
+		sortDesc := fs.Bool("sort-desc", false, "Reverse the order of -sort")
+		useIndex := fs.Bool("index", false, "Validate the shards with the model.safetensors.index.json of a sharded model and print the tensors in its order; -sort defaults to file")
+		estimateCompression := fs.Bool("estimate-compression", false, "Print the estimated size if the weights were entropy coded")
+		simulateDowncast := fs.String("simulate-downcast", "", "Print the error of downcasting float tensors to this dtype: bf16, f16, f8_e4m3 or f8_e5m2")
+		whatIf := fs.String("whatif", "", "Print the model wide size and error of converting every float tensor to this dtype: fp8e4m3")
+		compareDType := fs.String("compare-dtype", "", "Print how many values of float tensors would overflow or underflow if stored as this dtype: bf16, f16, f8_e4m3 or f8_e5m2")
+		downcastErrors := fs.Bool("downcast-errors", false, "Print the RMS error of downcasting float tensors to each of bf16, f16 and f8_e4m3")
+		pruneThreshold := fs.Float64("prune-threshold", 0, "Print how many float weights have an absolute value below this and could be pruned")
+		ftz := fs.Bool("ftz", false, "Flush subnormal values to zero before analysis, like FTZ hardware")
+		distinctValues := fs.Bool("distinct-values", false, "Print the number of distinct values of 8 and 16 bits float tensors")
+		asTF32 := fs.Bool("as-tf32", false, "Analyze F32 tensors as TF32, only considering the top 10 bits of the mantissa")
+		lowmem := fs.Bool("lowmem", false, "Only track which mantissa bits are used in F16 and F32 tensors, instead of every distinct mantissa; uses much less memory but may overestimate the mantissa bits used")
+		autoTune := fs.Bool("auto-tune", false, "Benchmark concurrency levels on the first file and use the fastest for the remaining files")
+		workers := fs.Int("workers", 0, "Number of tensors analyzed concurrently (default: number of CPUs)")
+		shards := fs.Int("shards", 0, "Split each tensor larger than 1MiB in up to this many shards analyzed concurrently, within -workers; each shard allocates its own histogram")
+		fileWorkers := fs.Int("file-workers", 0, "Number of files processed concurrently (default: 16, within the memory limit)")
+		failOnNonFinite := fs.Bool("fail-on-nonfinite", false, "Exit with an error if any tensor contains NaN or Inf")
+		maxRelError := fs.Float64("max-rel-error", 0, "Exit with an error if the relative RMS error of any tensor downcast to the -whatif or -simulate-downcast dtype is above this")
+		packBits := fs.Int("pack-bits", 0, "Unpack I32 and U32 tensors as weights of this many bits, e.g. 4 for GPTQ and AWQ; defaults to the bits hinted in the safetensors metadata")
+		findDuplicates := fs.Bool("find-duplicates", false, "Print the tensors with identical content and the bytes that deduplication would save")
+		skipUnsupported := fs.Bool("skip-unsupported", true, "Skip the tensors of an unsupported dtype with a warning instead of failing")
+		showProgress := fs.Bool("progress", false, "Log the progress and ETA every 2s")
 		if fs.Parse(args[1:]) != nil {
 			return context.Canceled
 		}
@@ -147,15 +228,282 @@ func mainImpl(args []string) error {
 		}
 		if *verbose {
 			programLevel.Set(slog.LevelDebug)
+		} else if *showProgress {
+			programLevel.Set(slog.LevelInfo)
+		}
+		if err := applyLogFlags(); err != nil {
+			return err
+		}
+		if *name != "" {
+			if hfToken != "" {
+				return errors.New("can't use both -name and -hf-token")
+			}
+			if hfRepo != "" {
+				return errors.New("can't use both -name and -hf-repo")
+			}
+			if *hfGlob != "" {
+				return errors.New("can't use both -name and -hf-glob")
+			}
+			if *useIndex {
+				return errors.New("can't use both -name and -index")
+			}
+			if *dir != "" {
+				return errors.New("can't use both -name and -dir")
+			}
+			if *rawURL != "" {
+				return errors.New("can't use both -name and -url")
+			}
+		} else if *dir != "" {
+			if hfToken != "" {
+				return errors.New("can't use both -dir and -hf-token")
+			}
+			if hfRepo != "" {
+				return errors.New("can't use both -dir and -hf-repo")
+			}
+			if *rawURL != "" {
+				return errors.New("can't use both -dir and -url")
+			}
+		} else if *rawURL == "" {
+			if hfRepo == "" {
+				return errors.New("-hf-repo is required")
+			}
+		} else {
+			if hfToken != "" {
+				return errors.New("can't use both -url and -hf-token")
+			}
+			if hfRepo != "" {
+				return errors.New("can't use both -url and -hf-repo")
+			}
+			if *hfGlob != "" {
+				return errors.New("can't use both -url and -hf-glob")
+			}
+			if *useIndex {
+				return errors.New("can't use both -url and -index")
+			}
 		}
-		if hfRepo == "" {
-			return errors.New("-hf-repo is required")
+		if *useIndex && *hfGlob != "" {
+			// The index lists the tensors of all the shards.
+			return errors.New("can't use both -index and -hf-glob")
 		}
 		reTensors, err := regexp.Compile(*tensors)
 		if err != nil {
 			return fmt.Errorf("-tensors regexp is invalid: %w", err)
 		}
-		return cmdAnalyze(ctx, hfToken.String(), hfRepo.Org(), hfRepo.Repo(), *hfGlob, reTensors, *out)
+		var reExclude *regexp.Regexp
+		if *exclude != "" {
+			if reExclude, err = regexp.Compile(*exclude); err != nil {
+				return fmt.Errorf("-exclude regexp is invalid: %w", err)
+			}
+		}
+		if *top < 0 {
+			return errors.New("-top must be positive")
+		}
+		if *groupDepth < 0 {
+			return errors.New("-group-depth must be positive")
+		}
+		if *quiet && *top != 0 {
+			return errors.New("can't use both -quiet and -top")
+		}
+		if !slices.Contains(sortKeys, *sortKey) {
+			return fmt.Errorf("-sort must be one of %s", strings.Join(sortKeys, ", "))
+		}
+		if *useIndex && !isFlagSet(fs, "sort") {
+			*sortKey = "file"
+		}
+		if *jsonStream && *out == "" {
+			return errors.New("-json-stream requires -json")
+		}
+		if *maxRelError < 0 {
+			return errors.New("-max-rel-error must be positive")
+		}
+		if *pruneThreshold < 0 {
+			return errors.New("-prune-threshold must be positive")
+		}
+		if *retries < 1 {
+			return errors.New("-retries must be positive")
+		}
+		if *maxFileBytes < 0 {
+			return errors.New("-max-file-bytes must be positive")
+		}
+		if *minNumEl < 0 {
+			return errors.New("-min-numel must be positive")
+		}
+		if *workers < 0 {
+			return errors.New("-workers must be positive")
+		}
+		if *shards < 0 {
+			return errors.New("-shards must be positive")
+		}
+		if *fileWorkers < 0 {
+			return errors.New("-file-workers must be positive")
+		}
+		if *autoTune && *workers != 0 {
+			return errors.New("can't use both -auto-tune and -workers")
+		}
+		if *packBits != 0 && !validPackBits(*packBits) {
+			return errors.New("-pack-bits must be 1, 2, 4 or 8")
+		}
+		opts := analyzeOptions{
+			reTensors:           reTensors,
+			reExclude:           reExclude,
+			minNumEl:            *minNumEl,
+			jsonOut:             *out,
+			jsonStream:          *jsonStream,
+			ndjsonOut:           *ndjsonOut,
+			csvOut:              *csvOut,
+			htmlOut:             *htmlOut,
+			promOut:             *promOut,
+			exportHist:          *exportHist,
+			grades:              grades,
+			top:                 *top,
+			quiet:               *quiet,
+			showShape:           *showShape,
+			showBitmask:         *showBitmask,
+			sparkline:           *sparkline,
+			sortKey:             *sortKey,
+			sortDesc:            *sortDesc,
+			byLayer:             *byLayer,
+			groupDepth:          *groupDepth,
+			useIndex:            *useIndex,
+			estimateCompression: *estimateCompression,
+			autoTune:            *autoTune,
+			workers:             *workers,
+			fileWorkers:         *fileWorkers,
+			failOnNonFinite:     *failOnNonFinite,
+			maxRelError:         *maxRelError,
+			packBits:            *packBits,
+			findDuplicates:      *findDuplicates,
+			retries:             *retries,
+			maxFileBytes:        *maxFileBytes,
+			progress:            *showProgress,
+		}
+		opts.tensorOpts.FlushToZero = *ftz
+		opts.tensorOpts.LowMemory = *lowmem
+		opts.tensorOpts.Shards = *shards
+		opts.tensorOpts.AsTF32 = *asTF32
+		opts.tensorOpts.DistinctValues = *distinctValues
+		opts.skipUnsupported = *skipUnsupported
+		opts.tensorOpts.DowncastErrors = *downcastErrors
+		opts.tensorOpts.PruneThreshold = *pruneThreshold
+		opts.tensorOpts.Hash = *findDuplicates
+		if *simulateDowncast != "" {
+			d := safetensors.DType(strings.ToUpper(*simulateDowncast))
+			if d != safetensors.BF16 && d != safetensors.F16 && d != safetensors.F8_E4M3 && d != safetensors.F8_E5M2 {
+				return fmt.Errorf("-simulate-downcast: unsupported dtype %q", *simulateDowncast)
+			}
+			opts.tensorOpts.Downcast = d
+		}
+		if *compareDType != "" {
+			d := safetensors.DType(strings.ToUpper(*compareDType))
+			if d != safetensors.BF16 && d != safetensors.F16 && d != safetensors.F8_E4M3 && d != safetensors.F8_E5M2 {
+				return fmt.Errorf("-compare-dtype: unsupported dtype %q", *compareDType)
+			}
+			opts.compareDType = d
+		}
+		if *whatIf != "" {
+			if strings.ToLower(*whatIf) != "fp8e4m3" {
+				return fmt.Errorf("-whatif: unsupported dtype %q", *whatIf)
+			}
+			if opts.tensorOpts.Downcast != "" && opts.tensorOpts.Downcast != safetensors.F8_E4M3 {
+				return errors.New("-whatif requires -simulate-downcast to be unset or f8_e4m3")
+			}
+			opts.whatIf = safetensors.F8_E4M3
+			opts.tensorOpts.Downcast = safetensors.F8_E4M3
+		}
+		if *maxRelError != 0 && opts.tensorOpts.Downcast == "" {
+			return errors.New("-max-rel-error requires -whatif or -simulate-downcast")
+		}
+		return cmdAnalyze(ctx, hfToken.String(), hfRepo.Org(), hfRepo.Repo(), *hfGlob, *name, *rawURL, *dir, &opts)
+
+	case "report":
+		in := fs.String("json", "", "JSON file previously saved with analyze -json")
+		htmlOut := fs.String("html", "", "Save a self-contained HTML report")
+		var grades gradeThresholds
+		fs.Var(&grades, "grades", "Maximum percentages of bits wasted for the efficiency grades A to E; above is F")
+		top := fs.Int("top", 0, "Only print the N tensors wasting the most bytes")
+		byLayer := fs.Bool("by-layer", false, "Print the bytes wasted aggregated per layer")
+		groupDepth := fs.Int("group-depth", 0, "Print the bytes wasted aggregated by the first N dot separated components of the tensor names")
+		estimateCompression := fs.Bool("estimate-compression", false, "Print the estimated size if the weights were entropy coded")
+		if fs.Parse(args[1:]) != nil {
+			return context.Canceled
+		}
+		if len(fs.Args()) != 0 {
+			return errors.New("unexpected argument")
+		}
+		if *verbose {
+			programLevel.Set(slog.LevelDebug)
+		}
+		if err := applyLogFlags(); err != nil {
+			return err
+		}
+		if *in == "" {
+			return errors.New("-json is required")
+		}
+		if *top < 0 {
+			return errors.New("-top must be positive")
+		}
+		if *groupDepth < 0 {
+			return errors.New("-group-depth must be positive")
+		}
+		return cmdReport(os.Stdout, *in, &analyzeOptions{htmlOut: *htmlOut, grades: grades, top: *top, byLayer: *byLayer, groupDepth: *groupDepth, estimateCompression: *estimateCompression})
+
+	case "diff":
+		var in stringsArg
+		fs.Var(&in, "json", "JSON file previously saved with analyze -json; specify twice, old then new")
+		normalizeNames := fs.Bool("normalize-names", false, "Match the tensors named differently by HuggingFace and GGUF, e.g. to compare a model with its GGUF conversion")
+		if fs.Parse(args[1:]) != nil {
+			return context.Canceled
+		}
+		if len(fs.Args()) != 0 {
+			return errors.New("unexpected argument")
+		}
+		if *verbose {
+			programLevel.Set(slog.LevelDebug)
+		}
+		if err := applyLogFlags(); err != nil {
+			return err
+		}
+		if len(in) != 2 {
+			return errors.New("-json must be specified exactly twice")
+		}
+		return cmdDiff(os.Stdout, in[0], in[1], *normalizeNames)
+
+	case "quantize":
+		in := fs.String("in", "", "safetensors file to quantize")
+		out := fs.String("out", "", "safetensors file to write")
+		dtype := fs.String("dtype", "", "Store float tensors as this dtype even if lossy: bf16, f16 or f8_e4m3; by default only lossless conversions are done")
+		tensors := fs.String("tensors", ".*", "regexp of tensors to quantize")
+		exclude := fs.String("exclude", "", "regexp to keep as is tensors that matched -tensors")
+		if fs.Parse(args[1:]) != nil {
+			return context.Canceled
+		}
+		if len(fs.Args()) != 0 {
+			return errors.New("unexpected argument")
+		}
+		if *verbose {
+			programLevel.Set(slog.LevelDebug)
+		}
+		if err := applyLogFlags(); err != nil {
+			return err
+		}
+		if *in == "" || *out == "" {
+			return errors.New("-in and -out are required")
+		}
+		opts := analyzeOptions{}
+		var err error
+		if opts.reTensors, err = regexp.Compile(*tensors); err != nil {
+			return fmt.Errorf("-tensors regexp is invalid: %w", err)
+		}
+		if *exclude != "" {
+			if opts.reExclude, err = regexp.Compile(*exclude); err != nil {
+				return fmt.Errorf("-exclude regexp is invalid: %w", err)
+			}
+		}
+		target := safetensors.DType(strings.ToUpper(*dtype))
+		if target != "" && target != safetensors.BF16 && target != safetensors.F16 && target != safetensors.F8_E4M3 {
+			return fmt.Errorf("-dtype: unsupported dtype %q", *dtype)
+		}
+		return cmdQuantize(ctx, os.Stdout, *in, *out, target, &opts)
 
 	case "metadata":
 		var hfToken hfTokenArg
@@ -163,6 +511,7 @@ func mainImpl(args []string) error {
 		fs.Var(&hfToken, "hf-token", "HuggingFace token")
 		fs.Var(&hfRepo, "hf-repo", "HuggingFace repository, e.g. \"meta-llama/Llama-3.2-1B\"")
 		hfGlob := fs.String("hf-glob", "", "Glob to use when loading files (default:*.safetensors)")
+		retries := fs.Int("retries", 3, "Number of attempts to download the HuggingFace snapshot")
 		name := fs.String("name", "", "Single file to process")
 		if fs.Parse(args[1:]) != nil {
 			return context.Canceled
@@ -173,6 +522,12 @@ func mainImpl(args []string) error {
 		if *verbose {
 			programLevel.Set(slog.LevelDebug)
 		}
+		if err := applyLogFlags(); err != nil {
+			return err
+		}
+		if *retries < 1 {
+			return errors.New("-retries must be positive")
+		}
 		if *name == "" {
 			if hfRepo == "" {
 				return errors.New("-hf-repo is required")
@@ -188,7 +543,7 @@ func mainImpl(args []string) error {
 				return errors.New("can't use both -name and -hf-glob")
 			}
 		}
-		return cmdMetadata(ctx, *name, hfToken.String(), hfRepo.Org(), hfRepo.Repo(), *hfGlob)
+		return cmdMetadata(ctx, *name, hfToken.String(), hfRepo.Org(), hfRepo.Repo(), *hfGlob, *retries)
 
 	default:
 		fs.Usage()
@@ -5,7 +5,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
 	"testing"
 )
 
@@ -14,3 +18,45 @@ func TestMainImpl(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMainImpl_LogFlags(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	if err := mainImpl([]string{"diff", "-log-level", "verbose"}); err == nil || !strings.Contains(err.Error(), "-log-level is invalid") {
+		t.Fatal(err)
+	}
+	// The flags are applied, then the missing -json is reported.
+	if err := mainImpl([]string{"diff", "-log-json", "-log-level", "warn"}); err == nil || err.Error() != "-json must be specified exactly twice" {
+		t.Fatal(err)
+	}
+	if _, ok := slog.Default().Handler().(*slog.JSONHandler); !ok {
+		t.Fatalf("unexpected %T", slog.Default().Handler())
+	}
+}
+
+func TestNewJSONHandler(t *testing.T) {
+	b := bytes.Buffer{}
+	level := &slog.LevelVar{}
+	level.Set(slog.LevelInfo)
+	logger := slog.New(newJSONHandler(&b, level))
+	logger.Debug("analyze", "hidden", true)
+	logger.Info("analyze", "file", "model.safetensors", "empty", "", "count", int64(0), "numel", int64(4))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("unexpected %q", b.String())
+	}
+	got := map[string]any{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["msg"] != "analyze" || got["level"] != "INFO" || got["file"] != "model.safetensors" || got["numel"] != 4. {
+		t.Fatalf("unexpected %v", got)
+	}
+	// The empty values are suppressed like with the text output.
+	if _, ok := got["empty"]; ok {
+		t.Fatalf("unexpected %v", got)
+	}
+	if _, ok := got["count"]; ok {
+		t.Fatalf("unexpected %v", got)
+	}
+}
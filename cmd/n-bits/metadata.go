@@ -7,27 +7,52 @@ package main
 import (
 	"context"
 	"fmt"
+	"maps"
+	"os"
 	"path/filepath"
 
 	"github.com/maruel/huggingface"
+	"github.com/maruel/n-bits-go/n_bits"
 	"github.com/maruel/safetensors"
 )
 
-func loadMetadata(name string) (*safetensors.Mapped, error) {
-	s := &safetensors.Mapped{}
+func loadMetadata(name string) (*n_bits.Mapped, error) {
+	s := &n_bits.Mapped{}
 	if err := s.Open(name); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
-func cmdMetadata(ctx context.Context, name, hfToken, author, repo, fileglob string) error {
+// localMetadata returns the __metadata__ of a local safetensors file. numpy
+// files have none.
+func localMetadata(ctx context.Context, name string) (map[string]string, error) {
+	if isNumpy(name) {
+		return nil, nil
+	}
+	s, err := loadMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := maps.Clone(s.Metadata)
+	return metadata, s.Close()
+}
+
+func cmdMetadata(ctx context.Context, name, hfToken, author, repo, fileglob string, retries int) error {
 	hf, err := huggingface.New(hfToken)
 	if err != nil {
 		return err
 	}
 	var files []string
 	if name != "" {
+		if isCompressed(name) {
+			tmp, err := decompressFile(name)
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(filepath.Dir(tmp))
+			name = tmp
+		}
 		files = []string{name}
 	} else {
 		if fileglob == "" {
@@ -35,12 +60,30 @@ func cmdMetadata(ctx context.Context, name, hfToken, author, repo, fileglob stri
 		}
 		ref := huggingface.ModelRef{Author: author, Repo: repo}
 		var err error
-		files, err = hf.EnsureSnapshot(ctx, ref, "main", []string{fileglob})
+		files, err = ensureSnapshot(ctx, hf.EnsureSnapshot, ref, []string{fileglob}, retries)
 		if err != nil {
 			return err
 		}
 	}
 	for _, f := range files {
+		if isNumpy(f) {
+			if err = printNumpyMetadata(os.Stdout, f); err != nil {
+				return err
+			}
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		if isGGUF(f) {
+			if err = printGGUFMetadata(os.Stdout, f); err != nil {
+				return err
+			}
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
 		s, err := loadMetadata(f)
 		if err != nil {
 			return err
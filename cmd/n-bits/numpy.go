@@ -0,0 +1,219 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/maruel/n-bits-go/n_bits"
+	"github.com/maruel/safetensors"
+)
+
+// npyMagic starts every .npy file.
+const npyMagic = "\x93NUMPY"
+
+// npyMaxHeader is the maximum length of a .npy header, to not allocate
+// unbounded memory on corrupted files.
+const npyMaxHeader = 1 << 20
+
+// npyDTypes maps the numpy dtype kind and size to the safetensors dtype.
+var npyDTypes = map[string]safetensors.DType{
+	"b1": safetensors.BOOL,
+	"u1": safetensors.U8,
+	"i1": safetensors.I8,
+	"u2": safetensors.U16,
+	"i2": safetensors.I16,
+	"f2": safetensors.F16,
+	"u4": safetensors.U32,
+	"i4": safetensors.I32,
+	"f4": safetensors.F32,
+	"u8": safetensors.U64,
+	"i8": safetensors.I64,
+	"f8": safetensors.F64,
+}
+
+var (
+	npyDescr   = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+	npyFortran = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShape   = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+// isNumpy returns true if the file is a numpy .npy or .npz file, based on its
+// extension.
+func isNumpy(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".npy" || ext == ".npz"
+}
+
+// parseNPYHeader parses the header of a .npy file and returns the dtype and
+// shape of the array that follows.
+//
+// Only C order arrays are supported.
+func parseNPYHeader(r io.Reader) (safetensors.DType, []uint64, error) {
+	var prefix [8]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return "", nil, fmt.Errorf("invalid npy header: %w", err)
+	}
+	if string(prefix[:6]) != npyMagic {
+		return "", nil, errors.New("not a npy file")
+	}
+	var l uint32
+	switch prefix[6] {
+	case 1:
+		var l16 uint16
+		if err := binary.Read(r, binary.LittleEndian, &l16); err != nil {
+			return "", nil, fmt.Errorf("invalid npy header: %w", err)
+		}
+		l = uint32(l16)
+	case 2, 3:
+		if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+			return "", nil, fmt.Errorf("invalid npy header: %w", err)
+		}
+	default:
+		return "", nil, fmt.Errorf("unsupported npy version %d.%d", prefix[6], prefix[7])
+	}
+	if l > npyMaxHeader {
+		return "", nil, fmt.Errorf("npy header too long: %d", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", nil, fmt.Errorf("invalid npy header: %w", err)
+	}
+	h := string(b)
+	m := npyFortran.FindStringSubmatch(h)
+	if m == nil {
+		return "", nil, errors.New("invalid npy header: missing fortran_order")
+	}
+	if m[1] == "True" {
+		return "", nil, errors.New("fortran_order arrays are not supported; save the array in C order")
+	}
+	if m = npyDescr.FindStringSubmatch(h); m == nil {
+		return "", nil, errors.New("invalid npy header: missing descr")
+	}
+	descr := m[1]
+	if len(descr) != 3 || (descr[0] != '<' && descr[0] != '|' && descr[0] != '=') {
+		return "", nil, fmt.Errorf("unsupported npy dtype %q", descr)
+	}
+	dtype, ok := npyDTypes[descr[1:]]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported npy dtype %q", descr)
+	}
+	if m = npyShape.FindStringSubmatch(h); m == nil {
+		return "", nil, errors.New("invalid npy header: missing shape")
+	}
+	var shape []uint64
+	for _, d := range strings.Split(m[1], ",") {
+		if d = strings.TrimSpace(d); d == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(d, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid npy shape %q", m[1])
+		}
+		shape = append(shape, v)
+	}
+	return dtype, shape, nil
+}
+
+// readNPY reads a .npy array as a tensor.
+func readNPY(r io.Reader, name string) (safetensors.Tensor, error) {
+	br := bufio.NewReader(r)
+	dtype, shape, err := parseNPYHeader(br)
+	if err != nil {
+		return safetensors.Tensor{}, fmt.Errorf("%s: %w", name, err)
+	}
+	t := safetensors.Tensor{Name: name, DType: dtype, Shape: shape}
+	n := dtype.WordSize()
+	for _, d := range shape {
+		n *= d
+	}
+	t.Data = make([]byte, n)
+	if _, err = io.ReadFull(br, t.Data); err != nil {
+		return safetensors.Tensor{}, fmt.Errorf("%s: truncated data: %w", name, err)
+	}
+	return t, nil
+}
+
+// readNumpy reads the arrays of a .npy or .npz file as tensors.
+//
+// The tensor of a .npy file is named after the file. The tensors of a .npz
+// file are named after the archive members, without the .npy extension.
+func readNumpy(name string) ([]safetensors.Tensor, error) {
+	if !strings.EqualFold(filepath.Ext(name), ".npz") {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		base := filepath.Base(name)
+		t, err := readNPY(f, strings.TrimSuffix(base, filepath.Ext(base)))
+		if err != nil {
+			return nil, err
+		}
+		return []safetensors.Tensor{t}, nil
+	}
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Base(name), err)
+	}
+	defer z.Close()
+	var out []safetensors.Tensor
+	for _, zf := range z.File {
+		r, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", zf.Name, err)
+		}
+		t, err := readNPY(r, strings.TrimSuffix(zf.Name, ".npy"))
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// processNumpyFile analyzes the arrays of a .npy or .npz file, like
+// processSafetensorsFile does for safetensors.
+func processNumpyFile(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+	tensors, err := readNumpy(name)
+	if err != nil {
+		return nil, err
+	}
+	return analyzeTensors(ctx, name, tensors, nil, nil, opts, cpuLimit)
+}
+
+// printNumpyMetadata prints the tensor types of a .npy or .npz file, like
+// cmdMetadata does for safetensors. numpy files have no metadata.
+func printNumpyMetadata(w io.Writer, name string) error {
+	tensors, err := readNumpy(name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s:\n", filepath.Base(name))
+	types := map[safetensors.DType]int{}
+	var order []safetensors.DType
+	for _, t := range tensors {
+		if types[t.DType] == 0 {
+			order = append(order, t.DType)
+		}
+		types[t.DType]++
+	}
+	for _, dtype := range order {
+		fmt.Fprintf(w, "  %d tensors of type %s\n", types[dtype], dtype)
+	}
+	return nil
+}
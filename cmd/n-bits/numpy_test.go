@@ -0,0 +1,89 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+func TestReadNumpy_NPY(t *testing.T) {
+	name := filepath.Join("testdata", "tiny.npy")
+	if !isNumpy(name) {
+		t.Fatal("expected numpy")
+	}
+	tensors, err := readNumpy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newF32Tensor("tiny", 1, -2, 0.5, 3, 0, -0.25)
+	want.Shape = []uint64{2, 3}
+	if len(tensors) != 1 || tensors[0].Name != want.Name || tensors[0].DType != want.DType || !slices.Equal(tensors[0].Shape, want.Shape) || !bytes.Equal(tensors[0].Data, want.Data) {
+		t.Fatalf("unexpected %+v", tensors)
+	}
+	analyzed, err := processLocalFile(context.Background(), name, &analyzeOptions{reTensors: regexp.MustCompile(".*")}, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analyzed) != 1 || analyzed[0].NumEl != 6 || analyzed[0].Min != -2 || analyzed[0].Max != 3 {
+		t.Fatalf("unexpected %+v", analyzed)
+	}
+}
+
+func TestReadNumpy_NPZ(t *testing.T) {
+	name := filepath.Join("testdata", "tiny.npz")
+	tensors, err := readNumpy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tensors) != 2 {
+		t.Fatalf("unexpected %+v", tensors)
+	}
+	if a := tensors[0]; a.Name != "weight" || a.DType != safetensors.F16 || !slices.Equal(a.Shape, []uint64{4}) || len(a.Data) != 8 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	if a := tensors[1]; a.Name != "index" || a.DType != safetensors.I32 || !slices.Equal(a.Shape, []uint64{3}) || len(a.Data) != 12 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	b := bytes.Buffer{}
+	if err = printNumpyMetadata(&b, name); err != nil {
+		t.Fatal(err)
+	}
+	want := "tiny.npz:\n  1 tensors of type F16\n  1 tensors of type I32\n"
+	if got := b.String(); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+}
+
+func TestParseNPYHeader_Errors(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "tiny.npy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fortran := bytes.Replace(data, []byte("'fortran_order': False"), []byte("'fortran_order': True "), 1)
+	if _, _, err = parseNPYHeader(bytes.NewReader(fortran)); err == nil || !strings.Contains(err.Error(), "fortran_order") {
+		t.Fatal(err)
+	}
+	bigEndian := bytes.Replace(data, []byte("'<f4'"), []byte("'>f4'"), 1)
+	if _, _, err = parseNPYHeader(bytes.NewReader(bigEndian)); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, l := range []int{0, 6, 9, 50} {
+		if _, _, err = parseNPYHeader(bytes.NewReader(data[:l])); err == nil {
+			t.Errorf("%d: expected error", l)
+		}
+	}
+	if _, err = readNPY(bytes.NewReader(data[:len(data)-1]), "t"); err == nil {
+		t.Fatal("expected error")
+	}
+}
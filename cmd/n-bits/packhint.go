@@ -0,0 +1,110 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// validPackBits returns true if the I32 and U32 tensors can be unpacked as
+// weights of this many bits.
+func validPackBits(bits int) bool {
+	return bits == 1 || bits == 2 || bits == 4 || bits == 8
+}
+
+// packHint is the number of bits per weight of the packed I32 and U32 tensors
+// of a quantized model, as hinted by its safetensors __metadata__.
+//
+// The safetensors dtype of these tensors doesn't reflect the weights they
+// contain, e.g. eight 4 bits weights per I32.
+type packHint struct {
+	// global applies to all the tensors without a per tensor hint. 0 if none.
+	global int
+	// quantized is the bits from the quantization config. It applies only to
+	// the packed tensors of GPTQ and AWQ, see packedTensor. 0 if none.
+	quantized int
+	// perTensor is set from the "<tensor>.bits" keys.
+	perTensor map[string]int
+}
+
+// newPackHint parses the hints in the metadata:
+//   - "<tensor>.bits" for a single tensor;
+//   - "bits" for all the tensors;
+//   - "quantization_config", a JSON object with "bits" and "quant_method"
+//     like in the HuggingFace config.json;
+//   - "quant_method" alone, for the 4 bits default of "gptq" and "awq".
+//
+// The quantization config only applies to the packed tensors, since the other
+// I32 tensors like GPTQ's g_idx hold plain integers.
+//
+// Invalid values are ignored with a warning.
+func newPackHint(metadata map[string]string) *packHint {
+	p := &packHint{}
+	parse := func(k, v string) int {
+		b, err := strconv.Atoi(v)
+		if err != nil || !validPackBits(b) {
+			slog.Warn("metadata", "key", k, "value", v, "message", "ignoring invalid bits")
+			return 0
+		}
+		return b
+	}
+	for k, v := range metadata {
+		if name, ok := strings.CutSuffix(k, ".bits"); ok {
+			if b := parse(k, v); b != 0 {
+				if p.perTensor == nil {
+					p.perTensor = map[string]int{}
+				}
+				p.perTensor[name] = b
+			}
+		}
+	}
+	method := metadata["quant_method"]
+	if v, ok := metadata["bits"]; ok {
+		p.global = parse("bits", v)
+	} else if v, ok := metadata["quantization_config"]; ok {
+		cfg := struct {
+			Bits        int    `json:"bits"`
+			QuantMethod string `json:"quant_method"`
+		}{}
+		if err := json.Unmarshal([]byte(v), &cfg); err != nil {
+			slog.Warn("metadata", "key", "quantization_config", "err", err)
+		} else if cfg.Bits != 0 {
+			p.quantized = parse("quantization_config", strconv.Itoa(cfg.Bits))
+		} else {
+			method = cfg.QuantMethod
+		}
+	}
+	if p.global == 0 && p.quantized == 0 && (method == "gptq" || method == "awq") {
+		p.quantized = 4
+	}
+	return p
+}
+
+// packedTensor returns true for the tensors GPTQ and AWQ pack the weights in.
+func packedTensor(name string) bool {
+	switch name[strings.LastIndexByte(name, '.')+1:] {
+	case "qweight", "qzeros":
+		return true
+	}
+	return false
+}
+
+// bits returns the number of bits per weight of the tensor, or 0 if there is
+// no hint.
+func (p *packHint) bits(name string) int {
+	if p == nil {
+		return 0
+	}
+	if b, ok := p.perTensor[name]; ok {
+		return b
+	}
+	if p.global == 0 && packedTensor(name) {
+		return p.quantized
+	}
+	return p.global
+}
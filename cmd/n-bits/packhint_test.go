@@ -0,0 +1,87 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+func TestPackHint(t *testing.T) {
+	data := []struct {
+		metadata map[string]string
+		name     string
+		want     int
+	}{
+		{nil, "w", 0},
+		{map[string]string{"format": "pt"}, "w", 0},
+		{map[string]string{"bits": "4"}, "w", 4},
+		{map[string]string{"bits": "3"}, "w", 0},
+		{map[string]string{"bits": "x"}, "w", 0},
+		{map[string]string{"bits": "4", "w.bits": "2"}, "w", 2},
+		{map[string]string{"bits": "4", "w.bits": "2"}, "v", 4},
+		{map[string]string{"quant_method": "gptq"}, "layers.0.qweight", 4},
+		{map[string]string{"quant_method": "gptq"}, "layers.0.qzeros", 4},
+		{map[string]string{"quant_method": "awq", "bits": "8"}, "qweight", 8},
+		{map[string]string{"quant_method": "bitsandbytes"}, "qweight", 0},
+		{map[string]string{"quantization_config": `{"bits": 2, "quant_method": "gptq"}`}, "qweight", 2},
+		{map[string]string{"quantization_config": `{"quant_method": "awq"}`}, "qweight", 4},
+		{map[string]string{"quantization_config": `{`}, "qweight", 0},
+		// GPTQ's g_idx holds plain group indices.
+		{map[string]string{"quant_method": "gptq"}, "layers.0.g_idx", 0},
+		{map[string]string{"quantization_config": `{"bits": 2, "quant_method": "gptq"}`}, "g_idx", 0},
+		{map[string]string{"quant_method": "gptq", "g_idx.bits": "8"}, "g_idx", 8},
+	}
+	for i, line := range data {
+		if got := newPackHint(line.metadata).bits(line.name); got != line.want {
+			t.Errorf("#%d: want %d, got %d", i, line.want, got)
+		}
+	}
+	if got := (*packHint)(nil).bits("w"); got != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestProcessLocalFile_PackHint(t *testing.T) {
+	// Two I32 holding eight 4 bits weights each, all 0x7 or 0x1.
+	raw := make([]byte, 8)
+	binary.LittleEndian.PutUint32(raw, 0x77777777)
+	binary.LittleEndian.PutUint32(raw[4:], 0x11111111)
+	packed := safetensors.Tensor{Name: "qweight", DType: safetensors.I32, Shape: []uint64{2}, Data: raw}
+	// g_idx is not packed.
+	gIdx := safetensors.Tensor{Name: "g_idx", DType: safetensors.I32, Shape: []uint64{2}, Data: raw}
+	name := filepath.Join(t.TempDir(), "model.safetensors")
+	writeSafetensors(t, name, map[string]string{"quant_method": "gptq"}, []safetensors.Tensor{packed, newF32Tensor("scales", 1, 2), gIdx})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*")}
+	analyzed, err := processLocalFile(context.Background(), name, &opts, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(analyzed) != 3 {
+		t.Fatalf("unexpected %+v", analyzed)
+	}
+	if a := analyzed[0]; a.PackBits != 4 || a.NumEl != 16 || a.Min != 1 || a.Max != 7 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	if a := analyzed[1]; a.PackBits != 0 || a.NumEl != 2 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	if a := analyzed[2]; a.PackBits != 0 || a.NumEl != 2 || a.Max != 0x77777777 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	// -pack-bits has precedence.
+	opts.packBits = 8
+	if analyzed, err = processLocalFile(context.Background(), name, &opts, make(chan struct{}, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if a := analyzed[0]; a.PackBits != 8 || a.NumEl != 8 {
+		t.Fatalf("unexpected %+v", a)
+	}
+}
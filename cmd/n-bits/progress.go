@@ -0,0 +1,80 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// progress tracks the files analyzed so far.
+type progress struct {
+	logger     *slog.Logger
+	start      time.Time
+	totalFiles int
+	totalBytes int64
+
+	mu    sync.Mutex
+	files int
+	bytes int64
+}
+
+func newProgress(logger *slog.Logger, files []string) *progress {
+	p := &progress{logger: logger, start: time.Now(), totalFiles: len(files)}
+	for _, f := range files {
+		p.totalBytes += fileWeight(f)
+	}
+	return p
+}
+
+// done records that a file was analyzed and logs the progress.
+func (p *progress) done(name string) {
+	p.mu.Lock()
+	p.files++
+	p.bytes += fileWeight(name)
+	p.mu.Unlock()
+	p.log()
+}
+
+// log logs the current progress.
+func (p *progress) log() {
+	p.mu.Lock()
+	files, bytes := p.files, p.bytes
+	p.mu.Unlock()
+	percent := 100.
+	if p.totalBytes != 0 {
+		percent = 100 * float64(bytes) / float64(p.totalBytes)
+	} else if p.totalFiles != 0 {
+		percent = 100 * float64(files) / float64(p.totalFiles)
+	}
+	attrs := []any{
+		"files", fmt.Sprintf("%d/%d", files, p.totalFiles),
+		"bytes", humanBytes(bytes) + "/" + humanBytes(p.totalBytes),
+		"percent", fmt.Sprintf("%.1f%%", percent),
+	}
+	if percent > 0 && percent < 100 {
+		elapsed := time.Since(p.start)
+		eta := time.Duration(float64(elapsed) * (100 - percent) / percent)
+		attrs = append(attrs, "eta", eta.Round(time.Second))
+	}
+	p.logger.Info("progress", attrs...)
+}
+
+// run logs the progress every interval until ctx is canceled.
+func (p *progress) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.log()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i, size := range []int{10, 30} {
+		name := filepath.Join(dir, string(rune('a'+i)))
+		if err := os.WriteFile(name, make([]byte, size), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, name)
+	}
+	b := bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}}))
+	p := newProgress(logger, files)
+	p.done(files[1])
+	p.done(files[0])
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected %q", b.String())
+	}
+	if !strings.HasPrefix(lines[0], "level=INFO msg=progress files=1/2 bytes=30B/40B percent=75.0% eta=") {
+		t.Fatalf("unexpected %q", lines[0])
+	}
+	if want := "level=INFO msg=progress files=2/2 bytes=40B/40B percent=100.0%"; lines[1] != want {
+		t.Fatalf("want %q\ngot  %q", want, lines[1])
+	}
+}
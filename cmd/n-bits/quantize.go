@@ -0,0 +1,73 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maruel/n-bits-go/n_bits"
+	"github.com/maruel/safetensors"
+)
+
+// quantizeDType returns the dtype to store the tensor as.
+//
+// It is the dtype recommended by the analysis, which is lossless. When
+// target is set and the recommendation is larger, target is used instead,
+// which is lossy.
+func quantizeDType(a *n_bits.AnalyzedTensor, target safetensors.DType) safetensors.DType {
+	dtype := a.RecommendDType()
+	if target != "" && target.WordSize() < dtype.WordSize() {
+		dtype = target
+	}
+	return dtype
+}
+
+// cmdQuantize writes a copy of the safetensors file in with the selected
+// float tensors stored in a smaller dtype.
+//
+// The other tensors and the metadata are copied verbatim.
+func cmdQuantize(ctx context.Context, w io.Writer, in, out string, target safetensors.DType, opts *analyzeOptions) error {
+	s := n_bits.Mapped{}
+	if err := s.Open(in); err != nil {
+		return err
+	}
+	defer s.Close()
+	dst := safetensors.File{Tensors: make([]safetensors.Tensor, len(s.Tensors)), Metadata: s.Metadata}
+	ao := opts.analyzerOptions()
+	var before, after int64
+	for i, t := range s.Tensors {
+		dst.Tensors[i] = t
+		before += int64(len(t.Data))
+		if ao.Selected(t.Name, t.Shape) && (t.DType == safetensors.F32 || t.DType == safetensors.F16 || t.DType == safetensors.BF16) {
+			a, err := opts.tensorOpts.AnalyzeTensor(ctx, t.Name, t)
+			if err != nil {
+				return err
+			}
+			if dtype := quantizeDType(&a, target); dtype.WordSize() < t.DType.WordSize() {
+				if dst.Tensors[i], err = n_bits.CastTensor(t, dtype, n_bits.RoundNearestEven); err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s: %s -> %s\n", t.Name, t.DType, dtype)
+			}
+		}
+		after += int64(len(dst.Tensors[i].Data))
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	err = dst.Serialize(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Wrote %s: %s -> %s\n", out, humanBytes(before), humanBytes(after))
+	return nil
+}
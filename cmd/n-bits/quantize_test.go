@@ -0,0 +1,72 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/maruel/n-bits-go/n_bits"
+	"github.com/maruel/safetensors"
+)
+
+func TestCmdQuantize(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.safetensors")
+	out := filepath.Join(dir, "out.safetensors")
+	lossy := []float32{0.1, -3.14159, 1000.5, 1e-3}
+	ints := safetensors.Tensor{Name: "ints", DType: safetensors.I32, Shape: []uint64{2}, Data: []byte{1, 0, 0, 0, 2, 0, 0, 0}}
+	metadata := map[string]string{"format": "pt"}
+	writeSafetensors(t, in, metadata, []safetensors.Tensor{
+		newF32Tensor("lossless", 1, 2, -0.5, 4),
+		newF32Tensor("lossy", lossy...),
+		newF32Tensor("skipped", lossy...),
+		ints,
+	})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), reExclude: regexp.MustCompile("^skipped$")}
+	b := bytes.Buffer{}
+	if err := cmdQuantize(context.Background(), &b, in, out, safetensors.BF16, &opts); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadMetadata(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Metadata["format"] != "pt" {
+		t.Fatalf("unexpected metadata %v", s.Metadata)
+	}
+	var dtypes []safetensors.DType
+	for _, tensor := range s.Tensors {
+		dtypes = append(dtypes, tensor.DType)
+	}
+	// The lossless conversion is smaller than the requested dtype.
+	if want := []safetensors.DType{safetensors.F8_E4M3, safetensors.BF16, safetensors.F32, safetensors.I32}; !slices.Equal(want, dtypes) {
+		t.Fatalf("want %v, got %v\n%s", want, dtypes, b.String())
+	}
+	if !bytes.Equal(s.Tensors[3].Data, ints.Data) || !bytes.Equal(s.Tensors[2].Data, newF32Tensor("", lossy...).Data) {
+		t.Fatal("tensors not preserved")
+	}
+	a, err := n_bits.AnalyzeTensor(context.Background(), "lossless", s.Tensors[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Min != -0.5 || a.Max != 4 || a.Avg != 6.5/4 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	for i, v := range lossy {
+		got := math.Float32frombits(uint32(binary.LittleEndian.Uint16(s.Tensors[1].Data[2*i:])) << 16)
+		// BF16 has 8 bits of precision.
+		if e := math.Abs(float64(got - v)); e > math.Abs(float64(v))/256 {
+			t.Fatalf("%g: got %g", v, got)
+		}
+	}
+}
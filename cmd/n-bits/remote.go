@@ -0,0 +1,452 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maruel/n-bits-go/n_bits"
+	"github.com/maruel/safetensors"
+)
+
+// fetcher reads byte ranges of a remote file.
+type fetcher interface {
+	// fetchRange returns a reader over length bytes starting at offset.
+	fetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+}
+
+// fetchers maps a URL scheme to the function returning a fetcher for it.
+//
+// Add an entry to support another backend.
+var fetchers = map[string]func(u *url.URL) (fetcher, error){
+	"http":  newHTTPFetcher,
+	"https": newHTTPFetcher,
+	"s3":    newS3Fetcher,
+	"gs":    newGCSFetcher,
+}
+
+func newFetcher(rawURL string) (fetcher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	f := fetchers[u.Scheme]
+	if f == nil {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	return f(u)
+}
+
+// httpFetcher fetches ranges with HTTP range requests.
+type httpFetcher struct {
+	url string
+	// sign is called on each request to add credentials, if set.
+	sign func(r *http.Request) error
+}
+
+func newHTTPFetcher(u *url.URL) (fetcher, error) {
+	return &httpFetcher{url: u.String()}, nil
+}
+
+func (h *httpFetcher) fetchRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if h.sign != nil {
+		if err = h.sign(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: range request failed: %s", h.url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// newS3Fetcher returns a fetcher for s3://bucket/key.
+//
+// It honors the standard AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, AWS_REGION, AWS_DEFAULT_REGION, AWS_ENDPOINT_URL_S3 and
+// AWS_ENDPOINT_URL environment variables. Without AWS_ACCESS_KEY_ID, the
+// static keys of the AWS_PROFILE profile are read from the shared credentials
+// file, see awsSharedCredentials. Requests are anonymous when no credentials
+// are found.
+//
+// Unlike the AWS SDK, it doesn't support the ~/.aws/config settings, the SSO
+// and credential_process profiles nor the EC2 and ECS instance metadata
+// service (IMDS).
+func newS3Fetcher(u *url.URL) (fetcher, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q", u)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	var target string
+	if endpoint != "" {
+		// Custom endpoints (e.g. MinIO) use path-style addressing.
+		target = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + awsURIEscape(key)
+	} else {
+		target = "https://" + bucket + ".s3." + region + ".amazonaws.com/" + awsURIEscape(key)
+	}
+	h := &httpFetcher{url: target}
+	s := &awsSigner{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		region:          region,
+		service:         "s3",
+	}
+	if s.accessKeyID == "" {
+		if err := s.loadSharedCredentials(); err != nil {
+			return nil, err
+		}
+	}
+	if s.accessKeyID != "" {
+		h.sign = func(r *http.Request) error {
+			s.sign(r, time.Now())
+			return nil
+		}
+	}
+	return h, nil
+}
+
+// newGCSFetcher returns a fetcher for gs://bucket/object.
+//
+// GOOGLE_OAUTH_ACCESS_TOKEN is an OAuth2 access token sent as is, e.g. the
+// output of "gcloud auth print-access-token". It is specific to this tool and
+// is not a standard GCS credential source: Application Default Credentials
+// and GOOGLE_APPLICATION_CREDENTIALS are not supported. STORAGE_EMULATOR_HOST
+// overrides the endpoint. Requests are anonymous when no token is set.
+func newGCSFetcher(u *url.URL) (fetcher, error) {
+	bucket, object := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, fmt.Errorf("invalid GCS URL %q", u)
+	}
+	endpoint := "https://storage.googleapis.com"
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = host
+		if !strings.Contains(host, "://") {
+			endpoint = "http://" + host
+		}
+	}
+	h := &httpFetcher{url: strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + awsURIEscape(object)}
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		h.sign = func(r *http.Request) error {
+			r.Header.Set("Authorization", "Bearer "+token)
+			return nil
+		}
+	}
+	return h, nil
+}
+
+// awsSigner signs requests with AWS Signature Version 4.
+//
+// See https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+type awsSigner struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+	service         string
+}
+
+// loadSharedCredentials reads the static keys of the AWS_PROFILE profile,
+// "default" if unset, from AWS_SHARED_CREDENTIALS_FILE or
+// ~/.aws/credentials. A missing file or profile is not an error.
+func (a *awsSigner) loadSharedCredentials() error {
+	name := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		name = filepath.Join(home, ".aws", "credentials")
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	section := ""
+	for _, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' || l[0] == ';' {
+			continue
+		}
+		if l[0] == '[' && l[len(l)-1] == ']' {
+			section = strings.TrimSpace(l[1 : len(l)-1])
+			continue
+		}
+		k, v, ok := strings.Cut(l, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			a.accessKeyID = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			a.secretAccessKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			a.sessionToken = strings.TrimSpace(v)
+		}
+	}
+	return nil
+}
+
+// emptySHA256 is the hex encoded SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds the Authorization header to a request without body.
+func (a *awsSigner) sign(r *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if a.sessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", a.sessionToken)
+	}
+	headers := map[string]string{"host": r.URL.Host}
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	uri := r.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method, uri, r.URL.Query().Encode(), canonicalHeaders.String(), signedHeaders, emptySHA256,
+	}, "\n")
+	scope := date + "/" + a.region + "/" + a.service + "/aws4_request"
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+	key := hmacSHA256([]byte("AWS4"+a.secretAccessKey), date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, a.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+a.accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEscape escapes each segment of the path as required by AWS.
+func awsURIEscape(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		b := strings.Builder{}
+		for _, c := range []byte(s) {
+			if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
+
+// remoteTensor is a tensor entry in a safetensors header.
+type remoteTensor struct {
+	Name        string            `json:"-"`
+	DType       safetensors.DType `json:"dtype"`
+	Shape       []uint64          `json:"shape"`
+	DataOffsets [2]int64          `json:"data_offsets"`
+}
+
+// parseSafetensorsHeader parses the JSON header of a safetensors file,
+// preserving the tensors order.
+func parseSafetensorsHeader(data []byte) ([]remoteTensor, map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if d, err := dec.Token(); err != nil || d != json.Delim('{') {
+		return nil, nil, errors.New("invalid safetensors header")
+	}
+	var tensors []remoteTensor
+	var metadata map[string]string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid json; expected string, got %T", key)
+		}
+		if name == "__metadata__" {
+			if err = dec.Decode(&metadata); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		t := remoteTensor{Name: name}
+		if err = dec.Decode(&t); err != nil {
+			return nil, nil, fmt.Errorf("tensor %q: %w", name, err)
+		}
+		numEl := uint64(1)
+		for _, d := range t.Shape {
+			numEl *= d
+		}
+		if t.DataOffsets[1] < t.DataOffsets[0] || uint64(t.DataOffsets[1]-t.DataOffsets[0]) != numEl*t.DType.WordSize() {
+			return nil, nil, fmt.Errorf("tensor %q: data offsets %v don't match dtype %s and shape %v", name, t.DataOffsets, t.DType, t.Shape)
+		}
+		tensors = append(tensors, t)
+	}
+	return tensors, metadata, nil
+}
+
+// maxHeaderSize is the maximum size of a safetensors header, like the
+// safetensors package.
+const maxHeaderSize = 100_000_000
+
+// readRange reads a whole range from the fetcher.
+func readRange(ctx context.Context, f fetcher, offset, length int64) ([]byte, error) {
+	r, err := f.fetchRange(ctx, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b := make([]byte, length)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readRemoteHeader fetches and parses the header of a remote safetensors file.
+//
+// start is the offset of the tensors data.
+func readRemoteHeader(ctx context.Context, f fetcher, name string) (tensors []remoteTensor, metadata map[string]string, start int64, err error) {
+	b, err := readRange(ctx, f, 0, 8)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	n := binary.LittleEndian.Uint64(b)
+	if n > maxHeaderSize {
+		return nil, nil, 0, fmt.Errorf("%s: header too large: %d", name, n)
+	}
+	if b, err = readRange(ctx, f, 8, int64(n)); err != nil {
+		return nil, nil, 0, err
+	}
+	if h := n_bits.NormalizeHeader(b); h != nil {
+		b = h
+	}
+	if tensors, metadata, err = parseSafetensorsHeader(b); err != nil {
+		return nil, nil, 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return tensors, metadata, 8 + int64(n), nil
+}
+
+// remoteMetadata returns the __metadata__ of a remote safetensors file.
+func remoteMetadata(ctx context.Context, name string) (map[string]string, error) {
+	f, err := newFetcher(name)
+	if err != nil {
+		return nil, err
+	}
+	_, metadata, _, err := readRemoteHeader(ctx, f, name)
+	return metadata, err
+}
+
+// processRemoteSafetensorsFile analyzes a remote safetensors file.
+//
+// Only the header and the selected tensors are fetched, with range requests.
+// The I32 and U32 tensors are unpacked as hinted by the header's metadata,
+// like processSafetensorsFile.
+func processRemoteSafetensorsFile(ctx context.Context, name string, opts *analyzeOptions, cpuLimit chan struct{}) ([]n_bits.AnalyzedTensor, error) {
+	f, err := newFetcher(name)
+	if err != nil {
+		return nil, err
+	}
+	remote, metadata, start, err := readRemoteHeader(ctx, f, name)
+	if err != nil {
+		return nil, err
+	}
+	tensors := make([]safetensors.Tensor, len(remote))
+	for i, t := range remote {
+		tensors[i] = safetensors.Tensor{Name: t.Name, DType: t.DType, Shape: t.Shape}
+	}
+	analyze := func(ctx context.Context, i int, ao *n_bits.AnalyzerOptions) (n_bits.AnalyzedTensor, error) {
+		t := remote[i]
+		length := t.DataOffsets[1] - t.DataOffsets[0]
+		// A zero length range request is invalid.
+		var r io.ReadCloser = io.NopCloser(bytes.NewReader(nil))
+		if length != 0 {
+			var err2 error
+			if r, err2 = f.fetchRange(ctx, start+t.DataOffsets[0], length); err2 != nil {
+				return n_bits.AnalyzedTensor{}, err2
+			}
+		}
+		defer r.Close()
+		if ao.PackBits != 0 && (t.DType == safetensors.I32 || t.DType == safetensors.U32) {
+			// Packed tensors are small enough to be read in memory.
+			data, err2 := io.ReadAll(r)
+			if err2 != nil {
+				return n_bits.AnalyzedTensor{}, err2
+			}
+			return ao.AnalyzeTensor(ctx, safetensors.Tensor{Name: t.Name, DType: t.DType, Shape: t.Shape, Data: data})
+		}
+		a, err2 := ao.Tensor.AnalyzeReader(ctx, t.Name, t.DType, r, length/int64(t.DType.WordSize()))
+		if err2 != nil {
+			return a, err2
+		}
+		for _, d := range t.Shape {
+			a.Shape = append(a.Shape, int64(d))
+		}
+		return a, nil
+	}
+	return analyzeTensors(ctx, name, tensors, newPackHint(metadata), analyze, opts, cpuLimit)
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/maruel/n-bits-go/n_bits"
+)
+
+// printModel prints the table of all the tensors, or only the top ones, the
+// optional per layer aggregation, then the summary with the dtype breakdown
+// and the optional compression estimate.
+func printModel(w io.Writer, all *n_bits.AnalyzedModel, opts *analyzeOptions) {
+	if opts.top != 0 {
+		printTop(w, all.Tensors, opts)
+	} else {
+		printTable(w, all.Tensors, opts)
+	}
+	if opts.byLayer {
+		printByLayer(w, all.Tensors)
+	}
+	if opts.groupDepth != 0 {
+		printByPrefix(w, all.Tensors, opts.groupDepth)
+	}
+	printMetadata(w, all.Metadata)
+	summary := all.Summary()
+	printSummary(w, &summary, opts)
+	printDTypes(w, all.Tensors, &summary)
+	if opts.estimateCompression {
+		printCompression(w, all.Tensors)
+	}
+}
+
+// printMetadata prints the safetensors metadata sorted by key.
+func printMetadata(w io.Writer, metadata map[string]string) {
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		fmt.Fprintf(w, "- %s: %s\n", k, metadata[k])
+	}
+}
+
+// loadAnalyzedModel loads an analysis previously saved with analyze -json.
+func loadAnalyzedModel(name string) (*n_bits.AnalyzedModel, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	all := &n_bits.AnalyzedModel{}
+	if err = json.Unmarshal(data, all); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return all, nil
+}
+
+// cmdReport prints the analysis previously saved with analyze -json.
+func cmdReport(w io.Writer, name string, opts *analyzeOptions) error {
+	all, err := loadAnalyzedModel(name)
+	if err != nil {
+		return err
+	}
+	printModel(w, all, opts)
+	if opts.htmlOut != "" {
+		return writeHTMLFile(opts.htmlOut, name, all, opts)
+	}
+	return nil
+}
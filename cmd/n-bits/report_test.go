@@ -0,0 +1,72 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+func TestCmdReport(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "model.safetensors")
+	writeSafetensors(t, name, nil, []safetensors.Tensor{
+		newF32Tensor("a", 1, 2, 3, 4),
+		newF32Tensor("b", -1, 0.5),
+		{Name: "c", DType: safetensors.I32, Shape: []uint64{2}, Data: []byte{1, 0, 0, 0, 2, 0, 0, 0}},
+	})
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), top: 10}
+	want := bytes.Buffer{}
+	all, err := analyzeFiles(context.Background(), &want, []string{name}, processSafetensorsFile, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := all.Summary()
+	printSummary(&want, &summary, &opts)
+	printDTypes(&want, all.Tensors, &summary)
+	data, err := json.Marshal(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := filepath.Join(dir, "model.json")
+	if err = os.WriteFile(saved, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	got := bytes.Buffer{}
+	if err = cmdReport(&got, saved, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if want.String() != got.String() {
+		t.Fatalf("want:\n%s\ngot:\n%s", want.String(), got.String())
+	}
+}
+
+func TestCmdReport_Metadata(t *testing.T) {
+	dir := t.TempDir()
+	metadata := map[string]string{"format": "pt", "quantization": "awq w4 g128"}
+	writeSafetensors(t, filepath.Join(dir, "model.safetensors"), metadata, []safetensors.Tensor{newF32Tensor("a", 1, 2, 3, 4)})
+	saved := filepath.Join(dir, "model.json")
+	opts := analyzeOptions{reTensors: regexp.MustCompile(".*"), jsonOut: saved}
+	if err := cmdAnalyze(context.Background(), "", "", "", "", "", "", dir, &opts); err != nil {
+		t.Fatal(err)
+	}
+	got := bytes.Buffer{}
+	if err := cmdReport(&got, saved, &opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"- format: pt\n", "- quantization: awq w4 g128\n"} {
+		if !strings.Contains(got.String(), want) {
+			t.Fatalf("missing %q in:\n%s", want, got.String())
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/maruel/huggingface"
+)
+
+// snapshotFunc downloads the files of a model matching the globs and returns
+// their local paths, like huggingface.Client.EnsureSnapshot.
+type snapshotFunc func(ctx context.Context, ref huggingface.ModelRef, revision string, globs []string) ([]string, error)
+
+// retryDelay is the delay before the first retry. It doubles at each attempt.
+var retryDelay = 2 * time.Second
+
+// ensureSnapshot calls snapshot up to attempts times until it succeeds, with
+// an exponential backoff between the attempts.
+//
+// It returns early if the context is canceled.
+func ensureSnapshot(ctx context.Context, snapshot snapshotFunc, ref huggingface.ModelRef, globs []string, attempts int) ([]string, error) {
+	delay := retryDelay
+	for i := 1; ; i++ {
+		files, err := snapshot(ctx, ref, "main", globs)
+		if err == nil || i >= attempts || ctx.Err() != nil {
+			return files, err
+		}
+		slog.Warn("snapshot", "repo", ref.RepoID(), "attempt", i, "attempts", attempts, "delay", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// hfFileLister lists the files of a model and their sizes, like
+// huggingface.Client.
+type hfFileLister interface {
+	GetModelInfo(ctx context.Context, m *huggingface.Model, ref string) error
+	GetFileInfo(ctx context.Context, ref huggingface.ModelRef, revision, file string) (string, string, int64, error)
+}
+
+// checkRemoteSizes checks the sizes of the files of the model matching the
+// globs with checkSizes, before they are downloaded. It does nothing if limit
+// is 0.
+func checkRemoteSizes(ctx context.Context, hf hfFileLister, ref huggingface.ModelRef, globs []string, limit int64) error {
+	if limit == 0 {
+		return nil
+	}
+	m := huggingface.Model{ModelRef: ref}
+	if err := hf.GetModelInfo(ctx, &m, "main"); err != nil {
+		return err
+	}
+	var names []string
+	var sizes []int64
+	for _, f := range m.Files {
+		for _, g := range globs {
+			if ok, err := filepath.Match(g, f); err != nil {
+				return fmt.Errorf("glob %q is invalid: %w", g, err)
+			} else if ok {
+				_, _, size, err := hf.GetFileInfo(ctx, ref, "main", f)
+				if err != nil {
+					return err
+				}
+				names = append(names, f)
+				sizes = append(sizes, size)
+				break
+			}
+		}
+	}
+	return checkSizes(names, sizes, limit)
+}
+
+// checkSizes returns an error listing the files larger than limit, or the
+// total size if the files are larger than limit combined.
+func checkSizes(names []string, sizes []int64, limit int64) error {
+	var total int64
+	var offenders []string
+	for i, size := range sizes {
+		total += size
+		if size > limit {
+			offenders = append(offenders, fmt.Sprintf("%s (%s)", filepath.Base(names[i]), humanBytes(size)))
+		}
+	}
+	if len(offenders) != 0 {
+		return fmt.Errorf("%d files are larger than -max-file-bytes %s: %s", len(offenders), humanBytes(limit), strings.Join(offenders, ", "))
+	}
+	if total > limit {
+		return fmt.Errorf("the %d files total %s, more than -max-file-bytes %s", len(names), humanBytes(total), humanBytes(limit))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maruel/huggingface"
+)
+
+func TestEnsureSnapshot(t *testing.T) {
+	old := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = old })
+	ref := huggingface.ModelRef{Author: "a", Repo: "r"}
+	attempts := 0
+	// Fails twice then succeeds.
+	snapshot := func(ctx context.Context, got huggingface.ModelRef, revision string, globs []string) ([]string, error) {
+		attempts++
+		if got != ref || revision != "main" || !slices.Equal(globs, []string{"*.safetensors"}) {
+			t.Errorf("unexpected %v %q %q", got, revision, globs)
+		}
+		if attempts < 3 {
+			return nil, errors.New("connection reset")
+		}
+		return []string{"model.safetensors"}, nil
+	}
+	files, err := ensureSnapshot(context.Background(), snapshot, ref, []string{"*.safetensors"}, 3)
+	if err != nil || attempts != 3 || !slices.Equal(files, []string{"model.safetensors"}) {
+		t.Fatal(files, err, attempts)
+	}
+
+	// Not enough attempts.
+	attempts = 0
+	if _, err = ensureSnapshot(context.Background(), snapshot, ref, []string{"*.safetensors"}, 2); err == nil || attempts != 2 {
+		t.Fatal(err, attempts)
+	}
+
+	// The context is honored between attempts.
+	retryDelay = time.Hour
+	attempts = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err = ensureSnapshot(ctx, snapshot, ref, []string{"*.safetensors"}, 3); !errors.Is(err, context.Canceled) || attempts != 1 {
+		t.Fatal(err, attempts)
+	}
+}
+
+// fakeLister is a hfFileLister with a fixed list of files.
+type fakeLister struct {
+	files map[string]int64
+	infos []string
+}
+
+func (f *fakeLister) GetModelInfo(ctx context.Context, m *huggingface.Model, ref string) error {
+	for name := range f.files {
+		m.Files = append(m.Files, name)
+	}
+	slices.Sort(m.Files)
+	return nil
+}
+
+func (f *fakeLister) GetFileInfo(ctx context.Context, ref huggingface.ModelRef, revision, file string) (string, string, int64, error) {
+	f.infos = append(f.infos, file)
+	size, ok := f.files[file]
+	if !ok {
+		return "", "", 0, errors.New("not found")
+	}
+	return "commit", "etag", size, nil
+}
+
+func TestCheckRemoteSizes(t *testing.T) {
+	ctx := context.Background()
+	ref := huggingface.ModelRef{Author: "a", Repo: "r"}
+	hf := &fakeLister{files: map[string]int64{
+		"README.md":                    1 << 40,
+		"model-00001.safetensors":      3 << 30,
+		"model-00002.safetensors":      1 << 30,
+		"model-00003.safetensors":      1 << 30,
+		"model.safetensors.index.json": 1 << 10,
+	}}
+	globs := []string{"*.safetensors"}
+	if err := checkRemoteSizes(ctx, hf, ref, globs, 0); err != nil || len(hf.infos) != 0 {
+		t.Fatal(err, hf.infos)
+	}
+	if err := checkRemoteSizes(ctx, hf, ref, globs, 5<<30); err != nil {
+		t.Fatal(err)
+	}
+	// Only the files matching the globs are looked up.
+	if want := []string{"model-00001.safetensors", "model-00002.safetensors", "model-00003.safetensors"}; !slices.Equal(hf.infos, want) {
+		t.Fatal(hf.infos)
+	}
+	err := checkRemoteSizes(ctx, hf, ref, globs, 2<<30)
+	if err == nil || !strings.Contains(err.Error(), "1 files are larger than -max-file-bytes 2.0GiB: model-00001.safetensors (3.0GiB)") {
+		t.Fatal(err)
+	}
+	err = checkRemoteSizes(ctx, hf, ref, globs, 4<<30)
+	if err == nil || !strings.Contains(err.Error(), "the 3 files total 5.0GiB") {
+		t.Fatal(err)
+	}
+	if err = checkRemoteSizes(ctx, hf, ref, []string{"["}, 1); err == nil {
+		t.Fatal("expected error")
+	}
+}
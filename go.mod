@@ -3,6 +3,8 @@ module github.com/maruel/n-bits-go
 go 1.23.3
 
 require (
+	github.com/edsrzf/mmap-go v1.2.0
+	github.com/klauspost/compress v1.17.11
 	github.com/lmittmann/tint v1.0.5
 	github.com/maruel/floatx v1.1.0
 	github.com/maruel/huggingface v0.0.0-20241109152749-1c0489b4de11
@@ -14,7 +16,6 @@ require (
 )
 
 require (
-	github.com/edsrzf/mmap-go v1.2.0 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/schollz/progressbar/v3 v3.17.1 // indirect
@@ -0,0 +1,170 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"regexp"
+	"runtime"
+	"sync"
+
+	"github.com/maruel/safetensors"
+	"golang.org/x/sync/errgroup"
+)
+
+// AnalyzerOptions controls which tensors an Analyzer analyzes and how.
+type AnalyzerOptions struct {
+	// Include selects the tensors to analyze. All the tensors are analyzed when
+	// nil.
+	Include *regexp.Regexp
+	// Exclude skips the tensors selected by Include, if set.
+	Exclude *regexp.Regexp
+	// MinNumEl skips the tensors with fewer elements, like the layer norm
+	// weights and the biases.
+	MinNumEl int64
+	// Workers is the maximum number of tensors analyzed concurrently. Defaults
+	// to the number of CPUs when 0.
+	Workers int
+	// PackBits unpacks I32 and U32 tensors as weights of this many bits with
+	// AnalyzeTensorPacked, when not 0.
+	PackBits int
+	// SkipUnsupported skips the tensors of an unsupported dtype with a warning
+	// and lists them in AnalyzedModel.Unsupported, instead of failing.
+	SkipUnsupported bool
+	// Tensor controls the analysis of each tensor, e.g. the downcast
+	// simulation.
+	Tensor TensorOptions
+}
+
+// Selected returns true if the tensor name is included and not excluded, and
+// the tensor has at least MinNumEl elements.
+func (o *AnalyzerOptions) Selected(name string, shape []uint64) bool {
+	if o.MinNumEl > 0 {
+		n := uint64(1)
+		for _, d := range shape {
+			n *= d
+		}
+		if n < uint64(o.MinNumEl) {
+			return false
+		}
+	}
+	return (o.Include == nil || o.Include.MatchString(name)) && (o.Exclude == nil || !o.Exclude.MatchString(name))
+}
+
+// AnalyzeTensor analyzes a tensor with AnalyzeTensorPacked when PackBits
+// applies to its dtype, otherwise with AnalyzeTensor.
+func (o *AnalyzerOptions) AnalyzeTensor(ctx context.Context, t safetensors.Tensor) (AnalyzedTensor, error) {
+	if o.PackBits != 0 && (t.DType == safetensors.I32 || t.DType == safetensors.U32) {
+		return o.Tensor.AnalyzeTensorPacked(ctx, t.Name, t, o.PackBits)
+	}
+	return o.Tensor.AnalyzeTensor(ctx, t.Name, t)
+}
+
+// Skip returns true if the error of analyzing a tensor is for an unsupported
+// dtype and SkipUnsupported is set. It logs a warning.
+func (o *AnalyzerOptions) Skip(name string, err error) bool {
+	if !o.SkipUnsupported || !errors.Is(err, ErrUnsupportedDType) {
+		return false
+	}
+	slog.Warn("n_bits", "tensor", name, "message", "skipped", "err", err)
+	return true
+}
+
+// Analyzer analyzes local safetensors files.
+//
+// It is safe for concurrent use; Options.Workers bounds the number of tensors
+// analyzed concurrently across all the calls. Options must not be modified
+// after the first call.
+type Analyzer struct {
+	Options AnalyzerOptions
+
+	once  sync.Once
+	limit chan struct{}
+}
+
+// Analyze analyzes the selected tensors of the files, in order.
+//
+// The metadata is the first non empty one, since it is normally the same in
+// every shard of a model.
+func (a *Analyzer) Analyze(ctx context.Context, files []string) (AnalyzedModel, error) {
+	all := AnalyzedModel{}
+	for _, name := range files {
+		m, err := a.AnalyzeFile(ctx, name)
+		if err != nil {
+			return all, err
+		}
+		if len(all.Metadata) == 0 {
+			all.Metadata = m.Metadata
+		}
+		all.Tensors = append(all.Tensors, m.Tensors...)
+		all.Unsupported = append(all.Unsupported, m.Unsupported...)
+	}
+	return all, nil
+}
+
+// AnalyzeFile analyzes the selected tensors of a safetensors file, in the
+// order they are stored.
+func (a *Analyzer) AnalyzeFile(ctx context.Context, name string) (AnalyzedModel, error) {
+	a.once.Do(func() {
+		n := a.Options.Workers
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		a.limit = make(chan struct{}, n)
+	})
+	s := Mapped{}
+	if err := s.Open(name); err != nil {
+		return AnalyzedModel{}, err
+	}
+	defer s.Close()
+	var toAnalyze []int
+	for i := range s.Tensors {
+		if a.Options.Selected(s.Tensors[i].Name, s.Tensors[i].Shape) {
+			toAnalyze = append(toAnalyze, i)
+		}
+	}
+	m := AnalyzedModel{Tensors: make([]AnalyzedTensor, len(toAnalyze)), Metadata: maps.Clone(s.Metadata)}
+	skipped := make([]bool, len(toAnalyze))
+	eg, ctx2 := errgroup.WithContext(ctx)
+	for j, i := range toAnalyze {
+		eg.Go(func() error {
+			select {
+			case a.limit <- struct{}{}:
+			case <-ctx2.Done():
+				return ctx2.Err()
+			}
+			defer func() {
+				<-a.limit
+			}()
+			// The shards of large tensors take slots from the same limit.
+			o := a.Options
+			o.Tensor.ShardLimit = a.limit
+			var err error
+			m.Tensors[j], err = o.AnalyzeTensor(ctx2, s.Tensors[i])
+			if err != nil && o.Skip(s.Tensors[i].Name, err) {
+				skipped[j] = true
+				return nil
+			}
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return AnalyzedModel{}, err
+	}
+	k := 0
+	for j, i := range toAnalyze {
+		if skipped[j] {
+			m.Unsupported = append(m.Unsupported, s.Tensors[i].Name)
+			continue
+		}
+		m.Tensors[k] = m.Tensors[j]
+		k++
+	}
+	m.Tensors = m.Tensors[:k]
+	return m, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+func TestAnalyzer(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, metadata map[string]string, tensors ...safetensors.Tensor) string {
+		p := filepath.Join(dir, name)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		sf := safetensors.File{Tensors: tensors, Metadata: metadata}
+		if err = sf.Serialize(f); err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	named := func(name string, tensor safetensors.Tensor) safetensors.Tensor {
+		tensor.Name = name
+		return tensor
+	}
+	packed := safetensors.Tensor{Name: "layer.0.qweight", DType: safetensors.U32, Shape: []uint64{1}, Data: []byte{0x10, 0x32, 0x54, 0x76}}
+	files := []string{
+		write("model-00001-of-00002.safetensors", map[string]string{"format": "pt"},
+			named("layer.0.weight", f32Tensor(1, 2, 3)),
+			named("layer.0.bias", f32Tensor(0.5)),
+			packed,
+		),
+		write("model-00002-of-00002.safetensors", map[string]string{"format": "other"},
+			named("layer.1.weight", f32Tensor(-1, 1+0x1p-9)),
+			named("other", f32Tensor(4)),
+		),
+	}
+	a := Analyzer{Options: AnalyzerOptions{
+		Include:  regexp.MustCompile(`^layer\.`),
+		Exclude:  regexp.MustCompile(`\.bias$`),
+		Workers:  1,
+		PackBits: 4,
+		Tensor:   TensorOptions{Downcast: safetensors.BF16},
+	}}
+	m, err := a.Analyze(context.Background(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tensor := range m.Tensors {
+		names = append(names, tensor.Name)
+	}
+	if len(names) != 3 || names[0] != "layer.0.weight" || names[1] != "layer.0.qweight" || names[2] != "layer.1.weight" {
+		t.Fatalf("unexpected tensors %q", names)
+	}
+	if m.Metadata["format"] != "pt" {
+		t.Fatalf("unexpected metadata %v", m.Metadata)
+	}
+	if m.Tensors[0].Max != 3 || m.Tensors[1].PackBits != 4 || m.Tensors[1].NumEl != 8 {
+		t.Fatalf("unexpected %+v", m.Tensors)
+	}
+	if maxErr, _ := m.Tensors[2].SimulateDowncast(safetensors.BF16, RoundTruncate); maxErr != 0x1p-9 {
+		t.Fatalf("unexpected downcast error %g", maxErr)
+	}
+	if _, err = a.Analyze(context.Background(), []string{filepath.Join(dir, "missing.safetensors")}); err == nil {
+		t.Fatal("expected error")
+	}
+	// All the tensors are selected by default.
+	if m, err = (&Analyzer{}).AnalyzeFile(context.Background(), files[1]); err != nil || len(m.Tensors) != 2 {
+		t.Fatal(m, err)
+	}
+}
+
+func TestAnalyzer_SkipUnsupported(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "model.safetensors")
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	weight := f32Tensor(1, 2, 3)
+	weight.Name = "weight"
+	double := safetensors.Tensor{Name: "double", DType: safetensors.F64, Shape: []uint64{1}, Data: make([]byte, 8)}
+	sf := safetensors.File{Tensors: []safetensors.Tensor{double, weight}}
+	if err = sf.Serialize(f); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&Analyzer{}).Analyze(context.Background(), []string{p})
+	var u *UnsupportedDTypeError
+	if !errors.Is(err, ErrUnsupportedDType) || !errors.As(err, &u) || u.DType != safetensors.F64 {
+		t.Fatal(err)
+	}
+	m, err := (&Analyzer{Options: AnalyzerOptions{SkipUnsupported: true}}).Analyze(context.Background(), []string{p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tensors) != 1 || m.Tensors[0].Name != "weight" || m.Tensors[0].Max != 3 {
+		t.Fatalf("unexpected %+v", m.Tensors)
+	}
+	if len(m.Unsupported) != 1 || m.Unsupported[0] != "double" {
+		t.Fatalf("unexpected %q", m.Unsupported)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/maruel/safetensors"
+)
+
+// CastTensor converts a F32, F16 or BF16 tensor to a smaller floating point
+// dtype, rounding each value with the rounding mode.
+//
+// Values overflowing target become infinite, or NaN when target has no
+// infinity like F8_E4M3. Infinite values also become NaN in that case. Use AnalyzedTensor.SimulateDowncast to know the
+// error beforehand.
+func CastTensor(t safetensors.Tensor, target safetensors.DType, mode RoundingMode) (safetensors.Tensor, error) {
+	t.DType = normalizeDType(t.Name, t.DType)
+	src := getFloatFormat(t.DType)
+	dst := getFloatFormat(target)
+	if src == nil || src.dtype.WordSize() == 1 {
+		return safetensors.Tensor{}, fmt.Errorf("%s: can't cast from dtype %s", t.Name, t.DType)
+	}
+	if dst == nil || dst.dtype.WordSize() >= src.dtype.WordSize() {
+		return safetensors.Tensor{}, fmt.Errorf("%s: can't cast %s to dtype %s", t.Name, t.DType, target)
+	}
+	if err := t.Validate(); err != nil {
+		return safetensors.Tensor{}, fmt.Errorf("%s: %w", t.Name, err)
+	}
+	srcSize := int(src.dtype.WordSize())
+	dstSize := int(dst.dtype.WordSize())
+	n := len(t.Data) / srcSize
+	out := safetensors.Tensor{Name: t.Name, DType: target, Shape: t.Shape, Data: make([]byte, n*dstSize)}
+	for i := range n {
+		var v float64
+		switch src.dtype {
+		case safetensors.F32:
+			v = float64(math.Float32frombits(binary.LittleEndian.Uint32(t.Data[4*i:])))
+		case safetensors.F16:
+			v = float64(f16Lookup[binary.LittleEndian.Uint16(t.Data[2*i:])])
+		case safetensors.BF16:
+			v = float64(bf16Lookup[binary.LittleEndian.Uint16(t.Data[2*i:])])
+		}
+		b := dst.encode(dst.round(v, mode))
+		if dstSize == 1 {
+			out.Data[i] = byte(b)
+		} else {
+			binary.LittleEndian.PutUint16(out.Data[2*i:], uint16(b))
+		}
+	}
+	return out, nil
+}
+
+// encode returns the bits of v, which must be exactly representable in f,
+// infinite or NaN.
+func (f *floatFormat) encode(v float64) uint32 {
+	sign := uint32(0)
+	if math.Signbit(v) {
+		sign = 1 << (f.exponentBits + f.mantissaBits)
+	}
+	allOnes := uint32(1)<<f.exponentBits - 1
+	switch {
+	case math.IsNaN(v), math.IsInf(v, 0) && f.finiteOnly:
+		// Without infinity, NaN is the only value that isn't finite.
+		if f.finiteOnly {
+			return sign | allOnes<<f.mantissaBits | (1<<f.mantissaBits - 1)
+		}
+		return sign | allOnes<<f.mantissaBits | 1<<(f.mantissaBits-1)
+	case math.IsInf(v, 0):
+		return sign | allOnes<<f.mantissaBits
+	case v == 0:
+		return sign
+	}
+	a := math.Abs(v)
+	_, exp := math.Frexp(a)
+	e := exp - 1
+	if e < f.minExp() {
+		// Subnormal.
+		return sign | uint32(math.Ldexp(a, f.mantissaBits-f.minExp()))
+	}
+	m := uint32(math.Ldexp(a, f.mantissaBits-e)) & (1<<f.mantissaBits - 1)
+	return sign | uint32(e+f.bias())<<f.mantissaBits | m
+}
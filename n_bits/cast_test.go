@@ -0,0 +1,228 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+func TestFloatFormat_Encode(t *testing.T) {
+	// Every finite value must round trip.
+	check := func(dtype safetensors.DType, lookup []float32) {
+		f := getFloatFormat(dtype)
+		for i, v := range lookup {
+			if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+				continue
+			}
+			if got := f.encode(float64(v)); got != uint32(i) {
+				t.Fatalf("%s: %g: want %#x, got %#x", dtype, v, i, got)
+			}
+		}
+	}
+	check(safetensors.F16, f16Lookup[:])
+	check(safetensors.BF16, bf16Lookup[:])
+	check(safetensors.F8_E4M3, f8E4M3Lookup[:])
+	check(safetensors.F8_E5M2, f8E5M2Lookup[:])
+	if got := getFloatFormat(safetensors.F8_E4M3).encode(math.NaN()); got != 0x7F {
+		t.Fatalf("want 0x7F, got %#x", got)
+	}
+	if got := getFloatFormat(safetensors.F16).encode(math.Inf(-1)); got != 0xFC00 {
+		t.Fatalf("want 0xFC00, got %#x", got)
+	}
+	// F8_E4M3 has no infinity; 0x78 would be 256.
+	if got := getFloatFormat(safetensors.F8_E4M3).encode(math.Inf(1)); got != 0x7F {
+		t.Fatalf("want 0x7F, got %#x", got)
+	}
+	if got := getFloatFormat(safetensors.F8_E4M3).encode(math.Inf(-1)); got != 0xFF {
+		t.Fatalf("want 0xFF, got %#x", got)
+	}
+	if got := getFloatFormat(safetensors.F8_E5M2).encode(math.Inf(-1)); got != 0xFC {
+		t.Fatalf("want 0xFC, got %#x", got)
+	}
+}
+
+func TestCastTensor(t *testing.T) {
+	values := []float32{1, -0.1, 3.14159, 1e-3, 70000}
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	tensor := safetensors.Tensor{Name: "t", DType: safetensors.F32, Shape: []uint64{1, 5}, Data: data}
+	got, err := CastTensor(tensor, safetensors.F16, RoundNearestEven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DType != safetensors.F16 || len(got.Data) != 10 || len(got.Shape) != 2 {
+		t.Fatalf("unexpected %+v", got)
+	}
+	for i, v := range values[:4] {
+		d := float64(f16Lookup[binary.LittleEndian.Uint16(got.Data[2*i:])])
+		if e := math.Abs(d - float64(v)); e > math.Abs(float64(v))/1024 {
+			t.Fatalf("%g: got %g", v, d)
+		}
+	}
+	// 70000 overflows F16.
+	if d := f16Lookup[binary.LittleEndian.Uint16(got.Data[8:])]; !math.IsInf(float64(d), 1) {
+		t.Fatalf("want +Inf, got %g", d)
+	}
+	// Infinities stay infinite, or become NaN without infinity.
+	inf := safetensors.Tensor{Name: "inf", DType: safetensors.F32, Shape: []uint64{2}, Data: make([]byte, 8)}
+	binary.LittleEndian.PutUint32(inf.Data, math.Float32bits(float32(math.Inf(1))))
+	binary.LittleEndian.PutUint32(inf.Data[4:], math.Float32bits(float32(math.Inf(-1))))
+	for dtype, want := range map[safetensors.DType][]byte{
+		safetensors.F8_E4M3: {0x7F, 0xFF},
+		safetensors.F8_E5M2: {0x7C, 0xFC},
+		safetensors.F16:     {0x00, 0x7C, 0x00, 0xFC},
+	} {
+		c, err := CastTensor(inf, dtype, RoundNearestEven)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c.Data, want) {
+			t.Fatalf("%s: want %x, got %x", dtype, want, c.Data)
+		}
+	}
+	if _, err = CastTensor(tensor, safetensors.F32, RoundNearestEven); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = CastTensor(safetensors.Tensor{Name: "i", DType: safetensors.I32, Shape: []uint64{1}, Data: data[:4]}, safetensors.F16, RoundNearestEven); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestFloatFormat_RoundEncode_Random(t *testing.T) {
+	// Differential test of the correctly rounded encoder: the result must be
+	// the closest value, ties to even, compared to its neighbors decoded with
+	// refDecode.
+	r := rand.New(rand.NewSource(1))
+	for _, dtype := range []safetensors.DType{safetensors.F16, safetensors.BF16, safetensors.F8_E4M3, safetensors.F8_E5M2} {
+		f := getFloatFormat(dtype)
+		signBit := uint32(1) << (f.exponentBits + f.mantissaBits)
+		for range 100000 {
+			// Cover the whole range of the format, including overflows and
+			// subnormals.
+			v := float64(math.Float32frombits(r.Uint32()))
+			if e := f.maxExp() + 2; math.Abs(v) > math.Ldexp(1, e) || math.IsNaN(v) {
+				v = math.Ldexp(r.Float64()*2-1, r.Intn(e-f.minExp()+f.mantissaBits+4)+f.minExp()-f.mantissaBits-2)
+			}
+			rounded := f.round(v, RoundNearestEven)
+			if math.IsInf(rounded, 0) || math.IsNaN(rounded) {
+				if math.Abs(v) < f.maxFinite() {
+					t.Fatalf("%s: %g overflowed", dtype, v)
+				}
+				continue
+			}
+			b := f.encode(rounded)
+			got := refDecode(f, b)
+			if got != rounded {
+				t.Fatalf("%s: %g: encoded %#x decodes to %g, want %g", dtype, v, b, got, rounded)
+			}
+			// Check the neighbors with the same sign.
+			for _, n := range []uint32{b - 1, b + 1} {
+				if n&signBit != b&signBit || (b&^signBit == 0 && n == b-1) {
+					continue
+				}
+				other := refDecode(f, n)
+				if math.IsNaN(other) || math.IsInf(other, 0) {
+					continue
+				}
+				d, o := math.Abs(got-v), math.Abs(other-v)
+				if o < d || (o == d && b&1 != 0) {
+					t.Fatalf("%s: %g: got %g (%#x), but %g (%#x) is closer or even", dtype, v, got, b, other, n)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkCastTensor(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 4*1024*1024)
+	for i := 0; i < len(data); i += 4 {
+		binary.LittleEndian.PutUint32(data[i:], math.Float32bits(float32(r.NormFloat64())))
+	}
+	tensor := safetensors.Tensor{DType: safetensors.F32, Shape: []uint64{uint64(len(data) / 4)}, Data: data}
+	for _, mode := range []RoundingMode{RoundNearestEven, RoundTruncate} {
+		b.Run(mode.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				if _, err := CastTensor(tensor, safetensors.F16, mode); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// refDecode decodes the bits of a value in f, independently of floatx.
+func refDecode(f *floatFormat, b uint32) float64 {
+	sign := 1.
+	if b&(1<<(f.exponentBits+f.mantissaBits)) != 0 {
+		sign = -1
+	}
+	e := int(b>>f.mantissaBits) & (1<<f.exponentBits - 1)
+	m := b & (1<<f.mantissaBits - 1)
+	switch {
+	case e == 0:
+		return sign * math.Ldexp(float64(m), f.minExp()-f.mantissaBits)
+	case f.finiteOnly && e == 1<<f.exponentBits-1 && m == 1<<f.mantissaBits-1:
+		return math.NaN()
+	case !f.finiteOnly && e == 1<<f.exponentBits-1:
+		if m == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	default:
+		return sign * math.Ldexp(float64(m|1<<f.mantissaBits), e-f.bias()-f.mantissaBits)
+	}
+}
+
+func TestCastTensor_RoundTrip(t *testing.T) {
+	// Encode(Decode(x)) must return x for every code of the 8 and 16 bits
+	// dtypes, in every rounding mode, since the decoded values are exactly
+	// representable. NaN codes only need to stay NaN.
+	data := []struct {
+		dtype  safetensors.DType
+		n      int
+		decode func(b uint32) float32
+	}{
+		{safetensors.F16, 1 << 16, func(b uint32) float32 { return f16Lookup[b] }},
+		{safetensors.BF16, 1 << 16, func(b uint32) float32 { return bf16Lookup[b] }},
+		{safetensors.F8_E4M3, 1 << 8, func(b uint32) float32 { return f8E4M3Lookup[b] }},
+		{safetensors.F8_E5M2, 1 << 8, func(b uint32) float32 { return f8E5M2Lookup[b] }},
+	}
+	for _, l := range data {
+		src := make([]byte, 4*l.n)
+		for i := range l.n {
+			binary.LittleEndian.PutUint32(src[4*i:], math.Float32bits(l.decode(uint32(i))))
+		}
+		tensor := safetensors.Tensor{Name: "t", DType: safetensors.F32, Shape: []uint64{uint64(l.n)}, Data: src}
+		for _, mode := range []RoundingMode{RoundNearestEven, RoundTruncate} {
+			got, err := CastTensor(tensor, l.dtype, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range l.n {
+				b := uint32(got.Data[i])
+				if l.n == 1<<16 {
+					b = uint32(binary.LittleEndian.Uint16(got.Data[2*i:]))
+				}
+				if math.IsNaN(float64(l.decode(uint32(i)))) {
+					if !math.IsNaN(float64(l.decode(b))) {
+						t.Fatalf("%s %s %#x: want NaN, got %#x", l.dtype, mode, i, b)
+					}
+				} else if b != uint32(i) {
+					t.Fatalf("%s %s %#x: got %#x", l.dtype, mode, i, b)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/maruel/safetensors"
+)
+
+// AnalyzeTensorPerChannel analyzes each channel of a tensor separately, e.g.
+// to decide on per-channel quantization.
+//
+// A channel is all the values at one index of axis: for a 2D tensor, axis 0
+// analyzes each row and axis 1 each column. The channels are named
+// "name[ch]".
+func AnalyzeTensorPerChannel(ctx context.Context, name string, t safetensors.Tensor, axis int) ([]AnalyzedTensor, error) {
+	return TensorOptions{}.AnalyzeTensorPerChannel(ctx, name, t, axis)
+}
+
+// AnalyzeTensorPerChannel analyzes each channel of a tensor separately.
+func (o TensorOptions) AnalyzeTensorPerChannel(ctx context.Context, name string, t safetensors.Tensor, axis int) ([]AnalyzedTensor, error) {
+	return o.AnalyzeTensorPerGroup(ctx, name, t, axis, 0)
+}
+
+// AnalyzeTensorPerGroup analyzes each group of groupSize consecutive values
+// of each channel of a tensor separately, to match quantizers that scale each
+// group, e.g. GPTQ with a group size of 128 along the input dimension of a
+// [out, in] weight is axis 0 with groupSize 128.
+//
+// axis selects the channels like AnalyzeTensorPerChannel and must be lower
+// than the number of dimensions. The values of a channel are taken in row
+// major order, so for a [out, in, kh, kw] convolution weight and axis 0, a
+// channel is the in*kh*kw values of an output channel.
+//
+// groupSize must divide the length of the channels; 0 analyzes each channel
+// as a whole. The groups are named "name[ch][group]", in the order of the
+// channels, or "name[ch]" when a channel is a single group.
+func AnalyzeTensorPerGroup(ctx context.Context, name string, t safetensors.Tensor, axis, groupSize int) ([]AnalyzedTensor, error) {
+	return TensorOptions{}.AnalyzeTensorPerGroup(ctx, name, t, axis, groupSize)
+}
+
+// AnalyzeTensorPerGroup analyzes each group of each channel of a tensor
+// separately.
+func (o TensorOptions) AnalyzeTensorPerGroup(ctx context.Context, name string, t safetensors.Tensor, axis, groupSize int) ([]AnalyzedTensor, error) {
+	if axis < 0 || axis >= len(t.Shape) {
+		return nil, fmt.Errorf("%s: invalid axis %d for a %dD tensor", name, axis, len(t.Shape))
+	}
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	// The tensor is seen as [outer, channels, inner].
+	outer, inner := 1, 1
+	for i, d := range t.Shape {
+		if i < axis {
+			outer *= int(d)
+		} else if i > axis {
+			inner *= int(d)
+		}
+	}
+	channels := int(t.Shape[axis])
+	length := outer * inner
+	ws := int(t.DType.WordSize())
+	groups := 1
+	if groupSize != 0 {
+		if groupSize < 0 || length%groupSize != 0 {
+			return nil, fmt.Errorf("%s: group size %d doesn't divide the channel length %d", name, groupSize, length)
+		}
+		groups = length / groupSize
+	} else {
+		groupSize = length
+	}
+	out := make([]AnalyzedTensor, 0, channels*groups)
+	var buf []byte
+	for ch := range channels {
+		var data []byte
+		if outer == 1 {
+			data = t.Data[ch*inner*ws : (ch+1)*inner*ws]
+		} else {
+			// Gather the channel.
+			if buf == nil {
+				buf = make([]byte, length*ws)
+			}
+			for i := range outer {
+				copy(buf[i*inner*ws:(i+1)*inner*ws], t.Data[(i*channels+ch)*inner*ws:])
+			}
+			data = buf
+		}
+		n := name + "[" + strconv.Itoa(ch) + "]"
+		for g := range groups {
+			gn := n
+			if groups != 1 {
+				gn += "[" + strconv.Itoa(g) + "]"
+			}
+			s := safetensors.Tensor{Name: gn, DType: t.DType, Shape: []uint64{uint64(groupSize)}, Data: data[g*groupSize*ws : (g+1)*groupSize*ws]}
+			a, err := o.AnalyzeTensor(ctx, gn, s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
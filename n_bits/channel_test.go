@@ -0,0 +1,100 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAnalyzeTensorPerChannel(t *testing.T) {
+	// [[1, -2, 3], [40, 50, -60]]
+	tensor := f32Tensor(1, -2, 3, 40, 50, -60)
+	tensor.Shape = []uint64{2, 3}
+	data := []struct {
+		axis     int
+		names    []string
+		min, max []float64
+	}{
+		{0, []string{"w[0]", "w[1]"}, []float64{-2, -60}, []float64{3, 50}},
+		{1, []string{"w[0]", "w[1]", "w[2]"}, []float64{1, -2, -60}, []float64{40, 50, 3}},
+	}
+	for _, l := range data {
+		got, err := AnalyzeTensorPerChannel(context.Background(), "w", tensor, l.axis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(l.names) {
+			t.Fatalf("axis %d: got %d channels", l.axis, len(got))
+		}
+		for i, a := range got {
+			if a.Name != l.names[i] || a.Min != l.min[i] || a.Max != l.max[i] || a.NumEl != int64(6/len(got)) {
+				t.Errorf("axis %d: channel %d: unexpected %+v", l.axis, i, a)
+			}
+		}
+	}
+	if _, err := AnalyzeTensorPerChannel(context.Background(), "w", tensor, 2); err == nil {
+		t.Fatal("expected error")
+	}
+	// The axis is validated against the number of dimensions.
+	if _, err := AnalyzeTensorPerChannel(context.Background(), "w", f32Tensor(1, 2), 1); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestAnalyzeTensorPerGroup(t *testing.T) {
+	// [[1, -2, 3, 4], [40, 50, -60, 70]]
+	tensor := f32Tensor(1, -2, 3, 4, 40, 50, -60, 70)
+	tensor.Shape = []uint64{2, 4}
+	data := []struct {
+		axis, groupSize int
+		names           []string
+		min, max        []float64
+	}{
+		{0, 2, []string{"w[0][0]", "w[0][1]", "w[1][0]", "w[1][1]"}, []float64{-2, 3, 40, -60}, []float64{1, 4, 50, 70}},
+		{0, 4, []string{"w[0]", "w[1]"}, []float64{-2, -60}, []float64{4, 70}},
+		{0, 0, []string{"w[0]", "w[1]"}, []float64{-2, -60}, []float64{4, 70}},
+		{1, 1, []string{"w[0][0]", "w[0][1]", "w[1][0]", "w[1][1]", "w[2][0]", "w[2][1]", "w[3][0]", "w[3][1]"}, []float64{1, 40, -2, 50, 3, -60, 4, 70}, []float64{1, 40, -2, 50, 3, -60, 4, 70}},
+	}
+	for _, l := range data {
+		got, err := AnalyzeTensorPerGroup(context.Background(), "w", tensor, l.axis, l.groupSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(l.names) {
+			t.Fatalf("axis %d group %d: got %d groups", l.axis, l.groupSize, len(got))
+		}
+		for i, a := range got {
+			if a.Name != l.names[i] || a.Min != l.min[i] || a.Max != l.max[i] || a.NumEl != int64(8/len(got)) {
+				t.Errorf("axis %d group %d: #%d: unexpected %+v", l.axis, l.groupSize, i, a)
+			}
+		}
+	}
+	// 3D: [2, 2, 2] with axis 1 gathers w[:, ch, :].
+	tensor.Shape = []uint64{2, 2, 2}
+	got, err := AnalyzeTensorPerGroup(context.Background(), "w", tensor, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ min, max float64 }{{-2, 1}, {40, 50}, {3, 4}, {-60, 70}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d groups", len(got))
+	}
+	for i, w := range want {
+		if got[i].Min != w.min || got[i].Max != w.max || got[i].NumEl != 2 {
+			t.Errorf("3D #%d: unexpected %+v", i, got[i])
+		}
+	}
+	if _, err = AnalyzeTensorPerGroup(context.Background(), "w", tensor, 3, 0); err == nil {
+		t.Fatal("expected error")
+	}
+	tensor.Shape = []uint64{2, 4}
+	// The group size must divide the channel length.
+	for _, groupSize := range []int{3, -1} {
+		if _, err := AnalyzeTensorPerGroup(context.Background(), "w", tensor, 0, groupSize); err == nil {
+			t.Fatalf("%d: expected error", groupSize)
+		}
+	}
+}
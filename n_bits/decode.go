@@ -0,0 +1,55 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DecodeBF16Slice decodes little endian BF16 values to float32 with the
+// shared lookup table.
+//
+// It returns an error if the length of b is not a multiple of 2.
+func DecodeBF16Slice(b []byte) ([]float32, error) {
+	return decode16(b, &bf16Lookup)
+}
+
+// DecodeF16Slice decodes little endian F16 values to float32 with the shared
+// lookup table.
+//
+// It returns an error if the length of b is not a multiple of 2.
+func DecodeF16Slice(b []byte) ([]float32, error) {
+	return decode16(b, &f16Lookup)
+}
+
+// DecodeF8E4M3Slice decodes F8_E4M3 values to float32.
+func DecodeF8E4M3Slice(b []byte) []float32 {
+	return decode8(b, &f8E4M3Lookup)
+}
+
+// DecodeF8E5M2Slice decodes F8_E5M2 values to float32.
+func DecodeF8E5M2Slice(b []byte) []float32 {
+	return decode8(b, &f8E5M2Lookup)
+}
+
+func decode16(b []byte, lookup *[1 << 16]float32) ([]float32, error) {
+	if len(b)%2 != 0 {
+		return nil, fmt.Errorf("%d bytes is not a multiple of 2", len(b))
+	}
+	out := make([]float32, len(b)/2)
+	for i := range out {
+		out[i] = lookup[binary.LittleEndian.Uint16(b[2*i:])]
+	}
+	return out, nil
+}
+
+func decode8(b []byte, lookup *[1 << 8]float32) []float32 {
+	out := make([]float32, len(b))
+	for i, v := range b {
+		out[i] = lookup[v]
+	}
+	return out
+}
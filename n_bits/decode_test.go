@@ -0,0 +1,59 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"math"
+	"testing"
+
+	"github.com/maruel/floatx"
+)
+
+func TestDecodeSlice(t *testing.T) {
+	b := make([]byte, 1<<17)
+	for i := range 1 << 16 {
+		b[2*i] = byte(i)
+		b[2*i+1] = byte(i >> 8)
+	}
+	same := func(a, b float32) bool {
+		return a == b || (math.IsNaN(float64(a)) && math.IsNaN(float64(b)))
+	}
+	f16, err := DecodeF16Slice(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf16, err := DecodeBF16Slice(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f16) != 1<<16 || len(bf16) != 1<<16 {
+		t.Fatal(len(f16), len(bf16))
+	}
+	for i := range 1 << 16 {
+		if want := floatx.F16(i).Float32(); !same(f16[i], want) {
+			t.Fatalf("F16 %#x: want %g, got %g", i, want, f16[i])
+		}
+		// floatx.BF16 mis-decodes subnormals.
+		if want := math.Float32frombits(uint32(i) << 16); !same(bf16[i], want) {
+			t.Fatalf("BF16 %#x: want %g, got %g", i, want, bf16[i])
+		}
+	}
+	e4m3 := DecodeF8E4M3Slice(b[:256])
+	e5m2 := DecodeF8E5M2Slice(b[:256])
+	for i, v := range b[:256] {
+		if want := floatx.F8E4M3Fn(v).Float32(); !same(e4m3[i], want) {
+			t.Fatalf("F8_E4M3 %#x: want %g, got %g", v, want, e4m3[i])
+		}
+		if want := floatx.F8E5M2(v).Float32(); !same(e5m2[i], want) {
+			t.Fatalf("F8_E5M2 %#x: want %g, got %g", v, want, e5m2[i])
+		}
+	}
+	if _, err = DecodeBF16Slice(b[:3]); err == nil || err.Error() != "3 bytes is not a multiple of 2" {
+		t.Fatal(err)
+	}
+	if _, err = DecodeF16Slice(b[:1]); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/maruel/safetensors"
+)
+
+// RoundingMode is the rounding used when downcasting to a smaller floating
+// point dtype.
+type RoundingMode int
+
+const (
+	// RoundNearestEven rounds to the nearest value, ties to even. This is what
+	// hardware normally does.
+	RoundNearestEven RoundingMode = iota
+	// RoundTruncate rounds toward zero, i.e. drops the extra mantissa bits.
+	RoundTruncate
+)
+
+func (r RoundingMode) String() string {
+	switch r {
+	case RoundNearestEven:
+		return "rne"
+	case RoundTruncate:
+		return "trunc"
+	default:
+		return fmt.Sprintf("RoundingMode(%d)", int(r))
+	}
+}
+
+// DowncastError is the error of downcasting the finite values of a tensor to
+// a smaller floating point dtype.
+//
+// Values overflowing the target dtype have an infinite error.
+type DowncastError struct {
+	DType      safetensors.DType `json:"dtype"`
+	Rounding   RoundingMode      `json:"rounding"`
+	MaxAbsErr  float64           `json:"max_abs_err"`
+	MeanAbsErr float64           `json:"mean_abs_err"`
+	// RelErr is the root mean square error divided by the root mean square of
+	// the values, so it doesn't depend on the scale of the tensor. It is 0 when
+	// every value is 0.
+	RelErr float64 `json:"rel_err"`
+}
+
+// SimulateDowncast returns the maximum and mean absolute error of
+// downcasting the tensor to target with the rounding mode.
+//
+// It is only available when the tensor was analyzed with
+// TensorOptions.Downcast set to target, otherwise it returns NaN.
+func (a *AnalyzedTensor) SimulateDowncast(target safetensors.DType, mode RoundingMode) (maxAbsErr, meanAbsErr float64) {
+	for _, d := range a.Downcast {
+		if d.DType == target && d.Rounding == mode {
+			return d.MaxAbsErr, d.MeanAbsErr
+		}
+	}
+	return math.NaN(), math.NaN()
+}
+
+// RelativeDowncastError returns DowncastError.RelErr of downcasting the tensor
+// to target with the rounding mode.
+//
+// It is only available when the tensor was analyzed with
+// TensorOptions.Downcast set to target, otherwise it returns NaN.
+func (a *AnalyzedTensor) RelativeDowncastError(target safetensors.DType, mode RoundingMode) float64 {
+	for _, d := range a.Downcast {
+		if d.DType == target && d.Rounding == mode {
+			return d.RelErr
+		}
+	}
+	return math.NaN()
+}
+
+// DowncastErrors returns the root mean square error of downcasting the finite
+// values to each of BF16, F16 and F8_E4M3 smaller than the tensor's dtype,
+// with RoundNearestEven.
+//
+// It is only available when the tensor was analyzed with
+// TensorOptions.DowncastErrors set, otherwise it returns nil.
+func (a *AnalyzedTensor) DowncastErrors() map[safetensors.DType]float64 {
+	return a.DowncastRMSE
+}
+
+// DTypeSimulation is the number of values of a floating point tensor that
+// would not keep their magnitude if stored in another floating point dtype.
+type DTypeSimulation struct {
+	DType safetensors.DType `json:"dtype"`
+	// Overflow is the number of finite values whose exponent is too large for
+	// DType, so they become infinite, or NaN for dtypes without infinity.
+	Overflow int64 `json:"overflow"`
+	// Underflow is the number of non zero values too small even for the
+	// subnormals of DType, so they become zero.
+	Underflow int64 `json:"underflow"`
+	// Subnormal is the number of values that become subnormal in DType, so
+	// they lose mantissa bits.
+	Subnormal int64 `json:"subnormal"`
+}
+
+// SimulateAsDType returns how many values would overflow or underflow if the
+// tensor was stored as target.
+//
+// It only uses the exponents seen, so it doesn't need another pass on the
+// data. Values with the largest exponent of target rounding up to infinity are
+// not counted as overflowing.
+func (a *AnalyzedTensor) SimulateAsDType(target safetensors.DType) (DTypeSimulation, error) {
+	src := getFloatFormat(a.DType)
+	if src == nil {
+		return DTypeSimulation{}, fmt.Errorf("%s is not a floating point dtype", a.DType)
+	}
+	dst := getFloatFormat(target)
+	if dst == nil {
+		return DTypeSimulation{}, fmt.Errorf("%s is not a floating point dtype", target)
+	}
+	exp, ok := a.Exponent.(*BitKindCount)
+	if !ok {
+		return DTypeSimulation{}, fmt.Errorf("%s: exponents were not tracked", a.Name)
+	}
+	out := DTypeSimulation{DType: target}
+	// Values below half the smallest subnormal of dst round to zero.
+	tiny := dst.minExp() - dst.mantissaBits - 1
+	classify := func(e int, n int64) {
+		switch {
+		case e > dst.maxExp():
+			out.Overflow += n
+		case e < tiny:
+			out.Underflow += n
+		case e < dst.minExp():
+			out.Subnormal += n
+		}
+	}
+	top := 1<<src.exponentBits - 1
+	if src.finiteOnly {
+		top++
+	}
+	for e := 1; e < top && e < exp.ValuesSeen.Len(); e++ {
+		if n := exp.ValuesSeen.Get(e); n != 0 {
+			classify(e-src.bias(), int64(n))
+		}
+	}
+	// The subnormals of the source are all below its smallest normal value.
+	if a.Subnormal != 0 {
+		classify(src.minExp()-1, int64(a.Subnormal))
+	}
+	return out, nil
+}
+
+// maxFinite returns the largest finite value.
+func (f *floatFormat) maxFinite() float64 {
+	m := f.mantissaBits
+	if f.finiteOnly {
+		// The all ones mantissa with the largest exponent is NaN.
+		m--
+	}
+	return (2 - math.Ldexp(1, -m)) * math.Ldexp(1, f.maxExp())
+}
+
+// clamp saturates the finite values out of the range of f to its largest
+// finite magnitude. Infinities and NaN are returned as is.
+func (f *floatFormat) clamp(v float64) float64 {
+	if m := f.maxFinite(); math.Abs(v) > m && !math.IsInf(v, 0) {
+		return math.Copysign(m, v)
+	}
+	return v
+}
+
+// ClampToBF16 saturates v to the finite range of BF16, like quantizers do,
+// instead of letting it overflow to infinity when downcast.
+func ClampToBF16(v float32) float32 {
+	return float32(getFloatFormat(safetensors.BF16).clamp(float64(v)))
+}
+
+// ClampToF16 saturates v to the finite range of F16.
+func ClampToF16(v float32) float32 {
+	return float32(getFloatFormat(safetensors.F16).clamp(float64(v)))
+}
+
+// ClampToF8E4M3 saturates v to the finite range of F8_E4M3, i.e. ±448.
+func ClampToF8E4M3(v float32) float32 {
+	return float32(getFloatFormat(safetensors.F8_E4M3).clamp(float64(v)))
+}
+
+// ClampToF8E5M2 saturates v to the finite range of F8_E5M2, i.e. ±57344.
+func ClampToF8E5M2(v float32) float32 {
+	return float32(getFloatFormat(safetensors.F8_E5M2).clamp(float64(v)))
+}
+
+// round returns v rounded to the closest value representable in f with the
+// rounding mode.
+//
+// Values overflowing f become infinite, or NaN when f has no infinity.
+func (f *floatFormat) round(v float64, mode RoundingMode) float64 {
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	// v = frac * 2^exp with frac in [0.5, 1).
+	_, exp := math.Frexp(v)
+	// The exponent of the least significant mantissa bit; subnormals share the
+	// exponent of the smallest normal value.
+	q := max(exp-1, f.minExp()) - f.mantissaBits
+	s := math.Ldexp(v, -q)
+	if mode == RoundTruncate {
+		s = math.Trunc(s)
+	} else {
+		s = math.RoundToEven(s)
+	}
+	r := math.Ldexp(s, q)
+	if math.Abs(r) > f.maxFinite() {
+		if f.finiteOnly {
+			return math.NaN()
+		}
+		return math.Inf(int(math.Copysign(1, v)))
+	}
+	return r
+}
+
+// downcaster accumulates the error of downcasting values to a smaller dtype,
+// for each rounding mode.
+type downcaster struct {
+	target *floatFormat
+	n      int64
+	sumSq  float64
+	max    [2]float64
+	sum    [2]float64
+	errSq  [2]float64
+}
+
+// add accumulates the error of the finite value v.
+func (d *downcaster) add(v float64) {
+	d.n++
+	d.sumSq += v * v
+	for i, mode := range [...]RoundingMode{RoundNearestEven, RoundTruncate} {
+		e := math.Abs(d.target.round(v, mode) - v)
+		if math.IsNaN(e) {
+			e = math.Inf(1)
+		}
+		d.max[i] = max(d.max[i], e)
+		d.sum[i] += e
+		d.errSq[i] += e * e
+	}
+}
+
+func (d *downcaster) sums() []*float64 {
+	return []*float64{&d.sumSq, &d.sum[0], &d.sum[1], &d.errSq[0], &d.errSq[1]}
+}
+
+func (d *downcaster) merge(o *downcaster) {
+	d.n += o.n
+	d.sumSq += o.sumSq
+	for i := range d.max {
+		d.max[i] = max(d.max[i], o.max[i])
+		d.sum[i] += o.sum[i]
+		d.errSq[i] += o.errSq[i]
+	}
+}
+
+func (d *downcaster) errors() []DowncastError {
+	out := make([]DowncastError, len(d.max))
+	for i, mode := range [...]RoundingMode{RoundNearestEven, RoundTruncate} {
+		out[i] = DowncastError{DType: d.target.dtype, Rounding: mode, MaxAbsErr: d.max[i]}
+		if d.n != 0 {
+			out[i].MeanAbsErr = d.sum[i] / float64(d.n)
+		}
+		if d.sumSq != 0 {
+			// The n cancel out.
+			out[i].RelErr = math.Sqrt(d.errSq[i] / d.sumSq)
+		}
+	}
+	return out
+}
+
+// rmseTargets are the dtypes for which TensorOptions.DowncastErrors
+// calculates the error.
+var rmseTargets = [...]*floatFormat{
+	getFloatFormat(safetensors.BF16),
+	getFloatFormat(safetensors.F16),
+	getFloatFormat(safetensors.F8_E4M3),
+}
+
+// rmser accumulates the squared error of downcasting values to each of
+// rmseTargets with RoundNearestEven.
+//
+// Values overflowing a target are saturated to its largest finite value, like
+// quantization kernels do, so the error stays finite.
+type rmser struct {
+	n     int64
+	sumSq [len(rmseTargets)]float64
+}
+
+// add accumulates the error of the finite value v.
+func (r *rmser) add(v float64) {
+	r.n++
+	for i, f := range rmseTargets {
+		d := f.round(f.clamp(v), RoundNearestEven) - v
+		r.sumSq[i] += d * d
+	}
+}
+
+func (r *rmser) sums() []*float64 {
+	out := make([]*float64, len(r.sumSq))
+	for i := range r.sumSq {
+		out[i] = &r.sumSq[i]
+	}
+	return out
+}
+
+func (r *rmser) merge(o *rmser) {
+	r.n += o.n
+	for i := range r.sumSq {
+		r.sumSq[i] += o.sumSq[i]
+	}
+}
+
+// errors returns the RMSE for each target smaller than dtype.
+func (r *rmser) errors(dtype safetensors.DType) map[safetensors.DType]float64 {
+	out := map[safetensors.DType]float64{}
+	for i, f := range rmseTargets {
+		if f.dtype.WordSize() < dtype.WordSize() {
+			out[f.dtype] = 0
+			if r.n != 0 {
+				out[f.dtype] = math.Sqrt(r.sumSq[i] / float64(r.n))
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"errors"
+
+	"github.com/maruel/safetensors"
+)
+
+// The errors returned, wrapped, by the analysis. A canceled analysis returns
+// an error wrapping the context's error instead.
+var (
+	// ErrUnsupportedDType is matched by UnsupportedDTypeError with errors.Is.
+	ErrUnsupportedDType = errors.New("unsupported dtype")
+	// ErrEmptyTensor is returned when a tensor has no data while its shape has
+	// elements, like in a truncated file. A tensor with a 0 dimension is valid.
+	ErrEmptyTensor = errors.New("empty tensor")
+)
+
+// UnsupportedDTypeError is returned, wrapped, when analyzing a tensor of a
+// dtype that is not supported. Use errors.As to get the dtype.
+type UnsupportedDTypeError struct {
+	DType safetensors.DType
+}
+
+func (e *UnsupportedDTypeError) Error() string {
+	return "unsupported dtype " + string(e.DType)
+}
+
+// Is returns true for ErrUnsupportedDType.
+func (e *UnsupportedDTypeError) Is(target error) bool {
+	return target == ErrUnsupportedDType
+}
+
+// checkNotEmpty returns ErrEmptyTensor if the tensor has no data while its
+// shape has elements.
+func checkNotEmpty(t *safetensors.Tensor) error {
+	if len(t.Data) != 0 {
+		return nil
+	}
+	for _, d := range t.Shape {
+		if d == 0 {
+			return nil
+		}
+	}
+	return ErrEmptyTensor
+}
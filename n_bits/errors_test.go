@@ -0,0 +1,52 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+func TestUnsupportedDTypeError(t *testing.T) {
+	tensor := safetensors.Tensor{DType: safetensors.F64, Shape: []uint64{1}, Data: make([]byte, 8)}
+	_, err := AnalyzeTensor(context.Background(), "t", tensor)
+	var u *UnsupportedDTypeError
+	if !errors.As(err, &u) || u.DType != safetensors.F64 {
+		t.Fatalf("unexpected %v", err)
+	}
+	if !errors.Is(err, ErrUnsupportedDType) {
+		t.Fatal(err)
+	}
+	if s := err.Error(); s != "t: unsupported dtype F64" {
+		t.Fatal(s)
+	}
+	_, err = AnalyzeTensorPacked(context.Background(), "t", f32Tensor(1), 4)
+	if !errors.As(err, &u) || u.DType != safetensors.F32 {
+		t.Fatalf("unexpected %v", err)
+	}
+}
+
+func TestErrEmptyTensor(t *testing.T) {
+	tensor := safetensors.Tensor{DType: safetensors.F32, Shape: []uint64{4}}
+	if _, err := AnalyzeTensor(context.Background(), "t", tensor); !errors.Is(err, ErrEmptyTensor) {
+		t.Fatalf("unexpected %v", err)
+	}
+	tensor.DType = safetensors.U32
+	if _, err := AnalyzeTensorPacked(context.Background(), "t", tensor, 4); !errors.Is(err, ErrEmptyTensor) {
+		t.Fatalf("unexpected %v", err)
+	}
+	if _, err := AnalyzeReader(context.Background(), "t", safetensors.F32, bytes.NewReader(nil), 4); !errors.Is(err, ErrEmptyTensor) {
+		t.Fatalf("unexpected %v", err)
+	}
+	// Truncated but not empty.
+	_, err := AnalyzeReader(context.Background(), "t", safetensors.F32, bytes.NewReader(make([]byte, 4)), 4)
+	if err == nil || errors.Is(err, ErrEmptyTensor) {
+		t.Fatalf("unexpected %v", err)
+	}
+}
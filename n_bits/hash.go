@@ -0,0 +1,138 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/fnv"
+	"io"
+
+	"github.com/maruel/safetensors"
+)
+
+// Hasher calculates the digest of the raw data of a tensor, to find
+// duplicated tensors.
+//
+// A Hasher implementing `New() hash.Hash` is fed incrementally by
+// AnalyzeReader instead of buffering the whole tensor.
+type Hasher interface {
+	Hash(data []byte) []byte
+}
+
+// streamHasher is a Hasher that can hash data incrementally.
+type streamHasher interface {
+	New() hash.Hash
+}
+
+// FNV64Hasher is the default Hasher. It is a fast non-cryptographic 64 bits
+// hash, so different tensors may collide; FindDuplicates compares the data.
+type FNV64Hasher struct{}
+
+func (FNV64Hasher) Hash(data []byte) []byte {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum(nil)
+}
+
+func (FNV64Hasher) New() hash.Hash {
+	return fnv.New64a()
+}
+
+// SHA256Hasher is a cryptographic Hasher, for when the digests are compared
+// without access to the data.
+type SHA256Hasher struct{}
+
+func (SHA256Hasher) Hash(data []byte) []byte {
+	d := sha256.Sum256(data)
+	return d[:]
+}
+
+func (SHA256Hasher) New() hash.Hash {
+	return sha256.New()
+}
+
+func (o *TensorOptions) hasher() Hasher {
+	if o.Hasher != nil {
+		return o.Hasher
+	}
+	return FNV64Hasher{}
+}
+
+// digest returns the hex encoded digest of the data.
+func (o *TensorOptions) digest(data []byte) string {
+	return hex.EncodeToString(o.hasher().Hash(data))
+}
+
+// newDigester returns a writer to feed the data incrementally and a function
+// returning the hex encoded digest of the data written.
+func (o *TensorOptions) newDigester() (io.Writer, func() string) {
+	h := o.hasher()
+	if s, ok := h.(streamHasher); ok {
+		d := s.New()
+		return d, func() string { return hex.EncodeToString(d.Sum(nil)) }
+	}
+	b := &bytes.Buffer{}
+	return b, func() string { return hex.EncodeToString(h.Hash(b.Bytes())) }
+}
+
+// FindDuplicates returns the names of the tensors with identical raw data,
+// grouped, in the order of their first tensor. Tensors without duplicate are
+// not returned.
+//
+// The tensors are first grouped by their digest with h, then compared byte
+// for byte so hash collisions are never reported. FNV64Hasher is used when h
+// is nil.
+func FindDuplicates(tensors []safetensors.Tensor, h Hasher) [][]string {
+	if h == nil {
+		h = FNV64Hasher{}
+	}
+	byDigest := map[string][]int{}
+	var order []string
+	for i := range tensors {
+		d := string(h.Hash(tensors[i].Data))
+		if len(byDigest[d]) == 0 {
+			order = append(order, d)
+		}
+		byDigest[d] = append(byDigest[d], i)
+	}
+	var out [][]string
+	for _, d := range order {
+		for _, g := range splitEqual(byDigest[d], func(i, j int) bool { return bytes.Equal(tensors[i].Data, tensors[j].Data) }) {
+			if len(g) < 2 {
+				continue
+			}
+			names := make([]string, len(g))
+			for k, i := range g {
+				names[k] = tensors[i].Name
+			}
+			out = append(out, names)
+		}
+	}
+	return out
+}
+
+// splitEqual partitions items into groups of equal items, as decided by
+// equal, preserving the order of the items within each group and of the
+// groups by their first item.
+func splitEqual[T any](items []T, equal func(a, b T) bool) [][]T {
+	var out [][]T
+	for _, item := range items {
+		found := false
+		for k := range out {
+			if equal(out[k][0], item) {
+				out[k] = append(out[k], item)
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, []T{item})
+		}
+	}
+	return out
+}
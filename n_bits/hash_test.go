@@ -0,0 +1,55 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+// collidingHasher returns the same digest for every input.
+type collidingHasher struct{}
+
+func (collidingHasher) Hash(data []byte) []byte {
+	return []byte{0}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	tensors := []safetensors.Tensor{
+		f32Tensor(1, 2, 3),
+		f32Tensor(1, 2),
+		f32Tensor(1, 2, 3),
+		f32Tensor(2, 1),
+		f32Tensor(2, 1),
+	}
+	for i, n := range []string{"a", "b", "c", "d", "e"} {
+		tensors[i].Name = n
+	}
+	want := [][]string{{"a", "c"}, {"d", "e"}}
+	for _, h := range []Hasher{nil, SHA256Hasher{}, collidingHasher{}} {
+		if got := FindDuplicates(tensors, h); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%T: want %q, got %q", h, want, got)
+		}
+	}
+	if got := FindDuplicates(tensors[:2], collidingHasher{}); got != nil {
+		t.Fatalf("want no duplicate, got %q", got)
+	}
+}
+
+func TestTensorOptions_Hasher_NotStreaming(t *testing.T) {
+	tensor := f32Tensor(1, 2, 3)
+	o := TensorOptions{Hash: true, Hasher: collidingHasher{}}
+	a, err := o.AnalyzeReader(context.Background(), "t", tensor.DType, bytes.NewReader(tensor.Data), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Digest != "00" {
+		t.Fatal(a.Digest)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"slices"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/maruel/safetensors"
+)
+
+// Mapped is a read-only memory mapped safetensors file, like
+// safetensors.Mapped, except that the header may use dtype aliases like
+// "bfloat16". See NormalizeHeader.
+type Mapped struct {
+	*safetensors.File
+	f *os.File
+	m mmap.MMap
+}
+
+// Close releases the memory region and the file handle.
+func (s *Mapped) Close() error {
+	err := s.m.Unmap()
+	if err2 := s.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Open opens a file and memory maps it read-only.
+//
+// When the header uses dtype aliases, the file is mapped copy-on-write
+// instead, so the header can be normalized in memory without modifying the
+// file.
+func (s *Mapped) Open(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	m, err := mmap.Map(f, mmap.RDONLY, 0)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if h := normalizedHeader(m); h != nil {
+		if err = m.Unmap(); err == nil {
+			m, err = mmap.Map(f, mmap.COPY, 0)
+		}
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		copy(m[8:], h)
+	}
+	s.f = f
+	s.m = m
+	if s.File, err = safetensors.Parse(m); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return nil
+}
+
+// parse parses a whole safetensors file in memory like safetensors.Parse,
+// except that the header may use dtype aliases. The buffer is not modified.
+func parse(buffer []byte) (*safetensors.File, error) {
+	if h := normalizedHeader(buffer); h != nil {
+		buffer = slices.Clone(buffer)
+		copy(buffer[8:], h)
+	}
+	return safetensors.Parse(buffer)
+}
+
+// normalizedHeader returns the header of the safetensors file in buffer with
+// its dtype aliases normalized, or nil if there is nothing to normalize.
+func normalizedHeader(buffer []byte) []byte {
+	if len(buffer) < 8 {
+		return nil
+	}
+	n := binary.LittleEndian.Uint64(buffer)
+	if n > uint64(len(buffer)-8) {
+		return nil
+	}
+	return NormalizeHeader(buffer[8 : 8+n])
+}
+
+// NormalizeHeader returns a copy of the JSON header of a safetensors file
+// where the tensors' dtype aliases, like "bfloat16" or "torch.float16", are
+// replaced with the canonical dtype, so the header can be parsed by the
+// safetensors package.
+//
+// The canonical names are never longer than the aliases so they are padded
+// with spaces: the header keeps its length and the data offsets stay valid.
+//
+// It returns nil if there is nothing to normalize or if the header is not
+// valid JSON, which is left for the safetensors package to report.
+func NormalizeHeader(header []byte) []byte {
+	var out []byte
+	dec := json.NewDecoder(bytes.NewReader(header))
+	// stack tracks for each level of nesting whether it is an object and
+	// the next string is a key.
+	type level struct {
+		object, key bool
+		// name is the last key read.
+		name string
+	}
+	var stack []level
+	// tensor is the name of the current top level entry.
+	tensor := ""
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			// io.EOF or invalid JSON.
+			if len(stack) != 0 {
+				return nil
+			}
+			return out
+		}
+		if d, ok := t.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				stack = append(stack, level{object: d == '{', key: d == '{'})
+			default:
+				stack = stack[:len(stack)-1]
+				if len(stack) != 0 && stack[len(stack)-1].object {
+					stack[len(stack)-1].key = true
+				}
+			}
+			continue
+		}
+		if len(stack) == 0 {
+			return nil
+		}
+		top := &stack[len(stack)-1]
+		if !top.object {
+			continue
+		}
+		if top.key {
+			top.name, _ = t.(string)
+			top.key = false
+			if len(stack) == 1 {
+				tensor = top.name
+			}
+			continue
+		}
+		top.key = true
+		s, ok := t.(string)
+		if !ok || len(stack) != 2 || top.name != "dtype" || tensor == "__metadata__" {
+			continue
+		}
+		d := normalizeDType(tensor, safetensors.DType(s))
+		if string(d) == s || d.WordSize() == 0 || len(d) > len(s) {
+			continue
+		}
+		// Only plain strings are replaced; the aliases don't need escaping.
+		end := int(dec.InputOffset())
+		start := end - len(s) - 2
+		if start < 0 || string(header[start:end]) != "\""+s+"\"" {
+			continue
+		}
+		if out == nil {
+			out = slices.Clone(header)
+		}
+		copy(out[start:end], "\""+string(d)+"\""+string(bytes.Repeat([]byte{' '}, len(s)-len(d))))
+	}
+}
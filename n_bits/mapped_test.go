@@ -0,0 +1,108 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+// aliasFile is a safetensors file whose header uses dtype aliases, like some
+// community exports: a BF16 tensor of 1, 2 and -4, and a F16 tensor of 0.5.
+func aliasFile() []byte {
+	header := `{"__metadata__":{"dtype":"bfloat16"},"w":{"dtype":"bfloat16","shape":[3],"data_offsets":[0,6]},"b":{"dtype":"torch.float16","shape":[1],"data_offsets":[6,8]}}`
+	out := binary.LittleEndian.AppendUint64(nil, uint64(len(header)))
+	out = append(out, header...)
+	return append(out, 0x80, 0x3F, 0x00, 0x40, 0x80, 0xC0, 0x00, 0x38)
+}
+
+func TestNormalizeHeader(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{
+			`{"w":{"dtype":"bfloat16","shape":[1],"data_offsets":[0,2]}}`,
+			`{"w":{"dtype":"BF16"    ,"shape":[1],"data_offsets":[0,2]}}`,
+		},
+		{
+			`{"w":{"shape":[1],"dtype":"f32","data_offsets":[0,4]},"v":{"dtype":"F8_E4M3","shape":[1],"data_offsets":[4,5]}}`,
+			`{"w":{"shape":[1],"dtype":"F32","data_offsets":[0,4]},"v":{"dtype":"F8_E4M3","shape":[1],"data_offsets":[4,5]}}`,
+		},
+		// The metadata is left alone.
+		{`{"__metadata__":{"dtype":"bfloat16"}}`, ""},
+		{
+			`{"w":{"dtype":"bf16","shape":[1],"data_offsets":[0,2]}}`,
+			`{"w":{"dtype":"BF16","shape":[1],"data_offsets":[0,2]}}`,
+		},
+		// Already canonical, unknown or escaped.
+		{`{"w":{"dtype":"BF16","shape":[1],"data_offsets":[0,2]}}`, ""},
+		{`{"w":{"dtype":"complex64","shape":[1],"data_offsets":[0,8]}}`, ""},
+		{`{"w":{"dtype":"bfloat\u0031\u0036","shape":[1],"data_offsets":[0,2]}}`, ""},
+		// Invalid JSON.
+		{`{"w":{"dtype":"bfloat16"`, ""},
+		{`[`, ""},
+	}
+	for i, line := range data {
+		if got := string(NormalizeHeader([]byte(line.in))); got != line.want {
+			t.Errorf("#%d: want %q\ngot  %q", i, line.want, got)
+		}
+	}
+}
+
+func TestMapped_Alias(t *testing.T) {
+	raw := aliasFile()
+	name := filepath.Join(t.TempDir(), "model.safetensors")
+	if err := os.WriteFile(name, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// safetensors can't parse it as is.
+	if _, err := safetensors.Parse(raw); err == nil {
+		t.Fatal("expected error")
+	}
+	s := Mapped{}
+	if err := s.Open(name); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tensors) != 2 || s.Tensors[0].Name != "w" || s.Tensors[0].DType != safetensors.BF16 || s.Tensors[1].DType != safetensors.F16 || len(s.Tensors[0].Data) != 6 {
+		t.Fatalf("unexpected %+v", s.Tensors)
+	}
+	if s.Metadata["dtype"] != "bfloat16" {
+		t.Fatalf("unexpected %+v", s.Metadata)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The file is not modified.
+	if got, err := os.ReadFile(name); err != nil || !bytes.Equal(got, raw) {
+		t.Fatal(err)
+	}
+
+	m, err := (&Analyzer{}).AnalyzeFile(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tensors) != 2 || m.Tensors[0].DType != safetensors.BF16 || m.Tensors[0].Min != -4 || m.Tensors[1].Max != 0.5 {
+		t.Fatalf("unexpected %+v", m.Tensors)
+	}
+
+	// AnalyzeBytes doesn't modify the buffer.
+	m, err = AnalyzeBytes(context.Background(), raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tensors) != 2 || m.Tensors[0].DType != safetensors.BF16 {
+		t.Fatalf("unexpected %+v", m.Tensors)
+	}
+	if !bytes.Equal(raw, aliasFile()) {
+		t.Fatal("buffer modified")
+	}
+}
@@ -5,8 +5,20 @@
 package n_bits
 
 import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"math"
+	"math/bits"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"unsafe"
 
 	"github.com/maruel/floatx"
@@ -16,28 +28,414 @@ import (
 // AnalyzedModel is the analyzed data.
 type AnalyzedModel struct {
 	Tensors []AnalyzedTensor `json:"tensors"`
+	// Metadata is the safetensors __metadata__ of the model, e.g. the
+	// framework and the quantization config.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Unsupported is the names of the tensors skipped because their dtype is
+	// not supported, with AnalyzerOptions.SkipUnsupported.
+	Unsupported []string `json:"unsupported,omitempty"`
+
+	// index maps the tensor names to their index in Tensors. It is built
+	// lazily by TensorByName and rebuilt when found stale.
+	index map[string]int
+	// indexLen is len(Tensors) when index was built.
+	indexLen int
+}
+
+// appendMu serializes AppendTensors. It is shared by all the models so
+// AnalyzedModel stays a plain value that can be copied and returned.
+var appendMu sync.Mutex
+
+// AppendTensors appends ts to Tensors.
+//
+// It is safe to call concurrently, e.g. from the goroutines analyzing each
+// file of a model. Tensors must not be read until all the calls returned.
+//
+// The lock is global to the package, not per model: concurrent appends to
+// different models wait for each other. The critical section is only the
+// append, so it matters only for callers appending one tensor at a time from
+// many goroutines.
+func (m *AnalyzedModel) AppendTensors(ts ...AnalyzedTensor) {
+	appendMu.Lock()
+	defer appendMu.Unlock()
+	m.Tensors = append(m.Tensors, ts...)
+}
+
+// TensorByName returns the tensor with this name.
+//
+// Repeated lookups are O(1), including for absent names. The index is rebuilt
+// when the number of tensors changed or the tensor found has another name. A
+// tensor renamed in place without changing the length is not found until
+// then. It is not safe for concurrent use.
+func (m *AnalyzedModel) TensorByName(name string) (*AnalyzedTensor, bool) {
+	i, ok := m.index[name]
+	if ok && i < len(m.Tensors) && m.Tensors[i].Name == name {
+		return &m.Tensors[i], true
+	}
+	if !ok && m.index != nil && m.indexLen == len(m.Tensors) {
+		return nil, false
+	}
+	m.indexLen = len(m.Tensors)
+	m.index = make(map[string]int, len(m.Tensors))
+	for i := range m.Tensors {
+		if _, ok := m.index[m.Tensors[i].Name]; !ok {
+			m.index[m.Tensors[i].Name] = i
+		}
+	}
+	if i, ok := m.index[name]; ok {
+		return &m.Tensors[i], true
+	}
+	return nil, false
+}
+
+// Names returns the names of the tensors, in order.
+func (m *AnalyzedModel) Names() []string {
+	out := make([]string, len(m.Tensors))
+	for i := range m.Tensors {
+		out[i] = m.Tensors[i].Name
+	}
+	return out
+}
+
+// MergeModels concatenates the tensors of models, e.g. shards of one model
+// analyzed separately.
+//
+// The metadata is the first non empty one, like Analyzer.Analyze, since it is
+// normally the same in every shard of a model.
+//
+// It returns an error if a tensor name is present more than once.
+func MergeModels(models ...AnalyzedModel) (AnalyzedModel, error) {
+	out := AnalyzedModel{}
+	seen := map[string]struct{}{}
+	for _, m := range models {
+		if len(out.Metadata) == 0 {
+			out.Metadata = maps.Clone(m.Metadata)
+		}
+		for _, t := range m.Tensors {
+			if _, ok := seen[t.Name]; ok {
+				return AnalyzedModel{}, fmt.Errorf("duplicate tensor %q", t.Name)
+			}
+			seen[t.Name] = struct{}{}
+			out.Tensors = append(out.Tensors, t)
+		}
+		out.Unsupported = append(out.Unsupported, m.Unsupported...)
+	}
+	return out, nil
+}
+
+// TotalWeights returns the number of weights in all the tensors.
+func (m *AnalyzedModel) TotalWeights() int64 {
+	n := int64(0)
+	for i := range m.Tensors {
+		n += m.Tensors[i].NumEl
+	}
+	return n
+}
+
+// TotalBytes returns the number of bytes of all the tensors.
+func (m *AnalyzedModel) TotalBytes() int64 {
+	n := int64(0)
+	for i := range m.Tensors {
+		n += m.Tensors[i].Len()
+	}
+	return n
+}
+
+// TotalWasted returns the number of bytes wasted in all the tensors.
+func (m *AnalyzedModel) TotalWasted() int64 {
+	n := int64(0)
+	for i := range m.Tensors {
+		n += m.Tensors[i].BytesWasted()
+	}
+	return n
+}
+
+// Summary returns the stats aggregated over all the tensors.
+func (m *AnalyzedModel) Summary() Summary {
+	s := Summary{
+		NumTensors:  len(m.Tensors),
+		NumEl:       m.TotalWeights(),
+		Bytes:       m.TotalBytes(),
+		BytesWasted: m.TotalWasted(),
+	}
+	for i := range m.Tensors {
+		a := &m.Tensors[i]
+		s.Inf += int64(a.Inf)
+		s.NaN += int64(a.NaN)
+		s.SignBitsWasted += a.NumEl * int64(a.Sign.BitsWasted())
+		s.ExponentBitsWasted += a.NumEl * int64(a.Exponent.BitsWasted())
+		s.MantissaBitsWasted += a.NumEl * int64(a.Mantissa.BitsWasted())
+	}
+	return s
+}
+
+// Summary is the stats of a whole model.
+type Summary struct {
+	NumTensors  int   `json:"tensors"`
+	NumEl       int64 `json:"numel"` // Number of weights.
+	Bytes       int64 `json:"bytes"`
+	BytesWasted int64 `json:"wasted"`
+	Inf         int64 `json:"inf"`
+	NaN         int64 `json:"nan"`
+	// SignBitsWasted, ExponentBitsWasted and MantissaBitsWasted are the bits
+	// wasted in each field, summed over all the weights.
+	SignBitsWasted     int64 `json:"sign_bits_wasted"`
+	ExponentBitsWasted int64 `json:"exponent_bits_wasted"`
+	MantissaBitsWasted int64 `json:"mantissa_bits_wasted"`
+}
+
+// WastedBreakdown returns the percentage of the wasted bits that is in the
+// sign, the exponent and the mantissa. They are all 0 if nothing is wasted.
+func (s *Summary) WastedBreakdown() (sign, exponent, mantissa float64) {
+	total := s.SignBitsWasted + s.ExponentBitsWasted + s.MantissaBitsWasted
+	if total == 0 {
+		return 0, 0, 0
+	}
+	return 100. * float64(s.SignBitsWasted) / float64(total),
+		100. * float64(s.ExponentBitsWasted) / float64(total),
+		100. * float64(s.MantissaBitsWasted) / float64(total)
+}
+
+// EffectiveBitsPerWeight returns the average number of bits actually used per
+// weight.
+func (s *Summary) EffectiveBitsPerWeight() float64 {
+	if s.NumEl == 0 {
+		return 0
+	}
+	return float64(8*(s.Bytes-s.BytesWasted)) / float64(s.NumEl)
 }
 
 // AnalyzedTensor contains the stats coming from an analyzed tensor.
 type AnalyzedTensor struct {
-	Name     string            `json:"name"`
-	DType    safetensors.DType `json:"dtype"`
-	NumEl    int64             `json:"numel"` // Number of weights.
-	Avg      float64           `json:"avg"`
-	Min      float64           `json:"min"`
-	Max      float64           `json:"max"`
-	Inf      int               `json:"inf"`
-	NaN      int               `json:"nan"`
-	Sign     BitAllocation     `json:"s"`
-	Exponent BitAllocation     `json:"exp"`
-	Mantissa BitAllocation     `json:"man"`
+	Name  string            `json:"name"`
+	DType safetensors.DType `json:"dtype"`
+	NumEl int64             `json:"numel"` // Number of weights.
+	// Shape is the shape of the tensor as stored. It is not set by
+	// AnalyzeReader.
+	Shape  []int64 `json:"shape,omitempty"`
+	Avg    float64 `json:"avg"`
+	StdDev float64 `json:"stddev"` // Population standard deviation.
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	// P001, P50 and P999 are the 0.1th, 50th and 99.9th percentiles of the
+	// absolute values for floating point tensors. They are derived from the
+	// exponent counts so their resolution is a power of two: each is the lower
+	// bound of the binade containing the percentile, or 0 for zero and
+	// subnormal values. Infinities and NaNs are ignored.
+	P001 float64 `json:"p001"`
+	P50  float64 `json:"p50"`
+	P999 float64 `json:"p999"`
+	// MinExp and MaxExp are the smallest and largest unbiased exponents of the
+	// normal values seen in floating point tensors, e.g. to check whether the
+	// dynamic range fits F8_E4M3. Zeros, subnormals, infinities and NaNs are
+	// ignored. Both are 0 if there is no normal value.
+	MinExp  int `json:"minexp"`
+	MaxExp  int `json:"maxexp"`
+	Inf     int `json:"inf"`
+	NaN     int `json:"nan"`
+	PosInf  int `json:"posinf"`  // Breakdown of Inf.
+	NegInf  int `json:"neginf"`  // Breakdown of Inf.
+	QNaN    int `json:"qnan"`    // Breakdown of NaN; quiet NaN.
+	SNaN    int `json:"snan"`    // Breakdown of NaN; signaling NaN.
+	Flushed int `json:"flushed"` // Subnormal values flushed to zero.
+	// NoFinite is set when the tensor is not empty but every value is Inf or
+	// NaN, like in a corrupted checkpoint. Min and Max are then 0.
+	NoFinite bool `json:"nofinite,omitempty"`
+	// AllIntegral is set when every finite value of a floating point tensor is
+	// a whole number, like quantized codes stored in a float dtype. See
+	// RecommendIntDType.
+	AllIntegral bool `json:"integral,omitempty"`
+	// IsConstant is set when every value of a non-empty tensor is the same,
+	// e.g. a bias or scale tensor that could be stored as a single value.
+	IsConstant bool `json:"constant,omitempty"`
+	// Prunable is the number of finite values whose absolute value is below
+	// TensorOptions.PruneThreshold.
+	Prunable int64 `json:"prunable,omitempty"`
+	// Subnormal is the number of subnormal values, when not flushed to zero.
+	Subnormal int `json:"subnormal"`
+	// Entropy is the estimated number of bits per weight needed if the sign and
+	// exponent were entropy coded. The mantissa uses the log2 estimate of
+	// BitsActuallyUsed since only the presence of each value is tracked.
+	Entropy  float64       `json:"entropy"`
+	Sign     BitAllocation `json:"s"`
+	Exponent BitAllocation `json:"exp"`
+	Mantissa BitAllocation `json:"man"`
+	// Downcast is the error of downcasting the tensor with each rounding mode
+	// when TensorOptions.Downcast is set.
+	Downcast []DowncastError `json:"downcast,omitempty"`
+	// DowncastRMSE is the root mean square error of downcasting the finite
+	// values to each smaller dtype of BF16, F16 and F8_E4M3 when
+	// TensorOptions.DowncastErrors is set. See DowncastErrors.
+	DowncastRMSE map[safetensors.DType]float64 `json:"downcast_rmse,omitempty"`
+	// PackBits is the number of bits per weight when the tensor was analyzed
+	// with AnalyzeTensorPacked.
+	PackBits int `json:"pack_bits,omitempty"`
+	// LowMemory is set when the tensor was analyzed with
+	// TensorOptions.LowMemory, so Mantissa is a BitMaskCount.
+	LowMemory bool `json:"lowmem,omitempty"`
+	// TF32 is set when the F32 tensor was analyzed with TensorOptions.AsTF32,
+	// so Mantissa only covers the top TF32ExponentOffset bits.
+	TF32 bool `json:"tf32,omitempty"`
+	// DistinctValues is the number of distinct raw values, when the tensor was
+	// analyzed with TensorOptions.DistinctValues. Unlike the per field counts,
+	// it is the true number of different values.
+	DistinctValues int32 `json:"distinct_values,omitempty"`
+	// MantissaTrailingZeros is the number of least significant mantissa bits
+	// that are zero in every value of a floating point tensor, i.e. the number
+	// of bits that could be dropped losslessly, like a BF16 tensor upcast from
+	// F8_E4M3 has at least 4. It equals the mantissa allocation when every
+	// mantissa is zero.
+	MantissaTrailingZeros int `json:"man_trailing_zeros,omitempty"`
+	// Digest is the hex encoded digest of the raw tensor bytes with
+	// TensorOptions.Hasher when TensorOptions.Hash is set.
+	Digest string `json:"digest,omitempty"`
 }
 
 // Len returns the number of bytes this tensor occupies.
 func (a *AnalyzedTensor) Len() int64 {
+	if a.PackBits != 0 {
+		return a.NumEl * int64(a.PackBits) / 8
+	}
 	return a.NumEl * int64(a.DType.WordSize())
 }
 
+// BitsWasted returns the number of bits wasted per element, summed over the
+// sign, the exponent and the mantissa.
+func (a *AnalyzedTensor) BitsWasted() int32 {
+	return a.Sign.BitsWasted() + a.Exponent.BitsWasted() + a.Mantissa.BitsWasted()
+}
+
+// BytesWasted returns the number of bytes wasted by the tensor.
+func (a *AnalyzedTensor) BytesWasted() int64 {
+	return a.NumEl * int64(a.BitsWasted()) / 8
+}
+
+// RecommendDType returns the smallest standard floating point dtype that can
+// losslessly represent every value seen in the tensor.
+//
+// Since the exponent and the mantissa are tracked independently, it assumes
+// the worst case that every exponent seen is used with every mantissa seen.
+// It returns the original dtype if none is smaller or if the tensor is not a
+// floating point one.
+func (a *AnalyzedTensor) RecommendDType() safetensors.DType {
+	src := getFloatFormat(a.DType)
+	if src != nil && a.TF32 {
+		// Only the top bits of the mantissas were tracked.
+		src = &floatFormat{dtype: a.DType, exponentBits: src.exponentBits, mantissaBits: TF32ExponentOffset}
+	}
+	exp, ok1 := a.Exponent.(*BitKindCount)
+	man, ok2 := a.Mantissa.(*BitKindBool)
+	if src == nil || !ok1 || !ok2 {
+		return a.DType
+	}
+	for i := range floatFormats {
+		dst := &floatFormats[i]
+		if dst.dtype.WordSize() < a.DType.WordSize() && src.fits(dst, &exp.ValuesSeen, &man.ValuesSeen, a.Subnormal != 0) {
+			return dst.dtype
+		}
+	}
+	return a.DType
+}
+
+// RecommendIntDType returns the smallest integer dtype that can represent
+// every value of a floating point tensor when AllIntegral is set, otherwise an
+// empty dtype.
+//
+// Unsigned dtypes are only used when no value is negative.
+func (a *AnalyzedTensor) RecommendIntDType() safetensors.DType {
+	if !a.AllIntegral {
+		return ""
+	}
+	if a.Min >= 0 {
+		switch {
+		case a.Max <= math.MaxUint8:
+			return safetensors.U8
+		case a.Max <= math.MaxUint16:
+			return safetensors.U16
+		case a.Max <= math.MaxUint32:
+			return safetensors.U32
+		}
+		return safetensors.U64
+	}
+	switch {
+	case a.Min >= math.MinInt8 && a.Max <= math.MaxInt8:
+		return safetensors.I8
+	case a.Min >= math.MinInt16 && a.Max <= math.MaxInt16:
+		return safetensors.I16
+	case a.Min >= math.MinInt32 && a.Max <= math.MaxInt32:
+		return safetensors.I32
+	}
+	return safetensors.I64
+}
+
+// ExponentHistogram returns the number of values seen for each biased
+// exponent value. It is empty for integer tensors.
+func (a *AnalyzedTensor) ExponentHistogram() []uint64 {
+	if e, ok := a.Exponent.(*BitKindCount); ok {
+		return e.ValuesSeen.Frequencies()
+	}
+	return nil
+}
+
+// MantissaBitOccupancy returns, for each mantissa bit starting with the least
+// significant one, how often it is set.
+//
+// For floating point tensors, only the distinct mantissa values are tracked so
+// it is the number of distinct mantissa values seen with this bit set. For
+// integer tensors, it is the number of values with this bit set.
+func (a *AnalyzedTensor) MantissaBitOccupancy() []uint64 {
+	switch m := a.Mantissa.(type) {
+	case *BitKindBool:
+		out := make([]uint64, m.Allocation)
+		m.ValuesSeen.ForEachSet(func(v int) {
+			for ; v != 0; v &= v - 1 {
+				out[bits.TrailingZeros(uint(v))]++
+			}
+		})
+		return out
+	case *BitMaskCount:
+		return m.ValuesSeen.Frequencies()
+	default:
+		return nil
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// The concrete BitAllocation types are deduced from the dtype.
+func (a *AnalyzedTensor) UnmarshalJSON(data []byte) error {
+	type alias AnalyzedTensor
+	v := struct {
+		*alias
+		Sign     json.RawMessage `json:"s"`
+		Exponent json.RawMessage `json:"exp"`
+		Mantissa json.RawMessage `json:"man"`
+	}{alias: (*alias)(a)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	a.Sign = &BitKindCount{}
+	a.Exponent = &BitKindCount{}
+	if getFloatFormat(a.DType) != nil && !a.LowMemory {
+		a.Mantissa = &BitKindBool{}
+	} else if a.PackBits != 0 {
+		a.Mantissa = &BitKindCount{}
+	} else {
+		a.Mantissa = &BitMaskCount{}
+	}
+	for _, f := range [...]struct {
+		raw json.RawMessage
+		dst BitAllocation
+	}{{v.Sign, a.Sign}, {v.Exponent, a.Exponent}, {v.Mantissa, a.Mantissa}} {
+		if len(f.raw) != 0 {
+			if err := json.Unmarshal(f.raw, f.dst); err != nil {
+				return fmt.Errorf("%s: %w", a.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
 /* TODO
 // IsFloat16Compatible returns true if the tensor can be represented as float16.
 func (a *AnalyzedTensor) IsFloat16Compatible() bool {
@@ -77,7 +475,8 @@ type BitKindCount struct {
 func (b *BitKindCount) cache() {
 	if !b.initialized {
 		b.effective = b.ValuesSeen.Effective()
-		a := math.Log2(float64(b.effective))
+		// An empty tensor uses no bits, like a constant one.
+		a := math.Log2(float64(max(b.effective, 1)))
 		b.actuallyUsed = a
 		b.wasted = 0
 		if b.Allocation != 0 {
@@ -121,7 +520,8 @@ type BitKindBool struct {
 func (b *BitKindBool) cache() {
 	if !b.initialized {
 		b.effective = b.ValuesSeen.Effective()
-		a := math.Log2(float64(b.effective))
+		// An empty tensor uses no bits, like a constant one.
+		a := math.Log2(float64(max(b.effective, 1)))
 		b.actuallyUsed = a
 		b.wasted = 0
 		if b.Allocation != 0 {
@@ -196,296 +596,1550 @@ func (b *BitMaskCount) BitsWasted() int32 {
 	return b.wasted
 }
 
+// BitOccupancy returns, for each bit starting with the least significant one,
+// whether it was set in at least one value.
+func (b *BitMaskCount) BitOccupancy() []bool {
+	out := make([]bool, b.Allocation)
+	for i := range out {
+		out[i] = i < b.ValuesSeen.Len() && b.ValuesSeen.Get(i) != 0
+	}
+	return out
+}
+
 //
 
+// hostLittleEndian is true when the host byte order matches safetensors'
+// little endian data. It is a variable so tests can simulate a big endian
+// host.
+var hostLittleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// toNative returns the little endian data in the host byte order, so it can be
+// remapped with unsafe.Slice.
+//
+// It is a no-op on little endian hosts. On big endian hosts, it returns a byte
+// swapped copy.
+func toNative(data []byte, wordSize int) []byte {
+	if hostLittleEndian || wordSize == 1 {
+		return data
+	}
+	out := make([]byte, len(data))
+	for i := 0; i+wordSize <= len(data); i += wordSize {
+		for j := range wordSize {
+			out[i+j] = data[i+wordSize-1-j]
+		}
+	}
+	return out
+}
+
 var f16Lookup [1 << 16]float32
 var bf16Lookup [1 << 16]float32
 
+// f8E4M3Lookup uses the "fn" variant, which is what safetensors' F8_E4M3 is.
+var f8E4M3Lookup [1 << 8]float32
+var f8E5M2Lookup [1 << 8]float32
+
 func init() {
 	for i := range bf16Lookup {
 		f16Lookup[i] = floatx.F16(uint16(i)).Float32()
-		bf16Lookup[i] = floatx.BF16(uint16(i)).Float32()
+		// BF16 is the top half of F32. Don't use floatx.BF16, it mis-decodes
+		// subnormals.
+		bf16Lookup[i] = math.Float32frombits(uint32(i) << 16)
+	}
+	for i := range f8E4M3Lookup {
+		f8E4M3Lookup[i] = floatx.F8E4M3Fn(uint8(i)).Float32()
+		f8E5M2Lookup[i] = floatx.F8E5M2(uint8(i)).Float32()
+	}
+}
+
+// F16ToFloat32 converts the bits of a F16 value to float32 with the shared
+// lookup table, which callers can't modify.
+func F16ToFloat32(bits uint16) float32 {
+	return f16Lookup[bits]
+}
+
+// BF16ToFloat32 converts the bits of a BF16 value to float32 with the shared
+// lookup table. Unlike floatx.BF16, it decodes subnormals correctly.
+func BF16ToFloat32(bits uint16) float32 {
+	return bf16Lookup[bits]
+}
+
+// floatFormat describes a floating point encoding.
+type floatFormat struct {
+	dtype        safetensors.DType
+	exponentBits int
+	mantissaBits int
+	// finiteOnly is true when the encoding has no infinity and uses the largest
+	// exponent for normal values, like F8_E4M3.
+	finiteOnly bool
+}
+
+// floatFormats is sorted by size then by preference.
+var floatFormats = [...]floatFormat{
+	{dtype: safetensors.F8_E4M3, exponentBits: 4, mantissaBits: 3, finiteOnly: true},
+	{dtype: safetensors.F8_E5M2, exponentBits: 5, mantissaBits: 2},
+	{dtype: safetensors.F16, exponentBits: 5, mantissaBits: 10},
+	{dtype: safetensors.BF16, exponentBits: 8, mantissaBits: 7},
+	{dtype: safetensors.F32, exponentBits: 8, mantissaBits: 23},
+}
+
+func getFloatFormat(dtype safetensors.DType) *floatFormat {
+	for i := range floatFormats {
+		if floatFormats[i].dtype == dtype {
+			return &floatFormats[i]
+		}
+	}
+	return nil
+}
+
+func (f *floatFormat) bias() int {
+	return 1<<(f.exponentBits-1) - 1
+}
+
+// minExp returns the unbiased exponent of the smallest normal value.
+func (f *floatFormat) minExp() int {
+	return 1 - f.bias()
+}
+
+// maxExp returns the unbiased exponent of the largest finite value.
+func (f *floatFormat) maxExp() int {
+	if f.finiteOnly {
+		return 1<<f.exponentBits - 1 - f.bias()
+	}
+	return 1<<f.exponentBits - 2 - f.bias()
+}
+
+// fitsValue returns true if a value whose most significant bit has the
+// exponent hi and least significant bit has the exponent lo can be
+// represented exactly in f.
+func (f *floatFormat) fitsValue(hi, lo int) bool {
+	return hi <= f.maxExp() && lo >= max(hi, f.minExp())-f.mantissaBits
+}
+
+// fits returns true if every combination of the exponents and mantissas seen
+// encoded in f can be represented exactly in dst.
+//
+// When subnormal is false, a zero exponent is only used for zeros.
+func (f *floatFormat) fits(dst *floatFormat, exponents *CountSet, mantissas *BitSet, subnormal bool) bool {
+	// Number of mantissa bits used.
+	used := 0
+	mantissas.ForEachSet(func(m int) {
+		if m != 0 {
+			used = max(used, f.mantissaBits-bits.TrailingZeros(uint(m)))
+		}
+	})
+	top := 1<<f.exponentBits - 1
+	if f.finiteOnly {
+		top = -1
+	}
+	for e := range exponents.Len() {
+		if exponents.Get(e) == 0 || (e == 0 && !subnormal) {
+			continue
+		}
+		switch e {
+		case 0:
+			// Zero or subnormal.
+			ok := true
+			lo := f.minExp() - f.mantissaBits
+			mantissas.ForEachSet(func(m int) {
+				if m != 0 && !dst.fitsValue(lo+bits.Len(uint(m))-1, lo+bits.TrailingZeros(uint(m))) {
+					ok = false
+				}
+			})
+			if !ok {
+				return false
+			}
+		case top:
+			// Infinity or NaN.
+			if dst.finiteOnly {
+				return false
+			}
+		default:
+			hi := e - f.bias()
+			if !dst.fitsValue(hi, hi-used) {
+				return false
+			}
+			if dst.finiteOnly && hi == dst.maxExp() && used == dst.mantissaBits {
+				// The all ones mantissa is NaN.
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stdDev returns the population standard deviation from a sum and a sum of
+// squares.
+func stdDev(total, sumSq float64, n int64) float64 {
+	if n == 0 {
+		return 0
+	}
+	avg := total / float64(n)
+	// Clamp the rounding error when all the values are equal.
+	return math.Sqrt(max(0, sumSq/float64(n)-avg*avg))
+}
+
+// exponentRange returns the smallest and largest unbiased exponents of the
+// normal values from the exponent counts.
+func exponentRange(exponents []uint64, exponentBits int32, finiteOnly bool) (int, int) {
+	bias := 1<<(exponentBits-1) - 1
+	last := len(exponents) - 1
+	if !finiteOnly {
+		// Skip infinities and NaNs.
+		last--
+	}
+	lo, hi := 0, -1
+	// Skip zeros and subnormals.
+	for e := 1; e <= last; e++ {
+		if exponents[e] != 0 {
+			if hi == -1 {
+				lo = e
+			}
+			hi = e
+		}
+	}
+	if hi == -1 {
+		return 0, 0
+	}
+	return lo - bias, hi - bias
+}
+
+// absPercentile returns the approximate p quantile of the finite absolute
+// values of a floating point tensor from its exponent counts.
+//
+// It returns the lower bound of the binade containing the quantile.
+//
+// finiteOnly must be set for formats like F8_E4M3 that use the all ones
+// exponent for normal values.
+func absPercentile(exponents []uint64, exponentBits int32, finiteOnly bool, p float64) float64 {
+	// Skip infinities and NaNs.
+	maxExp := 1<<exponentBits - 1
+	if !finiteOnly && len(exponents) > maxExp {
+		exponents = exponents[:maxExp]
+	}
+	n := uint64(0)
+	for _, c := range exponents {
+		n += c
+	}
+	if n == 0 {
+		return 0
+	}
+	target := max(1, uint64(math.Ceil(p*float64(n))))
+	bias := 1<<(exponentBits-1) - 1
+	seen := uint64(0)
+	for e, c := range exponents {
+		if seen += c; seen >= target {
+			if e == 0 {
+				return 0
+			}
+			return math.Ldexp(1, e-bias)
+		}
+	}
+	return 0
+}
+
+// log2 returns the number of bits needed to represent n different values.
+func log2(n int32) float64 {
+	if n == 0 {
+		return 0
+	}
+	return math.Log2(float64(n))
+}
+
+// dtypeAliases maps the lower case dtype names found in the wild to the
+// canonical dtype.
+var dtypeAliases = map[string]safetensors.DType{
+	"bfloat16":      safetensors.BF16,
+	"float16":       safetensors.F16,
+	"half":          safetensors.F16,
+	"fp16":          safetensors.F16,
+	"float32":       safetensors.F32,
+	"float":         safetensors.F32,
+	"fp32":          safetensors.F32,
+	"int16":         safetensors.I16,
+	"short":         safetensors.I16,
+	"uint16":        safetensors.U16,
+	"int32":         safetensors.I32,
+	"uint32":        safetensors.U32,
+	"float8_e4m3fn": safetensors.F8_E4M3,
+	"float8_e5m2":   safetensors.F8_E5M2,
+	"fp8_e4m3":      safetensors.F8_E4M3,
+	"fp8_e5m2":      safetensors.F8_E5M2,
+}
+
+// normalizeDType maps known dtype aliases, like "bfloat16" or "bf16", to the
+// canonical dtype. Unknown dtypes are returned as is.
+func normalizeDType(name string, dtype safetensors.DType) safetensors.DType {
+	if _, ok := safetensors.DTypeToWordSize[dtype]; ok {
+		return dtype
+	}
+	// PyTorch names are commonly used as is.
+	l := strings.TrimPrefix(strings.ToLower(string(dtype)), "torch.")
+	d, ok := dtypeAliases[l]
+	if !ok {
+		d = safetensors.DType(strings.ToUpper(l))
+		if _, ok = safetensors.DTypeToWordSize[d]; !ok {
+			return dtype
+		}
+	}
+	slog.Debug("n_bits", "tensor", name, "dtype", string(dtype), "canonical", string(d))
+	return d
+}
+
+// histogram accumulates the bit usage and stats of a tensor.
+//
+// Data can be fed in multiple chunks; the result is the same as if all the
+// data had been processed at once.
+type histogram interface {
+	// add processes the data. Its length must be a multiple of the word size.
+	add(data []byte)
+	// analyzed returns the stats accumulated so far.
+	analyzed(name string) AnalyzedTensor
+	// merge adds the stats accumulated by other, which must be of the same
+	// type.
+	merge(other histogram)
+	// sums returns the floating point sums accumulated by add, so they can be
+	// accumulated in blocks. See blockAdder.
+	sums() []*float64
+}
+
+// analyzed returns the stats of h. An empty tensor has its Avg, Min and Max
+// set to 0 instead of NaN and the initial sentinel values. Same for Min and
+// Max when no value is finite.
+func analyzed(h histogram, name string) AnalyzedTensor {
+	a := h.analyzed(name)
+	if a.NumEl == 0 {
+		a.Avg, a.Min, a.Max = 0, 0, 0
+	} else if int64(a.Inf+a.NaN) == a.NumEl {
+		slog.Warn("n_bits", "tensor", name, "message", "no finite value", "inf", a.Inf, "nan", a.NaN)
+		a.Min, a.Max = 0, 0
+		a.NoFinite = true
+	}
+	a.IsConstant = isConstant(&a)
+	return a
+}
+
+// isConstant returns true if every value of the tensor is the same.
+//
+// For floating point tensors, the sign, exponent and mantissa must each have a
+// single distinct value, so +0 and -0 differ. Integer tensors only track the
+// bits used, so it relies on Min and Max.
+func isConstant(a *AnalyzedTensor) bool {
+	if a.NumEl == 0 {
+		return false
+	}
+	man, ok := a.Mantissa.(*BitKindBool)
+	if !ok {
+		return a.Min == a.Max
+	}
+	sign, ok1 := a.Sign.(*BitKindCount)
+	exp, ok2 := a.Exponent.(*BitKindCount)
+	return ok1 && ok2 && sign.ValuesSeen.Effective() == 1 && exp.ValuesSeen.Effective() == 1 && man.ValuesSeen.Effective() == 1
+}
+
+// newHistogram returns the histogram for the dtype.
+func newHistogram(name string, dtype safetensors.DType, opts *TensorOptions) (histogram, error) {
+	if opts.Downcast != "" && getFloatFormat(opts.Downcast) == nil {
+		return nil, fmt.Errorf("%s: can't simulate downcast to %s", name, opts.Downcast)
+	}
+	switch dtype {
+	case safetensors.F8_E4M3:
+		return newF8Histogram(opts, safetensors.F8_E4M3, &f8E4M3Lookup), nil
+	case safetensors.F8_E5M2:
+		return newF8Histogram(opts, safetensors.F8_E5M2, &f8E5M2Lookup), nil
+	case safetensors.F16:
+		return newF16Histogram(opts), nil
+	case safetensors.BF16:
+		return newBF16Histogram(opts), nil
+	case safetensors.F32:
+		return newF32Histogram(opts), nil
+	case safetensors.I16:
+		return newI16Histogram(), nil
+	case safetensors.U16:
+		return newU16Histogram(), nil
+	case safetensors.I32:
+		// Used in AWQ and GPTQ.
+		return newI32Histogram(), nil
+	case safetensors.U32:
+		// Used in MLX.
+		return newU32Histogram(), nil
+	default:
+		return nil, fmt.Errorf("%s: %w", name, &UnsupportedDTypeError{DType: dtype})
+	}
+}
+
+// floatHistogram is the common state of the floating point histograms.
+type floatHistogram struct {
+	signs     CountSet
+	exponents CountSet
+	mantissas BitSet
+	// lowmem counts how often each mantissa bit is set in manBits instead of
+	// tracking every distinct mantissa in mantissas.
+	lowmem  bool
+	manBits [23]uint64
+	// manUsed is the union of the mantissa bits set in any value.
+	manUsed uint32
+	// distinct tracks every raw value seen, for dtypes of 16 bits or less with
+	// TensorOptions.DistinctValues.
+	distinct  *BitSet
+	numEl     int64
+	min       float64
+	max       float64
+	total     float64
+	sumSq     float64
+	inf       int
+	nan       int
+	posInf    int
+	negInf    int
+	qnan      int
+	snan      int
+	flushed   int
+	subnormal int
+	ftz       bool
+	downcast  *downcaster
+	rmse      *rmser
+	prune     float64
+	prunable  int64
+	// fractional is set once a finite value is not a whole number.
+	fractional bool
+}
+
+func (h *floatHistogram) init(opts *TensorOptions, exponentBits, mantissaBits int) {
+	h.ftz = opts.FlushToZero
+	h.signs.Resize(1 << 1)
+	h.exponents.Resize(1 << exponentBits)
+	// The mantissa BitSet is only large for F16 and F32.
+	if h.lowmem = opts.LowMemory && mantissaBits > 8; !h.lowmem {
+		h.mantissas.Resize(1 << mantissaBits)
+	}
+	if width := 1 + exponentBits + mantissaBits; opts.DistinctValues && width <= 16 {
+		h.distinct = &BitSet{}
+		h.distinct.Resize(1 << width)
+	}
+	h.min = math.MaxFloat32
+	h.max = -math.MaxFloat32
+	if opts.Downcast != "" {
+		h.downcast = &downcaster{target: getFloatFormat(opts.Downcast)}
+	}
+	if opts.DowncastErrors {
+		h.rmse = &rmser{}
+	}
+	h.prune = opts.PruneThreshold
+}
+
+func (h *floatHistogram) analyzedFloat(name string, dtype safetensors.DType, exponentBits, mantissaBits int32) AnalyzedTensor {
+	var downcast []DowncastError
+	if h.downcast != nil {
+		downcast = h.downcast.errors()
+	}
+	var rmse map[safetensors.DType]float64
+	if h.rmse != nil {
+		rmse = h.rmse.errors(dtype)
+	}
+	exp := h.exponents.Frequencies()
+	finiteOnly := getFloatFormat(dtype).finiteOnly
+	minExp, maxExp := exponentRange(exp, exponentBits, finiteOnly)
+	var mantissa BitAllocation = &BitKindBool{Allocation: mantissaBits, ValuesSeen: h.mantissas}
+	manEntropy := log2(h.mantissas.Effective())
+	if h.lowmem {
+		m := &BitMaskCount{Allocation: mantissaBits, ValuesSeen: CountSet{Wide: slices.Clone(h.manBits[:mantissaBits])}}
+		mantissa = m
+		// Only the bits used are known; assume every combination of them is.
+		manEntropy = m.BitsActuallyUsed()
+	}
+	distinct := int32(0)
+	if h.distinct != nil {
+		distinct = h.distinct.Effective()
+	}
+	trailing := 0
+	if h.numEl != 0 {
+		trailing = min(bits.TrailingZeros32(h.manUsed), int(mantissaBits))
+	}
+	return AnalyzedTensor{
+		Name:                  name,
+		DType:                 dtype,
+		NumEl:                 h.numEl,
+		Avg:                   h.total / float64(h.numEl),
+		StdDev:                stdDev(h.total, h.sumSq, h.numEl),
+		Min:                   h.min,
+		Max:                   h.max,
+		P001:                  absPercentile(exp, exponentBits, finiteOnly, 0.001),
+		P50:                   absPercentile(exp, exponentBits, finiteOnly, 0.5),
+		P999:                  absPercentile(exp, exponentBits, finiteOnly, 0.999),
+		MinExp:                minExp,
+		MaxExp:                maxExp,
+		Inf:                   h.inf,
+		NaN:                   h.nan,
+		PosInf:                h.posInf,
+		NegInf:                h.negInf,
+		QNaN:                  h.qnan,
+		SNaN:                  h.snan,
+		Flushed:               h.flushed,
+		Subnormal:             h.subnormal,
+		Prunable:              h.prunable,
+		Entropy:               h.signs.Entropy() + h.exponents.Entropy() + manEntropy,
+		Sign:                  &BitKindCount{Allocation: 1, ValuesSeen: h.signs},
+		Exponent:              &BitKindCount{Allocation: exponentBits, ValuesSeen: h.exponents},
+		Mantissa:              mantissa,
+		Downcast:              downcast,
+		DowncastRMSE:          rmse,
+		LowMemory:             h.lowmem,
+		DistinctValues:        distinct,
+		MantissaTrailingZeros: trailing,
+		AllIntegral:           !h.fractional && h.numEl > int64(h.inf+h.nan),
+	}
+}
+
+func (h *floatHistogram) sums() []*float64 {
+	out := []*float64{&h.total, &h.sumSq}
+	if h.downcast != nil {
+		out = append(out, h.downcast.sums()...)
+	}
+	if h.rmse != nil {
+		out = append(out, h.rmse.sums()...)
+	}
+	return out
+}
+
+func (h *floatHistogram) mergeFloat(o *floatHistogram) {
+	h.signs.Merge(&o.signs)
+	h.exponents.Merge(&o.exponents)
+	h.mantissas.Union(&o.mantissas)
+	if h.distinct != nil {
+		h.distinct.Union(o.distinct)
+	}
+	for i := range h.manBits {
+		h.manBits[i] += o.manBits[i]
+	}
+	h.manUsed |= o.manUsed
+	h.numEl += o.numEl
+	h.min = min(h.min, o.min)
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sumSq += o.sumSq
+	h.inf += o.inf
+	h.nan += o.nan
+	h.posInf += o.posInf
+	h.negInf += o.negInf
+	h.qnan += o.qnan
+	h.snan += o.snan
+	h.flushed += o.flushed
+	h.subnormal += o.subnormal
+	h.prunable += o.prunable
+	h.fractional = h.fractional || o.fractional
+	if h.downcast != nil {
+		h.downcast.merge(o.downcast)
+	}
+	if h.rmse != nil {
+		h.rmse.merge(o.rmse)
+	}
+}
+
+// addMantissa records the mantissa of a value.
+func (h *floatHistogram) addMantissa(m uint32) {
+	h.manUsed |= m
+	if !h.lowmem {
+		h.mantissas.Set(int(m))
+		return
+	}
+	for ; m != 0; m &= m - 1 {
+		h.manBits[bits.TrailingZeros32(m)]++
+	}
+}
+
+// addValue records the raw bits of a value when counting the distinct values.
+func (h *floatHistogram) addValue(v uint16) {
+	if h.distinct != nil {
+		h.distinct.Set(int(v))
+	}
+}
+
+// addNaN counts a NaN. quiet is the most significant bit of the mantissa.
+func (h *floatHistogram) addNaN(quiet bool) {
+	h.nan++
+	if quiet {
+		h.qnan++
+	} else {
+		h.snan++
+	}
+}
+
+// addInf counts an infinity.
+func (h *floatHistogram) addInf(positive bool) {
+	h.inf++
+	if positive {
+		h.posInf++
+	} else {
+		h.negInf++
+	}
+}
+
+// f8Histogram calculates the actual use of sign, exponent and mantissa bits
+// plus floating point stats for the float8 dtypes.
+type f8Histogram struct {
+	floatHistogram
+	format *floatFormat
+	lookup *[1 << 8]float32
+}
+
+func newF8Histogram(opts *TensorOptions, dtype safetensors.DType, lookup *[1 << 8]float32) *f8Histogram {
+	h := &f8Histogram{format: getFloatFormat(dtype), lookup: lookup}
+	h.init(opts, h.format.exponentBits, h.format.mantissaBits)
+	return h
+}
+
+func (h *f8Histogram) add(data []byte) {
+	h.numEl += int64(len(data))
+	mantissaBits := uint(h.format.mantissaBits)
+	exponentMask := uint8(1<<h.format.exponentBits - 1)
+	mantissaMask := uint8(1<<mantissaBits - 1)
+	for _, b := range data {
+		sign := b >> 7
+		exponent := (b >> mantissaBits) & exponentMask
+		mantissa := b & mantissaMask
+		if exponent == 0 && mantissa != 0 {
+			if h.ftz {
+				// Keep the sign.
+				b &= 1 << 7
+				mantissa = 0
+				h.flushed++
+			} else {
+				h.subnormal++
+			}
+		}
+		h.signs.Add(int(sign))
+		h.exponents.Add(int(exponent))
+		h.addMantissa(uint32(mantissa))
+		h.addValue(uint16(b))
+		if v := float64(h.lookup[b]); math.IsNaN(v) {
+			h.addNaN(mantissa>>(mantissaBits-1) != 0)
+		} else if math.IsInf(v, 0) {
+			h.addInf(v > 0)
+		} else {
+			h.total += v
+			h.sumSq += v * v
+			if v < h.min {
+				h.min = v
+			}
+			if v > h.max {
+				h.max = v
+			}
+			if h.downcast != nil {
+				h.downcast.add(v)
+			}
+			if h.rmse != nil {
+				h.rmse.add(v)
+			}
+			if math.Abs(v) < h.prune {
+				h.prunable++
+			}
+			if v != math.Trunc(v) {
+				h.fractional = true
+			}
+		}
 	}
 }
 
-// calcF16HistogramAndStats calculates the actual use of sign, exponent and
-// mantissa bits plus floating point stats.
-func calcF16HistogramAndStats(t safetensors.Tensor) (CountSet, CountSet, BitSet, float64, float64, float64, int, int) {
-	var signs, exponents CountSet
-	signs.Resize(1 << 1)
-	exponents.Resize(1 << (floatx.F16SignOffset - floatx.F16ExponentOffset))
-	var mantissas BitSet
-	mantissas.Resize(1 << floatx.F16ExponentOffset)
-	min := math.MaxFloat32
-	max := -math.MaxFloat32
-	total := 0.
-	inf := 0
-	nan := 0
+func (h *f8Histogram) merge(other histogram) {
+	h.mergeFloat(&other.(*f8Histogram).floatHistogram)
+}
+
+func (h *f8Histogram) analyzed(name string) AnalyzedTensor {
+	return h.analyzedFloat(name, h.format.dtype, int32(h.format.exponentBits), int32(h.format.mantissaBits))
+}
+
+// f16Histogram calculates the actual use of sign, exponent and mantissa bits
+// plus floating point stats.
+type f16Histogram struct {
+	floatHistogram
+}
+
+func newF16Histogram(opts *TensorOptions) *f16Histogram {
+	h := &f16Histogram{}
+	h.init(opts, floatx.F16SignOffset-floatx.F16ExponentOffset, floatx.F16ExponentOffset)
+	return h
+}
 
+func (h *f16Histogram) add(data []byte) {
+	data = toNative(data, int(safetensors.F16.WordSize()))
 	// Remapping the slice gives a significant performance boost (10%).
 	// #nosec G103
-	mapped := unsafe.Slice((*floatx.F16)(unsafe.Pointer(unsafe.SliceData(t.Data))), len(t.Data)/int(safetensors.F16.WordSize()))
-	numEl := len(mapped)
+	mapped := unsafe.Slice((*floatx.F16)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.F16.WordSize()))
+	h.numEl += int64(len(mapped))
 	for _, bf := range mapped {
 		sign, exponent, mantissa := bf.Components()
-		signs.Add(int(sign))
-		exponents.Add(int(exponent))
-		mantissas.Set(int(mantissa))
+		if exponent == 0 && mantissa != 0 {
+			if h.ftz {
+				// Keep the sign.
+				bf &= 1 << floatx.F16SignOffset
+				mantissa = 0
+				h.flushed++
+			} else {
+				h.subnormal++
+			}
+		}
+		h.signs.Add(int(sign))
+		h.exponents.Add(int(exponent))
+		h.addMantissa(uint32(mantissa))
+		h.addValue(uint16(bf))
 		// The lookup gives a small performance improvement (2%) over f.Float32().
 		// Consider anything in the 1e37 range infinity.
 		if v := float64(f16Lookup[bf]); math.IsNaN(v) {
-			nan++
+			h.addNaN(mantissa>>(floatx.F16ExponentOffset-1) != 0)
 		} else if math.IsInf(v, 0) || v < -1e37 && v > 1e37 {
-			inf++
+			h.addInf(v > 0)
 		} else {
-			total += v
-			if v < min {
-				min = v
+			h.total += v
+			h.sumSq += v * v
+			if v < h.min {
+				h.min = v
+			}
+			if v > h.max {
+				h.max = v
 			}
-			if v > max {
-				max = v
+			if h.downcast != nil {
+				h.downcast.add(v)
+			}
+			if h.rmse != nil {
+				h.rmse.add(v)
+			}
+			if math.Abs(v) < h.prune {
+				h.prunable++
+			}
+			if v != math.Trunc(v) {
+				h.fractional = true
 			}
 		}
 	}
-	return signs, exponents, mantissas, total / float64(numEl), min, max, inf, nan
 }
 
-// calcBF16HistogramAndStats calculates the actual use of sign, exponent and
-// mantissa bits plus floating point stats.
-func calcBF16HistogramAndStats(t safetensors.Tensor) (CountSet, CountSet, BitSet, float64, float64, float64, int, int) {
-	var signs, exponents CountSet
-	signs.Resize(1 << 1)
-	exponents.Resize(1 << (floatx.BF16SignOffset - floatx.BF16ExponentOffset))
-	var mantissas BitSet
-	mantissas.Resize(1 << floatx.BF16ExponentOffset)
-	min := math.MaxFloat32
-	max := -math.MaxFloat32
-	total := 0.
-	inf := 0
-	nan := 0
+func (h *f16Histogram) merge(other histogram) {
+	h.mergeFloat(&other.(*f16Histogram).floatHistogram)
+}
+
+func (h *f16Histogram) analyzed(name string) AnalyzedTensor {
+	return h.analyzedFloat(name, safetensors.F16, 5, 10)
+}
+
+// bf16Histogram calculates the actual use of sign, exponent and mantissa bits
+// plus floating point stats.
+type bf16Histogram struct {
+	floatHistogram
+}
+
+func newBF16Histogram(opts *TensorOptions) *bf16Histogram {
+	h := &bf16Histogram{}
+	h.init(opts, floatx.BF16SignOffset-floatx.BF16ExponentOffset, floatx.BF16ExponentOffset)
+	return h
+}
 
+func (h *bf16Histogram) add(data []byte) {
+	data = toNative(data, int(safetensors.BF16.WordSize()))
 	// Remapping the slice gives a significant performance boost (10%).
 	// #nosec G103
-	mapped := unsafe.Slice((*floatx.BF16)(unsafe.Pointer(unsafe.SliceData(t.Data))), len(t.Data)/int(safetensors.BF16.WordSize()))
-	numEl := len(mapped)
+	mapped := unsafe.Slice((*floatx.BF16)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.BF16.WordSize()))
+	h.numEl += int64(len(mapped))
 	for _, bf := range mapped {
 		sign, exponent, mantissa := bf.Components()
-		signs.Add(int(sign))
-		exponents.Add(int(exponent))
-		mantissas.Set(int(mantissa))
+		if exponent == 0 && mantissa != 0 {
+			if h.ftz {
+				// Keep the sign.
+				bf &= 1 << floatx.BF16SignOffset
+				mantissa = 0
+				h.flushed++
+			} else {
+				h.subnormal++
+			}
+		}
+		h.signs.Add(int(sign))
+		h.exponents.Add(int(exponent))
+		h.addMantissa(uint32(mantissa))
+		h.addValue(uint16(bf))
 		// The lookup gives a small performance improvement (2%) over bf.Float32().
 		// Consider anything in the 1e37 range infinity. This is necessary for Mistral-7B-v0.3.
 		if v := float64(bf16Lookup[bf]); math.IsNaN(v) {
-			nan++
+			h.addNaN(mantissa>>(floatx.BF16ExponentOffset-1) != 0)
 		} else if math.IsInf(v, 0) || v < -1e37 || v > 1e37 {
-			inf++
+			h.addInf(v > 0)
 		} else {
-			total += v
-			if v < min {
-				min = v
+			h.total += v
+			h.sumSq += v * v
+			if v < h.min {
+				h.min = v
+			}
+			if v > h.max {
+				h.max = v
+			}
+			if h.downcast != nil {
+				h.downcast.add(v)
 			}
-			if v > max {
-				max = v
+			if h.rmse != nil {
+				h.rmse.add(v)
+			}
+			if math.Abs(v) < h.prune {
+				h.prunable++
+			}
+			if v != math.Trunc(v) {
+				h.fractional = true
 			}
 		}
 	}
-	return signs, exponents, mantissas, total / float64(numEl), min, max, inf, nan
 }
 
-// calcF32HistogramAndStats calculates the actual use of sign, exponent and
-// mantissa bits plus floating point stats.
-func calcF32HistogramAndStats(t safetensors.Tensor) (CountSet, CountSet, BitSet, float64, float64, float64, int, int) {
-	var signs, exponents CountSet
-	signs.Resize(1 << 1)
-	exponents.Resize(1 << (floatx.F32SignOffset - floatx.F32ExponentOffset))
-	var mantissas BitSet
-	mantissas.Resize(1 << floatx.F32ExponentOffset)
-	min := math.MaxFloat32
-	max := -math.MaxFloat32
-	total := 0.
-	inf := 0
-	nan := 0
+func (h *bf16Histogram) merge(other histogram) {
+	h.mergeFloat(&other.(*bf16Histogram).floatHistogram)
+}
+
+func (h *bf16Histogram) analyzed(name string) AnalyzedTensor {
+	return h.analyzedFloat(name, safetensors.BF16, 8, 7)
+}
+
+// NVIDIA TensorFloat-32 has the 8 bits exponent of F32 and the 10 bits
+// mantissa of F16, in 19 bits stored in 32 bits. The offsets are like the ones
+// of floatx, which has no TF32 type.
+const (
+	TF32SignOffset     = 18
+	TF32ExponentOffset = 10
+)
+
+// tf32Shift is the number of low F32 mantissa bits ignored by TF32.
+const tf32Shift = floatx.F32ExponentOffset - TF32ExponentOffset
+
+// f32Histogram calculates the actual use of sign, exponent and mantissa bits
+// plus floating point stats.
+type f32Histogram struct {
+	floatHistogram
+	// tf32 only tracks the top TF32ExponentOffset bits of the mantissa.
+	tf32 bool
+}
+
+func newF32Histogram(opts *TensorOptions) *f32Histogram {
+	h := &f32Histogram{tf32: opts.AsTF32}
+	if h.tf32 {
+		h.init(opts, TF32SignOffset-TF32ExponentOffset, TF32ExponentOffset)
+	} else {
+		h.init(opts, floatx.F32SignOffset-floatx.F32ExponentOffset, floatx.F32ExponentOffset)
+	}
+	return h
+}
 
+func (h *f32Histogram) add(data []byte) {
+	data = toNative(data, int(safetensors.F32.WordSize()))
 	// Remapping the slice gives a significant performance boost (10%).
 	// #nosec G103
-	mapped := unsafe.Slice((*float32)(unsafe.Pointer(unsafe.SliceData(t.Data))), len(t.Data)/int(safetensors.F32.WordSize()))
-	numEl := len(mapped)
+	mapped := unsafe.Slice((*floatx.F32)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.F32.WordSize()))
+	h.numEl += int64(len(mapped))
+	// Computing min, max and the sums in a separate tight loop is a third
+	// slower, see addTwoPass and BenchmarkF32Histogram_Add: the Go compiler
+	// doesn't auto-vectorize it, so the second pass over the data only adds
+	// cost.
 	for _, f := range mapped {
-		b := math.Float32bits(f)
-		sign := b >> floatx.F32SignOffset
-		exponent := (b >> floatx.F32ExponentOffset) & floatx.F32ExponentMask
-		mantissa := b & floatx.F32MantissaMask
-		signs.Add(int(sign))
-		exponents.Add(int(exponent))
-		mantissas.Set(int(mantissa))
+		sign, exponent, mantissa := f.Components()
+		if exponent == 0 && mantissa != 0 {
+			if h.ftz {
+				// Keep the sign.
+				f = floatx.F32(math.Float32frombits(uint32(sign) << floatx.F32SignOffset))
+				mantissa = 0
+				h.flushed++
+			} else {
+				h.subnormal++
+			}
+		}
+		h.signs.Add(int(sign))
+		h.exponents.Add(int(exponent))
+		if h.tf32 {
+			h.addMantissa(uint32(mantissa) >> tf32Shift)
+		} else {
+			h.addMantissa(uint32(mantissa))
+		}
 		// Consider anything in the 1e37 range infinity.
 		if v := float64(f); math.IsNaN(v) {
-			nan++
+			h.addNaN(mantissa>>(floatx.F32ExponentOffset-1) != 0)
 		} else if math.IsInf(v, 0) || v < -1e37 || v > 1e37 {
-			inf++
+			h.addInf(v > 0)
 		} else {
-			if v < min {
-				min = v
+			h.total += v
+			h.sumSq += v * v
+			if v < h.min {
+				h.min = v
+			}
+			if v > h.max {
+				h.max = v
+			}
+			if h.downcast != nil {
+				h.downcast.add(v)
+			}
+			if h.rmse != nil {
+				h.rmse.add(v)
 			}
-			if v > max {
-				max = v
+			if math.Abs(v) < h.prune {
+				h.prunable++
+			}
+			if v != math.Trunc(v) {
+				h.fractional = true
 			}
 		}
 	}
-	return signs, exponents, mantissas, total / float64(numEl), min, max, inf, nan
 }
 
-// calcI32HistogramAndStats calculates the actual use of sign and mantissa bits
-// plus stats.
+func (h *f32Histogram) merge(other histogram) {
+	h.mergeFloat(&other.(*f32Histogram).floatHistogram)
+}
+
+func (h *f32Histogram) analyzed(name string) AnalyzedTensor {
+	if h.tf32 {
+		a := h.analyzedFloat(name, safetensors.F32, 8, TF32ExponentOffset)
+		a.TF32 = true
+		return a
+	}
+	return h.analyzedFloat(name, safetensors.F32, 8, 23)
+}
+
+// i32Histogram calculates the actual use of sign and mantissa bits plus stats.
 //
 // It does a very simplified analysis for now due to memory usage concern.
-func calcI32HistogramAndStats(t safetensors.Tensor) (CountSet, CountSet, float64, int32, int32) {
-	var min int32 = math.MaxInt32
-	var max int32 = math.MinInt32
-	var total int64
-	signs := CountSet{}
-	signs.Resize(1 << 1)
-	mantissas := CountSet{}
-	mantissas.Resize(31)
+type i32Histogram struct {
+	signs     CountSet
+	mantissas CountSet
+	numEl     int64
+	min       int32
+	max       int32
+	total     int64
+	sumSq     float64
+}
+
+func newI32Histogram() *i32Histogram {
+	h := &i32Histogram{min: math.MaxInt32, max: math.MinInt32}
+	h.signs.Resize(1 << 1)
+	h.mantissas.Resize(31)
+	return h
+}
+
+func (h *i32Histogram) add(data []byte) {
+	data = toNative(data, int(safetensors.I32.WordSize()))
 	// #nosec G103
-	mapped := unsafe.Slice((*int32)(unsafe.Pointer(unsafe.SliceData(t.Data))), len(t.Data)/int(safetensors.I32.WordSize()))
-	numEl := len(mapped)
+	mapped := unsafe.Slice((*int32)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.I32.WordSize()))
+	h.numEl += int64(len(mapped))
 	for _, i := range mapped {
-		signs.Add(int(uint32(i) >> 31))
+		h.signs.Add(int(uint32(i) >> 31))
 		for j := range 31 {
 			if i&(1<<j) != 0 {
-				mantissas.Add(j)
+				h.mantissas.Add(j)
 			}
 		}
-		total += int64(i)
-		if i < min {
-			min = i
+		h.total += int64(i)
+		h.sumSq += float64(i) * float64(i)
+		if i < h.min {
+			h.min = i
 		}
-		if i > max {
-			max = i
+		if i > h.max {
+			h.max = i
 		}
 	}
-	avg := float64(total) / float64(numEl)
-	return signs, mantissas, avg, min, max
 }
 
-// calcU32HistogramAndStats calculates the actual use of sign and mantissa bits
-// plus stats.
+func (h *i32Histogram) merge(other histogram) {
+	o := other.(*i32Histogram)
+	h.signs.Merge(&o.signs)
+	h.mantissas.Merge(&o.mantissas)
+	h.numEl += o.numEl
+	h.min = min(h.min, o.min)
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sumSq += o.sumSq
+}
+
+func (h *i32Histogram) sums() []*float64 {
+	return []*float64{&h.sumSq}
+}
+
+func (h *i32Histogram) analyzed(name string) AnalyzedTensor {
+	return AnalyzedTensor{
+		Name:     name,
+		DType:    safetensors.I32,
+		NumEl:    h.numEl,
+		Avg:      float64(h.total) / float64(h.numEl),
+		StdDev:   stdDev(float64(h.total), h.sumSq, h.numEl),
+		Min:      float64(h.min),
+		Max:      float64(h.max),
+		Inf:      0,
+		NaN:      0,
+		Entropy:  h.signs.Entropy() + float64(h.mantissas.Effective()),
+		Sign:     &BitKindCount{Allocation: 1, ValuesSeen: h.signs},
+		Exponent: &BitKindCount{Allocation: 0},
+		Mantissa: &BitMaskCount{Allocation: 31, ValuesSeen: h.mantissas},
+	}
+}
+
+// u32Histogram calculates the actual use of mantissa bits plus stats.
 //
 // It does a very simplified analysis for now due to memory usage concern.
-func calcU32HistogramAndStats(t safetensors.Tensor) (CountSet, float64, uint32, uint32) {
-	var min uint32 = math.MaxUint32
-	var max uint32 = 0
-	var total uint64
-	mantissas := CountSet{}
-	mantissas.Resize(32)
+type u32Histogram struct {
+	mantissas CountSet
+	numEl     int64
+	min       uint32
+	max       uint32
+	total     uint64
+	sumSq     float64
+}
+
+func newU32Histogram() *u32Histogram {
+	h := &u32Histogram{min: math.MaxUint32}
+	h.mantissas.Resize(32)
+	return h
+}
+
+func (h *u32Histogram) add(data []byte) {
+	data = toNative(data, int(safetensors.U32.WordSize()))
 	// #nosec G103
-	mapped := unsafe.Slice((*uint32)(unsafe.Pointer(unsafe.SliceData(t.Data))), len(t.Data)/int(safetensors.U32.WordSize()))
-	numEl := len(mapped)
+	mapped := unsafe.Slice((*uint32)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.U32.WordSize()))
+	h.numEl += int64(len(mapped))
 	for _, i := range mapped {
 		for j := range 32 {
 			if i&(1<<j) != 0 {
-				mantissas.Add(j)
+				h.mantissas.Add(j)
 			}
 		}
-		total += uint64(i)
-		if i < min {
-			min = i
+		h.total += uint64(i)
+		h.sumSq += float64(i) * float64(i)
+		if i < h.min {
+			h.min = i
 		}
-		if i > max {
-			max = i
+		if i > h.max {
+			h.max = i
 		}
 	}
-	avg := float64(total) / float64(numEl)
-	return mantissas, avg, min, max
+}
+
+func (h *u32Histogram) merge(other histogram) {
+	o := other.(*u32Histogram)
+	h.mantissas.Merge(&o.mantissas)
+	h.numEl += o.numEl
+	h.min = min(h.min, o.min)
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sumSq += o.sumSq
+}
+
+func (h *u32Histogram) sums() []*float64 {
+	return []*float64{&h.sumSq}
+}
+
+func (h *u32Histogram) analyzed(name string) AnalyzedTensor {
+	return AnalyzedTensor{
+		Name:     name,
+		DType:    safetensors.U32,
+		NumEl:    h.numEl,
+		Avg:      float64(h.total) / float64(h.numEl),
+		StdDev:   stdDev(float64(h.total), h.sumSq, h.numEl),
+		Min:      float64(h.min),
+		Max:      float64(h.max),
+		Inf:      0,
+		NaN:      0,
+		Entropy:  float64(h.mantissas.Effective()),
+		Sign:     &BitKindCount{Allocation: 0},
+		Exponent: &BitKindCount{Allocation: 0},
+		Mantissa: &BitMaskCount{Allocation: 32, ValuesSeen: h.mantissas},
+	}
+}
+
+// i16Histogram calculates the actual use of sign and mantissa bits plus
+// stats.
+//
+// Contrary to i32Histogram, every value is tracked since it's only 64KiB, so
+// the entropy is exact.
+type i16Histogram struct {
+	signs     CountSet
+	mantissas CountSet
+	values    CountSet
+	numEl     int64
+	min       int16
+	max       int16
+	total     int64
+	sumSq     float64
+}
+
+func newI16Histogram() *i16Histogram {
+	h := &i16Histogram{min: math.MaxInt16, max: math.MinInt16}
+	h.signs.Resize(1 << 1)
+	h.mantissas.Resize(15)
+	h.values.Resize(1 << 16)
+	return h
+}
+
+func (h *i16Histogram) add(data []byte) {
+	data = toNative(data, int(safetensors.I16.WordSize()))
+	// #nosec G103
+	mapped := unsafe.Slice((*int16)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.I16.WordSize()))
+	h.numEl += int64(len(mapped))
+	for _, i := range mapped {
+		h.signs.Add(int(uint16(i) >> 15))
+		for j := range 15 {
+			if i&(1<<j) != 0 {
+				h.mantissas.Add(j)
+			}
+		}
+		h.values.Add(int(uint16(i)))
+		h.total += int64(i)
+		h.sumSq += float64(i) * float64(i)
+		if i < h.min {
+			h.min = i
+		}
+		if i > h.max {
+			h.max = i
+		}
+	}
+}
+
+func (h *i16Histogram) merge(other histogram) {
+	o := other.(*i16Histogram)
+	h.signs.Merge(&o.signs)
+	h.mantissas.Merge(&o.mantissas)
+	h.values.Merge(&o.values)
+	h.numEl += o.numEl
+	h.min = min(h.min, o.min)
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sumSq += o.sumSq
+}
+
+func (h *i16Histogram) sums() []*float64 {
+	return []*float64{&h.sumSq}
+}
+
+func (h *i16Histogram) analyzed(name string) AnalyzedTensor {
+	return AnalyzedTensor{
+		Name:     name,
+		DType:    safetensors.I16,
+		NumEl:    h.numEl,
+		Avg:      float64(h.total) / float64(h.numEl),
+		StdDev:   stdDev(float64(h.total), h.sumSq, h.numEl),
+		Min:      float64(h.min),
+		Max:      float64(h.max),
+		Entropy:  h.values.Entropy(),
+		Sign:     &BitKindCount{Allocation: 1, ValuesSeen: h.signs},
+		Exponent: &BitKindCount{Allocation: 0},
+		Mantissa: &BitMaskCount{Allocation: 15, ValuesSeen: h.mantissas},
+	}
+}
+
+// u16Histogram calculates the actual use of mantissa bits plus stats.
+//
+// Every value is tracked, see i16Histogram.
+type u16Histogram struct {
+	mantissas CountSet
+	values    CountSet
+	numEl     int64
+	min       uint16
+	max       uint16
+	total     uint64
+	sumSq     float64
+}
+
+func newU16Histogram() *u16Histogram {
+	h := &u16Histogram{min: math.MaxUint16}
+	h.mantissas.Resize(16)
+	h.values.Resize(1 << 16)
+	return h
+}
+
+func (h *u16Histogram) add(data []byte) {
+	data = toNative(data, int(safetensors.U16.WordSize()))
+	// #nosec G103
+	mapped := unsafe.Slice((*uint16)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.U16.WordSize()))
+	h.numEl += int64(len(mapped))
+	for _, i := range mapped {
+		for j := range 16 {
+			if i&(1<<j) != 0 {
+				h.mantissas.Add(j)
+			}
+		}
+		h.values.Add(int(i))
+		h.total += uint64(i)
+		h.sumSq += float64(i) * float64(i)
+		if i < h.min {
+			h.min = i
+		}
+		if i > h.max {
+			h.max = i
+		}
+	}
+}
+
+func (h *u16Histogram) merge(other histogram) {
+	o := other.(*u16Histogram)
+	h.mantissas.Merge(&o.mantissas)
+	h.values.Merge(&o.values)
+	h.numEl += o.numEl
+	h.min = min(h.min, o.min)
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sumSq += o.sumSq
+}
+
+func (h *u16Histogram) sums() []*float64 {
+	return []*float64{&h.sumSq}
+}
+
+func (h *u16Histogram) analyzed(name string) AnalyzedTensor {
+	return AnalyzedTensor{
+		Name:     name,
+		DType:    safetensors.U16,
+		NumEl:    h.numEl,
+		Avg:      float64(h.total) / float64(h.numEl),
+		StdDev:   stdDev(float64(h.total), h.sumSq, h.numEl),
+		Min:      float64(h.min),
+		Max:      float64(h.max),
+		Entropy:  h.values.Entropy(),
+		Sign:     &BitKindCount{Allocation: 0},
+		Exponent: &BitKindCount{Allocation: 0},
+		Mantissa: &BitMaskCount{Allocation: 16, ValuesSeen: h.mantissas},
+	}
+}
+
+// TensorOptions controls the analysis of a tensor.
+//
+// The zero value is the default analysis.
+type TensorOptions struct {
+	// FlushToZero treats subnormal floating point values as zero, like hardware
+	// that flushes subnormals to zero does. The number of values flushed is
+	// reported in AnalyzedTensor.Flushed.
+	FlushToZero bool
+	// LowMemory counts how often each mantissa bit is set in F16 and F32
+	// tensors instead of tracking every distinct mantissa, which takes 1MiB
+	// per F32 tensor being analyzed. The number of distinct mantissas, hence
+	// the mantissa bits wasted, is then estimated from the bits used, which
+	// can overestimate it: the mantissas 0b01 and 0b10 use 2 bits while 1 bit
+	// is enough to tell them apart. RecommendDType is not available.
+	LowMemory bool
+	// Downcast, when set to a floating point dtype, simulates downcasting each
+	// value to it to calculate the error. See AnalyzedTensor.SimulateDowncast.
+	Downcast safetensors.DType
+	// DowncastErrors calculates the RMSE of downcasting each value to BF16,
+	// F16 and F8_E4M3. See AnalyzedTensor.DowncastErrors.
+	DowncastErrors bool
+	// PruneThreshold, when positive, counts the finite floating point values
+	// whose absolute value is below it in AnalyzedTensor.Prunable.
+	PruneThreshold float64
+	// Shards is the maximum number of goroutines used to analyze a single
+	// large tensor. 0 or 1 analyzes it serially. The result is the same as the
+	// serial analysis. Each shard beyond the first allocates its own
+	// histogram, e.g. 1MiB for a F32 tensor without LowMemory.
+	Shards int
+	// ShardLimit, if set, is a semaphore bounding the goroutines of the
+	// shards: each shard beyond the first runs only if it can take a slot
+	// without waiting, otherwise the tensor is split in fewer shards. Use the
+	// semaphore bounding the tensors analyzed concurrently so the shards don't
+	// add to it.
+	ShardLimit chan struct{}
+	// AsTF32 analyzes F32 tensors as TF32, as used by NVIDIA tensor cores:
+	// only the top 10 bits of the mantissa are considered, so the bits wasted
+	// are the ones of the 19 bits of TF32. See AnalyzedTensor.TF32.
+	AsTF32 bool
+	// DistinctValues counts the distinct raw values of F8, F16 and BF16
+	// tensors in AnalyzedTensor.DistinctValues, with a 8KiB BitSet per tensor.
+	DistinctValues bool
+	// Hash calculates AnalyzedTensor.Digest to find duplicated tensors.
+	Hash bool
+	// Hasher is used when Hash is set. Defaults to FNV64Hasher when nil.
+	Hasher Hasher
+}
+
+// minShardSize is the minimum number of bytes analyzed by a shard.
+const minShardSize = 1 << 20
+
+// addSharded processes the data in up to o.Shards concurrent shards, then
+// merges the results into h.
+func (o *TensorOptions) addSharded(ctx context.Context, h histogram, name string, dtype safetensors.DType, data []byte) error {
+	ws := int(dtype.WordSize())
+	n := min(o.Shards, len(data)/minShardSize)
+	if o.ShardLimit != nil {
+		// The first shard runs on the calling goroutine, the others take a
+		// slot released when they are done.
+		acquired := 0
+	loop:
+		for acquired < n-1 {
+			select {
+			case o.ShardLimit <- struct{}{}:
+				acquired++
+			default:
+				break loop
+			}
+		}
+		n = acquired + 1
+	}
+	if n <= 1 {
+		b := newBlockAdder(h, ws, false)
+		err := addChunks(ctx, b, name, data)
+		b.flush()
+		return err
+	}
+	// Split on block boundaries so the sums are added in the same blocks as
+	// the serial analysis.
+	perShard := (len(data)/ws + n - 1) / n
+	size := (perShard + sumBlock - 1) / sumBlock * sumBlock * ws
+	adders := make([]*blockAdder, n)
+	for i := range adders {
+		s := h
+		if i != 0 {
+			// The dtype was already validated.
+			s, _ = newHistogram(name, dtype, o)
+		}
+		adders[i] = newBlockAdder(s, ws, true)
+	}
+	errs := make([]error, n)
+	shard := func(i int) {
+		start := min(i*size, len(data))
+		end := min(start+size, len(data))
+		errs[i] = addChunks(ctx, adders[i], name, data[start:end])
+		adders[i].flush()
+	}
+	wg := sync.WaitGroup{}
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if o.ShardLimit != nil {
+				defer func() {
+					<-o.ShardLimit
+				}()
+			}
+			shard(i)
+		}()
+	}
+	shard(0)
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	// The shards recorded their sums instead of adding them, so they merge
+	// zeros. Add the sums of the blocks in order, like the serial analysis.
+	for _, b := range adders[1:] {
+		h.merge(b.h)
+	}
+	sums := h.sums()
+	for _, b := range adders {
+		for _, block := range b.blocks {
+			for i, v := range block {
+				*sums[i] += v
+			}
+		}
+	}
+	return nil
+}
+
+// sumBlock is the number of elements whose floating point sums are
+// accumulated from zero before being added to the totals, so that the totals
+// don't depend on how the data is split: serially, from a reader or in
+// shards.
+const sumBlock = 1 << 16
+
+// blockAdder adds data to a histogram, accumulating its sums in blocks of
+// sumBlock elements.
+type blockAdder struct {
+	h    histogram
+	ws   int
+	sums []*float64
+	// saved is the value of the sums before the current block.
+	saved []float64
+	// n is the number of elements added in the current block.
+	n int
+	// record saves the sums of each block in blocks instead of adding them to
+	// the totals, for a shard.
+	record bool
+	blocks [][]float64
+}
+
+func newBlockAdder(h histogram, ws int, record bool) *blockAdder {
+	sums := h.sums()
+	return &blockAdder{h: h, ws: ws, sums: sums, saved: make([]float64, len(sums)), record: record}
+}
+
+// add processes the data. Its length must be a multiple of the word size.
+func (b *blockAdder) add(data []byte) {
+	for len(data) != 0 {
+		if b.n == 0 {
+			for i, s := range b.sums {
+				b.saved[i] = *s
+				*s = 0
+			}
+		}
+		n := min(len(data)/b.ws, sumBlock-b.n)
+		b.h.add(data[:n*b.ws])
+		data = data[n*b.ws:]
+		if b.n += n; b.n == sumBlock {
+			b.flush()
+		}
+	}
+}
+
+// flush ends the current block, if any. It must be called once all the data
+// was added.
+func (b *blockAdder) flush() {
+	if b.n == 0 {
+		return
+	}
+	b.n = 0
+	if b.record {
+		block := make([]float64, len(b.sums))
+		for i, s := range b.sums {
+			block[i] = *s
+			*s = b.saved[i]
+		}
+		b.blocks = append(b.blocks, block)
+		return
+	}
+	for i, s := range b.sums {
+		*s += b.saved[i]
+	}
+}
+
+// checkEvery is the number of elements processed between checks of the
+// context.
+const checkEvery = 1 << 20
+
+// addChunks processes the data in chunks, returning early if the context is
+// canceled.
+func addChunks(ctx context.Context, b *blockAdder, name string, data []byte) error {
+	for len(data) != 0 {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		n := min(len(data), checkEvery*b.ws)
+		b.add(data[:n])
+		data = data[n:]
+	}
+	return nil
 }
 
 // AnalyzeTensor analyzes how well used the bits in a tensor are used.
-func AnalyzeTensor(name string, t safetensors.Tensor) (AnalyzedTensor, error) {
-	switch t.DType {
-	case safetensors.F16:
-		signs, exponents, mantissas, avg, min, max, inf, nan := calcF16HistogramAndStats(t)
-		analyzed := AnalyzedTensor{
-			Name:     name,
-			DType:    t.DType,
-			NumEl:    int64(len(t.Data)) / int64(t.DType.WordSize()),
-			Avg:      avg,
-			Min:      min,
-			Max:      max,
-			Inf:      inf,
-			NaN:      nan,
-			Sign:     &BitKindCount{Allocation: 1, ValuesSeen: signs},
-			Exponent: &BitKindCount{Allocation: 5, ValuesSeen: exponents},
-			Mantissa: &BitKindBool{Allocation: 10, ValuesSeen: mantissas},
-		}
-		return analyzed, nil
-	case safetensors.BF16:
-		signs, exponents, mantissas, avg, min, max, inf, nan := calcBF16HistogramAndStats(t)
-		analyzed := AnalyzedTensor{
-			Name:     name,
-			DType:    t.DType,
-			NumEl:    int64(len(t.Data)) / int64(t.DType.WordSize()),
-			Avg:      avg,
-			Min:      min,
-			Max:      max,
-			Inf:      inf,
-			NaN:      nan,
-			Sign:     &BitKindCount{Allocation: 1, ValuesSeen: signs},
-			Exponent: &BitKindCount{Allocation: 8, ValuesSeen: exponents},
-			Mantissa: &BitKindBool{Allocation: 7, ValuesSeen: mantissas},
-		}
-		return analyzed, nil
-	case safetensors.F32:
-		signs, exponents, mantissas, avg, min, max, inf, nan := calcF32HistogramAndStats(t)
-		analyzed := AnalyzedTensor{
-			Name:     name,
-			DType:    t.DType,
-			NumEl:    int64(len(t.Data)) / int64(t.DType.WordSize()),
-			Avg:      avg,
-			Min:      min,
-			Max:      max,
-			Inf:      inf,
-			NaN:      nan,
-			Sign:     &BitKindCount{Allocation: 1, ValuesSeen: signs},
-			Exponent: &BitKindCount{Allocation: 8, ValuesSeen: exponents},
-			Mantissa: &BitKindBool{Allocation: 23, ValuesSeen: mantissas},
-		}
-		return analyzed, nil
-	case safetensors.I32:
-		// Used in AWQ and GPTQ.
-		signs, mantissas, avg, min, max := calcI32HistogramAndStats(t)
-		analyzed := AnalyzedTensor{
-			Name:     name,
-			DType:    t.DType,
-			NumEl:    int64(len(t.Data)) / int64(t.DType.WordSize()),
-			Avg:      avg,
-			Min:      float64(min),
-			Max:      float64(max),
-			Inf:      0,
-			NaN:      0,
-			Sign:     &BitKindCount{Allocation: 1, ValuesSeen: signs},
-			Exponent: &BitKindCount{Allocation: 0},
-			Mantissa: &BitMaskCount{Allocation: 31, ValuesSeen: mantissas},
-		}
-		return analyzed, nil
-	case safetensors.U32:
-		// Used in MLX.
-		mantissas, avg, min, max := calcU32HistogramAndStats(t)
-		analyzed := AnalyzedTensor{
-			Name:     name,
-			DType:    t.DType,
-			NumEl:    int64(len(t.Data)) / int64(t.DType.WordSize()),
-			Avg:      avg,
-			Min:      float64(min),
-			Max:      float64(max),
-			Inf:      0,
-			NaN:      0,
-			Sign:     &BitKindCount{Allocation: 0},
-			Exponent: &BitKindCount{Allocation: 0},
-			Mantissa: &BitMaskCount{Allocation: 32, ValuesSeen: mantissas},
-		}
-		return analyzed, nil
-	default:
-		return AnalyzedTensor{}, fmt.Errorf("%s: TODO implement support for dtype %s", name, t.DType)
+//
+// It returns early with an error wrapping ctx.Err() if the context is
+// canceled.
+func AnalyzeTensor(ctx context.Context, name string, t safetensors.Tensor) (AnalyzedTensor, error) {
+	return TensorOptions{}.AnalyzeTensor(ctx, name, t)
+}
+
+// AnalyzeTensor analyzes how well used the bits in a tensor are used.
+func (o TensorOptions) AnalyzeTensor(ctx context.Context, name string, t safetensors.Tensor) (AnalyzedTensor, error) {
+	t.DType = normalizeDType(name, t.DType)
+	h, err := newHistogram(name, t.DType, &o)
+	if err != nil {
+		return AnalyzedTensor{}, err
+	}
+	if err = checkNotEmpty(&t); err != nil {
+		return AnalyzedTensor{}, fmt.Errorf("%s: %w", name, err)
+	}
+	// Catch malformed headers where the shape doesn't match the data.
+	if err = t.Validate(); err != nil {
+		return AnalyzedTensor{}, fmt.Errorf("%s: %w", name, err)
+	}
+	if err = o.addSharded(ctx, h, name, t.DType, t.Data); err != nil {
+		return AnalyzedTensor{}, err
+	}
+	a := analyzed(h, name)
+	a.Shape = toShape(t.Shape)
+	if o.Hash {
+		a.Digest = o.digest(t.Data)
+	}
+	return a, nil
+}
+
+// AnalyzeBytes analyzes the tensors of a whole safetensors file already in
+// memory.
+//
+// Only the tensors with a name matching include are analyzed. If include is
+// nil, all the tensors are analyzed.
+func AnalyzeBytes(ctx context.Context, data []byte, include *regexp.Regexp) (AnalyzedModel, error) {
+	return TensorOptions{}.AnalyzeBytes(ctx, data, include)
+}
+
+// AnalyzeBytes analyzes the tensors of a whole safetensors file already in
+// memory.
+func (o TensorOptions) AnalyzeBytes(ctx context.Context, data []byte, include *regexp.Regexp) (AnalyzedModel, error) {
+	f, err := parse(data)
+	if err != nil {
+		return AnalyzedModel{}, err
+	}
+	m := AnalyzedModel{}
+	for _, t := range f.Tensors {
+		if include != nil && !include.MatchString(t.Name) {
+			continue
+		}
+		a, err := o.AnalyzeTensor(ctx, t.Name, t)
+		if err != nil {
+			return m, err
+		}
+		m.Tensors = append(m.Tensors, a)
+	}
+	return m, nil
+}
+
+// toShape converts a safetensors shape.
+func toShape(shape []uint64) []int64 {
+	if shape == nil {
+		return nil
+	}
+	out := make([]int64, len(shape))
+	for i, d := range shape {
+		out[i] = int64(d)
+	}
+	return out
+}
+
+// readChunkSize is the size of the buffer used by AnalyzeReader.
+const readChunkSize = 1 << 20
+
+// AnalyzeReader analyzes a tensor of numEl elements of type dtype, reading its
+// raw little endian data from r.
+//
+// The data is read in bounded chunks so the tensor doesn't need to be loaded
+// in memory. Exactly numEl elements are read from r. The result is the same as
+// AnalyzeTensor with the same data.
+func AnalyzeReader(ctx context.Context, name string, dtype safetensors.DType, r io.Reader, numEl int64) (AnalyzedTensor, error) {
+	return TensorOptions{}.AnalyzeReader(ctx, name, dtype, r, numEl)
+}
+
+// AnalyzeReader analyzes a tensor of numEl elements of type dtype, reading its
+// raw little endian data from r.
+func (o TensorOptions) AnalyzeReader(ctx context.Context, name string, dtype safetensors.DType, r io.Reader, numEl int64) (AnalyzedTensor, error) {
+	if numEl < 0 {
+		return AnalyzedTensor{}, fmt.Errorf("%s: invalid number of elements %d", name, numEl)
+	}
+	dtype = normalizeDType(name, dtype)
+	h, err := newHistogram(name, dtype, &o)
+	if err != nil {
+		return AnalyzedTensor{}, err
+	}
+	var digest func() string
+	if o.Hash {
+		var w io.Writer
+		w, digest = o.newDigester()
+		r = io.TeeReader(r, w)
+	}
+	ws := int64(dtype.WordSize())
+	b := newBlockAdder(h, int(ws), false)
+	remaining := numEl * ws
+	// The buffer is aligned on the word size so chunks never split a word.
+	buf := make([]byte, min(remaining, readChunkSize-readChunkSize%ws))
+	for remaining > 0 {
+		if err = ctx.Err(); err != nil {
+			return AnalyzedTensor{}, fmt.Errorf("%s: %w", name, err)
+		}
+		n := min(remaining, int64(len(buf)))
+		if _, err = io.ReadFull(r, buf[:n]); err != nil {
+			if err == io.EOF && remaining == numEl*ws {
+				// Not a single byte.
+				err = ErrEmptyTensor
+			}
+			return AnalyzedTensor{}, fmt.Errorf("%s: %w", name, err)
+		}
+		b.add(buf[:n])
+		remaining -= n
+	}
+	b.flush()
+	a := analyzed(h, name)
+	if digest != nil {
+		a.Digest = digest()
 	}
+	return a, nil
 }
@@ -0,0 +1,1674 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/maruel/floatx"
+	"github.com/maruel/safetensors"
+)
+
+func TestAnalyzeReader(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// Large enough to span multiple chunks.
+	data := make([]byte, readChunkSize+4*1000+4)
+	r.Read(data)
+	for _, dtype := range []safetensors.DType{safetensors.F8_E4M3, safetensors.F8_E5M2, safetensors.F16, safetensors.BF16, safetensors.F32, safetensors.I16, safetensors.U16, safetensors.I32, safetensors.U32} {
+		t.Run(string(dtype), func(t *testing.T) {
+			tensor := safetensors.Tensor{Name: "t", DType: dtype, Shape: []uint64{uint64(len(data)) / dtype.WordSize()}, Data: data}
+			want, err := AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// AnalyzeReader doesn't know the shape.
+			want.Shape = nil
+			numEl := int64(len(data)) / int64(dtype.WordSize())
+			for _, split := range []int{1, 3, 7, 4097} {
+				got, err := AnalyzeReader(context.Background(), "t", dtype, &splitReader{data: data, split: split}, numEl)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(want, got) {
+					t.Fatalf("split %d: mismatch\nwant: %+v\ngot:  %+v", split, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzeReader_Short(t *testing.T) {
+	if _, err := AnalyzeReader(context.Background(), "t", safetensors.F32, bytes.NewReader(make([]byte, 7)), 2); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestAnalyzeReader_NumEl(t *testing.T) {
+	if _, err := AnalyzeReader(context.Background(), "t", safetensors.F32, bytes.NewReader(make([]byte, 8)), -1); err == nil || err.Error() != "t: invalid number of elements -1" {
+		t.Fatal(err)
+	}
+	// No element is like a tensor of shape [0].
+	got, err := AnalyzeReader(context.Background(), "t", safetensors.BF16, bytes.NewReader(nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := AnalyzeTensor(context.Background(), "t", safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.NumEl != 0 || got.Name != want.Name || got.DType != want.DType || got.Min != want.Min || got.Max != want.Max {
+		t.Fatalf("want %+v\ngot  %+v", want, got)
+	}
+}
+
+// splitReader returns the data at most split bytes at a time.
+type splitReader struct {
+	data  []byte
+	split int
+}
+
+func (s *splitReader) Read(p []byte) (int, error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), s.split)], s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func TestAnalyzedModel_Summary(t *testing.T) {
+	m := AnalyzedModel{}
+	for _, data := range [][]byte{{0, 0, 0x80, 0x3F, 0, 0, 0xC0, 0x7F}, {0, 0, 0, 0x40}} {
+		a, err := AnalyzeTensor(context.Background(), "t", safetensors.Tensor{DType: safetensors.F32, Shape: []uint64{uint64(len(data) / 4)}, Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Tensors = append(m.Tensors, a)
+	}
+	got := m.Summary()
+	// 1.0 and NaN: exponents 127 and 255, mantissas 0 and 1<<22: 1+7+22=30 bits
+	// wasted. 2.0: 1+8+23=32 bits wasted.
+	want := Summary{
+		NumTensors: 2, NumEl: 3, Bytes: 12, BytesWasted: 2*30/8 + 32/8, NaN: 1,
+		SignBitsWasted: 2*1 + 1, ExponentBitsWasted: 2*7 + 8, MantissaBitsWasted: 2*22 + 23,
+	}
+	if got != want {
+		t.Fatalf("want %+v\ngot  %+v", want, got)
+	}
+	if e := got.EffectiveBitsPerWeight(); e != float64(8*(12-11))/3 {
+		t.Fatal(e)
+	}
+}
+
+func TestAnalyzedModel_TensorByName(t *testing.T) {
+	m := AnalyzedModel{Tensors: []AnalyzedTensor{{Name: "a", NumEl: 1}, {Name: "b", NumEl: 2}, {Name: "c", NumEl: 3}}}
+	if got := m.Names(); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Fatal(got)
+	}
+	for _, name := range []string{"b", "b", "c", "a"} {
+		a, ok := m.TensorByName(name)
+		if !ok || a.Name != name || a != &m.Tensors[a.NumEl-1] {
+			t.Fatal(name, a, ok)
+		}
+	}
+	if a, ok := m.TensorByName("d"); ok || a != nil {
+		t.Fatal(a, ok)
+	}
+	// A miss doesn't rebuild the index when the tensors didn't change.
+	index := reflect.ValueOf(m.index).UnsafePointer()
+	if _, ok := m.TensorByName("e"); ok || reflect.ValueOf(m.index).UnsafePointer() != index {
+		t.Fatal("index was rebuilt")
+	}
+	// The index follows the changes to Tensors.
+	m.Tensors = append(m.Tensors[:1], AnalyzedTensor{Name: "d", NumEl: 2})
+	if a, ok := m.TensorByName("d"); !ok || a.NumEl != 2 {
+		t.Fatal(a, ok)
+	}
+	if _, ok := m.TensorByName("c"); ok {
+		t.Fatal("c was removed")
+	}
+	if got := (&AnalyzedModel{}).Names(); len(got) != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestAnalyzedModel_AppendTensors(t *testing.T) {
+	// Run with -race to detect unsynchronized accesses.
+	m := AnalyzedModel{}
+	wg := sync.WaitGroup{}
+	for i := range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 10 {
+				m.AppendTensors(AnalyzedTensor{Name: fmt.Sprintf("%d.%d", i, j)}, AnalyzedTensor{NumEl: 1})
+			}
+		}()
+	}
+	wg.Wait()
+	if len(m.Tensors) != 64*10*2 {
+		t.Fatal(len(m.Tensors))
+	}
+	if got := m.TotalWeights(); got != 64*10 {
+		t.Fatal(got)
+	}
+	if _, ok := m.TensorByName("63.9"); !ok {
+		t.Fatal("missing 63.9")
+	}
+}
+
+func TestMergeModels(t *testing.T) {
+	a, err := AnalyzeTensor(context.Background(), "a", f32Tensor(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := AnalyzeTensor(context.Background(), "b", f32Tensor(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1 := AnalyzedModel{Tensors: []AnalyzedTensor{a}}
+	m2 := AnalyzedModel{Tensors: []AnalyzedTensor{b}}
+	got, err := MergeModels(m1, m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Tensors) != 2 || got.Tensors[0].Name != "a" || got.Tensors[1].Name != "b" {
+		t.Fatalf("unexpected %+v", got)
+	}
+	if got.TotalWeights() != 3 || got.TotalBytes() != 12 {
+		t.Fatal(got.TotalWeights(), got.TotalBytes())
+	}
+	if w := got.TotalWasted(); w != m1.TotalWasted()+m2.TotalWasted() || w == 0 {
+		t.Fatal(w)
+	}
+	if s := got.Summary(); s.NumEl != got.TotalWeights() || s.Bytes != got.TotalBytes() || s.BytesWasted != got.TotalWasted() {
+		t.Fatalf("unexpected %+v", s)
+	}
+	if _, err = MergeModels(m1, m2, m1); err == nil || err.Error() != `duplicate tensor "a"` {
+		t.Fatal(err)
+	}
+	if got, err = MergeModels(); err != nil || len(got.Tensors) != 0 {
+		t.Fatal(got, err)
+	}
+	// The first non empty metadata is kept.
+	m2.Metadata = map[string]string{"format": "pt"}
+	m3 := AnalyzedModel{Metadata: map[string]string{"format": "other"}}
+	if got, err = MergeModels(m1, m2, m3); err != nil || !maps.Equal(got.Metadata, m2.Metadata) {
+		t.Fatal(got.Metadata, err)
+	}
+}
+
+func TestTensorOptions_FlushToZero(t *testing.T) {
+	// Two F16 subnormals (one negative) and 1.0.
+	tensor := safetensors.Tensor{DType: safetensors.F16, Shape: []uint64{3}, Data: []byte{0x01, 0x00, 0x02, 0x80, 0x00, 0x3C}}
+	a, err := TensorOptions{FlushToZero: true}.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Flushed != 2 {
+		t.Fatalf("flushed: %d", a.Flushed)
+	}
+	if a.Min != 0 || a.Max != 1 {
+		t.Fatalf("min=%g max=%g", a.Min, a.Max)
+	}
+	if n := a.Mantissa.NumberDifferentValuesSeen(); n != 1 {
+		t.Fatalf("mantissa: %d", n)
+	}
+	if n := a.Exponent.NumberDifferentValuesSeen(); n != 2 {
+		t.Fatalf("exponent: %d", n)
+	}
+	if n := a.Sign.NumberDifferentValuesSeen(); n != 2 {
+		t.Fatalf("sign: %d", n)
+	}
+
+	if a, err = AnalyzeTensor(context.Background(), "t", tensor); err != nil {
+		t.Fatal(err)
+	}
+	if a.Flushed != 0 {
+		t.Fatalf("flushed: %d", a.Flushed)
+	}
+	if a.Min >= 0 {
+		t.Fatalf("min=%g", a.Min)
+	}
+	if n := a.Mantissa.NumberDifferentValuesSeen(); n != 3 {
+		t.Fatalf("mantissa: %d", n)
+	}
+}
+
+func TestAnalyzeTensor_Entropy(t *testing.T) {
+	// 200 times 1.0 and 2^1..2^7 once: 8 different exponents but heavily skewed.
+	var values []float32
+	for range 200 {
+		values = append(values, 1)
+	}
+	for i := 1; i < 8; i++ {
+		values = append(values, float32(int(1)<<i))
+	}
+	a, err := AnalyzeTensor(context.Background(), "t", f32Tensor(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := a.Sign.BitsActuallyUsed() + a.Exponent.BitsActuallyUsed() + a.Mantissa.BitsActuallyUsed()
+	if used != 3 {
+		t.Fatalf("used: %g", used)
+	}
+	if a.Entropy <= 0 || a.Entropy > used/4 {
+		t.Fatalf("entropy: %g", a.Entropy)
+	}
+}
+
+// f32Tensor returns a 1D F32 tensor.
+func f32Tensor(values ...float32) safetensors.Tensor {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	return safetensors.Tensor{DType: safetensors.F32, Shape: []uint64{uint64(len(values))}, Data: data}
+}
+
+func TestAnalyzeTensor_ShapeMismatch(t *testing.T) {
+	tensor := f32Tensor(1, 2, 3, 4)
+	tensor.Shape = []uint64{3, 2}
+	if _, err := AnalyzeTensor(context.Background(), "t", tensor); err == nil {
+		t.Fatal("expected error")
+	}
+	tensor.Shape = []uint64{2, 2}
+	if _, err := AnalyzeTensor(context.Background(), "t", tensor); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnalyzedTensor_RecommendDType(t *testing.T) {
+	data := []struct {
+		name   string
+		values []float32
+		want   safetensors.DType
+	}{
+		{"e4m3", []float32{0, 1, -1.5, 0.125, 448, -448}, safetensors.F8_E4M3},
+		{"e4m3 subnormal", []float32{0x1p-9, 0x1p-7}, safetensors.F8_E4M3},
+		{"e4m3 nan", []float32{1.875, 256}, safetensors.F16},
+		{"e5m2 range", []float32{1, 1024}, safetensors.F8_E5M2},
+		{"e5m2 subnormal", []float32{0x1p-10, 0x1p-16}, safetensors.F8_E5M2},
+		{"f16 mantissa", []float32{1.0625, 2}, safetensors.F16},
+		{"bf16 range", []float32{0x1p40, -0x1p-40}, safetensors.BF16},
+		{"f32 subnormal", []float32{0x1p-140}, safetensors.F32},
+		{"bf16 infinity", []float32{float32(math.Inf(1)), 1.5}, safetensors.F8_E5M2},
+		{"none", []float32{1.0000001}, safetensors.F32},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			a, err := AnalyzeTensor(context.Background(), line.name, f32Tensor(line.values...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.RecommendDType(); got != line.want {
+				t.Fatalf("want %s, got %s", line.want, got)
+			}
+		})
+	}
+	a, err := AnalyzeTensor(context.Background(), "i32", safetensors.Tensor{DType: safetensors.I32, Shape: []uint64{1}, Data: make([]byte, 4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.RecommendDType(); got != safetensors.I32 {
+		t.Fatal(got)
+	}
+}
+
+func TestAnalyzeTensor_16Bits(t *testing.T) {
+	// -1, 3, 3, 256.
+	i16 := safetensors.Tensor{DType: safetensors.I16, Shape: []uint64{4}, Data: []byte{0xFF, 0xFF, 3, 0, 3, 0, 0, 1}}
+	a, err := AnalyzeTensor(context.Background(), "i16", i16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.NumEl != 4 || a.Len() != 8 || a.Min != -1 || a.Max != 256 || a.Avg != 261./4 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	// 3 distinct values with probabilities 1/4, 1/2 and 1/4.
+	if a.Entropy != 1.5 {
+		t.Fatalf("want entropy 1.5, got %g", a.Entropy)
+	}
+	if a.Sign.BitsActuallyUsed() != 1 || a.Mantissa.GetAllocation() != 15 || a.Mantissa.BitsWasted() != 0 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	// 1, 2, 2, 65535.
+	u16 := safetensors.Tensor{DType: safetensors.U16, Shape: []uint64{4}, Data: []byte{1, 0, 2, 0, 2, 0, 0xFF, 0xFF}}
+	if a, err = AnalyzeTensor(context.Background(), "u16", u16); err != nil {
+		t.Fatal(err)
+	}
+	if a.Min != 1 || a.Max != 65535 || a.Avg != 65540./4 || a.Entropy != 1.5 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	if a.Sign.GetAllocation() != 0 || a.Mantissa.GetAllocation() != 16 || a.Mantissa.BitsWasted() != 0 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	// Only the two low bits are used.
+	u16.Data = []byte{1, 0, 2, 0, 3, 0, 0, 0}
+	if a, err = AnalyzeTensor(context.Background(), "u16", u16); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.Mantissa.BitsWasted(); got != 14 {
+		t.Fatalf("want 14 bits wasted, got %d", got)
+	}
+	if got := normalizeDType("t", "torch.int16"); got != safetensors.I16 {
+		t.Fatal(got)
+	}
+}
+
+func TestNormalizeDType(t *testing.T) {
+	data := []struct {
+		in   safetensors.DType
+		want safetensors.DType
+	}{
+		{"BF16", safetensors.BF16},
+		{"bf16", safetensors.BF16},
+		{"bfloat16", safetensors.BF16},
+		{"BFloat16", safetensors.BF16},
+		{"torch.bfloat16", safetensors.BF16},
+		{"f16", safetensors.F16},
+		{"float16", safetensors.F16},
+		{"half", safetensors.F16},
+		{"float32", safetensors.F32},
+		{"fp32", safetensors.F32},
+		{"int32", safetensors.I32},
+		{"uint32", safetensors.U32},
+		{"float8_e4m3fn", safetensors.F8_E4M3},
+		{"f8_e5m2", safetensors.F8_E5M2},
+		{"unknown", "unknown"},
+	}
+	for _, line := range data {
+		if got := normalizeDType("t", line.in); got != line.want {
+			t.Errorf("%q: want %s, got %s", line.in, line.want, got)
+		}
+	}
+	tensor := f32Tensor(1, 2)
+	tensor.DType = "float32"
+	a, err := AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.DType != safetensors.F32 {
+		t.Fatal(a.DType)
+	}
+}
+
+func TestAnalyzedModel_JSON(t *testing.T) {
+	want := AnalyzedModel{}
+	for _, tensor := range []safetensors.Tensor{
+		f32Tensor(1, -2.5, 0x1p-130),
+		{DType: safetensors.I32, Shape: []uint64{1, 2}, Data: []byte{1, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{DType: safetensors.U32, Shape: []uint64{1}, Data: []byte{3, 0, 0, 0}},
+	} {
+		a, err := AnalyzeTensor(context.Background(), string(tensor.DType), tensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.Tensors = append(want.Tensors, a)
+	}
+	data, err := json.Marshal(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := AnalyzedModel{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Tensors) != len(want.Tensors) {
+		t.Fatalf("got %d tensors", len(got.Tensors))
+	}
+	if !slices.Equal(got.Tensors[1].Shape, []int64{1, 2}) {
+		t.Fatalf("unexpected shape %v", got.Tensors[1].Shape)
+	}
+	for i := range want.Tensors {
+		w := &want.Tensors[i]
+		g := &got.Tensors[i]
+		if g.Name != w.Name || g.DType != w.DType || g.NumEl != w.NumEl || !slices.Equal(g.Shape, w.Shape) || g.Min != w.Min || g.Max != w.Max || g.Subnormal != w.Subnormal {
+			t.Errorf("%s: want %+v\ngot  %+v", w.Name, w, g)
+		}
+		for j, b := range [][2]BitAllocation{{w.Sign, g.Sign}, {w.Exponent, g.Exponent}, {w.Mantissa, g.Mantissa}} {
+			if reflect.TypeOf(b[0]) != reflect.TypeOf(b[1]) || b[0].GetAllocation() != b[1].GetAllocation() || b[0].NumberDifferentValuesSeen() != b[1].NumberDifferentValuesSeen() || b[0].BitsWasted() != b[1].BitsWasted() {
+				t.Errorf("%s: allocation %d: want %#v, got %#v", w.Name, j, b[0], b[1])
+			}
+		}
+	}
+	if w, g := want.Summary(), got.Summary(); w != g {
+		t.Fatalf("want %+v\ngot  %+v", w, g)
+	}
+}
+
+func TestAnalyzedModel_JSON_Legacy(t *testing.T) {
+	// Saved by the first release, before the counts could be promoted to
+	// uint64, from a BF16 tensor of 1, 2, 2, -4, 0.5, 3.
+	data, err := os.ReadFile(filepath.Join("testdata", "analyzed_v0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := AnalyzedModel{}
+	if err = json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tensors) != 1 {
+		t.Fatalf("got %d tensors", len(m.Tensors))
+	}
+	a := &m.Tensors[0]
+	if a.Name != "w" || a.DType != safetensors.BF16 || a.NumEl != 6 || a.Min != -4 || a.Max != 3 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	sign := a.Sign.(*BitKindCount).ValuesSeen
+	if sign.Get(0) != 5 || sign.Get(1) != 1 {
+		t.Fatalf("unexpected sign %v", sign.Frequencies())
+	}
+	// 0.5, 1 and -4 have their own exponent; 2, 2 and 3 share 128.
+	exp := &a.Exponent.(*BitKindCount).ValuesSeen
+	if exp.Effective() != 4 || exp.Get(127) != 1 || exp.Get(128) != 3 {
+		t.Fatalf("unexpected exponents %v", exp.Frequencies())
+	}
+	if got := a.Mantissa.NumberDifferentValuesSeen(); got != 2 {
+		t.Fatal(got)
+	}
+	// Saving again keeps the format readable by the first release.
+	out, err := json.Marshal(&sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `"BQE"` {
+		t.Fatal(string(out))
+	}
+}
+
+func TestAnalyzeTensor_NonFinite(t *testing.T) {
+	data := []struct {
+		dtype  safetensors.DType
+		values []uint32
+	}{
+		// +Inf, -Inf, -Inf, qNaN, -qNaN, sNaN, 1.
+		{safetensors.F16, []uint32{0x7C00, 0xFC00, 0xFC00, 0x7E00, 0xFE00, 0x7C01, 0x3C00}},
+		{safetensors.BF16, []uint32{0x7F80, 0xFF80, 0xFF80, 0x7FC0, 0xFFC0, 0x7F81, 0x3F80}},
+		{safetensors.F32, []uint32{0x7F800000, 0xFF800000, 0xFF800000, 0x7FC00000, 0xFFC00000, 0x7F800001, 0x3F800000}},
+	}
+	for _, line := range data {
+		t.Run(string(line.dtype), func(t *testing.T) {
+			ws := int(line.dtype.WordSize())
+			tensor := safetensors.Tensor{DType: line.dtype, Shape: []uint64{uint64(len(line.values))}, Data: make([]byte, ws*len(line.values))}
+			for i, v := range line.values {
+				if ws == 2 {
+					binary.LittleEndian.PutUint16(tensor.Data[2*i:], uint16(v))
+				} else {
+					binary.LittleEndian.PutUint32(tensor.Data[4*i:], v)
+				}
+			}
+			a, err := AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Inf != 3 || a.PosInf != 1 || a.NegInf != 2 || a.NaN != 3 || a.QNaN != 2 || a.SNaN != 1 {
+				t.Fatalf("unexpected %+v", a)
+			}
+		})
+	}
+}
+
+func TestTensorOptions_Shards(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// Not a multiple of the shard size nor of the number of shards.
+	data := make([]byte, 3*minShardSize+12)
+	r.Read(data)
+	for _, dtype := range []safetensors.DType{safetensors.F8_E4M3, safetensors.F8_E5M2, safetensors.F16, safetensors.BF16, safetensors.F32, safetensors.I16, safetensors.U16, safetensors.I32, safetensors.U32} {
+		t.Run(string(dtype), func(t *testing.T) {
+			tensor := safetensors.Tensor{DType: dtype, Shape: []uint64{uint64(len(data)) / dtype.WordSize()}, Data: data}
+			o := TensorOptions{DistinctValues: true}
+			// The downcast sums are slow to calculate, only check them once.
+			if dtype == safetensors.BF16 {
+				o.Downcast = safetensors.F8_E4M3
+				o.DowncastErrors = true
+			}
+			want, err := o.AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			o.Shards = 4
+			got, err := o.AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The sums are the same bit for bit; compare the bits since they can
+			// be NaN with random data.
+			if math.Float64bits(want.Avg) != math.Float64bits(got.Avg) {
+				t.Fatalf("Avg: want %g, got %g", want.Avg, got.Avg)
+			}
+			if math.Float64bits(want.StdDev) != math.Float64bits(got.StdDev) {
+				t.Fatalf("StdDev: want %g, got %g", want.StdDev, got.StdDev)
+			}
+			want.Avg, want.StdDev = 0, 0
+			got.Avg, got.StdDev = 0, 0
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("want %+v\ngot  %+v", want, got)
+			}
+			// Same from a reader.
+			got, err = o.AnalyzeReader(context.Background(), "t", dtype, bytes.NewReader(data), int64(len(data))/int64(dtype.WordSize()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got.Avg, got.StdDev = 0, 0
+			want.Shape = nil
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("want %+v\ngot  %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestTensorOptions_ShardLimit(t *testing.T) {
+	// Values spanning many exponents, so the sums are rounded and depend on the
+	// summation order.
+	r := rand.New(rand.NewSource(1))
+	data := make([]float32, 4*minShardSize/4)
+	for i := range data {
+		data[i] = float32(r.NormFloat64() * math.Exp2(float64(r.Intn(40)-20)))
+	}
+	tensor := f32Tensor(data...)
+	want, err := TensorOptions{}.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The caller holds one of the 2 slots, so a single shard can be added.
+	limit := make(chan struct{}, 2)
+	limit <- struct{}{}
+	o := TensorOptions{Shards: 4, ShardLimit: limit}
+	got, err := o.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v\ngot  %+v", want, got)
+	}
+	if len(limit) != 1 {
+		t.Fatalf("slots not released: %d", len(limit))
+	}
+	// No slot left: analyzed serially instead of waiting.
+	limit <- struct{}{}
+	if got, err = o.AnalyzeTensor(context.Background(), "t", tensor); err != nil || !reflect.DeepEqual(want, got) {
+		t.Fatal(err, got)
+	}
+}
+
+func TestAnalyzeReader_Blocks(t *testing.T) {
+	// The sums are added in the same blocks as AnalyzeTensor, including the
+	// last partial one.
+	r := rand.New(rand.NewSource(1))
+	data := make([]float32, sumBlock*5/2)
+	for i := range data {
+		data[i] = float32(r.NormFloat64() * math.Exp2(float64(r.Intn(40)-20)))
+	}
+	tensor := f32Tensor(data...)
+	want, err := AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := AnalyzeReader(context.Background(), "t", safetensors.F32, bytes.NewReader(tensor.Data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Shape = nil
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v\ngot  %+v", want, got)
+	}
+}
+
+func BenchmarkAnalyzeTensor(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 64<<20)
+	r.Read(data)
+	tensor := safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{uint64(len(data)) / 2}, Data: data}
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			o := TensorOptions{Shards: shards}
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				if _, err := o.AnalyzeTensor(context.Background(), "t", tensor); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzedTensor_Histograms(t *testing.T) {
+	a, err := AnalyzeTensor(context.Background(), "t", f32Tensor(1, 1.5, 1.75, -2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := a.ExponentHistogram()
+	if len(e) != 256 || e[0] != 1 || e[127] != 3 || e[128] != 1 {
+		t.Fatalf("unexpected exponent histogram %v", e)
+	}
+	m := a.MantissaBitOccupancy()
+	// Mantissas seen: 0, 0b10..., 0b110...
+	if len(m) != 23 || m[22] != 2 || m[21] != 1 || m[0] != 0 {
+		t.Fatalf("unexpected mantissa occupancy %v", m)
+	}
+	i, err := AnalyzeTensor(context.Background(), "i", safetensors.Tensor{DType: safetensors.I32, Shape: []uint64{3}, Data: []byte{1, 0, 0, 0, 3, 0, 0, 0, 2, 0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := i.ExponentHistogram(); len(got) != 0 {
+		t.Fatalf("unexpected exponent histogram %v", got)
+	}
+	if got := i.MantissaBitOccupancy(); len(got) != 31 || got[0] != 2 || got[1] != 2 || got[2] != 0 {
+		t.Fatalf("unexpected mantissa occupancy %v", got)
+	}
+}
+
+func TestAnalyzedTensor_SimulateDowncast(t *testing.T) {
+	o := TensorOptions{Downcast: safetensors.BF16}
+	// Values exactly representable in BF16, including a subnormal.
+	a, err := o.AnalyzeTensor(context.Background(), "exact", f32Tensor(0, 1, -1.5, 0x1.fep100, 0x1p-130))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []RoundingMode{RoundNearestEven, RoundTruncate} {
+		if maxErr, meanErr := a.SimulateDowncast(safetensors.BF16, mode); maxErr != 0 || meanErr != 0 {
+			t.Fatalf("%s: %g, %g", mode, maxErr, meanErr)
+		}
+	}
+	if maxErr, _ := a.SimulateDowncast(safetensors.F16, RoundNearestEven); !math.IsNaN(maxErr) {
+		t.Fatal("expected NaN for a dtype not simulated")
+	}
+
+	r := rand.New(rand.NewSource(1))
+	values := make([]float32, 10000)
+	for i := range values {
+		values[i] = float32(r.NormFloat64())
+	}
+	if a, err = o.AnalyzeTensor(context.Background(), "random", f32Tensor(values...)); err != nil {
+		t.Fatal(err)
+	}
+	// BF16 has 8 bits of precision.
+	limit := max(math.Abs(a.Min), a.Max)
+	rne, rneMean := a.SimulateDowncast(safetensors.BF16, RoundNearestEven)
+	trunc, truncMean := a.SimulateDowncast(safetensors.BF16, RoundTruncate)
+	if rne == 0 || rne > limit*0x1p-8 || trunc > limit*0x1p-7 || rneMean >= truncMean {
+		t.Fatalf("rne=%g/%g trunc=%g/%g", rne, rneMean, trunc, truncMean)
+	}
+	// The relative error doesn't depend on the scale.
+	rel := a.RelativeDowncastError(safetensors.BF16, RoundNearestEven)
+	if rel == 0 || rel > 0x1p-8 {
+		t.Fatal(rel)
+	}
+	for i := range values {
+		values[i] *= 1024
+	}
+	scaled, err := o.AnalyzeTensor(context.Background(), "scaled", f32Tensor(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scaled.RelativeDowncastError(safetensors.BF16, RoundNearestEven); math.Abs(got-rel) > rel*1e-9 {
+		t.Fatalf("want %g, got %g", rel, got)
+	}
+	if got := scaled.RelativeDowncastError(safetensors.F16, RoundNearestEven); !math.IsNaN(got) {
+		t.Fatal(got)
+	}
+
+	if _, err = (TensorOptions{Downcast: safetensors.I32}).AnalyzeTensor(context.Background(), "t", f32Tensor(1)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestAnalyzedTensor_DowncastErrors(t *testing.T) {
+	o := TensorOptions{DowncastErrors: true}
+	// Exact F16 values; 65504 overflows F8_E4M3 and is saturated.
+	a, err := o.AnalyzeTensor(context.Background(), "t", f32Tensor(1+0x1p-10, -0.333251953125, 65504, float32(math.NaN())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := a.DowncastErrors()
+	if len(got) != 3 || got[safetensors.F16] != 0 || got[safetensors.BF16] == 0 || got[safetensors.F8_E4M3] == 0 || math.IsInf(got[safetensors.F8_E4M3], 0) {
+		t.Fatalf("unexpected %v", got)
+	}
+	if _, err = json.Marshal(&a); err != nil {
+		t.Fatal(err)
+	}
+	// Only smaller dtypes are reported.
+	tensor := safetensors.Tensor{DType: safetensors.F16, Shape: []uint64{1}, Data: []byte{0x00, 0x3C}}
+	if a, err = o.AnalyzeTensor(context.Background(), "t", tensor); err != nil {
+		t.Fatal(err)
+	}
+	if got = a.DowncastErrors(); len(got) != 1 || got[safetensors.F8_E4M3] != 0 {
+		t.Fatalf("unexpected %v", got)
+	}
+	if a, err = AnalyzeTensor(context.Background(), "t", tensor); err != nil || a.DowncastErrors() != nil {
+		t.Fatal(a, err)
+	}
+}
+
+func TestAnalyzedTensor_SimulateAsDType(t *testing.T) {
+	// BF16 values: 2^20 and -2^16 overflow F16, 2^-20 is subnormal and 2^-30
+	// underflows. 1 and 0 are unaffected.
+	values := []float32{1, 0x1p20, -0x1p16, 0x1p-20, 0x1p-30, 0, 65504}
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(math.Float32bits(v)>>16))
+	}
+	tensor := safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{uint64(len(values))}, Data: data}
+	a, err := AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.SimulateAsDType(safetensors.F16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (DTypeSimulation{DType: safetensors.F16, Overflow: 2, Underflow: 1, Subnormal: 1}); got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+	// Every BF16 value fits in F32.
+	if got, err = a.SimulateAsDType(safetensors.F32); err != nil || got != (DTypeSimulation{DType: safetensors.F32}) {
+		t.Fatal(got, err)
+	}
+	if _, err = a.SimulateAsDType(safetensors.I32); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestTensorOptions_AsTF32(t *testing.T) {
+	// Values exactly representable in BF16, so only the top 7 bits of the
+	// mantissa are used.
+	r := rand.New(rand.NewSource(1))
+	values := make([]float32, 4096)
+	for i := range values {
+		values[i] = math.Float32frombits(math.Float32bits(float32(r.NormFloat64())) &^ 0xFFFF)
+	}
+	tensor := f32Tensor(values...)
+	full, err := AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf32, err := TensorOptions{AsTF32: true}.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tf32.TF32 || full.TF32 {
+		t.Fatal("unexpected TF32")
+	}
+	if a := tf32.Mantissa.GetAllocation(); a != 10 {
+		t.Fatal(a)
+	}
+	// The same mantissas are seen, within 23 and 10 bits.
+	if n := tf32.Mantissa.NumberDifferentValuesSeen(); n != full.Mantissa.NumberDifferentValuesSeen() {
+		t.Fatalf("want %d, got %d", full.Mantissa.NumberDifferentValuesSeen(), n)
+	}
+	if f, w := full.Mantissa.BitsWasted(), tf32.Mantissa.BitsWasted(); f != 16 || w != 3 {
+		t.Fatalf("full=%d tf32=%d", f, w)
+	}
+	if tf32.Exponent.BitsWasted() != full.Exponent.BitsWasted() || tf32.Sign.BitsWasted() != full.Sign.BitsWasted() {
+		t.Fatalf("want %+v\ngot  %+v", full, tf32)
+	}
+	if d := tf32.RecommendDType(); d != full.RecommendDType() {
+		t.Fatal(d)
+	}
+
+	// The low 13 bits of the mantissa are ignored.
+	tf32, err = TensorOptions{AsTF32: true}.AnalyzeTensor(context.Background(), "t", f32Tensor(1, 1+0x1p-20, 1+0x1p-10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := tf32.Mantissa.NumberDifferentValuesSeen(); n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func TestTensorOptions_DistinctValues(t *testing.T) {
+	// 2 signs, 3 exponents and 1 mantissa but only 4 distinct values.
+	values := []float32{1, 1, 2, -1, 0.5, 2}
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(math.Float32bits(v)>>16))
+	}
+	tensor := safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{uint64(len(values))}, Data: data}
+	o := TensorOptions{DistinctValues: true}
+	a, err := o.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.DistinctValues != 4 {
+		t.Fatal(a.DistinctValues)
+	}
+	if s, e, m := a.Sign.NumberDifferentValuesSeen(), a.Exponent.NumberDifferentValuesSeen(), a.Mantissa.NumberDifferentValuesSeen(); s*e*m != 6 {
+		t.Fatal(s, e, m)
+	}
+	// Not counted by default nor for F32.
+	if a, err = AnalyzeTensor(context.Background(), "t", tensor); err != nil || a.DistinctValues != 0 {
+		t.Fatal(a.DistinctValues, err)
+	}
+	if a, err = o.AnalyzeTensor(context.Background(), "t", f32Tensor(values...)); err != nil || a.DistinctValues != 0 {
+		t.Fatal(a.DistinctValues, err)
+	}
+}
+
+func TestAnalyzeTensor_MantissaTrailingZeros(t *testing.T) {
+	bf16 := func(values ...float32) safetensors.Tensor {
+		data := make([]byte, 2*len(values))
+		for i, v := range values {
+			binary.LittleEndian.PutUint16(data[2*i:], uint16(math.Float32bits(v)>>16))
+		}
+		return safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{uint64(len(values))}, Data: data}
+	}
+	data := []struct {
+		name   string
+		tensor safetensors.Tensor
+		want   int
+	}{
+		// 1.125 has the mantissa 0b0010000 so the lowest 4 bits are never set.
+		{"bf16", bf16(1.5, 1.125, -3, 0), 4},
+		{"bf16_zero", bf16(1, 2, -4), 7},
+		{"f32", f32Tensor(1.5, 1.125, -3, 0), 20},
+		{"f32_full", f32Tensor(1.5, math.Nextafter32(1, 2)), 0},
+		{"empty", f32Tensor(), 0},
+	}
+	for _, line := range data {
+		t.Run(line.name, func(t *testing.T) {
+			a, err := AnalyzeTensor(context.Background(), "t", line.tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.MantissaTrailingZeros != line.want {
+				t.Fatalf("want %d, got %d", line.want, a.MantissaTrailingZeros)
+			}
+			// Low memory mode doesn't change the result.
+			o := TensorOptions{LowMemory: true}
+			if a, err = o.AnalyzeTensor(context.Background(), "t", line.tensor); err != nil || a.MantissaTrailingZeros != line.want {
+				t.Fatal(a.MantissaTrailingZeros, err)
+			}
+		})
+	}
+}
+
+func TestTensorOptions_LowMemory(t *testing.T) {
+	// Values exactly representable in BF16, so the low 16 bits of the mantissa
+	// are never used.
+	r := rand.New(rand.NewSource(1))
+	values := make([]float32, 4096)
+	for i := range values {
+		values[i] = math.Float32frombits(math.Float32bits(float32(r.NormFloat64())) &^ 0xFFFF)
+	}
+	tensor := f32Tensor(values...)
+	exact, err := AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := TensorOptions{LowMemory: true}
+	low, err := o.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !low.LowMemory || exact.LowMemory {
+		t.Fatal("unexpected LowMemory")
+	}
+	if _, ok := low.Mantissa.(*BitMaskCount); !ok {
+		t.Fatalf("unexpected %T", low.Mantissa)
+	}
+	if w := low.Mantissa.BitsWasted(); w != 16 || exact.Mantissa.BitsWasted() != w {
+		t.Fatalf("want 16, got %d and %d", w, exact.Mantissa.BitsWasted())
+	}
+	if low.Exponent.BitsWasted() != exact.Exponent.BitsWasted() || low.Sign.BitsWasted() != exact.Sign.BitsWasted() || low.Min != exact.Min {
+		t.Fatalf("want %+v\ngot  %+v", exact, low)
+	}
+	if low.RecommendDType() != safetensors.F32 {
+		t.Fatal(low.RecommendDType())
+	}
+	data, err := json.Marshal(&low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := AnalyzedTensor{}
+	if err = json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Mantissa.BitsWasted() != 16 {
+		t.Fatal(got.Mantissa.BitsWasted())
+	}
+
+	// The exact analysis allocates the 1MiB mantissa BitSet.
+	allocated := func(o TensorOptions) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := o.AnalyzeTensor(context.Background(), "t", tensor); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	if e, l := allocated(TensorOptions{}), allocated(o); e < 1<<20 || l > e/4 {
+		t.Fatalf("exact %d, lowmem %d", e, l)
+	}
+}
+
+func TestAnalyzedTensor_AllIntegral(t *testing.T) {
+	data := []struct {
+		values []float32
+		want   safetensors.DType
+	}{
+		{[]float32{-3, 0, 7, 127, float32(math.NaN())}, safetensors.I8},
+		{[]float32{0, 255}, safetensors.U8},
+		{[]float32{-200, 3}, safetensors.I16},
+		{[]float32{1e6}, safetensors.U32},
+		{[]float32{1, 2.5}, ""},
+		{[]float32{float32(math.Inf(1))}, ""},
+		{nil, ""},
+	}
+	for i, l := range data {
+		a, err := AnalyzeTensor(context.Background(), "t", f32Tensor(l.values...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.AllIntegral != (l.want != "") {
+			t.Errorf("#%d: AllIntegral=%t", i, a.AllIntegral)
+		}
+		if got := a.RecommendIntDType(); got != l.want {
+			t.Errorf("#%d: want %q, got %q", i, l.want, got)
+		}
+	}
+	// Integer tensors are not flagged.
+	a, err := AnalyzeTensor(context.Background(), "t", safetensors.Tensor{DType: safetensors.I32, Shape: []uint64{1}, Data: []byte{1, 0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.AllIntegral || a.RecommendIntDType() != "" {
+		t.Fatal("unexpected integral")
+	}
+}
+
+func TestClamp(t *testing.T) {
+	data := []struct {
+		clamp func(float32) float32
+		in    float32
+		want  float32
+	}{
+		{ClampToF8E4M3, 1e30, 448},
+		{ClampToF8E4M3, -449, -448},
+		{ClampToF8E4M3, 3, 3},
+		{ClampToF8E5M2, 1e30, 57344},
+		{ClampToF16, -1e30, -65504},
+		{ClampToF16, 0x1p-30, 0x1p-30},
+		{ClampToBF16, math.MaxFloat32, 0x1.fep127},
+		{ClampToBF16, float32(math.Inf(1)), float32(math.Inf(1))},
+	}
+	for i, l := range data {
+		if got := l.clamp(l.in); got != l.want {
+			t.Errorf("#%d: %g: want %g, got %g", i, l.in, l.want, got)
+		}
+	}
+	if got := ClampToF8E4M3(float32(math.NaN())); !math.IsNaN(float64(got)) {
+		t.Fatal(got)
+	}
+}
+
+func TestFloatFormat_Round(t *testing.T) {
+	e4m3 := getFloatFormat(safetensors.F8_E4M3)
+	bf16 := getFloatFormat(safetensors.BF16)
+	data := []struct {
+		f    *floatFormat
+		in   float64
+		mode RoundingMode
+		want float64
+	}{
+		{e4m3, 448, RoundNearestEven, 448},
+		{e4m3, 460, RoundNearestEven, 448},
+		{e4m3, 470, RoundNearestEven, math.NaN()},
+		{e4m3, 470, RoundTruncate, 448},
+		{e4m3, 1.0625, RoundNearestEven, 1},
+		{e4m3, 1.1875, RoundNearestEven, 1.25},
+		{e4m3, 1.1875, RoundTruncate, 1.125},
+		{e4m3, 0x1.8p-10, RoundNearestEven, 0x1p-9},
+		{e4m3, 0x1p-11, RoundNearestEven, 0},
+		{bf16, 1 + 0x1p-8, RoundNearestEven, 1},
+		{bf16, 1 + 0x1.8p-8, RoundNearestEven, 1 + 0x1p-7},
+		{bf16, -3.4e38, RoundNearestEven, math.Inf(-1)},
+	}
+	for _, line := range data {
+		got := line.f.round(line.in, line.mode)
+		if got != line.want && !(math.IsNaN(got) && math.IsNaN(line.want)) {
+			t.Errorf("%s(%g, %s) = %g, want %g", line.f.dtype, line.in, line.mode, got, line.want)
+		}
+	}
+}
+
+func TestAnalyzeTensor_Cancel(t *testing.T) {
+	data := make([]byte, 16*checkEvery*4)
+	tensor := safetensors.Tensor{DType: safetensors.F32, Shape: []uint64{uint64(len(data) / 4)}, Data: data}
+	for _, shards := range []int{1, 4} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				cancel()
+			}()
+			start := time.Now()
+			_, err := TensorOptions{Shards: shards}.AnalyzeTensor(ctx, "t", tensor)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Fatalf("took %s", d)
+			}
+		})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := AnalyzeReader(ctx, "t", safetensors.F32, bytes.NewReader(data), int64(len(data)/4)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAnalyzeBytes(t *testing.T) {
+	a := f32Tensor(1, 2, 3)
+	a.Name = "model.a"
+	b := f32Tensor(-1)
+	b.Name = "model.b"
+	c := safetensors.Tensor{Name: "other", DType: safetensors.I32, Shape: []uint64{1}, Data: make([]byte, 4)}
+	f := safetensors.File{Tensors: []safetensors.Tensor{a, b, c}}
+	buf := bytes.Buffer{}
+	if err := f.Serialize(&buf); err != nil {
+		t.Fatal(err)
+	}
+	m, err := AnalyzeBytes(context.Background(), buf.Bytes(), regexp.MustCompile(`^model\.`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tensors) != 2 || m.Tensors[0].Name != "model.a" || m.Tensors[0].NumEl != 3 || m.Tensors[0].Max != 3 || m.Tensors[1].Name != "model.b" || m.Tensors[1].Min != -1 {
+		t.Fatalf("unexpected %+v", m)
+	}
+	if m, err = AnalyzeBytes(context.Background(), buf.Bytes(), nil); err != nil || len(m.Tensors) != 3 {
+		t.Fatalf("unexpected %+v, %v", m, err)
+	}
+	if _, err = AnalyzeBytes(context.Background(), buf.Bytes()[:10], nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestAnalyzeTensor_StdDev(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	values := make([]float32, 10000)
+	for i := range values {
+		values[i] = float32(r.NormFloat64()*2 + 1)
+	}
+	got, err := AnalyzeTensor(context.Background(), "t", f32Tensor(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	avg := 0.
+	for _, v := range values {
+		avg += float64(v)
+	}
+	avg /= float64(len(values))
+	variance := 0.
+	for _, v := range values {
+		variance += (float64(v) - avg) * (float64(v) - avg)
+	}
+	want := math.Sqrt(variance / float64(len(values)))
+	if math.Abs(got.Avg-avg) > 1e-9 {
+		t.Fatalf("Avg: want %g, got %g", avg, got.Avg)
+	}
+	if math.Abs(got.StdDev-want) > 1e-9 {
+		t.Fatalf("StdDev: want %g, got %g", want, got.StdDev)
+	}
+	// The median of |N(1, 2)| is about 1.6, in the [1, 2) binade.
+	if got.P001 >= got.P50 || got.P50 != 1 || got.P999 != 4 {
+		t.Fatalf("percentiles: %g, %g, %g", got.P001, got.P50, got.P999)
+	}
+}
+
+func TestAbsPercentile(t *testing.T) {
+	// F16: exponent 15 is 1, 31 is Inf/NaN and ignored.
+	exp := make([]uint64, 32)
+	exp[0] = 1
+	exp[14] = 2
+	exp[16] = 7
+	exp[31] = 100
+	data := []struct {
+		p    float64
+		want float64
+	}{
+		{0, 0},
+		{0.1, 0},
+		{0.2, 0.5},
+		{0.3, 0.5},
+		{0.31, 2},
+		{1, 2},
+	}
+	for _, l := range data {
+		if got := absPercentile(exp, 5, false, l.p); got != l.want {
+			t.Errorf("absPercentile(%g) = %g, want %g", l.p, got, l.want)
+		}
+	}
+	if got := absPercentile(nil, 5, false, 0.5); got != 0 {
+		t.Fatal(got)
+	}
+}
+
+func TestAnalyzeTensor_F8(t *testing.T) {
+	data := []struct {
+		dtype     safetensors.DType
+		in        []byte
+		exponents map[int]uint64
+		mantissas int32
+		min, max  float64
+		nan, inf  int
+		subnormal int
+	}{
+		{
+			// 1, 448, 2^-9, -1.125, NaN.
+			safetensors.F8_E4M3, []byte{0x38, 0x7E, 0x01, 0xB9, 0x7F},
+			map[int]uint64{0: 1, 7: 2, 15: 2}, 4, -1.125, 448, 1, 0, 1,
+		},
+		{
+			// 1, +Inf, -2.5, 0.
+			safetensors.F8_E5M2, []byte{0x3C, 0x7C, 0xC1, 0x00},
+			map[int]uint64{0: 1, 15: 1, 16: 1, 31: 1}, 2, -2.5, 1, 0, 1, 0,
+		},
+	}
+	for _, l := range data {
+		t.Run(string(l.dtype), func(t *testing.T) {
+			tensor := safetensors.Tensor{DType: l.dtype, Shape: []uint64{uint64(len(l.in))}, Data: l.in}
+			a, err := AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := getFloatFormat(l.dtype)
+			if a.DType != l.dtype || a.NumEl != int64(len(l.in)) || a.Min != l.min || a.Max != l.max || a.NaN != l.nan || a.Inf != l.inf || a.Subnormal != l.subnormal {
+				t.Fatalf("unexpected %+v", a)
+			}
+			exp := a.Exponent.(*BitKindCount)
+			man := a.Mantissa.(*BitKindBool)
+			if exp.Allocation != int32(f.exponentBits) || man.Allocation != int32(f.mantissaBits) {
+				t.Fatalf("allocation: %d, %d", exp.Allocation, man.Allocation)
+			}
+			for i, c := range a.ExponentHistogram() {
+				if c != l.exponents[i] {
+					t.Fatalf("exponent %d: want %d, got %d", i, l.exponents[i], c)
+				}
+			}
+			if got := man.ValuesSeen.Count(); got != l.mantissas {
+				t.Fatalf("mantissas: want %d, got %d", l.mantissas, got)
+			}
+		})
+	}
+}
+
+func TestTensorOptions_Hash(t *testing.T) {
+	tensor := f32Tensor(1, 2, 3)
+	o := TensorOptions{Hash: true}
+	a, err := o.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := fnv.New64a()
+	h.Write(tensor.Data)
+	if want := hex.EncodeToString(h.Sum(nil)); a.Digest != want {
+		t.Fatalf("want %s, got %s", want, a.Digest)
+	}
+	r, err := o.AnalyzeReader(context.Background(), "t", tensor.DType, bytes.NewReader(tensor.Data), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Digest != a.Digest {
+		t.Fatalf("want %s, got %s", a.Digest, r.Digest)
+	}
+	o.Hasher = SHA256Hasher{}
+	if a, err = o.AnalyzeTensor(context.Background(), "t", tensor); err != nil {
+		t.Fatal(err)
+	}
+	d := sha256.Sum256(tensor.Data)
+	if want := hex.EncodeToString(d[:]); a.Digest != want {
+		t.Fatalf("want %s, got %s", want, a.Digest)
+	}
+	if a, err = AnalyzeTensor(context.Background(), "t", tensor); err != nil || a.Digest != "" {
+		t.Fatal(a.Digest, err)
+	}
+}
+
+func TestSummary_WastedBreakdown(t *testing.T) {
+	// Every sign and exponent of F8_E4M3 is used, but the mantissa is always
+	// 0 so all the waste is in the mantissa.
+	var data []byte
+	for sign := range 2 {
+		for e := range 16 {
+			data = append(data, byte(sign<<7|e<<3))
+		}
+	}
+	a, err := AnalyzeTensor(context.Background(), "t", safetensors.Tensor{DType: safetensors.F8_E4M3, Shape: []uint64{uint64(len(data))}, Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := AnalyzedModel{Tensors: []AnalyzedTensor{a, a}}
+	s := m.Summary()
+	if s.SignBitsWasted != 0 || s.ExponentBitsWasted != 0 || s.MantissaBitsWasted != 2*32*3 {
+		t.Fatalf("%+v", s)
+	}
+	if sign, exponent, mantissa := s.WastedBreakdown(); sign != 0 || exponent != 0 || mantissa != 100 {
+		t.Fatal(sign, exponent, mantissa)
+	}
+	s = Summary{}
+	if sign, exponent, mantissa := s.WastedBreakdown(); sign != 0 || exponent != 0 || mantissa != 0 {
+		t.Fatal(sign, exponent, mantissa)
+	}
+}
+
+func TestAnalyzedTensor_BytesWasted(t *testing.T) {
+	// Always positive: 1 bit of sign wasted. 4 exponents: 6 of 8 bits wasted.
+	// The mantissa is always 0: 23 bits wasted.
+	a, err := AnalyzeTensor(context.Background(), "t", f32Tensor(1, 2, 4, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, e, m := a.Sign.BitsWasted(), a.Exponent.BitsWasted(), a.Mantissa.BitsWasted(); s != 1 || e != 6 || m != 23 {
+		t.Fatal(s, e, m)
+	}
+	if got := a.BitsWasted(); got != 30 {
+		t.Fatal(got)
+	}
+	// 4 * 30 bits.
+	if got := a.BytesWasted(); got != 15 {
+		t.Fatal(got)
+	}
+	m := AnalyzedModel{Tensors: []AnalyzedTensor{a, a}}
+	if got := m.TotalWasted(); got != 30 {
+		t.Fatal(got)
+	}
+}
+
+func TestToNative_BigEndian(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 4096)
+	r.Read(data)
+	for _, dtype := range []safetensors.DType{safetensors.F16, safetensors.BF16, safetensors.F32, safetensors.I16, safetensors.U16, safetensors.I32, safetensors.U32} {
+		t.Run(string(dtype), func(t *testing.T) {
+			tensor := safetensors.Tensor{DType: dtype, Shape: []uint64{uint64(len(data)) / dtype.WordSize()}, Data: data}
+			want, err := AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Simulate a big endian host, where the words must be swapped to be
+			// read natively, by feeding pre-swapped data.
+			swapped := make([]byte, len(data))
+			ws := int(dtype.WordSize())
+			for i := 0; i < len(data); i += ws {
+				for j := range ws {
+					swapped[i+j] = data[i+ws-1-j]
+				}
+			}
+			hostLittleEndian = false
+			defer func() {
+				hostLittleEndian = true
+			}()
+			tensor.Data = swapped
+			got, err := AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("want %+v\ngot  %+v", want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkAnalyzeTensor_Weights(b *testing.B) {
+	// Weights are usually normally distributed around 0 with a small deviation.
+	r := rand.New(rand.NewSource(1))
+	values := make([]float32, 16<<20)
+	for i := range values {
+		values[i] = float32(r.NormFloat64() * 0.02)
+	}
+	for _, dtype := range []safetensors.DType{safetensors.BF16, safetensors.F32} {
+		b.Run(string(dtype), func(b *testing.B) {
+			ws := int(dtype.WordSize())
+			data := make([]byte, len(values)*ws)
+			for i, v := range values {
+				switch dtype {
+				case safetensors.BF16:
+					binary.LittleEndian.PutUint16(data[2*i:], uint16(math.Float32bits(v)>>16))
+				case safetensors.F32:
+					binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+				}
+			}
+			tensor := safetensors.Tensor{DType: dtype, Shape: []uint64{uint64(len(values))}, Data: data}
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := AnalyzeTensor(context.Background(), "t", tensor); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// addTwoPass is the rejected alternative to f32Histogram.add: min, max and
+// the sums are computed in a separate tight loop before the bit occupancy
+// pass. It is kept to reproduce the measurement with
+// BenchmarkF32Histogram_Add.
+func (h *f32Histogram) addTwoPass(data []byte) {
+	data = toNative(data, int(safetensors.F32.WordSize()))
+	// #nosec G103
+	mapped := unsafe.Slice((*float32)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/int(safetensors.F32.WordSize()))
+	h.numEl += int64(len(mapped))
+	for _, f := range mapped {
+		v := float64(f)
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < -1e37 || v > 1e37 {
+			continue
+		}
+		if h.ftz && v != 0 && math.Abs(v) < 0x1p-126 {
+			v = math.Copysign(0, v)
+		}
+		h.total += v
+		h.sumSq += v * v
+		h.min = min(h.min, v)
+		h.max = max(h.max, v)
+		if math.Abs(v) < h.prune {
+			h.prunable++
+		}
+		if v != math.Trunc(v) {
+			h.fractional = true
+		}
+	}
+	for _, f := range mapped {
+		f := floatx.F32(f)
+		sign, exponent, mantissa := f.Components()
+		if exponent == 0 && mantissa != 0 {
+			if h.ftz {
+				f = floatx.F32(math.Float32frombits(uint32(sign) << floatx.F32SignOffset))
+				mantissa = 0
+				h.flushed++
+			} else {
+				h.subnormal++
+			}
+		}
+		h.signs.Add(int(sign))
+		h.exponents.Add(int(exponent))
+		if h.tf32 {
+			h.addMantissa(uint32(mantissa) >> tf32Shift)
+		} else {
+			h.addMantissa(uint32(mantissa))
+		}
+		if v := float64(f); math.IsNaN(v) {
+			h.addNaN(mantissa>>(floatx.F32ExponentOffset-1) != 0)
+		} else if math.IsInf(v, 0) || v < -1e37 || v > 1e37 {
+			h.addInf(v > 0)
+		} else {
+			if h.downcast != nil {
+				h.downcast.add(v)
+			}
+			if h.rmse != nil {
+				h.rmse.add(v)
+			}
+		}
+	}
+}
+
+func TestF32Histogram_TwoPass(t *testing.T) {
+	// The rejected two pass loop must match the single pass exactly, so the
+	// benchmark compares equivalent work.
+	r := rand.New(rand.NewSource(1))
+	values := []float32{0x1p-140, -0x1p-130, float32(math.Inf(1)), float32(math.NaN()), 2e37, 3, -0}
+	for range 10000 {
+		values = append(values, float32(r.NormFloat64()*math.Exp2(float64(r.Intn(40)-20))))
+	}
+	// The minimum of the second set is a subnormal, flushed with FlushToZero.
+	for _, data := range [][]byte{f32Tensor(values...).Data, f32Tensor(0x1p-140, 0x1p-139, 1).Data} {
+		for _, opts := range []TensorOptions{{}, {FlushToZero: true, PruneThreshold: 0.01}, {Downcast: safetensors.BF16, DowncastErrors: true}} {
+			want := newF32Histogram(&opts)
+			want.add(data)
+			got := newF32Histogram(&opts)
+			got.addTwoPass(data)
+			if w, g := want.analyzed("t"), got.analyzed("t"); !reflect.DeepEqual(w, g) {
+				t.Fatalf("%+v:\nwant %+v\ngot  %+v", opts, w, g)
+			}
+		}
+	}
+}
+
+func BenchmarkF32Histogram_Add(b *testing.B) {
+	// Compares f32Histogram.add with the rejected addTwoPass.
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, 4*(16<<20))
+	for i := 0; i < len(data); i += 4 {
+		binary.LittleEndian.PutUint32(data[i:], math.Float32bits(float32(r.NormFloat64()*0.02)))
+	}
+	opts := TensorOptions{}
+	for _, l := range []struct {
+		name string
+		add  func(h *f32Histogram, data []byte)
+	}{
+		{"single_pass", (*f32Histogram).add},
+		{"two_pass", (*f32Histogram).addTwoPass},
+	} {
+		b.Run(l.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				l.add(newF32Histogram(&opts), data)
+			}
+		})
+	}
+}
+
+func TestAnalyzeTensor_F32Components(t *testing.T) {
+	a, err := AnalyzeTensor(context.Background(), "t", f32Tensor(1, -2, 0x1p-140, float32(math.Inf(1)), float32(math.NaN())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Subnormal != 1 || a.Inf != 1 || a.NaN != 1 || a.QNaN != 1 || a.Min != -2 || a.Max != 1 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	if got := a.Sign.(*BitKindCount).ValuesSeen.Frequencies(); !slices.Equal(got, []uint64{4, 1}) {
+		t.Fatalf("sign: %v", got)
+	}
+	exp := a.ExponentHistogram()
+	if exp[0] != 1 || exp[127] != 1 || exp[128] != 1 || exp[255] != 2 {
+		t.Fatalf("exponent: 0=%d 127=%d 128=%d 255=%d", exp[0], exp[127], exp[128], exp[255])
+	}
+	man := &a.Mantissa.(*BitKindBool).ValuesSeen
+	if man.Count() != 3 || !man.Get(0) || !man.Get(1<<9) || !man.Get(1<<22) {
+		t.Fatalf("mantissa: %d", man.Count())
+	}
+}
+
+func TestAnalyzeTensor_Empty(t *testing.T) {
+	for _, dtype := range []safetensors.DType{safetensors.F8_E4M3, safetensors.F8_E5M2, safetensors.F16, safetensors.BF16, safetensors.F32, safetensors.I16, safetensors.U16, safetensors.I32, safetensors.U32} {
+		t.Run(string(dtype), func(t *testing.T) {
+			tensor := safetensors.Tensor{DType: dtype, Shape: []uint64{0}}
+			a, err := AnalyzeTensor(context.Background(), "t", tensor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.NumEl != 0 || a.Len() != 0 || a.Avg != 0 || a.StdDev != 0 || a.Min != 0 || a.Max != 0 || a.Entropy != 0 || a.Exponent.BitsActuallyUsed() != 0 || a.Mantissa.BitsActuallyUsed() != 0 {
+				t.Fatalf("unexpected %+v", a)
+			}
+			r, err := AnalyzeReader(context.Background(), "t", dtype, bytes.NewReader(nil), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Avg != 0 || r.Min != 0 || r.Max != 0 {
+				t.Fatalf("unexpected %+v", r)
+			}
+			m := AnalyzedModel{Tensors: []AnalyzedTensor{a}}
+			if _, err = json.Marshal(&m); err != nil {
+				t.Fatal(err)
+			}
+			if s := m.Summary(); s.NumEl != 0 || s.Bytes != 0 || s.BytesWasted != 0 || s.EffectiveBitsPerWeight() != 0 {
+				t.Fatalf("unexpected %+v", s)
+			}
+		})
+	}
+	a, err := AnalyzeTensorPacked(context.Background(), "t", safetensors.Tensor{DType: safetensors.U32, Shape: []uint64{0}}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.NumEl != 0 || a.Avg != 0 || a.Min != 0 || a.Max != 0 {
+		t.Fatalf("unexpected %+v", a)
+	}
+}
+
+func TestBitMaskCount_BitOccupancy(t *testing.T) {
+	// Only the bits 0, 1 and 3 are used.
+	tensor := safetensors.Tensor{DType: safetensors.I32, Shape: []uint64{3}, Data: []byte{1, 0, 0, 0, 2, 0, 0, 0, 8, 0, 0, 0}}
+	a, err := AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := a.Mantissa.(*BitMaskCount).BitOccupancy()
+	if len(got) != 31 || !got[0] || !got[1] || got[2] || !got[3] {
+		t.Fatalf("unexpected %v", got)
+	}
+	for i := 4; i < len(got); i++ {
+		if got[i] {
+			t.Fatalf("bit %d: unexpected %v", i, got)
+		}
+	}
+}
+
+func TestAnalyzeTensor_IsConstant(t *testing.T) {
+	// 0.5 four times.
+	half := safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{2, 2}, Data: []byte{0, 0x3F, 0, 0x3F, 0, 0x3F, 0, 0x3F}}
+	a, err := AnalyzeTensor(context.Background(), "t", half)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsConstant {
+		t.Fatalf("unexpected %+v", a)
+	}
+	for _, tensor := range []safetensors.Tensor{
+		f32Tensor(0.5, 0.5, 0.75),
+		// Only the sign differs.
+		f32Tensor(1, -1),
+		{DType: safetensors.BF16, Shape: []uint64{0}},
+	} {
+		if a, err = AnalyzeTensor(context.Background(), "t", tensor); err != nil || a.IsConstant {
+			t.Fatal(a, err)
+		}
+	}
+	i32 := safetensors.Tensor{DType: safetensors.I32, Shape: []uint64{2}, Data: []byte{7, 0, 0, 0, 7, 0, 0, 0}}
+	if a, err = AnalyzeTensor(context.Background(), "t", i32); err != nil || !a.IsConstant {
+		t.Fatal(a, err)
+	}
+}
+
+func TestAnalyzeTensor_Prunable(t *testing.T) {
+	o := TensorOptions{PruneThreshold: 0.25}
+	// Half the values are below the threshold; NaN and Inf are never prunable.
+	tensor := f32Tensor(0, -0.001, 0.005, 1e-30, 0.25, -0.5, 2, 100, float32(math.NaN()), float32(math.Inf(-1)))
+	a, err := o.AnalyzeTensor(context.Background(), "t", tensor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Prunable != 4 {
+		t.Fatalf("want 4 prunable, got %d", a.Prunable)
+	}
+	if a, err = AnalyzeTensor(context.Background(), "t", tensor); err != nil || a.Prunable != 0 {
+		t.Fatal(a, err)
+	}
+	bf16 := safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{2}, Data: []byte{0x80, 0x3F, 0x00, 0x00}}
+	if a, err = o.AnalyzeTensor(context.Background(), "t", bf16); err != nil || a.Prunable != 1 {
+		t.Fatal(a, err)
+	}
+}
+
+func TestAnalyzeTensor_NoFinite(t *testing.T) {
+	nan := safetensors.Tensor{DType: safetensors.BF16, Shape: []uint64{3}, Data: []byte{0xC0, 0x7F, 0xC0, 0xFF, 0xC0, 0x7F}}
+	inf := f32Tensor(float32(math.Inf(1)), float32(math.Inf(-1)))
+	for _, tensor := range []safetensors.Tensor{nan, inf} {
+		a, err := AnalyzeTensor(context.Background(), "t", tensor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.NoFinite || a.Min != 0 || a.Max != 0 || a.Avg != 0 || int64(a.Inf+a.NaN) != a.NumEl {
+			t.Fatalf("unexpected %+v", a)
+		}
+	}
+	a, err := AnalyzeTensor(context.Background(), "t", f32Tensor(float32(math.NaN()), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.NoFinite || a.Min != 2 || a.Max != 2 {
+		t.Fatalf("unexpected %+v", a)
+	}
+}
+
+func TestAnalyzeTensor_ExponentRange(t *testing.T) {
+	data := []struct {
+		in     []float32
+		lo, hi int
+	}{
+		{[]float32{0.25, 1, -3, 1000}, -2, 9},
+		// Zeros, subnormals and infinities are ignored.
+		{[]float32{0, 0x1p-140, 0.5, float32(math.Inf(-1)), float32(math.NaN())}, -1, -1},
+		{[]float32{0, 0x1p-140}, 0, 0},
+		{[]float32{0x1p-126, 0x1p127}, -126, 127},
+	}
+	for i, l := range data {
+		a, err := AnalyzeTensor(context.Background(), "t", f32Tensor(l.in...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.MinExp != l.lo || a.MaxExp != l.hi {
+			t.Errorf("#%d: want [%d,%d], got [%d,%d]", i, l.lo, l.hi, a.MinExp, a.MaxExp)
+		}
+	}
+	// F8_E4M3 uses the all ones exponent for normal values: 448 is 1.75*2^8.
+	a, err := AnalyzeTensor(context.Background(), "t", safetensors.Tensor{DType: safetensors.F8_E4M3, Shape: []uint64{2}, Data: []byte{0x38, 0x7E}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.MinExp != 0 || a.MaxExp != 8 {
+		t.Fatalf("want [0,8], got [%d,%d]", a.MinExp, a.MaxExp)
+	}
+}
+
+func TestLookupTable(t *testing.T) {
+	// Compare every value against a reference implementation.
+	check := func(dtype safetensors.DType, n int, decode func(i int) float32) {
+		f := getFloatFormat(dtype)
+		for i := range n {
+			want := refDecode(f, uint32(i))
+			if got := decode(i); math.IsNaN(want) != math.IsNaN(float64(got)) || (!math.IsNaN(want) && float64(got) != want) {
+				t.Fatalf("%s %#x: want %g, got %g", dtype, i, want, got)
+			}
+		}
+	}
+	check(safetensors.F16, 1<<16, func(i int) float32 { return F16ToFloat32(uint16(i)) })
+	check(safetensors.BF16, 1<<16, func(i int) float32 { return BF16ToFloat32(uint16(i)) })
+	check(safetensors.F8_E4M3, 1<<8, func(i int) float32 { return f8E4M3Lookup[i] })
+	check(safetensors.F8_E5M2, 1<<8, func(i int) float32 { return f8E5M2Lookup[i] })
+	if got := F16ToFloat32(0x3C00); got != 1 {
+		t.Fatal(got)
+	}
+	// floatx.BF16 mis-decodes subnormals.
+	if got := BF16ToFloat32(0x0001); got != 0x1p-133 {
+		t.Fatal(got)
+	}
+}
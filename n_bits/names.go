@@ -0,0 +1,55 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ggufNames maps the GGUF names of the tensors outside of the blocks to the
+// HuggingFace transformers names.
+var ggufNames = map[string]string{
+	"token_embd":  "model.embed_tokens",
+	"output_norm": "model.norm",
+	"output":      "lm_head",
+}
+
+// ggufBlockNames maps the GGUF names of the tensors in a block to the
+// HuggingFace transformers names, relative to the layer.
+var ggufBlockNames = map[string]string{
+	"attn_q":      "self_attn.q_proj",
+	"attn_k":      "self_attn.k_proj",
+	"attn_v":      "self_attn.v_proj",
+	"attn_output": "self_attn.o_proj",
+	"attn_norm":   "input_layernorm",
+	"ffn_norm":    "post_attention_layernorm",
+	"ffn_gate":    "mlp.gate_proj",
+	"ffn_up":      "mlp.up_proj",
+	"ffn_down":    "mlp.down_proj",
+}
+
+var ggufBlock = regexp.MustCompile(`^blk\.(\d+)\.([a-z_]+)\.(weight|bias)$`)
+
+// NormalizeName returns the HuggingFace transformers name of a tensor named by
+// another framework, so the same tensor can be matched across conversions.
+//
+// It knows the GGUF names of the llama architecture, e.g.
+// "blk.0.ffn_gate.weight" becomes "model.layers.0.mlp.gate_proj.weight". Other
+// names are returned as is.
+func NormalizeName(name string) string {
+	if m := ggufBlock.FindStringSubmatch(name); m != nil {
+		if n, ok := ggufBlockNames[m[2]]; ok {
+			return "model.layers." + m[1] + "." + n + "." + m[3]
+		}
+		return name
+	}
+	if base, suffix, ok := strings.Cut(name, "."); ok {
+		if n, ok := ggufNames[base]; ok && (suffix == "weight" || suffix == "bias") {
+			return n + "." + suffix
+		}
+	}
+	return name
+}
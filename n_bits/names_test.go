@@ -0,0 +1,40 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import "testing"
+
+func TestNormalizeName(t *testing.T) {
+	data := []struct {
+		gguf string
+		hf   string
+	}{
+		{"token_embd.weight", "model.embed_tokens.weight"},
+		{"output_norm.weight", "model.norm.weight"},
+		{"output.weight", "lm_head.weight"},
+		{"blk.0.attn_q.weight", "model.layers.0.self_attn.q_proj.weight"},
+		{"blk.3.attn_k.bias", "model.layers.3.self_attn.k_proj.bias"},
+		{"blk.11.attn_output.weight", "model.layers.11.self_attn.o_proj.weight"},
+		{"blk.0.attn_norm.weight", "model.layers.0.input_layernorm.weight"},
+		{"blk.0.ffn_norm.weight", "model.layers.0.post_attention_layernorm.weight"},
+		{"blk.0.ffn_gate.weight", "model.layers.0.mlp.gate_proj.weight"},
+		{"blk.0.ffn_up.weight", "model.layers.0.mlp.up_proj.weight"},
+		{"blk.0.ffn_down.weight", "model.layers.0.mlp.down_proj.weight"},
+	}
+	for _, l := range data {
+		if got := NormalizeName(l.gguf); got != l.hf {
+			t.Errorf("%s: want %s, got %s", l.gguf, l.hf, got)
+		}
+		// HuggingFace names are already normalized.
+		if got := NormalizeName(l.hf); got != l.hf {
+			t.Errorf("%s: got %s", l.hf, got)
+		}
+	}
+	for _, name := range []string{"blk.0.unknown.weight", "output.scales", "encoder.conv1.weight"} {
+		if got := NormalizeName(name); got != name {
+			t.Errorf("%s: got %s", name, got)
+		}
+	}
+}
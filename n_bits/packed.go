@@ -0,0 +1,90 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/maruel/safetensors"
+)
+
+// AnalyzeTensorPacked analyzes an integer tensor containing weights packed
+// bitsPerWeight bits at a time, like the 4 bits weights of GPTQ and AWQ
+// stored in I32 or U32 tensors.
+//
+// The weights are unpacked starting from the least significant bits. The
+// returned AnalyzedTensor.NumEl is the number of packed weights and Mantissa
+// reports how many of the 1<<bitsPerWeight possible codes are used.
+func AnalyzeTensorPacked(ctx context.Context, name string, t safetensors.Tensor, bitsPerWeight int) (AnalyzedTensor, error) {
+	return TensorOptions{}.AnalyzeTensorPacked(ctx, name, t, bitsPerWeight)
+}
+
+// AnalyzeTensorPacked analyzes an integer tensor containing weights packed
+// bitsPerWeight bits at a time.
+//
+// Only TensorOptions.Hash applies.
+func (o TensorOptions) AnalyzeTensorPacked(ctx context.Context, name string, t safetensors.Tensor, bitsPerWeight int) (AnalyzedTensor, error) {
+	switch bitsPerWeight {
+	case 1, 2, 4, 8:
+	default:
+		return AnalyzedTensor{}, fmt.Errorf("%s: unsupported bits per weight %d", name, bitsPerWeight)
+	}
+	t.DType = normalizeDType(name, t.DType)
+	if t.DType != safetensors.I32 && t.DType != safetensors.U32 {
+		return AnalyzedTensor{}, fmt.Errorf("%s: can't unpack: %w", name, &UnsupportedDTypeError{DType: t.DType})
+	}
+	if err := checkNotEmpty(&t); err != nil {
+		return AnalyzedTensor{}, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := t.Validate(); err != nil {
+		return AnalyzedTensor{}, fmt.Errorf("%s: %w", name, err)
+	}
+	codes := CountSet{}
+	codes.Resize(1 << bitsPerWeight)
+	mask := byte(1<<bitsPerWeight - 1)
+	total := uint64(0)
+	lo, hi := int(mask), 0
+	for i, b := range t.Data {
+		if i%checkEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return AnalyzedTensor{}, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		for j := 0; j < 8; j += bitsPerWeight {
+			c := int((b >> j) & mask)
+			codes.Add(c)
+			total += uint64(c)
+			lo = min(lo, c)
+			hi = max(hi, c)
+		}
+	}
+	numEl := int64(len(t.Data)) * 8 / int64(bitsPerWeight)
+	avg := 0.
+	if numEl == 0 {
+		lo = 0
+	} else {
+		avg = float64(total) / float64(numEl)
+	}
+	a := AnalyzedTensor{
+		Name:       name,
+		DType:      t.DType,
+		NumEl:      numEl,
+		Shape:      toShape(t.Shape),
+		PackBits:   bitsPerWeight,
+		Avg:        avg,
+		Min:        float64(lo),
+		Max:        float64(hi),
+		Entropy:    codes.Entropy(),
+		IsConstant: codes.Effective() == 1,
+		Sign:       &BitKindCount{Allocation: 0},
+		Exponent:   &BitKindCount{Allocation: 0},
+		Mantissa:   &BitKindCount{Allocation: int32(bitsPerWeight), ValuesSeen: codes},
+	}
+	if o.Hash {
+		a.Digest = o.digest(t.Data)
+	}
+	return a, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package n_bits
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/maruel/safetensors"
+)
+
+func TestAnalyzeTensorPacked(t *testing.T) {
+	data := make([]byte, 8)
+	// Codes 0 to 7 then eight 0.
+	binary.LittleEndian.PutUint32(data, 0x76543210)
+	tensor := safetensors.Tensor{DType: safetensors.U32, Shape: []uint64{2}, Data: data}
+	a, err := AnalyzeTensorPacked(context.Background(), "t", tensor, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.NumEl != 16 || a.Len() != 8 || a.Min != 0 || a.Max != 7 || a.Avg != 28./16 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	if got := a.Mantissa.BitsActuallyUsed(); got != 3 {
+		t.Fatalf("want 3 bits used, got %g", got)
+	}
+	if got := a.Mantissa.BitsWasted(); got != 1 {
+		t.Fatalf("want 1 bit wasted, got %d", got)
+	}
+	if codes := a.Mantissa.(*BitKindCount).ValuesSeen.Frequencies(); codes[0] != 9 || codes[7] != 1 || codes[8] != 0 {
+		t.Fatalf("unexpected codes %v", codes)
+	}
+	m := AnalyzedModel{Tensors: []AnalyzedTensor{a}}
+	if s := m.Summary(); s.Bytes != 8 || s.BytesWasted != 2 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+	b, err := json.Marshal(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := AnalyzedTensor{}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.PackBits != 4 || got.Mantissa.BitsActuallyUsed() != 3 {
+		t.Fatalf("unexpected %+v", got)
+	}
+
+	if _, err = AnalyzeTensorPacked(context.Background(), "t", tensor, 3); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = AnalyzeTensorPacked(context.Background(), "t", f32Tensor(1), 4); err == nil {
+		t.Fatal("expected error")
+	}
+}
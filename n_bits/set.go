@@ -9,7 +9,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"math/bits"
+	"strings"
 )
 
 // Note: there's many many high efficiency bit sets but few with counts? I
@@ -29,14 +32,28 @@ type BitSet struct {
 	Bits []uint64
 }
 
+// Resize sets the number of bits, keeping the bits below both the old and
+// the new length.
+//
+// When shrinking, the bits at indices >= l in the last word are cleared so
+// they are never counted.
 func (b *BitSet) Resize(l int) {
 	d := make([]uint64, (l+63)/64)
 	// Backup the old data if any.
-	copy(b.Bits, d)
+	copy(d, b.Bits)
+	if r := l % 64; r != 0 {
+		d[len(d)-1] &= 1<<r - 1
+	}
 	b.Len = l
 	b.Bits = d
 }
 
+// Clear unsets all the bits in place, keeping Len, so the set can be reused
+// without allocating.
+func (b *BitSet) Clear() {
+	clear(b.Bits)
+}
+
 func (b *BitSet) Set(i int) {
 	b.Bits[i/64] |= 1 << (i % 64)
 }
@@ -45,6 +62,24 @@ func (b *BitSet) Get(i int) bool {
 	return b.Bits[i/64]&(1<<(i%64)) != 0
 }
 
+// SetChecked is like Set but returns an error if i is out of range instead of
+// panicking or silently setting a bit past Len.
+func (b *BitSet) SetChecked(i int) error {
+	if i < 0 || i >= b.Len {
+		return fmt.Errorf("BitSet.Set(i=%d) out of range [0,%d)", i, b.Len)
+	}
+	b.Set(i)
+	return nil
+}
+
+// GetChecked is like Get but returns an error if i is out of range.
+func (b *BitSet) GetChecked(i int) (bool, error) {
+	if i < 0 || i >= b.Len {
+		return false, fmt.Errorf("BitSet.Get(i=%d) out of range [0,%d)", i, b.Len)
+	}
+	return b.Get(i), nil
+}
+
 func (b *BitSet) Expand() []bool {
 	out := make([]bool, b.Len)
 	// TODO: This is the slow version.
@@ -63,6 +98,49 @@ func (b *BitSet) Effective() int32 {
 	return int32(o)
 }
 
+// ForEachSet calls fn with the index of each set bit, in increasing order.
+//
+// It skips zero words so it is much faster than Expand for sparse sets and
+// doesn't allocate.
+func (b *BitSet) ForEachSet(fn func(i int)) {
+	for w, v := range b.Bits {
+		for ; v != 0; v &= v - 1 {
+			fn(w*64 + bits.TrailingZeros64(v))
+		}
+	}
+}
+
+// Count returns the number of set bits. It is an alias of Effective.
+func (b *BitSet) Count() int32 {
+	return b.Effective()
+}
+
+// Union sets the bits that are set in other.
+//
+// Only the prefix common to both sets is considered; the bits of b past
+// other.Len are left intact.
+func (b *BitSet) Union(other *BitSet) {
+	l := min(b.Len, other.Len)
+	for i := range l / 64 {
+		b.Bits[i] |= other.Bits[i]
+	}
+	if r := l % 64; r != 0 {
+		b.Bits[l/64] |= other.Bits[l/64] & (1<<r - 1)
+	}
+}
+
+// Intersection clears the bits that are not set in other.
+//
+// Only the prefix common to both sets is kept; the bits of b past other.Len
+// are cleared.
+func (b *BitSet) Intersection(other *BitSet) {
+	l := min(len(b.Bits), len(other.Bits))
+	for i := range l {
+		b.Bits[i] &= other.Bits[i]
+	}
+	clear(b.Bits[l:])
+}
+
 // MarshalJSON implements json.Marshaler
 //
 // The first byte is the number of valid bits in the last uint64. If 0, it
@@ -122,48 +200,202 @@ func (b *BitSet) UnmarshalJSON(data []byte) error {
 //
 // It is designed to be densely stored in JSON.
 //
-// TODO: Handle overflows.
+// Counts are stored as uint8 until one of them would overflow, then all the
+// counts are transparently promoted to uint64 in Wide.
 type CountSet struct {
 	Counts []uint8
+	// Wide replaces Counts once a count overflowed uint8.
+	Wide []uint64
 }
 
+// Resize sets the number of values tracked, keeping the counts below both the
+// old and the new length.
 func (c *CountSet) Resize(l int) {
+	if c.Wide != nil {
+		d := make([]uint64, l)
+		copy(d, c.Wide)
+		c.Wide = d
+		return
+	}
 	d := make([]uint8, l)
 	// Backup the old data if any.
-	copy(c.Counts, d)
+	copy(d, c.Counts)
 	c.Counts = d
 }
 
+// Clear zeros all the counts in place, keeping the length, so the set can be
+// reused without allocating. Counts already promoted to Wide stay wide.
+func (c *CountSet) Clear() {
+	clear(c.Counts)
+	clear(c.Wide)
+}
+
 func (c *CountSet) Add(i int) {
-	if c.Counts[i] != 0xFF {
+	if c.Wide != nil {
+		c.Wide[i]++
+	} else if c.Counts[i] != 0xFF {
 		c.Counts[i]++
+	} else {
+		c.widen()
+		c.Wide[i]++
+	}
+}
+
+// AddChecked is like Add but returns an error if i is out of range instead of
+// panicking.
+func (c *CountSet) AddChecked(i int) error {
+	if i < 0 || i >= c.Len() {
+		return fmt.Errorf("CountSet.Add(i=%d) out of range [0,%d)", i, c.Len())
+	}
+	c.Add(i)
+	return nil
+}
+
+// widen promotes the counts to uint64.
+func (c *CountSet) widen() {
+	c.Wide = make([]uint64, len(c.Counts))
+	for i, v := range c.Counts {
+		c.Wide[i] = uint64(v)
+	}
+	c.Counts = nil
+}
+
+func (c *CountSet) Get(i int) uint64 {
+	if c.Wide != nil {
+		return c.Wide[i]
+	}
+	return uint64(c.Counts[i])
+}
+
+// GetChecked is like Get but returns an error if i is out of range.
+func (c *CountSet) GetChecked(i int) (uint64, error) {
+	if i < 0 || i >= c.Len() {
+		return 0, fmt.Errorf("CountSet.Get(i=%d) out of range [0,%d)", i, c.Len())
 	}
-	// else handle overflow.
+	return c.Get(i), nil
 }
 
-func (c *CountSet) Get(i int) uint8 {
-	return c.Counts[i]
+// Merge adds the counts of other, which must have the same length.
+func (c *CountSet) Merge(other *CountSet) {
+	for i := range other.Len() {
+		v := other.Get(i)
+		if v == 0 {
+			continue
+		}
+		if c.Wide == nil && uint64(c.Counts[i])+v > 0xFF {
+			c.widen()
+		}
+		if c.Wide != nil {
+			c.Wide[i] += v
+		} else {
+			c.Counts[i] += uint8(v)
+		}
+	}
+}
+
+// Len returns the number of values tracked.
+func (c *CountSet) Len() int {
+	if c.Wide != nil {
+		return len(c.Wide)
+	}
+	return len(c.Counts)
 }
 
 // Effective returns the number of non-zero items in the slice.
 func (c *CountSet) Effective() int32 {
 	o := 0
-	for _, v := range c.Counts {
-		if v != 0 {
+	for i := range c.Len() {
+		if c.Get(i) != 0 {
 			o += 1
 		}
 	}
 	return int32(o)
 }
 
+// Entropy returns the Shannon entropy in bits of the distribution of the
+// counts.
+//
+// It is the average number of bits needed per value if the values were
+// entropy coded.
+func (c *CountSet) Entropy() float64 {
+	f := c.Frequencies()
+	total := 0.
+	for _, v := range f {
+		total += float64(v)
+	}
+	e := 0.
+	for _, v := range f {
+		if v != 0 {
+			p := float64(v) / total
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// Frequencies returns a copy of the counts.
+func (c *CountSet) Frequencies() []uint64 {
+	out := make([]uint64, c.Len())
+	for i := range out {
+		out[i] = c.Get(i)
+	}
+	return out
+}
+
+// Mode returns the most frequent value and its count. Ties return the
+// smallest value.
+//
+// It returns -1 if the set is empty.
+func (c *CountSet) Mode() (index int, count uint64) {
+	index = -1
+	for i := range c.Len() {
+		if v := c.Get(i); v > count {
+			index, count = i, v
+		}
+	}
+	return index, count
+}
+
+// Quantile returns the value at which the cumulative count reaches q times
+// the total count. q is clamped to [0, 1]; 0 returns the smallest value seen.
+//
+// It returns -1 if the set is empty.
+func (c *CountSet) Quantile(q float64) int {
+	total := uint64(0)
+	for i := range c.Len() {
+		total += c.Get(i)
+	}
+	if total == 0 {
+		return -1
+	}
+	target := max(1, uint64(math.Ceil(min(max(q, 0), 1)*float64(total))))
+	seen := uint64(0)
+	for i := range c.Len() {
+		if seen += c.Get(i); seen >= target {
+			return i
+		}
+	}
+	return c.Len() - 1
+}
+
+// wideCountsPrefix prefixes the JSON encoding of counts promoted to uint64.
+// ":" is not a base64 character so it can't be confused with the uint8 counts,
+// which are encoded as before the promotion existed.
+const wideCountsPrefix = "w:"
+
 // MarshalJSON implements json.Marshaler
+//
+// The uint8 counts are encoded as base64. The uint64 counts are encoded as
+// wideCountsPrefix followed by the base64 of the little endian values.
 func (c *CountSet) MarshalJSON() ([]byte, error) {
-	var dst []byte
-	if len(c.Counts) != 0 {
-		dst = make([]byte, base64.RawStdEncoding.EncodedLen(len(c.Counts)))
-		base64.RawStdEncoding.Encode(dst, c.Counts)
+	if c.Wide != nil {
+		d := make([]byte, 0, 8*len(c.Wide))
+		for _, v := range c.Wide {
+			d = binary.LittleEndian.AppendUint64(d, v)
+		}
+		return json.Marshal(wideCountsPrefix + base64.RawStdEncoding.EncodeToString(d))
 	}
-	return json.Marshal(string(dst))
+	return json.Marshal(base64.RawStdEncoding.EncodeToString(c.Counts))
 }
 
 // UnmarshalJSON implements json.Unmarshaler
@@ -172,17 +404,29 @@ func (c *CountSet) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &s); err != nil {
 		return err
 	}
+	c.Counts = nil
+	c.Wide = nil
 	if len(s) == 0 {
-		c.Counts = nil
 		return nil
 	}
-	d, err := base64.RawStdEncoding.DecodeString(s)
+	wide := strings.HasPrefix(s, wideCountsPrefix)
+	d, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, wideCountsPrefix))
 	if err != nil {
 		return err
 	}
 	if len(d) == 0 {
-		return errors.New("invalid BitSet base64 encoding")
+		return errors.New("invalid CountSet base64 encoding")
+	}
+	if !wide {
+		c.Counts = d
+		return nil
+	}
+	if len(d)%8 != 0 {
+		return errors.New("invalid CountSet encoding")
+	}
+	c.Wide = make([]uint64, len(d)/8)
+	for i := range c.Wide {
+		c.Wide[i] = binary.LittleEndian.Uint64(d[8*i:])
 	}
-	c.Counts = d
 	return nil
 }
@@ -6,6 +6,7 @@ package n_bits
 
 import (
 	"encoding/json"
+	"slices"
 	"strconv"
 	"testing"
 )
@@ -117,6 +118,193 @@ func TestBitSet(t *testing.T) {
 	}
 }
 
+func TestBitSet_Union(t *testing.T) {
+	for _, l := range [][2]int{{64, 64}, {63, 65}, {65, 63}, {100, 130}, {130, 100}, {128, 64}} {
+		t.Run(strconv.Itoa(l[0])+"_"+strconv.Itoa(l[1]), func(t *testing.T) {
+			a := newBitSet(l[0], 0, 62, l[0]-1)
+			b := newBitSet(l[1], 1, 62, l[1]-1)
+			want := a.Expand()
+			for i, v := range b.Expand() {
+				if i < len(want) {
+					want[i] = want[i] || v
+				}
+			}
+			a.Union(b)
+			if got := a.Expand(); !slices.Equal(want, got) {
+				t.Fatalf("want %v\ngot  %v", want, got)
+			}
+			if a.Count() != int32(bitsSet(want)) {
+				t.Fatalf("bits set past Len: %v", a.Bits)
+			}
+		})
+	}
+}
+
+func TestBitSet_Intersection(t *testing.T) {
+	for _, l := range [][2]int{{64, 64}, {63, 65}, {65, 63}, {100, 130}, {130, 100}, {128, 64}} {
+		t.Run(strconv.Itoa(l[0])+"_"+strconv.Itoa(l[1]), func(t *testing.T) {
+			a := newBitSet(l[0], 0, 1, 62, l[0]-1)
+			b := newBitSet(l[1], 1, 62, l[1]-1)
+			want := a.Expand()
+			other := b.Expand()
+			for i := range want {
+				want[i] = want[i] && i < len(other) && other[i]
+			}
+			a.Intersection(b)
+			if got := a.Expand(); !slices.Equal(want, got) {
+				t.Fatalf("want %v\ngot  %v", want, got)
+			}
+			if a.Count() != int32(bitsSet(want)) {
+				t.Fatalf("bits set past Len: %v", a.Bits)
+			}
+		})
+	}
+}
+
+func bitsSet(b []bool) int {
+	n := 0
+	for _, v := range b {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+func newBitSet(l int, set ...int) *BitSet {
+	b := &BitSet{}
+	b.Resize(l)
+	for _, i := range set {
+		b.Set(i)
+	}
+	return b
+}
+
+func TestBitSet_Checked(t *testing.T) {
+	b := BitSet{}
+	b.Resize(70)
+	if err := b.SetChecked(69); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.GetChecked(69); err != nil || !v {
+		t.Fatal(v, err)
+	}
+	// 70 is within the last word so Set wouldn't catch it.
+	for _, i := range []int{-1, 70, 128} {
+		want := "BitSet.Set(i=" + strconv.Itoa(i) + ") out of range [0,70)"
+		if err := b.SetChecked(i); err == nil || err.Error() != want {
+			t.Fatalf("want %q, got %v", want, err)
+		}
+		if _, err := b.GetChecked(i); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if b.Effective() != 1 {
+		t.Fatal(b.Effective())
+	}
+	// The unchecked version panics.
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	b.Set(128)
+}
+
+func TestCountSet_Checked(t *testing.T) {
+	c := CountSet{}
+	c.Resize(3)
+	if err := c.AddChecked(2); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.GetChecked(2); err != nil || v != 1 {
+		t.Fatal(v, err)
+	}
+	if err := c.AddChecked(3); err == nil || err.Error() != "CountSet.Add(i=3) out of range [0,3)" {
+		t.Fatal(err)
+	}
+	if _, err := c.GetChecked(-1); err == nil || err.Error() != "CountSet.Get(i=-1) out of range [0,3)" {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	c.Add(3)
+}
+
+func TestBitSet_Clear(t *testing.T) {
+	b := newBitSet(100, 0, 63, 64, 99)
+	bits := b.Bits
+	b.Clear()
+	if b.Effective() != 0 || b.Len != 100 || &b.Bits[0] != &bits[0] {
+		t.Fatalf("unexpected %+v", b)
+	}
+	b.Set(99)
+	if !b.Get(99) || b.Get(0) || b.Effective() != 1 {
+		t.Fatalf("unexpected %+v", b)
+	}
+}
+
+func TestBitSet_Resize(t *testing.T) {
+	b := newBitSet(100, 3, 60, 70, 99)
+	b.Resize(80)
+	if b.Len != 80 || len(b.Bits) != 2 || !b.Get(3) || !b.Get(60) || !b.Get(70) || b.Effective() != 3 {
+		t.Fatalf("unexpected %+v", b)
+	}
+	// 99 is in the last word kept but past Len.
+	if b.Get(99) || b.Count() != 3 {
+		t.Fatalf("unexpected %+v", b)
+	}
+	// Growing back doesn't resurrect the bit.
+	b.Resize(100)
+	if b.Get(99) || b.Effective() != 3 {
+		t.Fatalf("unexpected %+v", b)
+	}
+	b.Resize(64)
+	if len(b.Bits) != 1 || b.Effective() != 2 || !b.Get(60) {
+		t.Fatalf("unexpected %+v", b)
+	}
+}
+
+func TestCountSet_Resize(t *testing.T) {
+	for _, n := range []int{1, 300} {
+		c := CountSet{}
+		c.Resize(4)
+		for range n {
+			c.Add(1)
+		}
+		c.Add(3)
+		c.Resize(8)
+		if c.Len() != 8 || c.Get(1) != uint64(n) || c.Get(3) != 1 || c.Effective() != 2 {
+			t.Fatalf("%d: unexpected %+v", n, c)
+		}
+		c.Resize(2)
+		if c.Len() != 2 || c.Get(1) != uint64(n) || c.Effective() != 1 {
+			t.Fatalf("%d: unexpected %+v", n, c)
+		}
+	}
+}
+
+func TestCountSet_Clear(t *testing.T) {
+	for _, n := range []int{1, 300} {
+		c := CountSet{}
+		c.Resize(10)
+		for range n {
+			c.Add(3)
+		}
+		c.Clear()
+		if c.Effective() != 0 || c.Len() != 10 {
+			t.Fatalf("%d: unexpected %+v", n, c)
+		}
+		c.Add(9)
+		if c.Get(9) != 1 || c.Get(3) != 0 || c.Effective() != 1 {
+			t.Fatalf("%d: unexpected %+v", n, c)
+		}
+	}
+}
+
 func TestCountSet(t *testing.T) {
 	c := CountSet{Counts: make([]uint8, 5)}
 	c.Resize(10)
@@ -132,13 +320,13 @@ func TestCountSet(t *testing.T) {
 	for range 256 {
 		c.Add(0)
 	}
-	if c.Counts[0] != 255 {
-		t.Errorf("Expected count 255, got %d", c.Counts[0])
+	if c.Get(0) != 259 {
+		t.Errorf("Expected count 259, got %d", c.Get(0))
 	}
 	if c.Get(1) != 0 {
 		t.Errorf("Expected 0, got %d", c.Get(1))
 	}
-	c.Counts = []uint8{1, 0, 3, 0, 0}
+	c = CountSet{Counts: []uint8{1, 0, 3, 0, 0}}
 	if c.Effective() != 2 {
 		t.Errorf("Expected 2 effective items, got %d", c.Effective())
 	}
@@ -169,3 +357,202 @@ func TestCountSet(t *testing.T) {
 		t.Errorf("Unexpected deserialized value: %v", got.Counts)
 	}
 }
+
+func TestCountSet_Entropy(t *testing.T) {
+	data := []struct {
+		counts []uint8
+		want   float64
+	}{
+		{nil, 0},
+		{[]uint8{0, 5, 0}, 0},
+		{[]uint8{3, 3}, 1},
+		{[]uint8{1, 1, 1, 1}, 2},
+		{[]uint8{2, 1, 1}, 1.5},
+	}
+	for i, line := range data {
+		c := CountSet{Counts: line.counts}
+		if got := c.Entropy(); got != line.want {
+			t.Errorf("#%d: want %g, got %g", i, line.want, got)
+		}
+	}
+}
+
+func TestCountSet_Overflow(t *testing.T) {
+	c := CountSet{}
+	c.Resize(4)
+	c.Add(1)
+	for range 70000 {
+		c.Add(2)
+	}
+	if got := c.Get(2); got != 70000 {
+		t.Fatalf("Expected 70000, got %d", got)
+	}
+	if got := c.Get(1); got != 1 {
+		t.Fatalf("Expected 1, got %d", got)
+	}
+	if c.Len() != 4 || c.Effective() != 2 {
+		t.Fatalf("Unexpected len %d, effective %d", c.Len(), c.Effective())
+	}
+	b, err := json.Marshal(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := CountSet{}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != 4 || got.Get(1) != 1 || got.Get(2) != 70000 {
+		t.Fatalf("Unexpected deserialized value: %+v", got)
+	}
+}
+
+func TestCountSet_Merge(t *testing.T) {
+	a := CountSet{}
+	a.Resize(3)
+	b := CountSet{}
+	b.Resize(3)
+	for range 200 {
+		a.Add(0)
+		b.Add(0)
+	}
+	b.Add(1)
+	a.Merge(&b)
+	if a.Wide == nil || a.Get(0) != 400 || a.Get(1) != 1 || a.Get(2) != 0 {
+		t.Fatalf("unexpected %+v", a)
+	}
+	c := CountSet{}
+	c.Resize(3)
+	c.Add(2)
+	c.Merge(&b)
+	// Counts are only promoted on overflow, like Add.
+	if c.Wide != nil || c.Get(0) != 200 || c.Get(1) != 1 || c.Get(2) != 1 {
+		t.Fatalf("unexpected %+v", c)
+	}
+	d := CountSet{}
+	d.Resize(3)
+	d.Merge(&a)
+	if d.Wide == nil || d.Get(0) != 400 {
+		t.Fatalf("unexpected %+v", d)
+	}
+}
+
+func TestCountSet_Frequencies(t *testing.T) {
+	c := CountSet{}
+	c.Resize(3)
+	c.Add(0)
+	c.Add(2)
+	c.Add(2)
+	if got := c.Frequencies(); !slices.Equal(got, []uint64{1, 0, 2}) {
+		t.Fatal(got)
+	}
+	for range 300 {
+		c.Add(1)
+	}
+	if got := c.Frequencies(); !slices.Equal(got, []uint64{1, 300, 2}) {
+		t.Fatal(got)
+	}
+}
+
+func TestCountSet_Mode_Quantile(t *testing.T) {
+	c := CountSet{}
+	c.Resize(8)
+	if i, n := c.Mode(); i != -1 || n != 0 {
+		t.Fatal(i, n)
+	}
+	if i := c.Quantile(0.5); i != -1 {
+		t.Fatal(i)
+	}
+	// 1 at 1, 6 at 3, 2 at 4, 1 at 6.
+	for _, v := range []int{1, 3, 3, 3, 3, 3, 3, 4, 4, 6} {
+		c.Add(v)
+	}
+	if i, n := c.Mode(); i != 3 || n != 6 {
+		t.Fatal(i, n)
+	}
+	data := []struct {
+		q    float64
+		want int
+	}{
+		{-1, 1},
+		{0, 1},
+		{0.1, 1},
+		{0.11, 3},
+		{0.5, 3},
+		{0.7, 3},
+		{0.71, 4},
+		{0.9, 4},
+		{0.91, 6},
+		{1, 6},
+		{2, 6},
+	}
+	for _, l := range data {
+		if got := c.Quantile(l.q); got != l.want {
+			t.Errorf("Quantile(%g) = %d, want %d", l.q, got, l.want)
+		}
+	}
+	// Ties return the smallest value.
+	c.Add(4)
+	c.Add(4)
+	c.Add(4)
+	c.Add(4)
+	if i, n := c.Mode(); i != 3 || n != 6 {
+		t.Fatal(i, n)
+	}
+}
+
+func TestBitSet_ForEachSet(t *testing.T) {
+	for _, l := range []int{0, 1, 63, 64, 65, 1 << 10} {
+		t.Run(strconv.Itoa(l), func(t *testing.T) {
+			var set []int
+			for i := 0; i < l; i += 7 {
+				set = append(set, i)
+			}
+			if l != 0 {
+				set = append(set, l-1)
+			}
+			b := newBitSet(l, set...)
+			var want []int
+			for i, v := range b.Expand() {
+				if v {
+					want = append(want, i)
+				}
+			}
+			var got []int
+			b.ForEachSet(func(i int) {
+				got = append(got, i)
+			})
+			if !slices.Equal(want, got) {
+				t.Fatalf("want %v\ngot  %v", want, got)
+			}
+		})
+	}
+}
+
+func BenchmarkBitSet_ForEachSet(b *testing.B) {
+	// Sparse float32 mantissa set.
+	s := newBitSet(1<<23, 0, 1<<22, 1<<21, 3<<21, 1<<23-1)
+	b.Run("Expand", func(b *testing.B) {
+		for range b.N {
+			n := 0
+			for _, v := range s.Expand() {
+				if v {
+					n++
+				}
+			}
+			if n != 5 {
+				b.Fatal(n)
+			}
+		}
+	})
+	b.Run("ForEachSet", func(b *testing.B) {
+		for range b.N {
+			n := 0
+			s.ForEachSet(func(int) {
+				n++
+			})
+			if n != 5 {
+				b.Fatal(n)
+			}
+		}
+	})
+}